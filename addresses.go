@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Address is a postal address of a user, shown on the user with
+// ?expand=addresses
+type Address struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	TenantID   uint      `json:"-" gorm:"not null;default:1;index"`
+	UserID     uint      `json:"user_id" gorm:"not null;index"`
+	Label      string    `json:"label" gorm:"size:50"`
+	Line1      string    `json:"line1" gorm:"size:200;not null"`
+	Line2      string    `json:"line2" gorm:"size:200"`
+	City       string    `json:"city" gorm:"size:100;not null"`
+	Region     string    `json:"region" gorm:"size:100"`
+	PostalCode string    `json:"postal_code" gorm:"size:20"`
+	Country    string    `json:"country" gorm:"size:2;not null"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (a Address) MarshalJSON() ([]byte, error) {
+	type plainAddress Address
+	if userIDType != idTypeUUID {
+		return json.Marshal(plainAddress(a))
+	}
+	user, err := userUUID(a.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainAddress
+		UserID *string `json:"user_id"`
+	}{plainAddress(a), user})
+}
+
+// The fields of an address, all replaced on update
+type addressRequest struct {
+	Label      string `json:"label" validate:"max=50"`
+	Line1      string `json:"line1" validate:"required,max=200"`
+	Line2      string `json:"line2" validate:"max=200"`
+	City       string `json:"city" validate:"required,max=100"`
+	Region     string `json:"region" validate:"max=100"`
+	PostalCode string `json:"postal_code" validate:"max=20"`
+	Country    string `json:"country" validate:"required,iso3166_1_alpha2"`
+}
+
+func (r *addressRequest) apply(a *Address) {
+	a.Label, a.Line1, a.Line2 = r.Label, r.Line1, r.Line2
+	a.City, a.Region, a.PostalCode = r.City, r.Region, r.PostalCode
+	a.Country = r.Country
+}
+
+// Path of a user's address under the request's API prefix
+func addressPath(c echo.Context, a *Address) string {
+	return fmt.Sprintf("%s/addresses/%d", userPathByID(c, a.UserID), a.ID)
+}
+
+// Wrap an address with links to itself and the user
+func newAddressResource(c echo.Context, a *Address) Resource {
+	return Resource{Data: a, Links: Links{"self": addressPath(c, a), "user": userPathByID(c, a.UserID)}}
+}
+
+// Read and validate an address from the request body
+func bindAddress(c echo.Context) (*addressRequest, error) {
+	req := new(addressRequest)
+	if err := c.Bind(req); err != nil {
+		return nil, bindError(err)
+	}
+	req.Country = strings.ToUpper(req.Country)
+	if err := c.Validate(req); err != nil {
+		return nil, validationError(err)
+	}
+	return req, nil
+}
+
+// Load the :address_id of the user named by :id
+func findAddress(c echo.Context, tx *gorm.DB) (*Address, error) {
+	owner, err := userID(c)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(c.Param("address_id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid address ID")
+	}
+	var a Address
+	if err := tx.Where("user_id = ?", owner).First(&a, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Address not found")
+	}
+	return &a, nil
+}
+
+// List a user's addresses, oldest first
+func getAddresses(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	var addresses []Address
+	var total int64
+	q := dbCtx(c).Model(&Address{}).Where("user_id = ?", id)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch addresses")
+	}
+	if err := q.Order("id").Offset(p.Offset).Limit(p.Limit).Find(&addresses).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch addresses")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, addresses))
+}
+
+// Add an address to a user
+func createAddress(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req, err := bindAddress(c)
+	if err != nil {
+		return err
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	a := Address{UserID: id}
+	req.apply(&a)
+	if err := dbCtx(c).Create(&a).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create address")
+	}
+	c.Response().Header().Set(echo.HeaderLocation, addressPath(c, &a))
+	return respond(c, http.StatusCreated, newAddressResource(c, &a))
+}
+
+// Fetch one of a user's addresses
+func getAddress(c echo.Context) error {
+	a, err := findAddress(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, newAddressResource(c, a))
+}
+
+// Replace an address's fields
+func updateAddress(c echo.Context) error {
+	req, err := bindAddress(c)
+	if err != nil {
+		return err
+	}
+	a, err := findAddress(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	req.apply(a)
+	if err := dbCtx(c).Save(a).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to update address")
+	}
+	return respond(c, http.StatusOK, newAddressResource(c, a))
+}
+
+// Delete an address
+func deleteAddress(c echo.Context) error {
+	a, err := findAddress(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	if err := dbCtx(c).Delete(a).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to delete address")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Oldest age the age filters accept
+const maxAge = 150
+
+// strftime formats SQLite reads each date part with
+var sqliteDateParts = map[string]string{"year": "%Y", "month": "%m", "day": "%d"}
+
+// Whole years from the date until now; nil for an unknown date
+func (d Date) Age(now time.Time) *int {
+	if d.IsZero() {
+		return nil
+	}
+	age := now.Year() - d.Year()
+	if now.Month() < d.Month() || now.Month() == d.Month() && now.Day() < d.Day() {
+		age--
+	}
+	return &age
+}
+
+func parseAge(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxAge {
+		return 0, errors.New("Invalid age, expected a whole number of years from 0 to 150")
+	}
+	return n, nil
+}
+
+// Turn ?min_age= into the latest birthday old enough, compared with <=
+func parseMinAgeParam(v string) (interface{}, error) {
+	n, err := parseAge(v)
+	if err != nil {
+		return nil, err
+	}
+	return Date{time.Now().AddDate(-n, 0, 0)}.String(), nil
+}
+
+// Turn ?max_age= into the last birthday too old, compared with >
+func parseMaxAgeParam(v string) (interface{}, error) {
+	n, err := parseAge(v)
+	if err != nil {
+		return nil, err
+	}
+	return Date{time.Now().AddDate(-n-1, 0, 0)}.String(), nil
+}
+
+func parseMonthParam(v string) (interface{}, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 12 {
+		return nil, errors.New("Invalid month, expected 1 to 12")
+	}
+	return n, nil
+}
+
+// Build an expression reading a part of a date column as a number
+func datePart(q *gorm.DB, column, part string) clause.Expr {
+	col := clause.Column{Name: column}
+	switch q.Dialector.Name() {
+	case "postgres":
+		return clause.Expr{SQL: "EXTRACT(" + part + " FROM ?)", Vars: []interface{}{col}}
+	case "mysql", "sqlserver":
+		return clause.Expr{SQL: part + "(?)", Vars: []interface{}{col}}
+	}
+	return clause.Expr{SQL: "CAST(strftime(?, ?) AS INTEGER)", Vars: []interface{}{sqliteDateParts[part], col}}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Name an anonymized user is left with
+const anonymizedName = "Anonymized user"
+
+// User columns anonymizing clears, whose values are also redacted from the
+// user's earlier audit entries
+var anonymizedColumns = map[string]bool{
+	"name":          true,
+	"email":         true,
+	"birthday":      true,
+	"password_hash": true,
+	"avatar":        true,
+	"metadata":      true,
+}
+
+// Columns that identify a row rather than describe a person
+var anonymizedKeptColumns = map[string]bool{
+	"id":        true,
+	"tenant_id": true,
+	"user_id":   true,
+}
+
+// Redact the personal values in an audit entry's changes, with all every
+// column's but the keys, and report whether anything changed
+func redactAuditChanges(changes AuditChanges, all bool) bool {
+	redacted := false
+	for column, change := range changes {
+		if all && anonymizedKeptColumns[column] || !all && !anonymizedColumns[column] {
+			continue
+		}
+		if auditValueSet(change.Before) {
+			change.Before, redacted = redactedValue, true
+		}
+		if auditValueSet(change.After) {
+			change.After, redacted = redactedValue, true
+		}
+		changes[column] = change
+	}
+	return redacted
+}
+
+// Report whether a logged value holds anything to redact
+func auditValueSet(v interface{}) bool {
+	return v != nil && v != "" && v != redactedValue
+}
+
+// Replace a user's personal data with placeholders for good. Unlike a delete
+// the user stays, so their posts and memberships still point at someone, and
+// the audit log records that it happened but not what was there.
+func anonymizeUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	user, err := userService.Anonymize(ctx, id)
+	if err != nil {
+		return userError(err, "Failed to anonymize user")
+	}
+	if err := revokeRefreshTokens(ctx, "user_id = ?", id); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to revoke sessions")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
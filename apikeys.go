@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "ek_"
+)
+
+// Each scope implies the ones before it
+var scopeRank = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// Scopes is stored as a comma-separated list
+type Scopes []string
+
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, ","), nil
+}
+
+func (s *Scopes) Scan(value interface{}) error {
+	list, err := scanCommaList(value)
+	*s = list
+	return err
+}
+
+// Split a comma-separated column value into its items
+func scanCommaList(value interface{}) ([]string, error) {
+	var raw string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return nil, fmt.Errorf("cannot scan %T as a list", value)
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	return strings.Split(raw, ","), nil
+}
+
+// Report whether the scopes grant the required one
+func (s Scopes) Allow(required string) bool {
+	for _, scope := range s {
+		if scopeRank[scope] >= scopeRank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey authenticates machine clients; only a hash of the key is stored
+type APIKey struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TenantID    uint       `json:"-" gorm:"not null;default:1;index"`
+	Name        string     `json:"name" gorm:"size:100;not null"`
+	Prefix      string     `json:"prefix" gorm:"size:16;not null"`
+	KeyHash     string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Scopes      Scopes     `json:"scopes" gorm:"size:100;not null"`
+	CreatedByID uint       `json:"created_by_id"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,oneof=read write admin"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Hash a plaintext key for storage and lookup
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a random key with a recognizable prefix
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Look up a live API key and record its use
+func authenticateAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	var apiKey APIKey
+	if err := db.WithContext(ctx).Where("key_hash = ?", hashAPIKey(key)).First(&apiKey).Error; err != nil {
+		return nil, newProblem(http.StatusUnauthorized, "Invalid API key")
+	}
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		return nil, newProblem(http.StatusUnauthorized, "API key expired or revoked")
+	}
+	db.WithContext(ctx).Model(&apiKey).UpdateColumn("last_used_at", now)
+	return &apiKey, nil
+}
+
+// Middleware accepting an X-API-Key holding the scope, or else running the
+// fallback middleware (JWT and role checks) for the request
+func requireScopeOr(scope string, fallback ...echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		viaToken := next
+		for i := len(fallback) - 1; i >= 0; i-- {
+			viaToken = fallback[i](viaToken)
+		}
+
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(apiKeyHeader)
+			if key == "" {
+				return viaToken(c)
+			}
+
+			apiKey, err := authenticateAPIKey(c.Request().Context(), key)
+			if err != nil {
+				return err
+			}
+			if !apiKey.Scopes.Allow(scope) {
+				return newProblem(http.StatusForbidden, "API key lacks the "+scope+" scope")
+			}
+			c.Set("apiKey", apiKey)
+			setAuditActor(c.Request().Context(), actorAPIKey, apiKey.ID)
+			return next(c)
+		}
+	}
+}
+
+// List all API keys
+func getAPIKeys(c echo.Context) error {
+	var keys []APIKey
+	if err := dbCtx(c).Order("id").Find(&keys).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch API keys")
+	}
+	return respond(c, http.StatusOK, keys)
+}
+
+// Mint a new API key; the plaintext key is only ever returned here
+func createAPIKey(c echo.Context) error {
+	req := new(createAPIKeyRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+		p.Errors = map[string]string{"expires_at": "must be in the future"}
+		return p
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create API key")
+	}
+	apiKey := APIKey{
+		Name:      req.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   hashAPIKey(key),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if user, ok := c.Get("currentUser").(*User); ok {
+		apiKey.CreatedByID = user.ID
+	}
+	if err := dbCtx(c).Create(&apiKey).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create API key")
+	}
+
+	return respond(c, http.StatusCreated, map[string]interface{}{
+		"api_key": apiKey,
+		"key":     key,
+	})
+}
+
+// Revoke an API key
+func revokeAPIKey(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid API key ID")
+	}
+
+	var apiKey APIKey
+	if err := dbCtx(c).First(&apiKey, id).Error; err != nil {
+		return newProblem(http.StatusNotFound, "API key not found")
+	}
+	if apiKey.RevokedAt == nil {
+		now := time.Now()
+		if err := dbCtx(c).Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to revoke API key")
+		}
+		apiKey.RevokedAt = &now
+	}
+	return respond(c, http.StatusOK, apiKey)
+}
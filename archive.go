@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Attachment bytes above which a ZIP archive is built in the background
+const maxSyncArchiveBytes = 10 << 20
+
+// File extension and content type of each user archive format
+var archiveFormats = map[string]struct{ ext, contentType string }{
+	"json": {"json", echo.MIMEApplicationJSON},
+	"zip":  {"zip", "application/zip"},
+}
+
+// UserArchive is everything stored about one user, for GET /users/:id/export
+type UserArchive struct {
+	ExportedAt  time.Time      `json:"exported_at"`
+	User        User           `json:"user"`
+	Addresses   []Address      `json:"addresses"`
+	Groups      []Group        `json:"groups"`
+	Posts       []Post         `json:"posts"`
+	Attachments []Attachment   `json:"attachments"`
+	Identities  []UserIdentity `json:"identities"`
+	Consents    []Consent      `json:"consents"`
+	History     []UserVersion  `json:"history"`
+	Audit       []AuditLog     `json:"audit"`
+}
+
+// Report whether the caller may read the personal data of user id: the user
+// themselves, an admin, or an API key with the admin scope
+func actsForUser(c echo.Context, id uint) bool {
+	if key, ok := c.Get("apiKey").(*APIKey); ok {
+		return key.Scopes.Allow(ScopeAdmin)
+	}
+	current, ok := c.Get("currentUser").(*User)
+	return ok && (current.ID == id || current.HasRole(RoleAdmin))
+}
+
+// Query the audit entries about a user, their posts, addresses and consents, or
+// made by them
+func userAuditQuery(q *gorm.DB, id uint) *gorm.DB {
+	entityID := strconv.FormatUint(uint64(id), 10)
+	// Entity IDs are stored as text
+	idText := "CAST(id AS VARCHAR(64))"
+	if q.Dialector.Name() == "mysql" {
+		idText = "CAST(id AS CHAR)"
+	}
+	posts := q.Model(&Post{}).Select(idText).Where("user_id = ?", id)
+	addresses := q.Model(&Address{}).Select(idText).Where("user_id = ?", id)
+	consents := q.Model(&Consent{}).Select(idText).Where("user_id = ?", id)
+	return q.Model(&AuditLog{}).
+		Where("entity_type = ? AND entity_id = ?", "users", entityID).
+		Or("actor_type = ? AND actor_id = ?", actorUser, id).
+		Or("entity_type = ? AND entity_id IN (?)", "posts", posts).
+		Or("entity_type = ? AND entity_id IN (?)", "addresses", addresses).
+		Or("entity_type = ? AND entity_id IN (?)", "consents", consents)
+}
+
+// Count the records in a user's archive and the bytes of their files, to
+// decide whether it is built within the request
+func sizeUserArchive(ctx context.Context, id uint) (rows, bytes int64, err error) {
+	q := db.WithContext(ctx)
+	for _, query := range []*gorm.DB{
+		q.Model(&Address{}).Where("user_id = ?", id),
+		q.Model(&GroupMember{}).Where("user_id = ?", id),
+		q.Model(&Post{}).Where("user_id = ?", id),
+		q.Model(&Attachment{}).Where("user_id = ?", id),
+		q.Model(&UserIdentity{}).Where("user_id = ?", id),
+		q.Model(&Consent{}).Where("user_id = ?", id),
+		q.Model(&UserVersion{}).Where("user_id = ?", id),
+		userAuditQuery(q, id),
+	} {
+		var n int64
+		if err := query.Count(&n).Error; err != nil {
+			return 0, 0, err
+		}
+		rows += n
+	}
+	err = q.Model(&Attachment{}).Where("user_id = ? AND status = ?", id, attachmentUploaded).
+		Select("COALESCE(SUM(size), 0)").Scan(&bytes).Error
+	return rows, bytes, err
+}
+
+// Load everything stored about a user
+func loadUserArchive(ctx context.Context, id uint) (*UserArchive, error) {
+	q := db.WithContext(ctx)
+	a := UserArchive{ExportedAt: time.Now().UTC()}
+	if err := q.Preload("Roles").First(&a.User, id).Error; err != nil {
+		return nil, err
+	}
+	err := q.Model(&a.User).Order("groups.id").Association("Groups").Find(&a.Groups)
+	if err != nil {
+		return nil, err
+	}
+	for _, find := range []func() error{
+		func() error { return q.Where("user_id = ?", id).Order("id").Find(&a.Addresses).Error },
+		func() error { return q.Where("user_id = ?", id).Order("id").Find(&a.Posts).Error },
+		func() error { return q.Where("user_id = ?", id).Order("id").Find(&a.Attachments).Error },
+		func() error { return q.Where("user_id = ?", id).Order("id").Find(&a.Identities).Error },
+		func() error { return q.Where("user_id = ?", id).Order("id").Find(&a.Consents).Error },
+		func() error { return q.Where("user_id = ?", id).Order("version").Find(&a.History).Error },
+		func() error { return userAuditQuery(q, id).Order("id").Find(&a.Audit).Error },
+	} {
+		if err := find(); err != nil {
+			return nil, err
+		}
+	}
+	return &a, nil
+}
+
+// Write a user's archive as one JSON document
+func writeArchiveJSON(w io.Writer, a *UserArchive) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+// Write a user's archive as a ZIP of archive.json with the user's uploaded
+// attachments and original avatar under files/
+func writeArchiveZIP(ctx context.Context, w io.Writer, a *UserArchive) error {
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("archive.json")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveJSON(f, a); err != nil {
+		return err
+	}
+
+	files := map[string]string{}
+	var names []string
+	for _, att := range a.Attachments {
+		if att.Status != attachmentUploaded {
+			continue
+		}
+		name := fmt.Sprintf("files/attachments/%d-%s", att.ID, path.Base(att.Filename))
+		files[name] = att.Key
+		names = append(names, name)
+	}
+	if a.User.Avatar != "" && a.User.AvatarStatus != avatarPending && a.User.AvatarStatus != avatarFailed {
+		name := "files/avatar" + path.Ext(a.User.Avatar)
+		files[name] = a.User.Avatar
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if err := copyStoredObject(ctx, zw, name, files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Copy a stored object into a new ZIP entry
+func copyStoredObject(ctx context.Context, zw *zip.Writer, name, key string) error {
+	r, err := fileStorage.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", key, err)
+	}
+	defer r.Close()
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// Export everything stored about a user as ?format=json (the default) or zip,
+// which adds their files. Small accounts get the archive in the response;
+// larger ones get 202 with an export to poll at GET /exports/:id.
+func exportUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	if !actsForUser(c, id) {
+		return newProblem(http.StatusForbidden, "Only admins may export other users' data")
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := archiveFormats[format]; !ok {
+		return newProblem(http.StatusBadRequest, "Unsupported export format, expected json or zip")
+	}
+	ctx := c.Request().Context()
+	if _, err := userService.Get(ctx, id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+
+	rows, bytes, err := sizeUserArchive(ctx, id)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to export user")
+	}
+	if rows > int64(cfg.Export.UserSyncRows) || format == "zip" && bytes > maxSyncArchiveBytes {
+		return startUserExport(c, id, format)
+	}
+
+	archive, err := loadUserArchive(ctx, id)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to export user")
+	}
+	f := archiveFormats[format]
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, f.contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="user-%d.%s"`, id, f.ext))
+	res.WriteHeader(http.StatusOK)
+	if format == "zip" {
+		err = writeArchiveZIP(ctx, res, archive)
+	} else {
+		err = writeArchiveJSON(res, archive)
+	}
+	if err != nil {
+		// The status line is already sent, so the best we can do is cut the stream short
+		contextLogger(ctx).Error("user archive failed", "user_id", id, "error", err)
+	}
+	return nil
+}
+
+// Queue a user's archive to be built by an export job
+func startUserExport(c echo.Context, id uint, format string) error {
+	export := Export{
+		UserID: &id,
+		Format: format,
+		Status: exportPending,
+	}
+	err := WithTx(c, func(tx *gorm.DB) error {
+		if err := tx.Create(&export).Error; err != nil {
+			return err
+		}
+		job, err := newJob(jobExport, exportJob{ExportID: export.ID})
+		if err != nil {
+			return err
+		}
+		jobs := []Job{job}
+		if err := enqueueJobs(tx, jobs); err != nil {
+			return err
+		}
+		export.JobID = jobs[0].ID
+		return tx.Model(&export).Update("job_id", export.JobID).Error
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to start export")
+	}
+	c.Response().Header().Set(echo.HeaderLocation, exportPath(c, export.ID))
+	return respond(c, http.StatusAccepted, newExportResource(c, &export))
+}
+
+// Write a user's archive to a new file in EXPORT_DIR, which only appears
+// under its final name once complete
+func writeUserArchive(ctx context.Context, export *Export) error {
+	archive, err := loadUserArchive(ctx, *export.UserID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Export.Dir, 0o750); err != nil {
+		return err
+	}
+	path := filepath.Join(cfg.Export.Dir, fmt.Sprintf("user-%d-%s.%s", *export.UserID, uuid.NewString(), archiveFormats[export.Format].ext))
+	tmp, err := os.CreateTemp(cfg.Export.Dir, ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := bufio.NewWriter(tmp)
+	if export.Format == "zip" {
+		err = writeArchiveZIP(ctx, buf, archive)
+	} else {
+		err = writeArchiveJSON(buf, archive)
+	}
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	rows := 1 + len(archive.Addresses) + len(archive.Groups) + len(archive.Posts) + len(archive.Attachments) +
+		len(archive.Identities) + len(archive.Consents) + len(archive.History) + len(archive.Audit)
+	export.Rows, export.Size, export.FilePath = int64(rows), info.Size(), path
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAttachmentSize = 5 << 30
+
+	attachmentPending  = "pending"
+	attachmentUploaded = "uploaded"
+)
+
+// Attachment is a file kept against a user. Clients upload it straight to
+// storage with a pre-signed URL, then confirm the upload.
+type Attachment struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TenantID    uint       `json:"-" gorm:"not null;default:1;index"`
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	Key         string     `json:"-" gorm:"size:255;not null"`
+	Filename    string     `json:"filename" gorm:"size:255;not null"`
+	ContentType string     `json:"content_type" gorm:"size:100;not null"`
+	Size        int64      `json:"size"`
+	Status      string     `json:"status" gorm:"size:20;not null"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UploadedAt  *time.Time `json:"uploaded_at"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (a Attachment) MarshalJSON() ([]byte, error) {
+	type plainAttachment Attachment
+	if userIDType != idTypeUUID {
+		return json.Marshal(plainAttachment(a))
+	}
+	user, err := userUUID(a.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainAttachment
+		UserID *string `json:"user_id"`
+	}{plainAttachment(a), user})
+}
+
+type createAttachmentRequest struct {
+	Filename    string `json:"filename" validate:"required,max=255"`
+	ContentType string `json:"content_type" validate:"required,max=100"`
+	Size        int64  `json:"size" validate:"required,min=1"`
+}
+
+// AttachmentUpload tells a client where to PUT an attachment's file
+type AttachmentUpload struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Path of a user's attachment under the request's API prefix
+func attachmentPath(c echo.Context, a *Attachment) string {
+	return fmt.Sprintf("%s/attachments/%d", userPathByID(c, a.UserID), a.ID)
+}
+
+// Wrap an attachment with links to itself, once uploaded its file, and the user
+func newAttachmentResource(c echo.Context, a *Attachment) Resource {
+	self := attachmentPath(c, a)
+	links := Links{"self": self, "user": userPathByID(c, a.UserID)}
+	if a.Status == attachmentUploaded {
+		links["download"] = self + "/download"
+	}
+	return Resource{Data: a, Links: links}
+}
+
+// Load the :attachment_id of the user named by :id
+func findAttachment(c echo.Context, tx *gorm.DB) (*Attachment, error) {
+	owner, err := userID(c)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(c.Param("attachment_id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid attachment ID")
+	}
+	var a Attachment
+	if err := tx.Where("user_id = ?", owner).First(&a, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Attachment not found")
+	}
+	return &a, nil
+}
+
+// List a user's uploaded attachments, newest first
+func getAttachments(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	var attachments []Attachment
+	var total int64
+	q := dbCtx(c).Model(&Attachment{}).Where("user_id = ? AND status = ?", id, attachmentUploaded)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch attachments")
+	}
+	if err := q.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&attachments).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch attachments")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, attachments))
+}
+
+// Record a pending attachment and issue a pre-signed URL to upload its file
+// to, valid for STORAGE_URL_TTL. The upload is confirmed at .../confirm.
+func createAttachment(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req := new(createAttachmentRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	if req.Size > maxAttachmentSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachments are limited to %d GB", maxAttachmentSize>>30))
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+
+	// Keep the extension so the file is served with a matching type
+	ext := strings.ToLower(path.Ext(req.Filename))
+	if len(ext) > 10 || strings.ContainsAny(ext, "/\\") {
+		ext = ""
+	}
+	a := Attachment{
+		UserID:      id,
+		Key:         fmt.Sprintf("attachments/%d/%s%s", id, uuid.NewString(), ext),
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Status:      attachmentPending,
+	}
+	url, err := fileStorage.UploadURL(c.Request().Context(), a.Key)
+	if errors.Is(err, ErrDirectUploadUnsupported) {
+		return newProblem(http.StatusNotImplemented, "Direct uploads need STORAGE_BACKEND=s3")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to sign upload")
+	}
+	if err := dbCtx(c).Create(&a).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create attachment")
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, attachmentPath(c, &a))
+	resource := newAttachmentResource(c, &a)
+	resource.Links["confirm"] = attachmentPath(c, &a) + "/confirm"
+	return respond(c, http.StatusCreated, map[string]interface{}{
+		"data":   resource.Data,
+		"links":  resource.Links,
+		"upload": AttachmentUpload{URL: url, Method: http.MethodPut, ExpiresAt: time.Now().Add(cfg.Storage.URLTTL)},
+	})
+}
+
+// Mark an attachment uploaded once its file is in storage, recording its
+// actual size. Confirming again is harmless.
+func confirmAttachment(c echo.Context) error {
+	var a *Attachment
+	err := WithTx(c, func(tx *gorm.DB) error {
+		var err error
+		if a, err = findAttachment(c, forUpdate(tx)); err != nil {
+			return err
+		}
+		if a.Status == attachmentUploaded {
+			return nil
+		}
+		size, err := fileStorage.Size(c.Request().Context(), a.Key)
+		if errors.Is(err, ErrObjectNotFound) {
+			return newProblem(http.StatusConflict, "The file has not been uploaded yet")
+		}
+		if err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to check upload")
+		}
+		if size > maxAttachmentSize {
+			deleteStoredObjects(c.Request().Context(), a.Key)
+			return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachments are limited to %d GB", maxAttachmentSize>>30))
+		}
+		now := time.Now()
+		a.Size, a.Status, a.UploadedAt = size, attachmentUploaded, &now
+		if err := tx.Save(a).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to confirm attachment")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, newAttachmentResource(c, a))
+}
+
+// Fetch an attachment's details
+func getAttachment(c echo.Context) error {
+	a, err := findAttachment(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, newAttachmentResource(c, a))
+}
+
+// Download an uploaded attachment
+func downloadAttachment(c echo.Context) error {
+	a, err := findAttachment(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	if a.Status != attachmentUploaded {
+		return newProblem(http.StatusConflict, "The file has not been uploaded yet")
+	}
+	return serveStoredObject(c, a.Key)
+}
+
+// Delete attachments never confirmed within a day of being requested, with
+// any files uploaded for them
+func deleteStaleAttachments(ctx context.Context) error {
+	var stale []Attachment
+	err := db.WithContext(ctx).Where("status = ? AND created_at < ?", attachmentPending, time.Now().Add(-24*time.Hour)).
+		Find(&stale).Error
+	if err != nil {
+		return err
+	}
+	for _, a := range stale {
+		if err := db.WithContext(ctx).Delete(&a).Error; err != nil {
+			return err
+		}
+		deleteStoredObjects(ctx, a.Key)
+	}
+	return nil
+}
+
+// Delete an attachment and its file
+func deleteAttachment(c echo.Context) error {
+	a, err := findAttachment(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	if err := dbCtx(c).Delete(a).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to delete attachment")
+	}
+	deleteStoredObjects(c.Request().Context(), a.Key)
+	return c.NoContent(http.StatusNoContent)
+}
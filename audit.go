@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	// Personal data replaced with placeholders, old values not recorded
+	auditAnonymize = "anonymize"
+
+	actorSystem = "system"
+	actorUser   = "user"
+	actorAPIKey = "api_key"
+
+	// Instance setting holding the rows loaded before an update or delete
+	auditBeforeSetting = "audit:before"
+	// Session setting that turns auditing off, for schema migrations
+	auditSkipSetting = "audit:skip"
+	redactedValue    = "[redacted]"
+)
+
+// Tables whose writes are not audited: the log itself, migration, delivery, job,
+// export and outbox bookkeeping, user history, stats and listings, the user-role
+// join table, whose changes are audited on the user, and password reset tokens,
+// whose hashes are credentials
+var auditSkipTables = map[string]bool{
+	"audit_logs":            true,
+	migrationsTable:         true,
+	"webhook_deliveries":    true,
+	"jobs":                  true,
+	"outbox_events":         true,
+	"exports":               true,
+	"user_stats":            true,
+	"user_listings":         true,
+	"user_versions":         true,
+	"user_roles":            true,
+	"idempotency_keys":      true,
+	"password_reset_tokens": true,
+	"refresh_tokens":        true,
+	"two_factor_secrets":    true,
+	"backup_codes":          true,
+	"login_throttles":       true,
+}
+
+// Columns that change as a side effect and are left out of diffs
+var auditIgnoredColumns = map[string]bool{
+	"updated_at":   true,
+	"last_used_at": true,
+}
+
+// Columns whose values never appear in the log; a change is still recorded
+var auditRedactedColumns = map[string]bool{
+	"password_hash": true,
+	"key_hash":      true,
+	"secret":        true,
+}
+
+// AuditChange is a column's value before and after a write
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditChanges is stored as a JSON object keyed by column
+type AuditChanges map[string]AuditChange
+
+func (a AuditChanges) Value() (driver.Value, error) {
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+func (a *AuditChanges) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	case []byte:
+		return json.Unmarshal(v, a)
+	case nil:
+		*a = nil
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T as audit changes", value)
+}
+
+// AuditLog records one write to one row, with who made it and from where
+type AuditLog struct {
+	ID         uint         `json:"id" gorm:"primaryKey"`
+	TenantID   uint         `json:"-" gorm:"not null;default:1;index"`
+	ActorType  string       `json:"actor_type" gorm:"size:20;not null;index:idx_audit_logs_actor,priority:1"`
+	ActorID    *uint        `json:"actor_id" gorm:"index:idx_audit_logs_actor,priority:2"`
+	Action     string       `json:"action" gorm:"size:10;not null"`
+	EntityType string       `json:"entity_type" gorm:"size:50;not null;index:idx_audit_logs_entity,priority:1"`
+	EntityID   string       `json:"entity_id" gorm:"size:64;not null;index:idx_audit_logs_entity,priority:2"`
+	Changes    AuditChanges `json:"changes" gorm:"type:text;not null"`
+	IP         string       `json:"ip" gorm:"size:45"`
+	RequestID  string       `json:"request_id" gorm:"size:64"`
+	CreatedAt  time.Time    `json:"created_at" gorm:"index"`
+}
+
+var auditQuery = QuerySpec{
+	Filters: []Filter{
+		{Param: "actor_type", Column: "actor_type", Op: "="},
+		{Param: "actor_id", Column: "actor_id", Op: "=", Parse: parseIDParam},
+		{Param: "action", Column: "action", Op: "="},
+		{Param: "entity_type", Column: "entity_type", Op: "="},
+		{Param: "entity_id", Column: "entity_id", Op: "="},
+		{Param: "request_id", Column: "request_id", Op: "="},
+		{Param: "created_after", Column: "created_at", Op: ">", Parse: parseTimeParam},
+		{Param: "created_before", Column: "created_at", Op: "<", Parse: parseTimeParam},
+	},
+	Sorts: map[string]string{
+		"id":         "id",
+		"created_at": "created_at",
+	},
+	DefaultSort: "-id",
+}
+
+// Parse a numeric ID query value
+func parseIDParam(v string) (interface{}, error) {
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid ID")
+	}
+	return id, nil
+}
+
+// auditContext identifies who is making the writes of a request
+type auditContext struct {
+	ActorType string
+	ActorID   *uint
+	IP        string
+	RequestID string
+}
+
+type auditContextKey struct{}
+
+// Middleware carrying the client IP and request ID to audited writes.
+// Authentication fills in the actor once it is known.
+func auditMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			info := &auditContext{ActorType: actorSystem, IP: c.RealIP(), RequestID: requestID(c)}
+			ctx := context.WithValue(c.Request().Context(), auditContextKey{}, info)
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// Attribute the writes made under ctx to an actor
+func setAuditActor(ctx context.Context, actorType string, id uint) {
+	if info, ok := ctx.Value(auditContextKey{}).(*auditContext); ok {
+		info.ActorType = actorType
+		info.ActorID = &id
+	}
+}
+
+// Report whether writes through the statement are audited
+func auditable(tx *gorm.DB) bool {
+	if _, skip := tx.Get(auditSkipSetting); skip {
+		return false
+	}
+	s := tx.Statement
+	return s.Schema != nil && !auditSkipTables[s.Table] && s.Schema.PrioritizedPrimaryField != nil
+}
+
+// Collect the non-zero primary keys of the statement's model values
+func auditModelIDs(tx *gorm.DB) []interface{} {
+	field := tx.Statement.Schema.PrioritizedPrimaryField
+	rv := tx.Statement.ReflectValue
+	var ids []interface{}
+	add := func(v reflect.Value) {
+		if id, zero := field.ValueOf(tx.Statement.Context, v); !zero {
+			ids = append(ids, id)
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			add(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		add(rv)
+	}
+	return ids
+}
+
+// Load the rows matching the conditions as column maps, keyed by primary key.
+// Soft-deleted rows are included.
+func auditLoadRows(tx *gorm.DB, conds ...clause.Expression) (map[string]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	err := tx.Session(&gorm.Session{NewDB: true}).Table(tx.Statement.Table).
+		Clauses(clause.Where{Exprs: conds}).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	pk := tx.Statement.Schema.PrioritizedPrimaryField.DBName
+	byID := make(map[string]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		byID[fmt.Sprint(auditValue(row[pk]))] = row
+	}
+	return byID, nil
+}
+
+// Remember the rows an update or delete is about to change
+func auditBefore(tx *gorm.DB) {
+	if tx.Error != nil || !auditable(tx) {
+		return
+	}
+	var conds []clause.Expression
+	if where, ok := tx.Statement.Clauses["WHERE"].Expression.(clause.Where); ok {
+		conds = append(conds, where.Exprs...)
+	}
+	if ids := auditModelIDs(tx); len(ids) > 0 {
+		pk := tx.Statement.Schema.PrioritizedPrimaryField.DBName
+		conds = append(conds, clause.IN{Column: clause.Column{Name: pk}, Values: ids})
+	}
+	if len(conds) == 0 {
+		// A global write; GORM refuses these unless explicitly allowed
+		return
+	}
+	rows, err := auditLoadRows(tx, conds...)
+	if err != nil {
+		tx.AddError(fmt.Errorf("audit: %w", err))
+		return
+	}
+	tx.InstanceSet(auditBeforeSetting, rows)
+}
+
+// Record the rows a write changed, in the same transaction as the write
+func auditAfter(action string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		if tx.Error != nil || tx.RowsAffected == 0 || !auditable(tx) {
+			return
+		}
+		var before map[string]map[string]interface{}
+		if v, ok := tx.InstanceGet(auditBeforeSetting); ok {
+			before = v.(map[string]map[string]interface{})
+		}
+
+		pk := tx.Statement.Schema.PrioritizedPrimaryField.DBName
+		var ids []interface{}
+		if action == auditCreate {
+			ids = auditModelIDs(tx)
+		} else {
+			for _, row := range before {
+				ids = append(ids, auditValue(row[pk]))
+			}
+			sort.Slice(ids, func(i, j int) bool { return fmt.Sprint(ids[i]) < fmt.Sprint(ids[j]) })
+		}
+		if len(ids) == 0 {
+			return
+		}
+		after, err := auditLoadRows(tx, clause.IN{Column: clause.Column{Name: pk}, Values: ids})
+		if err != nil {
+			tx.AddError(fmt.Errorf("audit: %w", err))
+			return
+		}
+
+		var logs []AuditLog
+		for _, id := range ids {
+			key := fmt.Sprint(auditValue(id))
+			changes := diffRows(before[key], after[key])
+			if len(changes) == 0 {
+				continue
+			}
+			logs = append(logs, newAuditLog(tx.Statement.Context, action, tx.Statement.Table, key, changes))
+		}
+		if err := writeAuditLogs(tx, logs...); err != nil {
+			tx.AddError(fmt.Errorf("audit: %w", err))
+		}
+	}
+}
+
+// Build a log entry attributed to the actor in ctx
+func newAuditLog(ctx context.Context, action, entityType, entityID string, changes AuditChanges) AuditLog {
+	log := AuditLog{
+		ActorType:  actorSystem,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Changes:    changes,
+	}
+	if info, ok := ctx.Value(auditContextKey{}).(*auditContext); ok {
+		log.ActorType = info.ActorType
+		log.ActorID = info.ActorID
+		log.IP = info.IP
+		log.RequestID = info.RequestID
+	}
+	return log
+}
+
+// Insert log entries on the statement's connection, inside its transaction
+func writeAuditLogs(tx *gorm.DB, logs ...AuditLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	return tx.Session(&gorm.Session{NewDB: true}).CreateInBatches(logs, bulkInsertBatchSize).Error
+}
+
+// Compare two rows column by column; a missing row has every column null
+func diffRows(before, after map[string]interface{}) AuditChanges {
+	changes := AuditChanges{}
+	columns := map[string]bool{}
+	for column := range before {
+		columns[column] = true
+	}
+	for column := range after {
+		columns[column] = true
+	}
+	for column := range columns {
+		if auditIgnoredColumns[column] {
+			continue
+		}
+		b, a := auditValue(before[column]), auditValue(after[column])
+		if reflect.DeepEqual(b, a) {
+			continue
+		}
+		if auditRedactedColumns[column] {
+			if b != nil {
+				b = redactedValue
+			}
+			if a != nil {
+				a = redactedValue
+			}
+		}
+		changes[column] = AuditChange{Before: b, After: a}
+	}
+	return changes
+}
+
+// Normalize a scanned column value so the same value compares equal, and
+// encodes the same, whichever driver scanned it
+func auditValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	}
+	return v
+}
+
+// Audit writes made through GORM: rows are read before updates and deletes
+// and after every write, and the differences stored in audit_logs
+func registerAuditCallbacks(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Update().Before("gorm:update").Register("audit:before_update", auditBefore); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register("audit:before_delete", auditBefore); err != nil {
+		return err
+	}
+	const commit = "gorm:commit_or_rollback_transaction"
+	if err := cb.Create().After("gorm:after_create").Before(commit).Register("audit:create", auditAfter(auditCreate)); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:after_update").Before(commit).Register("audit:update", auditAfter(auditUpdate)); err != nil {
+		return err
+	}
+	return cb.Delete().After("gorm:after_delete").Before(commit).Register("audit:delete", auditAfter(auditDelete))
+}
+
+// List audit log entries, newest first by default
+func getAuditLogs(c echo.Context) error {
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	conds, err := auditQuery.ParseFilters(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	sortFields, err := auditQuery.ParseSort(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	var logs []AuditLog
+	var total int64
+	q := applyConditions(dbCtx(c).Model(&AuditLog{}), conds)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch audit logs")
+	}
+	if err := applySort(q, sortFields).Offset(p.Offset).Limit(p.Limit).Find(&logs).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch audit logs")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, logs))
+}
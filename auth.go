@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	echojwt "github.com/labstack/echo-jwt/v4"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	jwtSecret []byte
+	tokenTTL  time.Duration
+)
+
+// Shortest JWT_SECRET accepted. It also signs session cookies and cursors.
+const minJWTSecretLength = 32
+
+// JWTClaims are embedded in every issued access token
+type JWTClaims struct {
+	UserID uint   `json:"uid"`
+	Name   string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+type loginRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	// TOTP or backup code, for users with two-factor authentication
+	OTP string `json:"otp"`
+}
+
+// Load JWT settings from the configuration
+func initAuth() {
+	if cfg.Auth.JWTSecret == "" {
+		log.Fatal("JWT_SECRET must be set")
+	}
+	if cfg.Auth.JWTSecret == "change-me" || len(cfg.Auth.JWTSecret) < minJWTSecretLength {
+		log.Fatalf("JWT_SECRET must be a random value of at least %d bytes, e.g. from openssl rand -base64 32", minJWTSecretLength)
+	}
+	jwtSecret = []byte(cfg.Auth.JWTSecret)
+	tokenTTL = cfg.Auth.JWTTTL
+}
+
+// Middleware rejecting requests without a valid bearer token or session.
+// Requests authenticated by the session cookie must pass the CSRF check.
+func requireAuth() echo.MiddlewareFunc {
+	bearer := echojwt.WithConfig(echojwt.Config{
+		SigningKey: jwtSecret,
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(JWTClaims)
+		},
+		ErrorHandler: func(c echo.Context, err error) error {
+			return newProblem(http.StatusUnauthorized, "Invalid or missing token")
+		},
+	})
+	csrf := csrfProtect()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		viaBearer, viaSession := bearer(next), csrf(next)
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(echo.HeaderAuthorization) == "" {
+				if id, ok := sessionUserID(c); ok {
+					c.Set("sessionUserID", id)
+					return viaSession(c)
+				}
+			}
+			return viaBearer(c)
+		}
+	}
+}
+
+// The ID of the user authenticated by the bearer token or session
+func authUserID(c echo.Context) (uint, bool) {
+	if token, ok := c.Get("user").(*jwt.Token); ok {
+		return token.Claims.(*JWTClaims).UserID, true
+	}
+	id, ok := c.Get("sessionUserID").(uint)
+	return id, ok
+}
+
+// Hash a plaintext password with bcrypt
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Sign an access token for the given user
+func issueToken(user User) (string, time.Time, error) {
+	expiresAt := time.Now().Add(tokenTTL)
+	claims := JWTClaims{
+		UserID: user.ID,
+		Name:   user.Name,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	return token, expiresAt, err
+}
+
+// Exchange name and password for a JWT
+func login(c echo.Context) error {
+	req := new(loginRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := checkLogin(c, *req)
+	if err != nil {
+		return err
+	}
+	tokens, err := issueTokens(c.Request().Context(), *user, "")
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to issue token")
+	}
+	return respond(c, http.StatusOK, tokens)
+}
+
+// Note when a user last logged in, for the inactive user retention rule. The
+// bare table update leaves the version, history, audit log and events alone.
+func recordLogin(ctx context.Context, id uint) {
+	err := db.WithContext(ctx).Table("users").Where("id = ?", id).UpdateColumn("last_login_at", time.Now()).Error
+	if err != nil {
+		contextLogger(ctx).Warn("failed to record login", "user_id", id, "error", err)
+	}
+}
+
+// Find the user with the login's name and password, with their roles, and
+// check their second factor. Failures count towards locking out the account
+// and the client's address; locked accounts are refused before their
+// password is checked, so a lockout says nothing about the password.
+func checkLogin(c echo.Context, req loginRequest) (*User, error) {
+	ctx := c.Request().Context()
+	address := addressThrottle(c.RealIP())
+	wait, err := lockedFor(ctx, address)
+	if err != nil {
+		return nil, newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	if wait > 0 {
+		return nil, lockedOut(c, http.StatusTooManyRequests, "Too many failed logins, try again later", wait)
+	}
+
+	var users []User
+	if err := dbCtx(c).Preload("Roles").Where("name = ? AND password_hash <> ''", req.Name).Find(&users).Error; err != nil {
+		return nil, newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	failed := []string{address}
+	var locked time.Duration
+	for _, user := range users {
+		account := accountThrottle(user.ID)
+		wait, err := lockedFor(ctx, account)
+		if err != nil {
+			return nil, newProblem(http.StatusInternalServerError, "Failed to log in")
+		}
+		if wait > 0 {
+			locked = max(locked, wait)
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+			failed = append(failed, account)
+			continue
+		}
+		if err := checkSecondFactor(ctx, user, req.OTP); err != nil {
+			// Asking for the code is the normal first step, not a failure
+			if req.OTP != "" {
+				recordLoginFailure(ctx, address, account)
+			}
+			return nil, err
+		}
+		clearLoginFailures(ctx, account)
+		if cfg.Auth.RequireVerifiedEmail && user.Email != nil && !user.IsVerified {
+			return nil, newProblem(http.StatusForbidden, "Verify your email address before logging in")
+		}
+		if err := inactiveUserProblem(&user); err != nil {
+			return nil, err
+		}
+		recordLogin(ctx, user.ID)
+		return &user, nil
+	}
+
+	recordLoginFailure(ctx, failed...)
+	if locked > 0 {
+		return nil, lockedOut(c, http.StatusLocked, "Account is locked after too many failed logins", locked)
+	}
+	return nil, newProblem(http.StatusUnauthorized, "Invalid credentials")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxAvatarSize = 5 << 20
+	// Smallest and largest width or height accepted
+	minAvatarDimension = 32
+	maxAvatarDimension = 4096
+
+	avatarPending = "pending"
+	avatarReady   = "ready"
+	avatarFailed  = "failed"
+
+	jobAvatarProcess = "avatar.process"
+)
+
+// Accepted avatar types, as sniffed from the upload, and the extension of the
+// images generated from them. GIFs become PNGs of their first frame.
+var avatarTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".png",
+}
+
+// The square sizes avatars are cut to, in pixels. The original is kept at
+// full size, only re-encoded.
+var avatarSizes = map[string]int{
+	"thumbnail": 64,
+	"medium":    256,
+}
+
+// The payload of an avatar processing job
+type avatarJob struct {
+	UserID uint   `json:"user_id"`
+	Key    string `json:"key"`
+}
+
+// A user's avatar is stored as its original under avatars/<id>/<uuid>/, with
+// each size beside it and the raw upload until it is processed. Avatars
+// uploaded before processing existed are a single file.
+func isProcessedAvatar(key string) bool {
+	return strings.HasPrefix(path.Base(key), "original.")
+}
+
+// The key of one size of the avatar whose original is stored under key
+func avatarKey(key, size string) string {
+	if !isProcessedAvatar(key) {
+		return key
+	}
+	return path.Join(path.Dir(key), size+path.Ext(key))
+}
+
+// The key the raw upload is kept under until it is processed
+func avatarUploadKey(key string) string {
+	return path.Join(path.Dir(key), "upload")
+}
+
+// Every object stored for an avatar, for deleting them all
+func avatarKeys(key string) []string {
+	if key == "" {
+		return nil
+	}
+	if !isProcessedAvatar(key) {
+		return []string{key}
+	}
+	keys := []string{key, avatarUploadKey(key)}
+	for size := range avatarSizes {
+		keys = append(keys, avatarKey(key, size))
+	}
+	return keys
+}
+
+// Process avatars with jobs
+func initAvatars() {
+	registerJobType(jobAvatarProcess, JobType{Run: processAvatar})
+}
+
+// Replace a user's avatar with an image uploaded in the "file" form field. The
+// upload is checked and stored as is; the sizes are generated in the
+// background, with the user's avatar_status showing progress.
+func putUserAvatar(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Expected an image upload in the file field")
+	}
+	if file.Size > maxAvatarSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("Avatars are limited to %d MB", maxAvatarSize>>20))
+	}
+	src, err := file.Open()
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Failed to read upload")
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxAvatarSize+1))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Failed to read upload")
+	}
+	if len(data) > maxAvatarSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("Avatars are limited to %d MB", maxAvatarSize>>20))
+	}
+	// Trust the content, not the type the client declared
+	contentType := http.DetectContentType(data)
+	ext, ok := avatarTypes[contentType]
+	if !ok {
+		return newProblem(http.StatusUnsupportedMediaType, "Expected a JPEG, PNG or GIF image")
+	}
+	// Only the header is read here, so huge images are turned away cheaply
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return newProblem(http.StatusUnprocessableEntity, "The image could not be read")
+	}
+	if min(config.Width, config.Height) < minAvatarDimension || max(config.Width, config.Height) > maxAvatarDimension {
+		return newProblem(http.StatusUnprocessableEntity, fmt.Sprintf("Avatars must be between %d and %d pixels wide and high", minAvatarDimension, maxAvatarDimension))
+	}
+
+	ctx := c.Request().Context()
+	key := fmt.Sprintf("avatars/%d/%s/original%s", id, uuid.NewString(), ext)
+	if err := fileStorage.Put(ctx, avatarUploadKey(key), data, contentType); err != nil {
+		requestLogger(c).Error("Failed to store avatar", "user_id", id, "error", err)
+		return newProblem(http.StatusInternalServerError, "Failed to store avatar")
+	}
+	user, old, err := userService.SetAvatar(ctx, id, key)
+	if err != nil {
+		deleteStoredObjects(ctx, avatarUploadKey(key))
+		return userError(err, "Failed to update user")
+	}
+	deleteStoredObjects(ctx, avatarKeys(old)...)
+	if err := enqueueJob(ctx, jobAvatarProcess, avatarJob{UserID: user.ID, Key: key}); err != nil {
+		requestLogger(c).Error("Failed to queue avatar processing", "user_id", id, "error", err)
+		userService.SetAvatarStatus(ctx, user.ID, key, avatarFailed)
+		return newProblem(http.StatusInternalServerError, "Failed to process avatar")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusAccepted, newUserResource(c, user))
+}
+
+// Generate the sizes of an uploaded avatar, retried by its job. Images that
+// cannot be decoded, and the last failed attempt, fail the avatar.
+func processAvatar(ctx context.Context, job *Job) error {
+	var payload avatarJob
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+	user, err := userService.Get(ctx, payload.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// A newer upload, or a removal, supersedes this one
+	if user.Avatar != payload.Key || user.AvatarStatus != avatarPending {
+		return nil
+	}
+
+	r, err := fileStorage.Open(ctx, avatarUploadKey(payload.Key))
+	if err != nil {
+		return failAvatar(ctx, job, payload, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarSize+1))
+	r.Close()
+	if err != nil {
+		return failAvatar(ctx, job, payload, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// Retrying would not decode it any better
+		contextLogger(ctx).Warn("Failed to decode avatar", "user_id", payload.UserID, "error", err)
+		_, err = userService.SetAvatarStatus(ctx, payload.UserID, payload.Key, avatarFailed)
+		return err
+	}
+
+	// Re-encoding from decoded pixels leaves EXIF and other metadata behind
+	format := "png"
+	if path.Ext(payload.Key) == ".jpg" {
+		format = "jpeg"
+	}
+	original := toRGBA(img)
+	square := cropSquare(original)
+	variants := map[string]image.Image{"original": original}
+	for size, side := range avatarSizes {
+		variants[size] = resize(square, min(side, square.Bounds().Dx()), min(side, square.Bounds().Dy()))
+	}
+	contentType := mime.TypeByExtension(path.Ext(payload.Key))
+	for size, variant := range variants {
+		encoded, err := encodeImage(variant, format)
+		if err != nil {
+			return failAvatar(ctx, job, payload, err)
+		}
+		if err := fileStorage.Put(ctx, avatarKey(payload.Key, size), encoded, contentType); err != nil {
+			return failAvatar(ctx, job, payload, err)
+		}
+	}
+
+	user, err = userService.SetAvatarStatus(ctx, payload.UserID, payload.Key, avatarReady)
+	if err != nil {
+		return err
+	}
+	if user.Avatar != payload.Key {
+		// Replaced while processing; the replacement already deleted these
+		deleteStoredObjects(ctx, avatarKeys(payload.Key)...)
+		return nil
+	}
+	deleteStoredObjects(ctx, avatarUploadKey(payload.Key))
+	return nil
+}
+
+// Fail an avatar on its job's last attempt, returning err for the job to record
+func failAvatar(ctx context.Context, job *Job, payload avatarJob, err error) error {
+	if job.RetryAt.IsZero() {
+		userService.SetAvatarStatus(ctx, payload.UserID, payload.Key, avatarFailed)
+	}
+	return err
+}
+
+// Serve one size of a user's avatar, chosen by ?size= and the original by
+// default, or redirect to it where the storage serves files itself
+func getUserAvatar(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	size := c.QueryParam("size")
+	if size == "" {
+		size = "original"
+	}
+	if _, ok := avatarSizes[size]; !ok && size != "original" {
+		return newProblem(http.StatusBadRequest, "Invalid size, expected thumbnail, medium or original")
+	}
+	user, err := userService.Get(c.Request().Context(), id)
+	if err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	switch {
+	case user.Avatar == "":
+		return newProblem(http.StatusNotFound, "User has no avatar")
+	case user.AvatarStatus == avatarPending:
+		return newProblem(http.StatusConflict, "Avatar is still being processed")
+	case user.AvatarStatus == avatarFailed:
+		return newProblem(http.StatusConflict, "Avatar could not be processed; upload another")
+	}
+	return serveStoredObject(c, avatarKey(user.Avatar, size))
+}
+
+// Remove a user's avatar
+func deleteUserAvatar(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	_, old, err := userService.SetAvatar(ctx, id, "")
+	if err != nil {
+		return userError(err, "Failed to update user")
+	}
+	if old == "" {
+		return newProblem(http.StatusNotFound, "User has no avatar")
+	}
+	deleteStoredObjects(ctx, avatarKeys(old)...)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Redirect to a stored object or stream it, typed by its key's extension
+func serveStoredObject(c echo.Context, key string) error {
+	ctx := c.Request().Context()
+	url, err := fileStorage.URL(ctx, key)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to link to file")
+	}
+	if url != "" {
+		return c.Redirect(http.StatusFound, url)
+	}
+	r, err := fileStorage.Open(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return newProblem(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to read file")
+	}
+	defer r.Close()
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	return c.Stream(http.StatusOK, contentType, r)
+}
+
+// Delete objects no longer referenced, logging failures: an orphaned file is
+// not worth failing a request that already succeeded
+func deleteStoredObjects(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := fileStorage.Delete(ctx, key); err != nil {
+			contextLogger(ctx).Warn("Failed to delete stored file", "key", key, "error", err)
+		}
+	}
+}
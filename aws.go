@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+
+// awsCredentials are the static AWS credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and, for temporary credentials, AWS_SESSION_TOKEN
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+}
+
+func configuredAWSCredentials() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     cfg.AWS.AccessKeyID,
+		SecretAccessKey: cfg.AWS.SecretAccessKey,
+		SessionToken:    cfg.AWS.SessionToken,
+		Region:          cfg.AWS.Region,
+	}
+}
+
+// Sign a request to an AWS service with Signature Version 4, setting its
+// X-Amz-* and Authorization headers. The body must be the request's body.
+func (c awsCredentials) sign(req *http.Request, service string, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		// AWS expects spaces as %20 rather than +
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := c.scope(amzDate, service)
+	signature := c.signature(amzDate, service, canonicalRequest)
+	req.Header.Set("Authorization", awsSigningAlgorithm+" Credential="+c.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Pre-sign a request to an AWS service with Signature Version 4, returning a
+// URL anyone can use until it expires. Only the host is signed, so clients may
+// send any headers and body.
+func (c awsCredentials) presign(method string, u *url.URL, service string, expires time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", awsSigningAlgorithm)
+	q.Set("X-Amz-Credential", c.AccessKeyID+"/"+c.scope(amzDate, service))
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if c.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	query := strings.ReplaceAll(q.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		query,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signed := *u
+	signed.RawQuery = query + "&X-Amz-Signature=" + c.signature(amzDate, service, canonicalRequest)
+	return signed.String()
+}
+
+// The credential scope of a signature made at amzDate
+func (c awsCredentials) scope(amzDate, service string) string {
+	return amzDate[:8] + "/" + c.Region + "/" + service + "/aws4_request"
+}
+
+// Sign a canonical request with a key derived from the secret for the day,
+// region and service
+func (c awsCredentials) signature(amzDate, service, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		c.scope(amzDate, service),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
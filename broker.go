@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Version of the JSON user events are published to the message broker as.
+// Consumers should check it before reading the payload; it only changes when a
+// field is removed or changes meaning.
+const brokerSchemaVersion = 1
+
+// Name the app gives brokers for its connections
+const brokerClientName = "echo-gorm"
+
+// MessageBroker publishes user events to other services, such as Kafka
+type MessageBroker interface {
+	// Publish the messages in order, returning once the broker has them
+	Publish(ctx context.Context, messages []BrokerMessage) error
+	Close() error
+}
+
+// BrokerMessage is one user event as sent to the message broker
+type BrokerMessage struct {
+	// The same each time the event is published, for brokers that drop duplicates
+	ID    string
+	Event string
+	// The user's ID, so one user's events stay in order
+	Key   string
+	Value []byte
+}
+
+// brokerEvent is the JSON payload of a BrokerMessage
+type brokerEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Event         string    `json:"event"`
+	OccurredAt    time.Time `json:"occurred_at"`
+	Data          *User     `json:"data"`
+}
+
+// Message broker user events are published to; nil when MESSAGE_BROKER is unset
+var messageBroker MessageBroker
+
+// Pick the message broker from MESSAGE_BROKER and publish every user event
+// to it. Events the broker does not take are published again by the outbox.
+func initBroker() {
+	switch cfg.Broker.Type {
+	case "", "none":
+		return
+	case "kafka":
+		messageBroker = NewKafkaPublisher(cfg.Kafka.Brokers, cfg.Kafka.Topic, cfg.Broker.Timeout)
+	case "nats":
+		publisher, err := NewNATSPublisher(cfg.NATS.URL, cfg.NATS.SubjectPrefix, cfg.NATS.Stream, cfg.Broker.Timeout)
+		if err != nil {
+			log.Fatalf("Invalid NATS_URL: %v", err)
+		}
+		messageBroker = publisher
+	case "rabbitmq":
+		publisher, err := NewRabbitMQPublisher(cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange, cfg.RabbitMQ.Queue, cfg.Broker.Timeout)
+		if err != nil {
+			log.Fatalf("Invalid RabbitMQ configuration: %v", err)
+		}
+		messageBroker = publisher
+	default:
+		log.Fatal("Unsupported MESSAGE_BROKER. Set it to 'kafka', 'nats' or 'rabbitmq'")
+	}
+	userEvents.Handle(publishToBroker)
+}
+
+// Send the events of one commit to the message broker
+func publishToBroker(ctx context.Context, events []UserEvent) error {
+	messages := make([]BrokerMessage, len(events))
+	for i, e := range events {
+		value, err := json.Marshal(brokerEvent{
+			SchemaVersion: brokerSchemaVersion,
+			Event:         e.Event,
+			OccurredAt:    e.OccurredAt,
+			Data:          e.Data,
+		})
+		if err != nil {
+			return err
+		}
+		key := strconv.FormatUint(uint64(e.Data.ID), 10)
+		if userIDType == idTypeUUID {
+			key = e.Data.UUID
+		}
+		messages[i] = BrokerMessage{
+			ID:    fmt.Sprintf("%s:%s:%d", e.Event, key, e.OccurredAt.UnixNano()),
+			Event: e.Event,
+			Key:   key,
+			Value: value,
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Broker.Timeout)
+	defer cancel()
+	if err := messageBroker.Publish(ctx, messages); err != nil {
+		return fmt.Errorf("%s: %w", cfg.Broker.Type, err)
+	}
+	return nil
+}
+
+// Close the message broker's connections, if one is configured
+func closeBroker() {
+	if messageBroker == nil {
+		return
+	}
+	if err := messageBroker.Close(); err != nil {
+		log.Printf("Failed to close message broker: %v", err)
+	}
+}
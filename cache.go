@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// ResponseCache stores rendered GET responses until they expire or are cleared
+type ResponseCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	Clear(ctx context.Context)
+}
+
+// Response cache for user reads; nil when CACHE_STORE is unset
+var userCache ResponseCache
+
+// Larger responses, such as streamed lists, are passed through uncached
+const maxCachedBody = 1 << 20
+
+// Pick the cache backend from CACHE_STORE (memory or redis) and CACHE_TTL
+func initCache() {
+	switch cfg.Cache.Store {
+	case "", "none":
+		userCache = nil
+	case "memory":
+		userCache = NewMemoryCache()
+	case "redis":
+		userCache = NewRedisCache("users")
+	default:
+		log.Fatal("Unsupported CACHE_STORE. Set it to 'memory' or 'redis'")
+	}
+	if userCache != nil {
+		userEvents.Handle(clearUserCache)
+	}
+}
+
+// Drop cached user responses once a change to users commits, whichever API made it
+func clearUserCache(ctx context.Context, _ []UserEvent) error {
+	userCache.Clear(ctx)
+	return nil
+}
+
+type memoryCacheEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryCache keeps entries in process; each replica has its own copy
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (m *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = memoryCacheEntry{value: value, expiresAt: now.Add(ttl)}
+}
+
+func (m *MemoryCache) Clear(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string]memoryCacheEntry)
+}
+
+// RedisCache shares entries between replicas. Clearing bumps a generation
+// counter that is part of every key, so stale entries simply expire.
+type RedisCache struct {
+	name string
+}
+
+func NewRedisCache(name string) *RedisCache {
+	return &RedisCache{name: name}
+}
+
+func (r *RedisCache) key(ctx context.Context, key string) (string, error) {
+	gen, err := getRedis().Get(ctx, "cache:"+r.name+":gen").Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+	return "cache:" + r.name + ":" + strconv.FormatInt(gen, 10) + ":" + key, nil
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	k, err := r.key(ctx, key)
+	if err != nil {
+		return nil, false
+	}
+	value, err := getRedis().Get(ctx, k).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (r *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	k, err := r.key(ctx, key)
+	if err != nil {
+		return
+	}
+	if err := getRedis().Set(ctx, k, value, ttl).Err(); err != nil {
+		log.Printf("Cache unavailable: %v", err)
+	}
+}
+
+func (r *RedisCache) Clear(ctx context.Context) {
+	if err := getRedis().Incr(ctx, "cache:"+r.name+":gen").Err(); err != nil {
+		log.Printf("Failed to clear cache: %v", err)
+	}
+}
+
+// Headers handlers send with cacheable responses, replayed on cache hits and
+// on idempotent retries
+var cachedHeaders = []string{"X-Total-Count", "Link", "Last-Modified", "Location"}
+
+// A cached response with the headers needed to replay it
+type cachedResponse struct {
+	ContentType string              `json:"content_type"`
+	ETag        string              `json:"etag"`
+	Headers     map[string][]string `json:"headers,omitempty"`
+	Body        []byte              `json:"body"`
+}
+
+// Records the response body while passing it through to the client,
+// giving up once it exceeds maxCachedBody
+type bodyRecorder struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxCachedBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Middleware serving GET responses from the cache, keyed by tenant, Accept, URL and query.
+// Place it after authentication so only authorized callers reach the cache.
+func cacheResponses(store ResponseCache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if store == nil || c.Request().Method != http.MethodGet {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+			key := c.Request().Header.Get(echo.HeaderAccept) + " " + c.Request().URL.RequestURI()
+			if tenant, ok := tenantFrom(ctx); ok {
+				key = tenant.Slug + " " + key
+			}
+			varyOnAccept(c)
+
+			if raw, ok := store.Get(ctx, key); ok {
+				var cached cachedResponse
+				if err := json.Unmarshal(raw, &cached); err == nil {
+					c.Response().Header().Set("X-Cache", "HIT")
+					for name, values := range cached.Headers {
+						for _, v := range values {
+							c.Response().Header().Add(name, v)
+						}
+					}
+					if cached.ETag != "" {
+						c.Response().Header().Set("ETag", cached.ETag)
+						if notModified(c, cached.ETag) {
+							return c.NoContent(http.StatusNotModified)
+						}
+					}
+					return c.Blob(http.StatusOK, cached.ContentType, cached.Body)
+				}
+			}
+
+			c.Response().Header().Set("X-Cache", "MISS")
+			// Headers set before the handler, such as deprecation links, are set again on hits
+			before := map[string]int{}
+			for _, name := range cachedHeaders {
+				before[name] = len(c.Response().Header().Values(name))
+			}
+			recorder := &bodyRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			err := next(c)
+			c.Response().Writer = recorder.ResponseWriter
+
+			if err == nil && c.Response().Status == http.StatusOK && !recorder.overflow {
+				header := c.Response().Header()
+				headers := map[string][]string{}
+				for _, name := range cachedHeaders {
+					if values := header.Values(name); len(values) > before[name] {
+						headers[name] = values[before[name]:]
+					}
+				}
+				raw, _ := json.Marshal(cachedResponse{
+					ContentType: header.Get(echo.HeaderContentType),
+					ETag:        header.Get("ETag"),
+					Headers:     headers,
+					Body:        recorder.body.Bytes(),
+				})
+				store.Set(ctx, key, raw, cfg.Cache.TTL)
+			}
+			return err
+		}
+	}
+}
+
+// Middleware clearing the cache after any successful write in the group
+func invalidateCache(store ResponseCache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			method := c.Request().Method
+			if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+				return err
+			}
+			if store != nil && err == nil && c.Response().Status < http.StatusBadRequest {
+				store.Clear(c.Request().Context())
+			}
+			return err
+		}
+	}
+}
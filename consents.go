@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Consent records a user agreeing to one purpose, such as marketing, until it
+// is revoked. Rows are never updated but to revoke them, so a user's consents
+// are the history of what they agreed to and when.
+type Consent struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	TenantID  uint       `json:"-" gorm:"not null;default:1;index"`
+	UserID    uint       `json:"user_id" gorm:"not null;index:idx_consents_user_purpose,priority:1"`
+	Purpose   string     `json:"purpose" gorm:"size:50;not null;index:idx_consents_user_purpose,priority:2"`
+	Source    string     `json:"source" gorm:"size:100"`
+	GrantedAt time.Time  `json:"granted_at" gorm:"not null"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (c Consent) MarshalJSON() ([]byte, error) {
+	type plainConsent Consent
+	if userIDType != idTypeUUID {
+		return json.Marshal(plainConsent(c))
+	}
+	user, err := userUUID(c.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainConsent
+		UserID *string `json:"user_id"`
+	}{plainConsent(c), user})
+}
+
+// ConsentStatus is where a user stands on one purpose
+type ConsentStatus struct {
+	Granted   bool       `json:"granted"`
+	GrantedAt *time.Time `json:"granted_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ConsentSummary is a user's latest decision on each of CONSENT_PURPOSES,
+// shown on the user with ?expand=consents
+type ConsentSummary map[string]ConsentStatus
+
+type grantConsentRequest struct {
+	Purpose string `json:"purpose" validate:"required"`
+	// Where the consent was collected, such as a signup form
+	Source string `json:"source" validate:"max=100"`
+}
+
+// Summarize a user's consents: each purpose takes its latest record, and
+// purposes never granted are not granted
+func summarizeConsents(consents []Consent) ConsentSummary {
+	summary := make(ConsentSummary, len(cfg.Consent.Purposes))
+	for _, purpose := range cfg.Consent.Purposes {
+		summary[purpose] = ConsentStatus{}
+	}
+	for _, consent := range consents {
+		if last, ok := summary[consent.Purpose]; ok && last.GrantedAt != nil && last.GrantedAt.After(consent.GrantedAt) {
+			continue
+		}
+		summary[consent.Purpose] = ConsentStatus{
+			Granted:   consent.RevokedAt == nil,
+			GrantedAt: &consent.GrantedAt,
+			RevokedAt: consent.RevokedAt,
+		}
+	}
+	return summary
+}
+
+// Path of a user's consents under the request's API prefix
+func consentsPath(c echo.Context, userID uint) string {
+	return userPathByID(c, userID) + "/consents"
+}
+
+// Wrap a consent with links to its purpose, the user's consents and the user
+func newConsentResource(c echo.Context, consent *Consent) Resource {
+	collection := consentsPath(c, consent.UserID)
+	return Resource{Data: consent, Links: Links{
+		"self":       collection + "/" + consent.Purpose,
+		"collection": collection,
+		"user":       userPathByID(c, consent.UserID),
+	}}
+}
+
+// Report whether purpose is one of CONSENT_PURPOSES, as a validation problem if not
+func checkConsentPurpose(purpose string) error {
+	if slices.Contains(cfg.Consent.Purposes, purpose) {
+		return nil
+	}
+	p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+	p.Errors = map[string]string{"purpose": "must be one of: " + strings.Join(cfg.Consent.Purposes, ", ")}
+	return p
+}
+
+// Lock a live user's row for the rest of the transaction, so consents to the
+// same purpose are granted and revoked one at a time
+func lockConsentUser(tx *gorm.DB, id uint) error {
+	var user User
+	err := forUpdate(tx).Select("id").First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// List a user's consents, newest first, optionally for one ?purpose= or only
+// the ?active=true ones
+func getConsents(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	q := dbCtx(c).Model(&Consent{}).Where("user_id = ?", id)
+	if purpose := c.QueryParam("purpose"); purpose != "" {
+		q = q.Where("purpose = ?", purpose)
+	}
+	switch c.QueryParam("active") {
+	case "":
+	case "true":
+		q = q.Where("revoked_at IS NULL")
+	case "false":
+		q = q.Where("revoked_at IS NOT NULL")
+	default:
+		return newProblem(http.StatusBadRequest, "Invalid active, expected true or false")
+	}
+	var consents []Consent
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch consents")
+	}
+	if err := q.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&consents).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch consents")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, consents))
+}
+
+// Fetch a user's latest consent to the :purpose, standing or revoked
+func getConsent(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	purpose := c.Param("purpose")
+	if err := checkConsentPurpose(purpose); err != nil {
+		return err
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	var consent Consent
+	if err := dbCtx(c).Where("user_id = ? AND purpose = ?", id, purpose).Order("id DESC").Take(&consent).Error; err != nil {
+		return newProblem(http.StatusNotFound, "Consent never granted")
+	}
+	return respond(c, http.StatusOK, newConsentResource(c, &consent))
+}
+
+// Record a user granting consent to a purpose. Granting a purpose already
+// granted returns the standing consent unchanged.
+func grantConsent(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req := new(grantConsentRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	if err := checkConsentPurpose(req.Purpose); err != nil {
+		return err
+	}
+
+	var consent Consent
+	created := false
+	err = WithTx(c, func(tx *gorm.DB) error {
+		if err := lockConsentUser(tx, id); err != nil {
+			return err
+		}
+		err := tx.Where("user_id = ? AND purpose = ? AND revoked_at IS NULL", id, req.Purpose).Take(&consent).Error
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		consent = Consent{UserID: id, Purpose: req.Purpose, Source: req.Source, GrantedAt: time.Now()}
+		created = true
+		return tx.Create(&consent).Error
+	})
+	if err != nil {
+		return userError(err, "Failed to grant consent")
+	}
+	if !created {
+		return respond(c, http.StatusOK, newConsentResource(c, &consent))
+	}
+	c.Response().Header().Set(echo.HeaderLocation, consentsPath(c, id)+"/"+consent.Purpose)
+	return respond(c, http.StatusCreated, newConsentResource(c, &consent))
+}
+
+// Revoke a user's standing consent to the :purpose
+func revokeConsent(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	purpose := c.Param("purpose")
+	if err := checkConsentPurpose(purpose); err != nil {
+		return err
+	}
+
+	var consent Consent
+	err = WithTx(c, func(tx *gorm.DB) error {
+		if err := lockConsentUser(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND purpose = ? AND revoked_at IS NULL", id, purpose).Take(&consent).Error; err != nil {
+			return err
+		}
+		return tx.Model(&consent).Update("revoked_at", time.Now()).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusNotFound, "Consent not granted")
+	}
+	if err != nil {
+		return userError(err, "Failed to revoke consent")
+	}
+	return respond(c, http.StatusOK, newConsentResource(c, &consent))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Response headers browsers may read from cross-origin responses
+var corsExposedHeaders = []string{
+	echo.HeaderXRequestID,
+	echo.HeaderContentDisposition,
+	"ETag",
+	echo.HeaderLocation,
+	"Retry-After",
+	"X-Cache",
+	"X-Total-Count",
+	apiVersionHeader,
+	"Deprecation",
+	"Sunset",
+	"Link",
+}
+
+// Middleware answering CORS preflights and tagging responses for the origins in
+// CORS_ALLOWED_ORIGINS; without any, cross-origin browser calls stay blocked
+func corsMiddleware() echo.MiddlewareFunc {
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     cfg.CORS.AllowedOrigins,
+		AllowMethods:     cfg.CORS.AllowedMethods,
+		AllowHeaders:     cfg.CORS.AllowedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		ExposeHeaders:    corsExposedHeaders,
+		MaxAge:           int(cfg.CORS.MaxAge.Seconds()),
+	})
+}
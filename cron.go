@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduledTask is a recurring task run in-process on a cron schedule. Every
+// replica runs its own schedule, so tasks must be safe to run concurrently.
+type scheduledTask struct {
+	Name        string
+	Description string
+	Schedule    string
+	run         func(ctx context.Context) error
+	// Also run once when the server starts
+	atStartup bool
+
+	mu           sync.Mutex
+	entry        cron.EntryID
+	running      bool
+	lastRunAt    *time.Time
+	lastDuration time.Duration
+	lastError    string
+}
+
+// What the admin endpoint shows of a task
+type scheduledTaskStatus struct {
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Schedule       string     `json:"schedule"`
+	Running        bool       `json:"running"`
+	NextRunAt      *time.Time `json:"next_run_at"`
+	LastRunAt      *time.Time `json:"last_run_at"`
+	LastDurationMS int64      `json:"last_duration_ms"`
+	LastError      string     `json:"last_error"`
+}
+
+var (
+	scheduler      *cron.Cron
+	scheduledTasks []*scheduledTask
+	// Contexts of task runs, cancelled on shutdown
+	schedulerCtx context.Context
+	// Task runs triggered by admins, waited for on shutdown like scheduled ones
+	manualRuns sync.WaitGroup
+)
+
+// Run the task unless a run is already in progress, reporting whether it ran
+func (t *scheduledTask) execute(ctx context.Context) bool {
+	t.mu.Lock()
+	if t.running {
+		t.mu.Unlock()
+		return false
+	}
+	t.running = true
+	t.mu.Unlock()
+
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return t.run(ctx)
+	}()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = false
+	t.lastRunAt = &start
+	t.lastDuration = time.Since(start)
+	t.lastError = ""
+	outcome := "success"
+	if err != nil {
+		t.lastError = err.Error()
+		outcome = "failure"
+		if ctx.Err() == nil {
+			contextLogger(ctx).Error("scheduled task failed", "task", t.Name, "error", err)
+		}
+	}
+	cronRunsTotal.WithLabelValues(t.Name, outcome).Inc()
+	return true
+}
+
+func (t *scheduledTask) status() scheduledTaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := scheduledTaskStatus{
+		Name:           t.Name,
+		Description:    t.Description,
+		Schedule:       t.Schedule,
+		Running:        t.running,
+		LastRunAt:      t.lastRunAt,
+		LastDurationMS: t.lastDuration.Milliseconds(),
+		LastError:      t.lastError,
+	}
+	if next := scheduler.Entry(t.entry).Next; !next.IsZero() {
+		s.NextRunAt = &next
+	}
+	return s
+}
+
+// Schedule the recurring tasks whose CRON_* schedule is set and start running
+// them. The returned function stops the scheduler, cancelling runs in progress
+// and waiting for them until ctx expires.
+func startScheduler() func(ctx context.Context) {
+	tasks := []*scheduledTask{
+		{
+			Name:        "apply-retention",
+			Description: "Purge and anonymize users past the *_RETENTION ages, or only report them with RETENTION_DRY_RUN",
+			Schedule:    cfg.Cron.ApplyRetention,
+			run:         runRetention,
+		},
+		{
+			Name:        "refresh-stats",
+			Description: "Recount each tenant's users into user_stats and the users metric",
+			Schedule:    cfg.Cron.RefreshStats,
+			run:         refreshUserStats,
+			atStartup:   true,
+		},
+		{
+			Name:        "delete-expired-exports",
+			Description: "Delete exports older than EXPORT_TTL and their files",
+			Schedule:    cfg.Cron.DeleteExpiredExports,
+			run:         deleteExpiredExports,
+		},
+		{
+			Name:        "delete-stale-attachments",
+			Description: "Delete attachments whose upload was not confirmed within a day",
+			Schedule:    cfg.Cron.DeleteStaleAttachments,
+			run:         deleteStaleAttachments,
+		},
+	}
+	if cfg.ReadModel.Enabled {
+		tasks = append(tasks, &scheduledTask{
+			Name:        "rebuild-user-listings",
+			Description: "Copy every user into user_listings, catching up on changes that published no event",
+			Schedule:    cfg.Cron.RebuildUserListings,
+			run:         rebuildUserListings,
+			atStartup:   true,
+		})
+	}
+	if logFile != nil {
+		tasks = append(tasks, &scheduledTask{
+			Name:        "rotate-logs",
+			Description: "Start a new LOG_FILE, keeping LOG_MAX_BACKUPS old ones",
+			Schedule:    cfg.Cron.RotateLogs,
+			run: func(context.Context) error {
+				return logFile.Rotate()
+			},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	schedulerCtx = ctx
+	scheduler = cron.New()
+	for _, task := range tasks {
+		if task.Schedule == "" {
+			continue
+		}
+		entry, err := scheduler.AddFunc(task.Schedule, func() { task.execute(ctx) })
+		if err != nil {
+			log.Fatalf("Invalid schedule for %s: %v", task.Name, err)
+		}
+		task.entry = entry
+		scheduledTasks = append(scheduledTasks, task)
+	}
+	scheduler.Start()
+	for _, task := range scheduledTasks {
+		if task.atStartup {
+			manualRuns.Add(1)
+			go func() {
+				defer manualRuns.Done()
+				task.execute(ctx)
+			}()
+		}
+	}
+
+	return func(shutdownCtx context.Context) {
+		stopped := scheduler.Stop()
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			<-stopped.Done()
+			manualRuns.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-shutdownCtx.Done():
+		}
+	}
+}
+
+func findScheduledTask(name string) (*scheduledTask, bool) {
+	for _, task := range scheduledTasks {
+		if task.Name == name {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+// List the scheduled tasks of this replica, with their last and next runs
+func getScheduledTasks(c echo.Context) error {
+	statuses := make([]scheduledTaskStatus, len(scheduledTasks))
+	for i, task := range scheduledTasks {
+		statuses[i] = task.status()
+	}
+	return respond(c, http.StatusOK, statuses)
+}
+
+// Run a scheduled task now, in the background
+func runScheduledTask(c echo.Context) error {
+	task, ok := findScheduledTask(c.Param("name"))
+	if !ok {
+		return newProblem(http.StatusNotFound, "Task not found")
+	}
+	if task.status().Running {
+		return newProblem(http.StatusConflict, "Task is already running")
+	}
+	manualRuns.Add(1)
+	go func() {
+		defer manualRuns.Done()
+		task.execute(schedulerCtx)
+	}()
+	return respond(c, http.StatusAccepted, map[string]string{"message": "Task started"})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Sort orders cursor pagination supports; each is unique thanks to the id tie-break
+var keysetSorts = map[string][]SortField{
+	"id":          {{Column: "id"}},
+	"-id":         {{Column: "id", Desc: true}},
+	"created_at":  {{Column: "created_at"}, {Column: "id"}},
+	"-created_at": {{Column: "created_at", Desc: true}, {Column: "id", Desc: true}},
+}
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// Cursor marks the last row of a page; clients only ever see it signed and encoded
+type Cursor struct {
+	Sort      string     `json:"s"`
+	ID        uint       `json:"i"`
+	CreatedAt *time.Time `json:"c,omitempty"`
+}
+
+// Cursor pointing just past the user in the given keyset sort
+func cursorAfter(sort string, user User) Cursor {
+	cur := Cursor{Sort: sort, ID: user.ID}
+	if strings.TrimPrefix(sort, "-") == "created_at" {
+		createdAt := user.CreatedAt
+		cur.CreatedAt = &createdAt
+	}
+	return cur
+}
+
+// Sign the cursor so clients cannot forge positions
+func signCursor(payload []byte) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("cursor:"))
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+// Encode the cursor as an opaque, signed token
+func (cur Cursor) Encode() string {
+	payload, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signCursor(payload))
+}
+
+// Decode and verify a token produced by Encode
+func decodeCursor(token string) (*Cursor, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signCursor(payload)) {
+		return nil, errInvalidCursor
+	}
+
+	var cur Cursor
+	if err := json.Unmarshal(payload, &cur); err != nil {
+		return nil, errInvalidCursor
+	}
+	if _, ok := keysetSorts[cur.Sort]; !ok {
+		return nil, errInvalidCursor
+	}
+	if strings.TrimPrefix(cur.Sort, "-") == "created_at" && cur.CreatedAt == nil {
+		return nil, errInvalidCursor
+	}
+	return &cur, nil
+}
+
+// Restrict a GORM query to the rows after the cursor in its sort order
+func applyKeyset(q *gorm.DB, cur *Cursor) *gorm.DB {
+	op := ">"
+	if strings.HasPrefix(cur.Sort, "-") {
+		op = "<"
+	}
+	if cur.CreatedAt == nil {
+		return q.Where(clause.Expr{SQL: "id " + op + " ?", Vars: []interface{}{cur.ID}})
+	}
+	return q.Where(clause.Expr{
+		SQL:  "(created_at " + op + " ? OR (created_at = ? AND id " + op + " ?))",
+		Vars: []interface{}{*cur.CreatedAt, *cur.CreatedAt, cur.ID},
+	})
+}
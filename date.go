@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+var errInvalidDate = errors.New("Invalid date, expected YYYY-MM-DD")
+
+// Date is a calendar date serialized as YYYY-MM-DD
+type Date struct {
+	time.Time
+}
+
+// Build a Date from a YYYY-MM-DD string
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, errInvalidDate
+	}
+	return Date{t}, nil
+}
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(dateLayout)
+}
+
+// Report whether the date lies after today
+func (d Date) IsFuture() bool {
+	return d.String() > time.Now().Format(dateLayout)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errInvalidDate
+	}
+	if s == "" {
+		*d = Date{}
+		return nil
+	}
+	parsed, err := ParseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Store dates as YYYY-MM-DD so they compare correctly on every dialect
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+func (d *Date) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case time.Time:
+		*d = Date{time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)}
+		return nil
+	case []byte:
+		return d.scanString(string(v))
+	case string:
+		return d.scanString(v)
+	}
+	return fmt.Errorf("cannot scan %T into Date", value)
+}
+
+func (d *Date) scanString(s string) error {
+	if s == "" {
+		*d = Date{}
+		return nil
+	}
+	if len(s) > len(dateLayout) {
+		s = s[:len(dateLayout)]
+	}
+	parsed, err := ParseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Fields GET /users/duplicates compares unless ?match= names others
+var defaultDuplicateMatch = []string{"birthday", "name"}
+
+// DuplicateGroup is a set of live users who share the matched fields
+type DuplicateGroup struct {
+	Key   string `json:"key"`
+	Users []User `json:"users"`
+}
+
+// Parse ?match=name,email,birthday into the fields users must share
+func parseDuplicateMatch(c echo.Context) ([]string, error) {
+	v := c.QueryParam("match")
+	if v == "" {
+		return defaultDuplicateMatch, nil
+	}
+	var fields []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "name" && name != "email" && name != "birthday" {
+			return nil, errors.New("Invalid match field: " + name + ", expected name, email or birthday")
+		}
+		if !slices.Contains(fields, name) {
+			fields = append(fields, name)
+		}
+	}
+	// A fixed order gives the same key whichever order the fields came in
+	slices.Sort(fields)
+	return fields, nil
+}
+
+// SQL normalizing a field for comparison: names ignore case and surrounding
+// spaces, and emails also ignore a +tag in the local part
+func duplicateField(q *gorm.DB, field string) string {
+	switch field {
+	case "name":
+		return "LOWER(TRIM(name))"
+	case "email":
+		switch q.Dialector.Name() {
+		case "postgres":
+			return `regexp_replace(email, '\+[^@]*@', '@')`
+		case "mysql":
+			return "CONCAT(SUBSTRING_INDEX(SUBSTRING_INDEX(email, '@', 1), '+', 1), '@', SUBSTRING_INDEX(email, '@', -1))"
+		case "sqlserver":
+			return "CASE WHEN CHARINDEX('+', email) BETWEEN 1 AND CHARINDEX('@', email) " +
+				"THEN LEFT(email, CHARINDEX('+', email) - 1) + SUBSTRING(email, CHARINDEX('@', email), LEN(email)) ELSE email END"
+		}
+		return "CASE WHEN instr(email, '+') BETWEEN 1 AND instr(email, '@') " +
+			"THEN substr(email, 1, instr(email, '+') - 1) || substr(email, instr(email, '@')) ELSE email END"
+	}
+	return field
+}
+
+// SQL joining the normalized fields into one key, separated by |
+func duplicateKey(q *gorm.DB, fields []string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = duplicateField(q, f)
+	}
+	sqlite := q.Dialector.Name() == "sqlite"
+	if len(parts) == 1 {
+		// Appending '' reads a lone field, such as a date, as text. SQL
+		// Server's CONCAT needs two arguments anyway.
+		if sqlite {
+			return parts[0] + " || ''"
+		}
+		return "CONCAT(" + parts[0] + ", '')"
+	}
+	if sqlite {
+		return strings.Join(parts, " || '|' || ")
+	}
+	return "CONCAT(" + strings.Join(parts, ", '|', ") + ")"
+}
+
+// List groups of live users who look like the same person: by default the
+// same name and birthday, or the fields named in ?match=. Users missing a
+// matched field are left out. Groups are ordered by key.
+func getUserDuplicates(c echo.Context) error {
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	fields, err := parseDuplicateMatch(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	q := dbCtx(c)
+	matched := func() *gorm.DB {
+		sub := q.Model(&User{})
+		for _, f := range fields {
+			sub = sub.Where(f + " IS NOT NULL")
+		}
+		return sub
+	}
+	key := duplicateKey(q, fields)
+	groups := func() *gorm.DB {
+		keyed := matched().Select(key + " AS dup_key")
+		return q.Table("(?) AS keyed", keyed).Select("dup_key").Group("dup_key").Having("COUNT(*) > 1")
+	}
+
+	var total int64
+	if err := q.Table("(?) AS dups", groups()).Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to find duplicates")
+	}
+	var keys []string
+	if err := groups().Order("dup_key").Offset(p.Offset).Limit(p.Limit).Pluck("dup_key", &keys).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to find duplicates")
+	}
+
+	data := make([]DuplicateGroup, len(keys))
+	if len(keys) > 0 {
+		var rows []struct {
+			DupKey string
+			ID     uint
+		}
+		err := matched().Select(key+" AS dup_key, id").Where(key+" IN ?", keys).Order("id").Scan(&rows).Error
+		if err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to find duplicates")
+		}
+		ids := make([]uint, len(rows))
+		for i, row := range rows {
+			ids[i] = row.ID
+		}
+		var users []User
+		if err := q.Preload("Roles").Where("id IN ?", ids).Find(&users).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to find duplicates")
+		}
+		byID := make(map[uint]User, len(users))
+		for _, u := range users {
+			byID[u.ID] = u
+		}
+		for i, k := range keys {
+			data[i].Key = k
+			for _, row := range rows {
+				if row.DupKey == k {
+					data[i].Users = append(data[i].Users, byID[row.ID])
+				}
+			}
+		}
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, data))
+}
+
+// Merge the user named by :other_id into the one named by :id: the other
+// user's posts, addresses, attachments, groups, reports and sign-in
+// identities move over, fields the user lacks are filled from the other, and
+// the other user is soft-deleted, all in one transaction
+func mergeUsers(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	otherID, err := resolveUserRef(c, UserRef(c.Param("other_id")))
+	if err != nil {
+		return err
+	}
+	user, err := userService.Merge(c.Request().Context(), id, otherID)
+	switch {
+	case errors.Is(err, ErrMergeSelf):
+		return newProblem(http.StatusUnprocessableEntity, "A user cannot be merged into themselves")
+	case errors.Is(err, ErrManagerCycle):
+		return newProblem(http.StatusConflict, "The user reports to the other user through someone else")
+	case err != nil:
+		return userError(err, "Failed to merge users")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
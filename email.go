@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+	jobEmail = "email.send"
+
+	emailWelcome       = "welcome"
+	emailVerification  = "verification"
+	emailPasswordReset = "password_reset"
+)
+
+// Delivers email, chosen by EMAIL_PROVIDER
+var emailSender EmailSender = LogSender{}
+
+// Email is one message to one recipient, with plain text and HTML bodies
+type Email struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// EmailSender delivers email through some provider
+type EmailSender interface {
+	Send(ctx context.Context, msg Email) error
+}
+
+// LogSender only logs emails, at debug level since they carry live links, for
+// development without a mail provider
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, msg Email) error {
+	contextLogger(ctx).Debug("Email", "to", msg.To, "subject", msg.Subject, "text", msg.Text)
+	return nil
+}
+
+// SMTPSender delivers email to an SMTP relay, upgrading to TLS with STARTTLS
+// when the server offers it. Servers only taking TLS connections (port 465)
+// are not supported.
+type SMTPSender struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(ctx context.Context, msg Email) error {
+	body, err := mimeMessage(s.From, msg)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		// PlainAuth refuses to send the password over a connection without TLS,
+		// except to localhost
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Render a message with text and HTML alternatives, for SMTP
+func mimeMessage(from string, msg Email) ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+	for _, h := range [][2]string{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + uuid.NewString() + "@" + messageIDDomain(from) + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	} {
+		buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := io.WriteString(qp, part.body); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The domain of the sender, for Message-IDs
+func messageIDDomain(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			return addr.Address[at+1:]
+		}
+	}
+	return "localhost"
+}
+
+// SendGridSender delivers email with the SendGrid v3 API
+type SendGridSender struct {
+	APIKey string
+	From   *mail.Address
+	Client *http.Client
+}
+
+func (s SendGridSender) Send(ctx context.Context, msg Email) error {
+	type address struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"personalizations": []map[string][]address{{"to": {{Email: msg.To}}}},
+		"from":             address{Email: s.From.Address, Name: s.From.Name},
+		"subject":          msg.Subject,
+		"content":          []content{{"text/plain", msg.Text}, {"text/html", msg.HTML}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	return doEmailRequest(s.Client, req, "SendGrid")
+}
+
+// SESSender delivers email with the Amazon SES v2 API, signing requests with
+// the AWS_* credentials
+type SESSender struct {
+	Credentials awsCredentials
+	From        string
+	Client      *http.Client
+}
+
+func (s SESSender) Send(ctx context.Context, msg Email) error {
+	type text struct {
+		Data    string
+		Charset string
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": s.From,
+		"Destination":      map[string][]string{"ToAddresses": {msg.To}},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": text{msg.Subject, "UTF-8"},
+				"Body": map[string]text{
+					"Text": {msg.Text, "UTF-8"},
+					"Html": {msg.HTML, "UTF-8"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := "https://email." + s.Credentials.Region + ".amazonaws.com/v2/email/outbound-emails"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.Credentials.sign(req, "ses", body, time.Now())
+	return doEmailRequest(s.Client, req, "SES")
+}
+
+// Send a request to an email API, failing on any status but 2xx
+func doEmailRequest(client *http.Client, req *http.Request, provider string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s answered %s: %s", provider, resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// Set up the sender for EMAIL_PROVIDER, sending email with jobs, and welcome
+// new users with an email
+func initEmail() {
+	client := &http.Client{Timeout: cfg.Email.Timeout}
+	switch cfg.Email.Provider {
+	case "log":
+		emailSender = LogSender{}
+	case "smtp":
+		emailSender = SMTPSender{
+			Addr:     net.JoinHostPort(cfg.Email.SMTPHost, cfg.Email.SMTPPort),
+			Host:     cfg.Email.SMTPHost,
+			Username: cfg.Email.SMTPUsername,
+			Password: cfg.Email.SMTPPassword,
+			From:     cfg.Email.From,
+		}
+	case "sendgrid":
+		from, err := mail.ParseAddress(cfg.Email.From)
+		if err != nil {
+			log.Fatalf("Invalid EMAIL_FROM: %v", err)
+		}
+		emailSender = SendGridSender{APIKey: cfg.Email.SendGridAPIKey, From: from, Client: client}
+	case "ses":
+		emailSender = SESSender{Credentials: configuredAWSCredentials(), From: cfg.Email.From, Client: client}
+	default:
+		log.Fatal("Unsupported EMAIL_PROVIDER. Set it to 'log', 'smtp', 'sendgrid' or 'ses'")
+	}
+
+	registerJobType(jobEmail, JobType{Run: runEmailJob, Timeout: cfg.Email.Timeout})
+
+	if cfg.Email.Welcome {
+		userEvents.Handle(func(ctx context.Context, events []UserEvent) error {
+			for _, e := range events {
+				if e.Event == EventUserCreated && e.Data.Email != nil {
+					if err := sendTemplatedEmail(ctx, emailWelcome, *e.Data.Email, emailData{User: *e.Data}); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// Send an email with a job, so requests do not wait on the mail provider and
+// failures are retried
+func sendEmail(ctx context.Context, msg Email) error {
+	return enqueueJob(ctx, jobEmail, msg)
+}
+
+// Hand a queued email to the mail provider
+func runEmailJob(ctx context.Context, job *Job) error {
+	var msg Email
+	if err := json.Unmarshal([]byte(job.Payload), &msg); err != nil {
+		return err
+	}
+	if err := emailSender.Send(ctx, msg); err != nil {
+		emailsSentTotal.WithLabelValues("failed").Inc()
+		return err
+	}
+	emailsSentTotal.WithLabelValues("sent").Inc()
+	return nil
+}
+
+// emailData is what the templates can use
+type emailData struct {
+	User User
+	// The link to follow, for verification and password reset emails
+	Link    string
+	Product string
+	// How long the link works, e.g. "3 days"
+	Expires string
+}
+
+// emailTemplate renders one kind of email
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func newEmailTemplate(name, subject, text, html string) emailTemplate {
+	return emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name).Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name).Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name).Parse(html)),
+	}
+}
+
+var emailTemplates = map[string]emailTemplate{
+	emailWelcome: newEmailTemplate(emailWelcome,
+		`Welcome to {{.Product}}`,
+		`Hi {{.User.Name}},
+
+Welcome to {{.Product}}! Your account is ready.
+`,
+		`<p>Hi {{.User.Name}},</p>
+<p>Welcome to {{.Product}}! Your account is ready.</p>
+`),
+	emailVerification: newEmailTemplate(emailVerification,
+		`Verify your email for {{.Product}}`,
+		`Hi {{.User.Name}},
+
+Please confirm this is your email address by opening this link:
+
+{{.Link}}
+
+The link expires in {{.Expires}}. If you did not sign up for {{.Product}}, you can ignore this email.
+`,
+		`<p>Hi {{.User.Name}},</p>
+<p>Please confirm this is your email address:</p>
+<p><a href="{{.Link}}">Verify email</a></p>
+<p>The link expires in {{.Expires}}. If you did not sign up for {{.Product}}, you can ignore this email.</p>
+`),
+	emailPasswordReset: newEmailTemplate(emailPasswordReset,
+		`Reset your {{.Product}} password`,
+		`Hi {{.User.Name}},
+
+Someone asked to reset your password. To choose a new one, open this link:
+
+{{.Link}}
+
+The link expires in {{.Expires}} and works once. If you did not ask for it, you can ignore this email.
+`,
+		`<p>Hi {{.User.Name}},</p>
+<p>Someone asked to reset your password.</p>
+<p><a href="{{.Link}}">Choose a new password</a></p>
+<p>The link expires in {{.Expires}} and works once. If you did not ask for it, you can ignore this email.</p>
+`),
+}
+
+// A link lifetime in words, in whole days or hours where it is one
+func lifetime(d time.Duration) string {
+	unit, n := "", 0
+	switch {
+	case d%(24*time.Hour) == 0:
+		unit, n = "day", int(d/(24*time.Hour))
+	case d%time.Hour == 0:
+		unit, n = "hour", int(d/time.Hour)
+	case d%time.Minute == 0:
+		unit, n = "minute", int(d/time.Minute)
+	default:
+		return d.String()
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return strconv.Itoa(n) + " " + unit
+}
+
+// Render the named template for the recipient and queue it for sending
+func sendTemplatedEmail(ctx context.Context, name, to string, data emailData) error {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return errors.New("unknown email template: " + name)
+	}
+	data.Product = cfg.Email.ProductName
+	var subject, text, html strings.Builder
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return err
+	}
+	return sendEmail(ctx, Email{To: to, Subject: subject.String(), Text: text.String(), HTML: html.String()})
+}
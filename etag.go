@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Strong ETag for a user, derived from its version
+func userETag(user *User) string {
+	return `"` + strconv.FormatUint(uint64(user.Version), 10) + `"`
+}
+
+// Set the user's ETag on the response
+func setUserETag(c echo.Context, user *User) {
+	c.Response().Header().Set("ETag", userETag(user))
+}
+
+// Parse the version the client expects from the required If-Match header.
+// "*" matches any version and is returned as zero.
+func ifMatchVersion(c echo.Context) (uint, error) {
+	header := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if header == "" {
+		return 0, newProblem(http.StatusPreconditionRequired, "If-Match header is required")
+	}
+	if header == "*" {
+		return 0, nil
+	}
+	// Weak validators never match under the strong comparison If-Match requires
+	version, err := strconv.ParseUint(strings.Trim(header, `"`), 10, 0)
+	if err != nil || version == 0 || !strings.HasPrefix(header, `"`) {
+		return 0, newProblem(http.StatusPreconditionFailed, "If-Match does not match the current version")
+	}
+	return uint(version), nil
+}
+
+// Report whether If-None-Match lists the given ETag, using weak comparison
+func notModified(c echo.Context, etag string) bool {
+	header := c.Request().Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Write v in the negotiated format with a weak ETag over the body,
+// or 304 if the client already has it
+func respondWithETag(c echo.Context, status int, v interface{}) error {
+	contentType, body, err := encodeResponse(c, v)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	varyOnAccept(c)
+	c.Response().Header().Set("ETag", etag)
+	if notModified(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(status, contentType, body)
+}
+
+// Context key set on routes whose user reads send Last-Modified
+const lastModifiedKey = "lastModified"
+
+// Middleware sending a route group's caching headers: cacheControl, unless
+// none, as the Cache-Control of successful responses whose handler set none,
+// and Last-Modified on the user reads that support it if lastModified is set
+func cacheHeaders(cacheControl string, lastModified bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if lastModified {
+				c.Set(lastModifiedKey, true)
+			}
+			if cacheControl != "none" {
+				res := c.Response()
+				res.Before(func() {
+					if res.Status < http.StatusBadRequest && res.Header().Get("Cache-Control") == "" {
+						res.Header().Set("Cache-Control", cacheControl)
+					}
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Send Last-Modified if the route's group enables it; a zero time sends none
+func setLastModified(c echo.Context, t time.Time) {
+	if enabled, _ := c.Get(lastModifiedKey).(bool); enabled && !t.IsZero() {
+		c.Response().Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Report whether a resource last modified at t is unchanged since
+// If-Modified-Since. It is ignored where Last-Modified is not sent, and in
+// favour of If-None-Match when both are present.
+func notModifiedSince(c echo.Context, t time.Time) bool {
+	header := c.Request().Header
+	if enabled, _ := c.Get(lastModifiedKey).(bool); !enabled || t.IsZero() || header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(header.Get("If-Modified-Since"))
+	return err == nil && !t.Truncate(time.Second).After(since)
+}
+
+// The newest update among the users, zero if none has its updatedAt loaded
+func latestUpdate(users []User) time.Time {
+	var latest time.Time
+	for _, u := range users {
+		if u.UpdatedAt.After(latest) {
+			latest = u.UpdatedAt
+		}
+	}
+	return latest
+}
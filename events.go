@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// Events buffered per subscriber before it is considered too slow and dropped
+	eventBufferSize = 64
+
+	// Statement setting holding the changes recorded by User hooks
+	userChangesSetting = "events:user_changes"
+)
+
+// UserEvent announces a committed change to a user
+type UserEvent struct {
+	ID         uint64    `json:"-"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       *User     `json:"data"`
+}
+
+// EventHandler reacts to the events of one commit, in order
+type EventHandler func(ctx context.Context, events []UserEvent) error
+
+// Parse a list of event types into a set, rejecting unknown ones
+func parseEventTypes(types []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(types))
+	for _, event := range types {
+		event = strings.TrimSpace(event)
+		if event != EventUserCreated && event != EventUserUpdated && event != EventUserDeleted {
+			return nil, errors.New("Unknown event type: " + event)
+		}
+		set[event] = true
+	}
+	return set, nil
+}
+
+// EventBus fans user events out to in-process handlers and subscribers.
+// Handlers run synchronously after each commit; subscribers get a buffered
+// channel and are dropped if they fall behind.
+type EventBus struct {
+	mu       sync.Mutex
+	nextID   uint64
+	handlers []EventHandler
+	subs     map[chan UserEvent]struct{}
+	closed   bool
+}
+
+var userEvents = NewEventBus()
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan UserEvent]struct{})}
+}
+
+// Run the handler for every commit that changes users
+func (b *EventBus) Handle(h EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Subscribe to events published from now on. The channel is closed by the
+// returned cancel function, or by the bus if the subscriber falls behind.
+func (b *EventBus) Subscribe() (<-chan UserEvent, func()) {
+	ch := make(chan UserEvent, eventBufferSize)
+	b.mu.Lock()
+	if b.closed {
+		close(ch)
+	} else {
+		b.subs[ch] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish the events of one commit. Subscribers are never blocked on: one
+// whose buffer is full is dropped rather than silently missing events.
+// Handler errors are logged and returned, so the outbox can publish the events
+// again. Handlers keep the context's values but not its cancellation, so a
+// client disconnecting after the commit cannot drop webhook deliveries.
+func (b *EventBus) Publish(ctx context.Context, events []UserEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ctx = context.WithoutCancel(ctx)
+	b.Deliver(events)
+	b.mu.Lock()
+	handlers := b.handlers
+	b.mu.Unlock()
+
+	var errs []error
+	for _, h := range handlers {
+		if err := h(ctx, events); err != nil {
+			contextLogger(ctx).Error("user event handler failed", "event", events[0].Event, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Hand events to the subscribers only, numbering them for this process, as
+// for events published on another replica whose handlers ran there
+func (b *EventBus) Deliver(events []UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range events {
+		b.nextID++
+		events[i].ID = b.nextID
+		for ch := range b.subs {
+			select {
+			case ch <- events[i]:
+			default:
+				delete(b.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Close every subscription so long-lived streams end; later subscriptions
+// start closed. Called when the server begins shutting down.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// userChange is a write to a user seen by a hook, not yet known to be committed
+type userChange struct {
+	event string
+	user  *User
+}
+
+// Snapshot the changes as events, merging several changes to one user into
+// one event: a create followed by updates stays a create, and a delete wins.
+func newUserEvents(changes []userChange) []UserEvent {
+	now := time.Now()
+	var events []UserEvent
+	index := map[uint]int{}
+	for _, change := range changes {
+		snapshot := *change.user
+		if i, ok := index[snapshot.ID]; ok {
+			if change.event == EventUserDeleted {
+				events[i].Event = EventUserDeleted
+			}
+			events[i].Data = &snapshot
+			continue
+		}
+		index[snapshot.ID] = len(events)
+		events = append(events, UserEvent{Event: change.event, OccurredAt: now, Data: &snapshot})
+	}
+	return events
+}
+
+func (u *User) AfterCreate(tx *gorm.DB) error {
+	// An insert whose conflict clause skipped the row created nobody. Hooks get
+	// a new session, so the count is on the statement's own DB.
+	if tx.Statement.RowsAffected == 0 {
+		return nil
+	}
+	recordUserChange(tx, EventUserCreated, u)
+	return nil
+}
+
+func (u *User) AfterUpdate(tx *gorm.DB) error {
+	recordUserChange(tx, EventUserUpdated, u)
+	return nil
+}
+
+func (u *User) AfterDelete(tx *gorm.DB) error {
+	if tx.Statement.Unscoped {
+		// Purging a soft-deleted user was announced when it was deleted
+		if u.DeletedAt.Valid {
+			return nil
+		}
+	} else if !u.DeletedAt.Valid {
+		// GORM only stamps the first row of a batch soft delete
+		u.DeletedAt = gorm.DeletedAt{Time: tx.NowFunc(), Valid: true}
+	}
+	recordUserChange(tx, EventUserDeleted, u)
+	return nil
+}
+
+// Remember a change on the statement until it is known to have committed.
+// Hooks for a bulk statement run once per row, all on the same statement.
+func recordUserChange(tx *gorm.DB, event string, u *User) {
+	var changes []userChange
+	if v, ok := tx.Statement.Settings.Load(userChangesSetting); ok {
+		changes = v.([]userChange)
+	}
+	tx.Statement.Settings.Store(userChangesSetting, append(changes, userChange{event, u}))
+}
+
+// Changes made inside open userTransactions, keyed by the transaction's connection
+var pendingChanges sync.Map
+
+// Run fn in a transaction, adding the user changes it makes to the outbox
+// before it commits and publishing them once it has. GORM has no after-commit
+// hook, so writes to users inside a plain db.Transaction are left in the
+// outbox for the relay to publish.
+func userTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	var changes *[]userChange
+	var batch *outboxBatch
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// A nested transaction shares the connection; the outermost one publishes
+		conn := tx.Statement.ConnPool
+		if _, nested := pendingChanges.Load(conn); !nested {
+			changes = new([]userChange)
+			pendingChanges.Store(conn, changes)
+			defer pendingChanges.Delete(conn)
+		}
+		if err := fn(tx); err != nil || changes == nil {
+			return err
+		}
+		var err error
+		batch, err = writeOutbox(tx, newUserEvents(*changes))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	publishOutbox(db.Statement.Context, batch)
+	return nil
+}
+
+// GORM callback run after each write commits, or after each statement inside
+// a transaction: publish the changes its User hooks recorded and added to the
+// outbox, or hold them for the enclosing userTransaction. A statement inside
+// a plain transaction cannot know it committed, so the relay publishes it.
+func publishUserChanges(tx *gorm.DB) {
+	v, ok := tx.Statement.Settings.LoadAndDelete(userChangesSetting)
+	if !ok || tx.Error != nil || tx.RowsAffected == 0 {
+		return
+	}
+	if pending, ok := pendingChanges.Load(tx.Statement.ConnPool); ok {
+		held := pending.(*[]userChange)
+		*held = append(*held, v.([]userChange)...)
+		return
+	}
+	batch, ok := tx.Statement.Settings.LoadAndDelete(outboxSetting)
+	if _, committed := tx.InstanceGet("gorm:started_transaction"); !ok || !committed {
+		return
+	}
+	publishOutbox(tx.Statement.Context, batch.(*outboxBatch))
+}
+
+// Publish user events from GORM writes once they commit
+func registerEventCallbacks(db *gorm.DB) error {
+	const name = "events:publish_user_changes"
+	const after = "gorm:commit_or_rollback_transaction"
+	if err := db.Callback().Create().After(after).Register(name, publishUserChanges); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After(after).Register(name, publishUserChanges); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After(after).Register(name, publishUserChanges)
+}
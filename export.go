@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// Rows loaded per query while exporting
+	exportBatchSize = 1000
+
+	ndjsonContentType = "application/x-ndjson"
+
+	jobExport = "export.users"
+
+	exportPending = "pending"
+	exportRunning = "running"
+	exportDone    = "done"
+	exportFailed  = "failed"
+)
+
+var userCSVHeader = []string{"id", "uuid", "name", "email", "is_verified", "birthday", "roles", "version", "created_at", "updated_at", "deleted_at"}
+
+// Flatten a user into a CSV record matching userCSVHeader
+func userCSVRecord(u User) []string {
+	roles := make([]string, len(u.Roles))
+	for i, role := range u.Roles {
+		roles[i] = role.Name
+	}
+	deletedAt := ""
+	if u.DeletedAt.Valid {
+		deletedAt = u.DeletedAt.Time.Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatUint(uint64(u.ID), 10),
+		u.UUID,
+		u.Name,
+		derefEmail(u.Email),
+		strconv.FormatBool(u.IsVerified),
+		u.Birthday.String(),
+		strings.Join(roles, ";"),
+		strconv.FormatUint(uint64(u.Version), 10),
+		u.CreatedAt.Format(time.RFC3339),
+		u.UpdatedAt.Format(time.RFC3339),
+		deletedAt,
+	}
+}
+
+// Stream every user matching the list filters as CSV, one batch at a time
+func exportUsers(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" {
+		return newProblem(http.StatusBadRequest, "Unsupported export format, expected csv")
+	}
+	conds, err := userQuery.ParseFilters(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	// Without a Content-Length the body goes out with chunked transfer encoding
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="users.csv"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write(userCSVHeader)
+	ctx := c.Request().Context()
+	err = userService.Export(ctx, UserQuery{
+		Conditions:     conds,
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+	}, func(users []User) error {
+		for _, u := range users {
+			w.Write(userCSVRecord(u))
+		}
+		w.Flush()
+		res.Flush()
+		return w.Error()
+	})
+	if err != nil {
+		// The status line is already sent, so the best we can do is cut the stream short
+		contextLogger(ctx).Error("user export failed", "error", err)
+	}
+	return nil
+}
+
+// Report whether the client asked for newline-delimited JSON
+func acceptsNDJSON(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), ndjsonContentType)
+}
+
+// Stream the users matching q as one JSON object per line, in ID order
+func streamUsersNDJSON(c echo.Context, q UserQuery) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, ndjsonContentType)
+	res.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(res)
+	ctx := c.Request().Context()
+	err := userService.Export(ctx, q, func(users []User) error {
+		if q.Fields != nil {
+			objects, err := q.Fields.Project(users)
+			if err != nil {
+				return err
+			}
+			for _, obj := range objects {
+				if err := enc.Encode(obj); err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, u := range users {
+				if err := enc.Encode(u); err != nil {
+					return err
+				}
+			}
+		}
+		res.Flush()
+		return nil
+	})
+	if err != nil {
+		contextLogger(ctx).Error("user stream failed", "error", err)
+	}
+	return nil
+}
+
+// Export is a file of users, or with UserID one user's archive, generated in
+// the background by a job for exports too large to stream within a request.
+// The file is deleted once it expires.
+type Export struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	TenantID       uint       `json:"-" gorm:"not null;default:1;index"`
+	UserID         *uint      `json:"user_id,omitempty" gorm:"index"`
+	Format         string     `json:"format" gorm:"size:10;not null"`
+	Query          string     `json:"-" gorm:"type:text;not null"`
+	IncludeDeleted bool       `json:"include_deleted" gorm:"not null"`
+	Status         string     `json:"status" gorm:"size:20;not null"`
+	Rows           int64      `json:"rows"`
+	Size           int64      `json:"size"`
+	Error          string     `json:"error,omitempty" gorm:"size:500"`
+	FilePath       string     `json:"-" gorm:"size:1024"`
+	JobID          uint       `json:"job_id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at"`
+	ExpiresAt      *time.Time `json:"expires_at" gorm:"index"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (e Export) MarshalJSON() ([]byte, error) {
+	type plainExport Export
+	if userIDType != idTypeUUID || e.UserID == nil {
+		return json.Marshal(plainExport(e))
+	}
+	user, err := userUUID(*e.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainExport
+		UserID *string `json:"user_id,omitempty"`
+	}{plainExport(e), user})
+}
+
+// The payload of an export job
+type exportJob struct {
+	ExportID uint `json:"export_id"`
+}
+
+// File extension and content type of each export format
+var exportFormats = map[string]struct{ ext, contentType string }{
+	"csv":    {"csv", "text/csv; charset=utf-8"},
+	"ndjson": {"ndjson", ndjsonContentType},
+}
+
+// Generate exports with jobs
+func initExports() {
+	registerJobType(jobExport, JobType{Run: runExport, Timeout: cfg.Export.Timeout})
+}
+
+// Start generating an export of every user matching the list filters, to be
+// polled at GET /exports/:id
+func createExport(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	if _, ok := exportFormats[format]; !ok {
+		return newProblem(http.StatusBadRequest, "Unsupported export format, expected csv or ndjson")
+	}
+	if _, err := userQuery.ParseFilters(c); err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	export := Export{
+		Format:         format,
+		Query:          c.QueryParams().Encode(),
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+		Status:         exportPending,
+	}
+	err := WithTx(c, func(tx *gorm.DB) error {
+		if err := tx.Create(&export).Error; err != nil {
+			return err
+		}
+		job, err := newJob(jobExport, exportJob{ExportID: export.ID})
+		if err != nil {
+			return err
+		}
+		jobs := []Job{job}
+		if err := enqueueJobs(tx, jobs); err != nil {
+			return err
+		}
+		export.JobID = jobs[0].ID
+		return tx.Model(&export).Update("job_id", export.JobID).Error
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to start export")
+	}
+	c.Response().Header().Set(echo.HeaderLocation, exportPath(c, export.ID))
+	return respond(c, http.StatusAccepted, newExportResource(c, &export))
+}
+
+// Path of an export under the request's API prefix
+func exportPath(c echo.Context, id uint) string {
+	return fmt.Sprintf("%s/exports/%d", apiBase(c), id)
+}
+
+// Wrap an export with links to itself and, once generated, its file
+func newExportResource(c echo.Context, export *Export) Resource {
+	self := exportPath(c, export.ID)
+	links := Links{"self": self}
+	if export.Status == exportDone {
+		links["download"] = self + "/download"
+	}
+	return Resource{Data: export, Links: links}
+}
+
+// Load the export named by the id path parameter
+func findExport(c echo.Context) (*Export, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid export ID")
+	}
+	var export Export
+	if err := dbCtx(c).First(&export, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Export not found")
+	}
+	// A user's archive is as private as the data in it
+	if export.UserID != nil && !actsForUser(c, *export.UserID) {
+		return nil, newProblem(http.StatusNotFound, "Export not found")
+	}
+	return &export, nil
+}
+
+// Fetch an export's status, with a download link once it is generated
+func getExport(c echo.Context) error {
+	export, err := findExport(c)
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, newExportResource(c, export))
+}
+
+// Download a generated export
+func downloadExport(c echo.Context) error {
+	export, err := findExport(c)
+	if err != nil {
+		return err
+	}
+	switch {
+	case export.Status == exportFailed:
+		return newProblem(http.StatusConflict, "Export failed")
+	case export.Status != exportDone:
+		return newProblem(http.StatusConflict, "Export is not ready yet")
+	case export.ExpiresAt != nil && export.ExpiresAt.Before(time.Now()):
+		return newProblem(http.StatusGone, "Export has expired")
+	}
+	name, contentType := exportFile(export)
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	return c.Attachment(export.FilePath, name)
+}
+
+// Download name and content type of an export's file
+func exportFile(export *Export) (string, string) {
+	if export.UserID != nil {
+		format := archiveFormats[export.Format]
+		return fmt.Sprintf("user-%d.%s", *export.UserID, format.ext), format.contentType
+	}
+	format := exportFormats[export.Format]
+	return "users." + format.ext, format.contentType
+}
+
+// Write an export's file, retried by its job. The last failed attempt fails
+// the export.
+func runExport(ctx context.Context, job *Job) error {
+	var payload exportJob
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+	var export Export
+	if err := db.WithContext(ctx).Take(&export, payload.ExportID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if export.Status == exportDone {
+		return nil
+	}
+	if err := db.WithContext(ctx).Model(&export).Update("status", exportRunning).Error; err != nil {
+		return err
+	}
+
+	err := writeExport(ctx, &export)
+	if err != nil {
+		if job.RetryAt.IsZero() {
+			db.WithContext(ctx).Model(&export).Updates(map[string]interface{}{
+				"status": exportFailed,
+				"error":  truncate(err.Error(), maxJobErrorLength),
+			})
+		}
+		return err
+	}
+	now := time.Now()
+	expires := now.Add(cfg.Export.TTL)
+	return db.WithContext(ctx).Model(&export).Updates(map[string]interface{}{
+		"status":       exportDone,
+		"rows":         export.Rows,
+		"size":         export.Size,
+		"file_path":    export.FilePath,
+		"error":        "",
+		"completed_at": now,
+		"expires_at":   expires,
+	}).Error
+}
+
+// Write the users matching an export's filters to a new file in EXPORT_DIR,
+// which only appears under its final name once complete
+func writeExport(ctx context.Context, export *Export) error {
+	if export.UserID != nil {
+		return writeUserArchive(ctx, export)
+	}
+	values, err := url.ParseQuery(export.Query)
+	if err != nil {
+		return err
+	}
+	conds, err := userQuery.ParseFilterValues(values)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Export.Dir, 0o750); err != nil {
+		return err
+	}
+	path := filepath.Join(cfg.Export.Dir, fmt.Sprintf("users-%d-%s.%s", export.ID, uuid.NewString(), exportFormats[export.Format].ext))
+	tmp, err := os.CreateTemp(cfg.Export.Dir, ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := bufio.NewWriter(tmp)
+	var rows int64
+	var write func(users []User) error
+	switch export.Format {
+	case "ndjson":
+		enc := json.NewEncoder(buf)
+		write = func(users []User) error {
+			for _, u := range users {
+				if err := enc.Encode(u); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	default:
+		w := csv.NewWriter(buf)
+		w.Write(userCSVHeader)
+		write = func(users []User) error {
+			for _, u := range users {
+				w.Write(userCSVRecord(u))
+			}
+			w.Flush()
+			return w.Error()
+		}
+	}
+	err = userService.Export(ctx, UserQuery{Conditions: conds, IncludeDeleted: export.IncludeDeleted}, func(users []User) error {
+		rows += int64(len(users))
+		return write(users)
+	})
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	export.Rows, export.Size, export.FilePath = rows, info.Size(), path
+	return nil
+}
+
+// Delete exports past their expiry, with their files
+func deleteExpiredExports(ctx context.Context) error {
+	var expired []Export
+	err := db.WithContext(ctx).Where("expires_at < ?", time.Now()).Find(&expired).Error
+	if err != nil {
+		return err
+	}
+	for _, export := range expired {
+		if export.FilePath != "" {
+			if err := os.Remove(export.FilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := db.WithContext(ctx).Delete(&export).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
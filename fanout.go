@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// Tells this replica's broadcasts apart from the others' on the channel
+var fanoutOrigin = uuid.NewString()
+
+// fanoutMessage carries the events of one commit between replicas
+type fanoutMessage struct {
+	Origin string        `json:"origin"`
+	Events []fanoutEvent `json:"events"`
+}
+
+// The user's tenant is not part of its JSON, so it travels alongside
+type fanoutEvent struct {
+	TenantID uint `json:"tenant_id"`
+	outboxPayload
+}
+
+// Share user events with the other replicas when EVENTS_FANOUT is set, so
+// SSE and WebSocket clients see changes made through any of them
+func initFanout() {
+	switch cfg.Fanout.Type {
+	case "", "none":
+		return
+	case "redis":
+		userEvents.Handle(broadcastUserEvents)
+	default:
+		log.Fatal("Unsupported EVENTS_FANOUT. Set it to 'redis'")
+	}
+}
+
+// Publish the events of one commit to the other replicas. Streams are best
+// effort, so a failure is only logged rather than having the outbox publish
+// the events to every handler again.
+func broadcastUserEvents(ctx context.Context, events []UserEvent) error {
+	msg := fanoutMessage{Origin: fanoutOrigin, Events: make([]fanoutEvent, len(events))}
+	for i, e := range events {
+		msg.Events[i] = fanoutEvent{TenantID: e.Data.TenantID, outboxPayload: newOutboxPayload(e)}
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := getRedis().Publish(ctx, cfg.Fanout.Channel, payload).Err(); err != nil {
+		contextLogger(ctx).Warn("failed to broadcast user events", "error", err)
+	}
+	return nil
+}
+
+// Pass events broadcast by the other replicas to this one's streams. Their
+// handlers already ran where the change was made.
+func startEventFanout() func() {
+	if cfg.Fanout.Type != "redis" {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// Resubscribes by itself after losing the connection
+	pubsub := getRedis().Subscribe(ctx, cfg.Fanout.Channel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range pubsub.Channel() {
+			var msg fanoutMessage
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				contextLogger(ctx).Warn("invalid user event broadcast", "error", err)
+				continue
+			}
+			if msg.Origin == fanoutOrigin {
+				continue
+			}
+			events := make([]UserEvent, 0, len(msg.Events))
+			for _, e := range msg.Events {
+				if e.Data != nil {
+					events = append(events, e.userEvent(e.TenantID))
+				}
+			}
+			userEvents.Deliver(events)
+		}
+	}()
+	return func() {
+		cancel()
+		pubsub.Close()
+		<-done
+	}
+}
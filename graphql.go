@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+)
+
+type echoContextKey struct{}
+
+// graphQLError carries a problem's status and field errors as GraphQL error extensions
+type graphQLError struct {
+	*Problem
+}
+
+func (e graphQLError) Error() string {
+	return e.Detail
+}
+
+func (e graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"status": e.Status}
+	if len(e.Errors) > 0 {
+		ext["errors"] = e.Errors
+	}
+	return ext
+}
+
+// Convert a handler-style error into a GraphQL error
+func toGraphQLError(err error) error {
+	var p *Problem
+	if errors.As(err, &p) {
+		return graphQLError{p}
+	}
+	return err
+}
+
+// Report whether the caller holds the API key scope or one of the roles
+func callerAllowed(c echo.Context, scope string, roles ...string) bool {
+	if key, ok := c.Get("apiKey").(*APIKey); ok {
+		return key.Scopes.Allow(scope)
+	}
+	if user, ok := c.Get("currentUser").(*User); ok {
+		return user.HasRole(roles...)
+	}
+	return false
+}
+
+var graphQLRole = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Role",
+	Fields: graphql.Fields{
+		"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+// Resolve a field of the User in p.Source
+func userField(fn func(u *User) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		switch u := p.Source.(type) {
+		case *User:
+			return fn(u), nil
+		case User:
+			return fn(&u), nil
+		}
+		return nil, nil
+	}
+}
+
+var graphQLUser = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.ID),
+			Resolve: userField(func(u *User) interface{} {
+				if userIDType == idTypeUUID {
+					return u.UUID
+				}
+				return strconv.FormatUint(uint64(u.ID), 10)
+			}),
+		},
+		"uuid": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *User) interface{} { return u.UUID })},
+		"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *User) interface{} { return u.Name })},
+		"email": &graphql.Field{Type: graphql.String, Resolve: userField(func(u *User) interface{} {
+			if u.Email == nil {
+				return nil
+			}
+			return *u.Email
+		})},
+		"isVerified": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: userField(func(u *User) interface{} { return u.IsVerified })},
+		"status":     &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *User) interface{} { return u.Status })},
+		"birthday": &graphql.Field{Type: graphql.String, Resolve: userField(func(u *User) interface{} {
+			if u.Birthday.IsZero() {
+				return nil
+			}
+			return u.Birthday.String()
+		})},
+		"age": &graphql.Field{Type: graphql.Int, Resolve: userField(func(u *User) interface{} {
+			if age := u.Birthday.Age(time.Now()); age != nil {
+				return *age
+			}
+			return nil
+		})},
+		"roles":     &graphql.Field{Type: graphql.NewList(graphQLRole), Resolve: userField(func(u *User) interface{} { return u.Roles })},
+		"version":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: userField(func(u *User) interface{} { return int(u.Version) })},
+		"createdAt": &graphql.Field{Type: graphql.DateTime, Resolve: userField(func(u *User) interface{} { return u.CreatedAt })},
+		"updatedAt": &graphql.Field{Type: graphql.DateTime, Resolve: userField(func(u *User) interface{} { return u.UpdatedAt })},
+	},
+})
+
+var graphQLPageMeta = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PageMeta",
+	Fields: graphql.Fields{
+		"page":       &graphql.Field{Type: graphql.Int},
+		"limit":      &graphql.Field{Type: graphql.Int},
+		"total":      &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return int(p.Source.(PageMeta).Total), nil }},
+		"totalPages": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(PageMeta).TotalPages, nil }},
+		"nextPage":   &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(PageMeta).NextPage, nil }},
+		"prevPage":   &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(PageMeta).PrevPage, nil }},
+	},
+})
+
+var graphQLUserPage = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserPage",
+	Fields: graphql.Fields{
+		"data": &graphql.Field{Type: graphql.NewList(graphQLUser)},
+		"meta": &graphql.Field{Type: graphQLPageMeta},
+	},
+})
+
+var graphQLCreateUserInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "CreateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"name":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"email":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"birthday": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"password": &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var graphQLUpdateUserInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "UpdateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"name":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"email":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"birthday": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"password": &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var pageArgs = graphql.FieldConfigArgument{
+	"page":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+	"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize},
+}
+
+// Turn page/limit arguments into a Pagination, applying the REST limits
+func graphQLPagination(args map[string]interface{}) (Pagination, error) {
+	page, _ := args["page"].(int)
+	limit, _ := args["limit"].(int)
+	if page < 1 || limit < 1 {
+		return Pagination{}, graphQLError{newProblem(http.StatusBadRequest, "page and limit must be positive")}
+	}
+	limit = min(limit, maxPageSize)
+	return Pagination{Page: page, Limit: limit, Offset: (page - 1) * limit}, nil
+}
+
+// Fields of a create or update input as strings
+func inputString(input map[string]interface{}, key string) string {
+	s, _ := input[key].(string)
+	return s
+}
+
+// Parse a birthday input, reporting malformed dates as a field error
+func inputBirthday(input map[string]interface{}) (Date, error) {
+	s := inputString(input, "birthday")
+	if s == "" {
+		return Date{}, nil
+	}
+	d, err := ParseDate(s)
+	if err != nil {
+		return Date{}, toGraphQLError(bindError(err))
+	}
+	return d, nil
+}
+
+// Resolve the user referenced by an id argument
+func graphQLUserID(ctx context.Context, args map[string]interface{}) (uint, error) {
+	ref, _ := args["id"].(string)
+	id, err := userService.Resolve(ctx, UserRef(ref))
+	if errors.Is(err, errInvalidUserRef) {
+		return 0, graphQLError{newProblem(http.StatusBadRequest, err.Error())}
+	}
+	if err != nil {
+		return 0, toGraphQLError(userError(err, "Failed to fetch user"))
+	}
+	return id, nil
+}
+
+// Fail unless the caller may perform a write that needs the scope or roles
+func requireGraphQLAccess(ctx context.Context, scope string, roles ...string) error {
+	c, _ := ctx.Value(echoContextKey{}).(echo.Context)
+	if c == nil || !callerAllowed(c, scope, roles...) {
+		return graphQLError{newProblem(http.StatusForbidden, "Forbidden")}
+	}
+	return nil
+}
+
+var graphQLQuery = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"users": &graphql.Field{
+			Type: graphQLUserPage,
+			Args: graphql.FieldConfigArgument{
+				"page":           pageArgs["page"],
+				"limit":          pageArgs["limit"],
+				"name":           &graphql.ArgumentConfig{Type: graphql.String},
+				"email":          &graphql.ArgumentConfig{Type: graphql.String},
+				"status":         &graphql.ArgumentConfig{Type: graphql.String},
+				"sort":           &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: userQuery.DefaultSort},
+				"includeDeleted": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				page, err := graphQLPagination(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				var conds []Condition
+				if name, ok := p.Args["name"].(string); ok {
+					conds = append(conds, Condition{Column: "name", Op: "=", Value: name})
+				}
+				if email, ok := p.Args["email"].(string); ok {
+					conds = append(conds, Condition{Column: "email", Op: "=", Value: normalizeEmail(email)})
+				}
+				if status, ok := p.Args["status"].(string); ok {
+					if _, err := parseStatusParam(status); err != nil {
+						return nil, graphQLError{newProblem(http.StatusBadRequest, err.Error())}
+					}
+					conds = append(conds, Condition{Column: "status", Op: "=", Value: status})
+				}
+				sort, err := userQuery.SortFields(p.Args["sort"].(string))
+				if err != nil {
+					return nil, graphQLError{newProblem(http.StatusBadRequest, err.Error())}
+				}
+
+				users, total, err := userService.List(p.Context, UserQuery{
+					Conditions:     conds,
+					Sort:           sort,
+					Offset:         page.Offset,
+					Limit:          page.Limit,
+					IncludeDeleted: p.Args["includeDeleted"].(bool),
+				})
+				if err != nil {
+					return nil, err
+				}
+				return PagedResponse{Data: users, Meta: newPageMeta(page, total)}, nil
+			},
+		},
+		"searchUsers": &graphql.Field{
+			Type: graphQLUserPage,
+			Args: graphql.FieldConfigArgument{
+				"q":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"page":  pageArgs["page"],
+				"limit": pageArgs["limit"],
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				page, err := graphQLPagination(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				users, total, err := userService.Search(p.Context, p.Args["q"].(string), page.Offset, page.Limit)
+				if err != nil {
+					return nil, err
+				}
+				return PagedResponse{Data: users, Meta: newPageMeta(page, total)}, nil
+			},
+		},
+		"user": &graphql.Field{
+			Type: graphQLUser,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				id, err := graphQLUserID(p.Context, p.Args)
+				if err != nil {
+					return nil, err
+				}
+				user, err := userService.Get(p.Context, id)
+				if err != nil {
+					return nil, toGraphQLError(userError(err, "Failed to fetch user"))
+				}
+				return user, nil
+			},
+		},
+	},
+})
+
+var graphQLMutation = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"createUser": &graphql.Field{
+			Type: graphQLUser,
+			Args: graphql.FieldConfigArgument{
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphQLCreateUserInput)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := requireGraphQLAccess(p.Context, ScopeWrite, RoleAdmin, RoleEditor); err != nil {
+					return nil, err
+				}
+				input := p.Args["input"].(map[string]interface{})
+				birthday, err := inputBirthday(input)
+				if err != nil {
+					return nil, err
+				}
+				user, err := userService.Create(p.Context, createUserRequest{
+					Name:     inputString(input, "name"),
+					Email:    inputString(input, "email"),
+					Birthday: birthday,
+					Password: inputString(input, "password"),
+				})
+				if err != nil {
+					return nil, toGraphQLError(userError(err, "Failed to create user"))
+				}
+				return user, nil
+			},
+		},
+		"updateUser": &graphql.Field{
+			Type: graphQLUser,
+			Args: graphql.FieldConfigArgument{
+				"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"version": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int), Description: "Version the change is based on"},
+				"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphQLUpdateUserInput)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := requireGraphQLAccess(p.Context, ScopeWrite, RoleAdmin, RoleEditor); err != nil {
+					return nil, err
+				}
+				id, err := graphQLUserID(p.Context, p.Args)
+				if err != nil {
+					return nil, err
+				}
+				input := p.Args["input"].(map[string]interface{})
+				birthday, err := inputBirthday(input)
+				if err != nil {
+					return nil, err
+				}
+				user, err := userService.Update(p.Context, id, uint(p.Args["version"].(int)), updateUserRequest{
+					Name:     inputString(input, "name"),
+					Email:    inputString(input, "email"),
+					Birthday: birthday,
+					Password: inputString(input, "password"),
+				})
+				if err != nil {
+					return nil, toGraphQLError(userError(err, "Failed to update user"))
+				}
+				return user, nil
+			},
+		},
+		"deleteUser": &graphql.Field{
+			Type: graphql.Boolean,
+			Args: graphql.FieldConfigArgument{
+				"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"version": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int), Description: "Version the deletion is based on"},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if err := requireGraphQLAccess(p.Context, ScopeAdmin, RoleAdmin); err != nil {
+					return nil, err
+				}
+				id, err := graphQLUserID(p.Context, p.Args)
+				if err != nil {
+					return nil, err
+				}
+				if err := userService.Delete(p.Context, id, uint(p.Args["version"].(int))); err != nil {
+					return nil, toGraphQLError(userError(err, "Failed to delete user"))
+				}
+				return true, nil
+			},
+		},
+	},
+})
+
+var graphQLSchema graphql.Schema
+
+// Build the GraphQL schema; called once at startup
+func initGraphQL() {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: graphQLQuery, Mutation: graphQLMutation})
+	if err != nil {
+		panic(err)
+	}
+	graphQLSchema = schema
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Execute a GraphQL query or mutation sent as JSON.
+// Only the fields the client selects are resolved and returned.
+func graphQLHandler(c echo.Context) error {
+	req := new(graphQLRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if req.Query == "" {
+		return newProblem(http.StatusBadRequest, "Missing query")
+	}
+
+	ctx := context.WithValue(c.Request().Context(), echoContextKey{}, c)
+	result := graphql.Do(graphql.Params{
+		Schema:         graphQLSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+	return respond(c, http.StatusOK, result)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm/clause"
+)
+
+// Group is a named team of users, shown on a user with ?expand=groups
+type Group struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TenantID    uint      `json:"-" gorm:"not null;default:1;uniqueIndex:idx_groups_tenant_name,priority:1"`
+	Name        string    `json:"name" gorm:"size:100;not null;uniqueIndex:idx_groups_tenant_name,priority:2"`
+	Description string    `json:"description" gorm:"size:500"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// GroupMember puts a user in a group: a row of the join table behind
+// User.Groups, recording when the user joined
+type GroupMember struct {
+	GroupID   uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"primaryKey;index"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+type createGroupRequest struct {
+	Name        string `json:"name" validate:"required,max=100"`
+	Description string `json:"description" validate:"max=500"`
+}
+
+type addGroupMemberRequest struct {
+	UserID UserRef `json:"user_id" validate:"required"`
+}
+
+// Path of a group under the request's API prefix
+func groupPath(c echo.Context, g *Group) string {
+	return fmt.Sprintf("%s/groups/%d", apiBase(c), g.ID)
+}
+
+// Wrap a group with links to itself, its users and the group collection
+func newGroupResource(c echo.Context, g *Group) Resource {
+	self := groupPath(c, g)
+	return Resource{Data: g, Links: Links{"self": self, "users": self + "/users", "collection": apiBase(c) + "/groups"}}
+}
+
+// Load the group named by :id
+func findGroup(c echo.Context) (*Group, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid group ID")
+	}
+	var g Group
+	if err := dbCtx(c).First(&g, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Group not found")
+	}
+	return &g, nil
+}
+
+// List groups by name
+func getGroups(c echo.Context) error {
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	var groups []Group
+	var total int64
+	q := dbCtx(c).Model(&Group{})
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch groups")
+	}
+	if err := q.Order("name, id").Offset(p.Offset).Limit(p.Limit).Find(&groups).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch groups")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, groups))
+}
+
+// Create a group with a name unique within the tenant
+func createGroup(c echo.Context) error {
+	req := new(createGroupRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	g := Group{Name: req.Name, Description: req.Description}
+	if err := dbCtx(c).Create(&g).Error; err != nil {
+		if errors.Is(translateError(err), ErrDuplicate) {
+			p := newProblem(http.StatusConflict, "A group with this name already exists")
+			p.Errors = map[string]string{"name": "is already in use"}
+			return p
+		}
+		return newProblem(http.StatusInternalServerError, "Failed to create group")
+	}
+	c.Response().Header().Set(echo.HeaderLocation, groupPath(c, &g))
+	return respond(c, http.StatusCreated, newGroupResource(c, &g))
+}
+
+// Fetch a group
+func getGroup(c echo.Context) error {
+	g, err := findGroup(c)
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, newGroupResource(c, g))
+}
+
+// List a group's live users in ID order
+func getGroupUsers(c echo.Context) error {
+	g, err := findGroup(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	var users []User
+	var total int64
+	q := dbCtx(c).Model(&User{}).
+		Joins("JOIN group_members ON group_members.user_id = users.id").
+		Where("group_members.group_id = ?", g.ID)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	if err := q.Preload("Roles").Order("users.id").Offset(p.Offset).Limit(p.Limit).Find(&users).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, users))
+}
+
+// List the groups a user belongs to by name
+func getUserGroups(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	var groups []Group
+	var total int64
+	q := dbCtx(c).Model(&Group{}).
+		Joins("JOIN group_members ON group_members.group_id = groups.id").
+		Where("group_members.user_id = ?", id)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch groups")
+	}
+	if err := q.Order("groups.name, groups.id").Offset(p.Offset).Limit(p.Limit).Find(&groups).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch groups")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, groups))
+}
+
+// Add a live user to a group. Adding a member again changes nothing.
+func addGroupMember(c echo.Context) error {
+	g, err := findGroup(c)
+	if err != nil {
+		return err
+	}
+	req := new(addGroupMemberRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	id, err := resolveUserRef(c, req.UserID)
+	if err != nil {
+		return err
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	member := GroupMember{GroupID: g.ID, UserID: id}
+	if err := dbCtx(c).Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to add member")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Remove a user from a group
+func removeGroupMember(c echo.Context) error {
+	g, err := findGroup(c)
+	if err != nil {
+		return err
+	}
+	id, err := resolveUserRef(c, UserRef(c.Param("user_id")))
+	if err != nil {
+		return err
+	}
+	result := dbCtx(c).Where("group_id = ? AND user_id = ?", g.ID, id).Delete(&GroupMember{})
+	if result.Error != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to remove member")
+	}
+	if result.RowsAffected == 0 {
+		return newProblem(http.StatusNotFound, "User is not a member of the group")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
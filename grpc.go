@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"main.go/proto/userpb"
+)
+
+// Scope each user RPC requires; other services (health, reflection) are open
+var grpcMethodScopes = map[string]string{
+	userpb.UserService_GetUser_FullMethodName:    ScopeRead,
+	userpb.UserService_ListUsers_FullMethodName:  ScopeRead,
+	userpb.UserService_CreateUser_FullMethodName: ScopeWrite,
+	userpb.UserService_UpdateUser_FullMethodName: ScopeWrite,
+	userpb.UserService_DeleteUser_FullMethodName: ScopeAdmin,
+}
+
+// Roles granting each scope to JWT callers, matching the REST routes
+var scopeRoles = map[string][]string{
+	ScopeRead:  {RoleAdmin, RoleEditor, RoleViewer},
+	ScopeWrite: {RoleAdmin, RoleEditor},
+	ScopeAdmin: {RoleAdmin},
+}
+
+// HTTP statuses used by the service layer and their gRPC equivalents
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.AlreadyExists,
+	http.StatusPreconditionFailed:    codes.Aborted,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+}
+
+// Convert a problem into a gRPC status, carrying field errors as BadRequest details
+func grpcError(err error) error {
+	var p *Problem
+	if !errors.As(err, &p) {
+		return status.Error(codes.Internal, "Internal error")
+	}
+	code, ok := grpcCodes[p.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	st := status.New(code, p.Detail)
+	if len(p.Errors) > 0 {
+		details := &errdetails.BadRequest{}
+		for field, message := range p.Errors {
+			details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       field,
+				Description: message,
+			})
+		}
+		if withDetails, err := st.WithDetails(details); err == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
+
+// Authenticate user RPCs with an x-api-key or bearer token in the metadata
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	scope, ok := grpcMethodScopes[info.FullMethod]
+	if !ok {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	slug := defaultTenantSlug
+	if tenants := md.Get(strings.ToLower(tenantHeader)); len(tenants) > 0 {
+		slug = tenants[0]
+	}
+	tenant, err := findTenant(ctx, slug)
+	if errors.Is(err, errUnknownTenant) {
+		return nil, status.Error(codes.NotFound, "Tenant not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to resolve tenant")
+	}
+	ctx = grpcAuditContext(withTenant(ctx, tenant), md)
+
+	if keys := md.Get(strings.ToLower(apiKeyHeader)); len(keys) > 0 {
+		apiKey, err := authenticateAPIKey(ctx, keys[0])
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		if !apiKey.Scopes.Allow(scope) {
+			return nil, status.Error(codes.PermissionDenied, "API key lacks the "+scope+" scope")
+		}
+		setAuditActor(ctx, actorAPIKey, apiKey.ID)
+		return handler(ctx, req)
+	}
+
+	auth := md.Get("authorization")
+	if len(auth) == 0 || !strings.HasPrefix(auth[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "Invalid or missing token")
+	}
+	claims := new(JWTClaims)
+	_, err = jwt.ParseWithClaims(strings.TrimPrefix(auth[0], "Bearer "), claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid or missing token")
+	}
+	var user User
+	if err := db.WithContext(ctx).Preload("Roles").First(&user, claims.UserID).Error; err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid or missing token")
+	}
+	if !user.HasRole(scopeRoles[scope]...) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+	setAuditActor(ctx, actorUser, user.ID)
+	return handler(ctx, req)
+}
+
+// Carry the peer address and request ID of an RPC to audited writes
+func grpcAuditContext(ctx context.Context, md metadata.MD) context.Context {
+	info := &auditContext{ActorType: actorSystem}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			info.IP = host
+		}
+	}
+	if ids := md.Get("x-request-id"); len(ids) > 0 {
+		info.RequestID = ids[0]
+	}
+	return context.WithValue(ctx, auditContextKey{}, info)
+}
+
+// userGRPCServer serves the UserService RPCs from the same service layer as REST
+type userGRPCServer struct {
+	userpb.UnimplementedUserServiceServer
+	users *UserService
+}
+
+// Convert a user to its protobuf form
+func toProtoUser(u *User) *userpb.User {
+	roles := make([]string, len(u.Roles))
+	for i, role := range u.Roles {
+		roles[i] = role.Name
+	}
+	id := strconv.FormatUint(uint64(u.ID), 10)
+	if userIDType == idTypeUUID {
+		id = u.UUID
+	}
+	return &userpb.User{
+		Id:        id,
+		Uuid:      u.UUID,
+		Name:      u.Name,
+		Email:     derefEmail(u.Email),
+		Birthday:  u.Birthday.String(),
+		Roles:     roles,
+		Version:   uint32(u.Version),
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+}
+
+// Resolve an integer ID or UUID to a user ID
+func (s *userGRPCServer) resolve(ctx context.Context, ref string) (uint, error) {
+	id, err := s.users.Resolve(ctx, UserRef(ref))
+	if errors.Is(err, errInvalidUserRef) {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return 0, grpcError(userError(err, "Failed to fetch user"))
+	}
+	return id, nil
+}
+
+// Parse an optional YYYY-MM-DD birthday
+func protoBirthday(s string) (Date, error) {
+	if s == "" {
+		return Date{}, nil
+	}
+	d, err := ParseDate(s)
+	if err != nil {
+		return Date{}, grpcError(bindError(err))
+	}
+	return d, nil
+}
+
+func (s *userGRPCServer) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.User, error) {
+	id, err := s.resolve(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.users.Get(ctx, id)
+	if err != nil {
+		return nil, grpcError(userError(err, "Failed to fetch user"))
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userGRPCServer) ListUsers(ctx context.Context, req *userpb.ListUsersRequest) (*userpb.ListUsersResponse, error) {
+	page, limit := int(req.Page), int(req.Limit)
+	if page == 0 {
+		page = 1
+	}
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if page < 0 || limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page and limit must be positive")
+	}
+	limit = min(limit, maxPageSize)
+
+	var conds []Condition
+	if req.Name != "" {
+		conds = append(conds, Condition{Column: "name", Op: "=", Value: req.Name})
+	}
+	if req.Email != "" {
+		conds = append(conds, Condition{Column: "email", Op: "=", Value: normalizeEmail(req.Email)})
+	}
+	sort, err := userQuery.SortFields(req.Sort)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	users, total, err := s.users.List(ctx, UserQuery{
+		Conditions:     conds,
+		Sort:           sort,
+		Offset:         (page - 1) * limit,
+		Limit:          limit,
+		IncludeDeleted: req.IncludeDeleted,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to fetch users")
+	}
+	resp := &userpb.ListUsersResponse{Total: total, Page: int32(page), Limit: int32(limit)}
+	for i := range users {
+		resp.Users = append(resp.Users, toProtoUser(&users[i]))
+	}
+	return resp, nil
+}
+
+func (s *userGRPCServer) CreateUser(ctx context.Context, req *userpb.CreateUserRequest) (*userpb.User, error) {
+	birthday, err := protoBirthday(req.Birthday)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.users.Create(ctx, createUserRequest{
+		Name:     req.Name,
+		Email:    req.Email,
+		Birthday: birthday,
+		Password: req.Password,
+	})
+	if err != nil {
+		return nil, grpcError(userError(err, "Failed to create user"))
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userGRPCServer) UpdateUser(ctx context.Context, req *userpb.UpdateUserRequest) (*userpb.User, error) {
+	id, err := s.resolve(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	birthday, err := protoBirthday(req.Birthday)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.users.Update(ctx, id, uint(req.Version), updateUserRequest{
+		Name:     req.Name,
+		Email:    req.Email,
+		Birthday: birthday,
+		Password: req.Password,
+	})
+	if err != nil {
+		return nil, grpcError(userError(err, "Failed to update user"))
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userGRPCServer) DeleteUser(ctx context.Context, req *userpb.DeleteUserRequest) (*userpb.DeleteUserResponse, error) {
+	id, err := s.resolve(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.Delete(ctx, id, uint(req.Version)); err != nil {
+		return nil, grpcError(userError(err, "Failed to delete user"))
+	}
+	return &userpb.DeleteUserResponse{}, nil
+}
+
+// Serve the gRPC API with health and reflection services on the given port.
+// The returned function drains in-flight RPCs, giving up when ctx expires.
+func startGRPCServer(port string) func(ctx context.Context) {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcAuthInterceptor))
+	userpb.RegisterUserServiceServer(srv, &userGRPCServer{users: userService})
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(userpb.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthServer)
+	reflection.Register(srv)
+
+	go func() {
+		log.Printf("gRPC listening on :%s", port)
+		if err := srv.Serve(lis); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+	}()
+
+	return func(ctx context.Context) {
+		healthServer.Shutdown()
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			srv.Stop()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// Outcome of the latest background ping of the database; nil means reachable
+var dbPing struct {
+	sync.RWMutex
+	err error
+}
+
+func dbPingError() error {
+	dbPing.RLock()
+	defer dbPing.RUnlock()
+	return dbPing.err
+}
+
+// Ping the database every DB_PING_INTERVAL so readiness follows its
+// availability, logging when it goes away and comes back
+func startDBMonitor() func() {
+	interval := cfg.DB.PingInterval
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pingDB(ctx)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func pingDB(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, readinessTimeout)
+	defer cancel()
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if parent.Err() != nil {
+		// Shutting down, not a database failure
+		return
+	}
+
+	dbPing.Lock()
+	prev := dbPing.err
+	dbPing.err = err
+	dbPing.Unlock()
+	switch {
+	case err != nil && prev == nil:
+		log.Printf("Database unreachable: %v", err)
+	case err == nil && prev != nil:
+		log.Println("Database reachable again")
+	}
+}
+
+// Report that the process is up
+func healthz(c echo.Context) error {
+	return respond(c, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Report that the process is alive and able to serve requests
+func livez(c echo.Context) error {
+	return respond(c, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Report whether the database was reachable at the last background ping and
+// is fully migrated
+func readyz(c echo.Context) error {
+	checks := map[string]string{"database": "ok", "migrations": "ok"}
+	status := http.StatusOK
+
+	if err := dbPingError(); err != nil {
+		checks["database"] = err.Error()
+		checks["migrations"] = "unknown"
+		status = http.StatusServiceUnavailable
+	} else if pending, err := pendingMigrations(); err != nil {
+		checks["migrations"] = err.Error()
+		status = http.StatusServiceUnavailable
+	} else if len(pending) > 0 {
+		checks["migrations"] = "pending"
+		status = http.StatusServiceUnavailable
+	}
+
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unavailable"
+	}
+	return respond(c, status, map[string]interface{}{"status": result, "checks": checks})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Longest management chain followed; deeper ones are cut short
+const maxManagerDepth = 100
+
+type setManagerRequest struct {
+	// Null removes the manager
+	ManagerID *UserRef `json:"manager_id"`
+}
+
+// Set or clear who a user reports to. A user cannot report to themselves or
+// to anyone who reports to them, directly or not.
+func setUserManager(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req := new(setManagerRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	ctx := c.Request().Context()
+	var managerID uint
+	if req.ManagerID != nil {
+		managerID, err = userService.Resolve(ctx, *req.ManagerID)
+		if errors.Is(err, ErrNotFound) {
+			err = ErrManagerNotFound
+		}
+	}
+	var user *User
+	if err == nil {
+		user, err = userService.SetManager(ctx, id, managerID)
+	}
+	switch {
+	case errors.Is(err, errInvalidUserRef):
+		p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+		p.Errors = map[string]string{"manager_id": "must be a user ID or UUID"}
+		return p
+	case errors.Is(err, ErrManagerNotFound):
+		return newProblem(http.StatusUnprocessableEntity, "Manager not found")
+	case errors.Is(err, ErrManagerCycle):
+		p := newProblem(http.StatusConflict, "The manager reports to this user")
+		p.Errors = map[string]string{"manager_id": "would create a cycle"}
+		return p
+	case err != nil:
+		return userError(err, "Failed to update user")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
+
+// List a user's direct reports, sorted like the user list
+func getUserReports(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	sort, err := userQuery.ParseSort(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	ctx := c.Request().Context()
+	if _, err := userService.Get(ctx, id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	users, total, err := userService.List(ctx, UserQuery{
+		Conditions: []Condition{{Column: "manager_id", Op: "=", Value: id}},
+		Sort:       sort,
+		Offset:     p.Offset,
+		Limit:      p.Limit,
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, users))
+}
+
+// List a user's managers, from their own up to the top of the hierarchy
+func getUserChain(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	managers, err := userService.ManagerChain(c.Request().Context(), id)
+	if err != nil {
+		return userError(err, "Failed to fetch managers")
+	}
+	return respond(c, http.StatusOK, map[string]interface{}{"data": managers})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	idempotencyKeyHeader       = "Idempotency-Key"
+	idempotentReplayedHeader   = "Idempotent-Replayed"
+	maxIdempotencyKeyLength    = 255
+	idempotencyCleanupInterval = time.Hour
+)
+
+// IdempotencyKey records the response to a request sent with an Idempotency-Key
+// header, so retries of the request get the same response instead of a repeat.
+// Keys belong to the caller that sent them; others may reuse them freely.
+type IdempotencyKey struct {
+	ID       uint `gorm:"primaryKey"`
+	TenantID uint `gorm:"not null;default:1;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:1"`
+	// The authenticated caller, such as "user:3" or "api_key:7"
+	Principal   string `gorm:"size:50;not null;default:'';uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:2"`
+	Key         string `gorm:"column:idempotency_key;size:255;not null;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:3"`
+	RequestHash string `gorm:"size:64;not null"`
+	// Zero until the first request finishes
+	Status      int    `gorm:"not null"`
+	ContentType string `gorm:"size:100"`
+	ETag        string `gorm:"size:100"`
+	Headers     storedHeaders
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// storedHeaders stores the replayed response headers as a JSON object
+type storedHeaders map[string][]string
+
+func (storedHeaders) GormDataType() string {
+	return "text"
+}
+
+func (h storedHeaders) Value() (driver.Value, error) {
+	if h == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(map[string][]string(h))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (h *storedHeaders) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, (*map[string][]string)(h))
+	case string:
+		return json.Unmarshal([]byte(v), (*map[string][]string)(h))
+	}
+	return fmt.Errorf("cannot scan %T into headers", value)
+}
+
+// Middleware making a route safe to retry: the first request with a given
+// Idempotency-Key runs, and later ones within IDEMPOTENCY_TTL get its response
+// replayed. Failed requests release the key so they can be retried.
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return newProblem(http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s %s\n", c.Request().Method, unversionedPath(c))
+		sum.Write(body)
+		hash := hex.EncodeToString(sum.Sum(nil))
+
+		claim, prior, err := claimIdempotencyKey(c, key, hash)
+		if err != nil {
+			return err
+		}
+		if prior != nil {
+			header := c.Response().Header()
+			header.Set(idempotentReplayedHeader, "true")
+			if prior.ETag != "" {
+				header.Set("ETag", prior.ETag)
+			}
+			for name, values := range prior.Headers {
+				header[name] = values
+			}
+			return c.Blob(prior.Status, prior.ContentType, prior.Body)
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		err = next(c)
+		c.Response().Writer = recorder.ResponseWriter
+
+		// Settle the key even if the client has gone away
+		tx := db.WithContext(context.WithoutCancel(c.Request().Context()))
+		status := c.Response().Status
+		if err == nil && status < http.StatusBadRequest && !recorder.overflow {
+			header := c.Response().Header()
+			headers := storedHeaders{}
+			for _, name := range cachedHeaders {
+				if values := header.Values(name); len(values) > 0 {
+					headers[name] = values
+				}
+			}
+			saveErr := tx.Model(claim).Updates(IdempotencyKey{
+				Status:      status,
+				ContentType: header.Get(echo.HeaderContentType),
+				ETag:        header.Get("ETag"),
+				Headers:     headers,
+				Body:        recorder.body.Bytes(),
+			}).Error
+			if saveErr != nil {
+				requestLogger(c).Error("failed to save idempotent response", "error", saveErr)
+			}
+		} else if delErr := tx.Delete(claim).Error; delErr != nil {
+			requestLogger(c).Error("failed to release idempotency key", "error", delErr)
+		}
+		return err
+	}
+}
+
+// Claim a key for this request, or find the finished request that claimed it.
+// Expired keys, and keys left unfinished past REQUEST_TIMEOUT by a crashed
+// request, are taken over.
+func claimIdempotencyKey(c echo.Context, key, hash string) (claim, prior *IdempotencyKey, _ error) {
+	principal := requestPrincipal(c)
+	for attempt := 0; attempt < 3; attempt++ {
+		now := time.Now()
+		claim = &IdempotencyKey{Principal: principal, Key: key, RequestHash: hash, ExpiresAt: now.Add(cfg.IdempotencyTTL)}
+		err := dbCtx(c).Create(claim).Error
+		if err == nil {
+			return claim, nil, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, nil, newProblem(http.StatusInternalServerError, "Failed to record idempotency key")
+		}
+
+		existing := new(IdempotencyKey)
+		err = dbCtx(c).Where("principal = ? AND idempotency_key = ?", principal, key).Take(existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, newProblem(http.StatusInternalServerError, "Failed to record idempotency key")
+		}
+		abandoned := existing.Status == 0 && existing.CreatedAt.Before(now.Add(-cfg.HTTP.RequestTimeout))
+		if existing.ExpiresAt.Before(now) || abandoned {
+			if err := dbCtx(c).Delete(existing).Error; err != nil {
+				return nil, nil, newProblem(http.StatusInternalServerError, "Failed to record idempotency key")
+			}
+			continue
+		}
+		if existing.RequestHash != hash {
+			return nil, nil, newProblem(http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+		}
+		if existing.Status == 0 {
+			return nil, nil, newProblem(http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+		}
+		return nil, existing, nil
+	}
+	return nil, nil, newProblem(http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+}
+
+// The caller a request is authenticated as, such as "user:3" or "api_key:7",
+// taken from the actor its writes are audited under
+func requestPrincipal(c echo.Context) string {
+	info, ok := c.Request().Context().Value(auditContextKey{}).(*auditContext)
+	if !ok || info.ActorID == nil {
+		return actorSystem
+	}
+	return fmt.Sprintf("%s:%d", info.ActorType, *info.ActorID)
+}
+
+// Delete expired idempotency keys every hour. The returned function stops the cleanup.
+func startIdempotencyCleanup() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(idempotencyCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&IdempotencyKey{}).Error
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Failed to delete expired idempotency keys: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	idTypeInt  = "int"
+	idTypeUUID = "uuid"
+)
+
+// Which identifier the API exposes as a user's "id"
+var userIDType = idTypeInt
+
+var errInvalidUserRef = errors.New("Invalid user ID")
+
+// Load ID_TYPE (int or uuid) from the configuration
+func initIDType() {
+	switch v := cfg.IDType; v {
+	case "", idTypeInt:
+		userIDType = idTypeInt
+	case idTypeUUID:
+		userIDType = idTypeUUID
+	default:
+		log.Fatalf("Invalid ID_TYPE %q, expected 'int' or 'uuid'", v)
+	}
+}
+
+// UserRef identifies a user by integer ID or UUID; both are always accepted
+type UserRef string
+
+// Accept refs as JSON numbers or strings
+func (r *UserRef) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*r = UserRef(s)
+		return nil
+	}
+	var n json.Number
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&n); err != nil {
+		return errInvalidUserRef
+	}
+	*r = UserRef(n.String())
+	return nil
+}
+
+// Split the ref into an integer ID or a canonical UUID
+func (r UserRef) Parse() (uint, string, error) {
+	if id, err := strconv.ParseUint(string(r), 10, 0); err == nil && id > 0 {
+		return uint(id), "", nil
+	}
+	if u, err := uuid.Parse(string(r)); err == nil {
+		return 0, u.String(), nil
+	}
+	return 0, "", errInvalidUserRef
+}
+
+// Parse a user ID query value, which may also be a UUID
+func parseUserRefParam(v string) (interface{}, error) {
+	id, u, err := UserRef(v).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if u != "" {
+		return clause.Expr{SQL: "(SELECT id FROM users WHERE uuid = ?)", Vars: []interface{}{u}}, nil
+	}
+	return id, nil
+}
+
+// UUIDs of users by ID. Neither ever changes, so entries never go stale.
+var userUUIDs sync.Map
+
+// The UUID of the user with the given ID, or nil if it has been purged
+func userUUID(id uint) (*string, error) {
+	if u, ok := userUUIDs.Load(id); ok {
+		s := u.(string)
+		return &s, nil
+	}
+	var user User
+	err := db.Unscoped().Select("uuid").Where("id = ?", id).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	userUUIDs.Store(id, user.UUID)
+	return &user.UUID, nil
+}
+
+// Remember the UUIDs of loaded users, so references to them need no lookup
+func (u *User) AfterFind(tx *gorm.DB) error {
+	if userIDType == idTypeUUID && u.ID != 0 && u.UUID != "" {
+		userUUIDs.Store(u.ID, u.UUID)
+	}
+	return nil
+}
+
+// Assign a time-ordered UUID to new users and start them active at version 1
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.UUID == "" {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return err
+		}
+		u.UUID = id.String()
+	}
+	if u.Version == 0 {
+		u.Version = 1
+	}
+	if u.Status == "" {
+		u.Status = userActive
+	}
+	return nil
+}
+
+// Add the age derived from the birthday, and expose the UUIDs of the user and
+// its manager when ID_TYPE=uuid
+func (u User) MarshalJSON() ([]byte, error) {
+	type plainUser User
+	type agedUser struct {
+		plainUser
+		Age *int `json:"age"`
+	}
+	aged := agedUser{plainUser(u), u.Birthday.Age(time.Now())}
+	if userIDType != idTypeUUID {
+		return json.Marshal(aged)
+	}
+	var manager *string
+	switch {
+	case u.Manager != nil:
+		manager = &u.Manager.UUID
+	case u.ManagerID != nil:
+		var err error
+		if manager, err = userUUID(*u.ManagerID); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(struct {
+		ID        string  `json:"id"`
+		ManagerID *string `json:"manager_id"`
+		agedUser
+	}{u.UUID, manager, aged})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	maxImportSize   = 20 << 20
+	maxImportRows   = 100000
+	importChunkRows = 1000
+
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+var errNoNameColumn = errors.New("The header row must contain a name column")
+
+// importRow is a data row of an import file with its line number
+type importRow struct {
+	Line   int
+	Fields map[string]string
+}
+
+// ImportRowError reports why a row was not imported
+type ImportRowError struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// ImportReport summarizes an import
+type ImportReport struct {
+	Total   int              `json:"total"`
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+// Read the rows of a CSV file, keyed by the lower-cased header row
+func readCSVRows(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var header []string
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if header == nil {
+			header = record
+			continue
+		}
+		if row, ok := newImportRow(header, record, line); ok {
+			rows = append(rows, row)
+		}
+		if len(rows) > maxImportRows {
+			break
+		}
+	}
+	return rows, checkHeader(header)
+}
+
+// Read the rows of the first sheet of an XLSX workbook
+func readXLSXRows(r io.Reader) ([]importRow, error) {
+	// Raw values keep dates as serial numbers instead of locale-formatted text
+	book, err := excelize.OpenReader(r, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, err
+	}
+	defer book.Close()
+
+	sheets := book.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, errNoNameColumn
+	}
+	iter, err := book.Rows(sheets[0])
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var header []string
+	var rows []importRow
+	for line := 1; iter.Next(); line++ {
+		record, err := iter.Columns()
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			header = record
+			continue
+		}
+		if row, ok := newImportRow(header, record, line); ok {
+			if v := row.Fields["birthday"]; v != "" {
+				row.Fields["birthday"] = excelDate(v)
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) > maxImportRows {
+			break
+		}
+	}
+	return rows, checkHeader(header)
+}
+
+// Convert an Excel date serial to YYYY-MM-DD; other values pass through
+func excelDate(v string) string {
+	serial, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return v
+	}
+	t, err := excelize.ExcelDateToTime(serial, false)
+	if err != nil {
+		return v
+	}
+	return t.Format(dateLayout)
+}
+
+// Pair a record with the header; blank records are skipped
+func newImportRow(header, record []string, line int) (importRow, bool) {
+	row := importRow{Line: line, Fields: map[string]string{}}
+	blank := true
+	for i, value := range record {
+		if i >= len(header) {
+			break
+		}
+		value = strings.TrimSpace(value)
+		if value != "" {
+			blank = false
+		}
+		row.Fields[strings.ToLower(strings.TrimSpace(header[i]))] = value
+	}
+	return row, !blank
+}
+
+func checkHeader(header []string) error {
+	for _, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), "name") {
+			return nil
+		}
+	}
+	return errNoNameColumn
+}
+
+// Validate and insert the rows in chunks, reporting row-level failures.
+// Columns other than name, email, birthday and password are ignored.
+func importUserRows(ctx context.Context, rows []importRow) (*ImportReport, error) {
+	report := &ImportReport{Total: len(rows), Errors: []ImportRowError{}}
+	for start := 0; start < len(rows); start += importChunkRows {
+		chunk := rows[start:min(start+importChunkRows, len(rows))]
+
+		var reqs []createUserRequest
+		var lines []int
+		for _, row := range chunk {
+			birthday, err := ParseDate(row.Fields["birthday"])
+			if err != nil && row.Fields["birthday"] != "" {
+				report.Errors = append(report.Errors, ImportRowError{
+					Line:   row.Line,
+					Errors: map[string]string{"birthday": "must be a date in YYYY-MM-DD format"},
+				})
+				continue
+			}
+			reqs = append(reqs, createUserRequest{
+				Name:     row.Fields["name"],
+				Email:    row.Fields["email"],
+				Birthday: birthday,
+				Password: row.Fields["password"],
+			})
+			lines = append(lines, row.Line)
+		}
+		if len(reqs) == 0 {
+			continue
+		}
+
+		results, err := userService.CreateMany(ctx, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if result.Status == http.StatusCreated {
+				report.Created++
+				continue
+			}
+			report.Errors = append(report.Errors, ImportRowError{Line: lines[result.Index], Errors: result.Errors})
+		}
+	}
+	sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+	report.Failed = len(report.Errors)
+	return report, nil
+}
+
+// Import users from an uploaded CSV or XLSX file in the "file" form field
+func importUsers(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Expected a CSV or XLSX upload in the file field")
+	}
+	if file.Size > maxImportSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("Import files are limited to %d MB", maxImportSize>>20))
+	}
+	src, err := file.Open()
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Failed to read upload")
+	}
+	defer src.Close()
+
+	var rows []importRow
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	contentType := file.Header.Get(echo.HeaderContentType)
+	switch {
+	case ext == ".csv" || strings.HasPrefix(contentType, "text/csv"):
+		rows, err = readCSVRows(src)
+	case ext == ".xlsx" || contentType == xlsxContentType:
+		rows, err = readXLSXRows(src)
+	default:
+		return newProblem(http.StatusUnsupportedMediaType, "Expected a .csv or .xlsx file")
+	}
+	if errors.Is(err, errNoNameColumn) {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Failed to parse file: "+err.Error())
+	}
+	if len(rows) == 0 {
+		return newProblem(http.StatusBadRequest, "The file contains no rows")
+	}
+	if len(rows) > maxImportRows {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d rows per import", maxImportRows))
+	}
+
+	report, err := importUserRows(c.Request().Context(), rows)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to import users")
+	}
+	return respond(c, http.StatusOK, report)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	// Out of attempts: kept, with its payload, until an admin retries or deletes it
+	jobDead = "dead"
+
+	// Due jobs fetched per poll
+	jobBatchSize = 50
+	// Longest wait between attempts, however many have failed
+	jobMaxBackoff = time.Hour
+	// Most of a failure's message kept on the job
+	maxJobErrorLength = 500
+	jobPurgeInterval  = time.Hour
+)
+
+// Job is background work of a registered type. Failed attempts are retried
+// with exponential backoff; a job out of attempts is dead-lettered.
+type Job struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	TenantID    uint   `json:"-" gorm:"not null;default:1;index"`
+	Type        string `json:"type" gorm:"size:50;not null;index"`
+	Payload     string `json:"-" gorm:"type:text;not null"`
+	Status      string `json:"status" gorm:"size:20;not null;index:idx_jobs_due,priority:1"`
+	Attempts    int    `json:"attempts" gorm:"not null"`
+	MaxAttempts int    `json:"max_attempts" gorm:"not null"`
+	// When a pending job is due; while it runs, when its claim lapses
+	RunAt      time.Time  `json:"run_at" gorm:"index:idx_jobs_due,priority:2"`
+	LastError  string     `json:"last_error" gorm:"size:500"`
+	FinishedAt *time.Time `json:"finished_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// When the job runs again if the current attempt fails, zero on the last one
+	RetryAt time.Time `json:"-" gorm:"-"`
+}
+
+// JobType runs the jobs of one type. Zero settings take the JOB_* defaults.
+type JobType struct {
+	Run         func(ctx context.Context, job *Job) error
+	MaxAttempts int
+	// Wait before the first retry, doubling with each further one
+	Backoff time.Duration
+	// Longest an attempt may run
+	Timeout time.Duration
+}
+
+func (t JobType) maxAttempts() int {
+	if t.MaxAttempts > 0 {
+		return t.MaxAttempts
+	}
+	return cfg.Jobs.MaxAttempts
+}
+
+func (t JobType) backoff() time.Duration {
+	if t.Backoff > 0 {
+		return t.Backoff
+	}
+	return cfg.Jobs.Backoff
+}
+
+func (t JobType) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return cfg.Jobs.Timeout
+}
+
+var (
+	// Job types by name, registered at startup before the workers start
+	jobTypes = map[string]JobType{}
+	// Wakes the workers when jobs are queued
+	jobWake = make(chan struct{}, 1)
+)
+
+// Register how jobs of a type are run
+func registerJobType(name string, t JobType) {
+	jobTypes[name] = t
+}
+
+// A pending job of a registered type, due now
+func newJob(jobType string, payload interface{}) (Job, error) {
+	t, ok := jobTypes[jobType]
+	if !ok {
+		return Job{}, errors.New("unknown job type: " + jobType)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{
+		Type:        jobType,
+		Payload:     string(body),
+		Status:      jobPending,
+		MaxAttempts: t.maxAttempts(),
+		RunAt:       time.Now(),
+	}, nil
+}
+
+// Queue jobs in the given transaction, or outside one with db. They belong to
+// the context's tenant and run with queries scoped to it.
+func enqueueJobs(tx *gorm.DB, jobs []Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if err := tx.CreateInBatches(jobs, bulkInsertBatchSize).Error; err != nil {
+		return err
+	}
+	wakeJobWorkers()
+	return nil
+}
+
+// Queue one job with its payload encoded as JSON
+func enqueueJob(ctx context.Context, jobType string, payload interface{}) error {
+	job, err := newJob(jobType, payload)
+	if err != nil {
+		return err
+	}
+	return enqueueJobs(db.WithContext(ctx), []Job{job})
+}
+
+func wakeJobWorkers() {
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// Delay before the given retry: doubling from base, capped, with up to 20% jitter
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := jobMaxBackoff
+	if attempt < 20 {
+		d = min(base<<(attempt-1), jobMaxBackoff)
+	}
+	return d + mathrand.N(d/5+1)
+}
+
+// Start JOB_WORKERS workers running due jobs in the background. The returned
+// function stops them, waiting for the jobs in flight until ctx expires.
+func startJobWorkers() func(ctx context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// A slot per worker, taken while a job runs
+	slots := make(chan struct{}, cfg.Jobs.Workers)
+	var running sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Jobs.PollInterval)
+		defer ticker.Stop()
+		purge := time.NewTicker(jobPurgeInterval)
+		defer purge.Stop()
+		for {
+			runDueJobs(ctx, slots, &running)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-jobWake:
+			case <-purge.C:
+				purgeFinishedJobs(ctx)
+			}
+		}
+	}()
+
+	return func(shutdownCtx context.Context) {
+		cancel()
+		<-done
+		finished := make(chan struct{})
+		go func() {
+			running.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-shutdownCtx.Done():
+		}
+	}
+}
+
+// Claim and start every due job, as workers free up. Running jobs whose claim
+// lapsed, because their replica died, are due again.
+func runDueJobs(ctx context.Context, slots chan struct{}, running *sync.WaitGroup) {
+	for ctx.Err() == nil {
+		var due []Job
+		err := db.WithContext(ctx).
+			Where("status IN ? AND run_at <= ?", []string{jobPending, jobRunning}, time.Now()).
+			Order("run_at, id").Limit(jobBatchSize).Find(&due).Error
+		if err != nil {
+			if ctx.Err() == nil {
+				contextLogger(ctx).Error("failed to load jobs", "error", err)
+			}
+			return
+		}
+		for i := range due {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if !claimJob(ctx, &due[i]) {
+				<-slots
+				continue
+			}
+			running.Add(1)
+			go func(job *Job) {
+				defer running.Done()
+				defer func() { <-slots }()
+				// Jobs already started run to completion (bounded by their
+				// timeout) rather than being cut off by shutdown
+				runJob(context.Background(), job)
+			}(&due[i])
+		}
+		if len(due) < jobBatchSize {
+			return
+		}
+	}
+}
+
+// Claim a job for this worker. Claiming bumps the attempt count and pushes
+// run_at out past the job's timeout, so other replicas skip it while it runs.
+func claimJob(ctx context.Context, job *Job) bool {
+	lease := time.Now().Add(jobTypes[job.Type].timeout() + time.Minute)
+	claim := db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+		Updates(map[string]interface{}{"status": jobRunning, "attempts": job.Attempts + 1, "run_at": lease})
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return false
+	}
+	job.Status = jobRunning
+	job.Attempts++
+	return true
+}
+
+// Run a claimed job in its tenant and record the outcome
+func runJob(ctx context.Context, job *Job) {
+	t, ok := jobTypes[job.Type]
+	if job.Attempts < job.MaxAttempts {
+		job.RetryAt = time.Now().Add(retryBackoff(t.backoff(), job.Attempts))
+	}
+
+	var err error
+	if !ok {
+		err = errors.New("unknown job type")
+		job.RetryAt = time.Time{}
+	} else {
+		var tenant Tenant
+		if err = db.WithContext(ctx).Take(&tenant, job.TenantID).Error; err == nil {
+			err = runJobHandler(withTenant(ctx, &tenant), t, job)
+		}
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	switch {
+	case err == nil:
+		// Payloads may hold secrets, such as reset links, that are no longer needed
+		updates["status"] = jobDone
+		updates["payload"] = ""
+		updates["last_error"] = ""
+		updates["finished_at"] = now
+	case job.RetryAt.IsZero():
+		updates["status"] = jobDead
+		updates["last_error"] = truncate(err.Error(), maxJobErrorLength)
+		updates["finished_at"] = now
+		contextLogger(ctx).Error("job failed for the last time",
+			"job_id", job.ID, "type", job.Type, "attempt", job.Attempts, "error", err)
+	default:
+		updates["status"] = jobPending
+		updates["run_at"] = job.RetryAt
+		updates["last_error"] = truncate(err.Error(), maxJobErrorLength)
+		contextLogger(ctx).Warn("job failed",
+			"job_id", job.ID, "type", job.Type, "attempt", job.Attempts, "error", err)
+	}
+	if err := db.WithContext(ctx).Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		contextLogger(ctx).Error("failed to record job outcome", "job_id", job.ID, "error", err)
+	}
+}
+
+// Run the job's handler within its timeout, turning a panic into a failure
+func runJobHandler(ctx context.Context, t JobType, job *Job) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout())
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return t.Run(ctx, job)
+}
+
+// Delete jobs finished more than JOB_RETENTION ago. Dead jobs stay until an
+// admin deals with them.
+func purgeFinishedJobs(ctx context.Context) {
+	err := db.WithContext(ctx).
+		Where("status = ? AND finished_at < ?", jobDone, time.Now().Add(-cfg.Jobs.Retention)).
+		Delete(&Job{}).Error
+	if err != nil && ctx.Err() == nil {
+		contextLogger(ctx).Error("failed to delete finished jobs", "error", err)
+	}
+}
+
+// Load the job named by the id path parameter
+func findJob(c echo.Context, tx *gorm.DB) (*Job, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid job ID")
+	}
+	var job Job
+	if err := tx.First(&job, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Job not found")
+	}
+	return &job, nil
+}
+
+// List jobs, newest first, optionally of one status or type
+func getJobs(c echo.Context) error {
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	var jobs []Job
+	var total int64
+	q := dbCtx(c).Model(&Job{})
+	if status := c.QueryParam("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if jobType := c.QueryParam("type"); jobType != "" {
+		q = q.Where("type = ?", jobType)
+	}
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch jobs")
+	}
+	if err := q.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&jobs).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch jobs")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, jobs))
+}
+
+// Fetch a job
+func getJob(c echo.Context) error {
+	job, err := findJob(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, job)
+}
+
+// Give a dead job a fresh set of attempts
+func retryJob(c echo.Context) error {
+	job, err := findJob(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	result := dbCtx(c).Model(job).Where("status = ?", jobDead).Updates(map[string]interface{}{
+		"status":      jobPending,
+		"attempts":    0,
+		"run_at":      time.Now(),
+		"finished_at": nil,
+	})
+	if result.Error != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to retry job")
+	}
+	if result.RowsAffected == 0 {
+		return newProblem(http.StatusConflict, "Only dead jobs can be retried")
+	}
+	wakeJobWorkers()
+	if err := dbCtx(c).First(job, job.ID).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to retry job")
+	}
+	return respond(c, http.StatusOK, job)
+}
+
+// Delete a job that is not running
+func deleteJob(c echo.Context) error {
+	job, err := findJob(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	result := dbCtx(c).Where("status <> ?", jobRunning).Delete(job)
+	if result.Error != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to delete job")
+	}
+	if result.RowsAffected == 0 {
+		return newProblem(http.StatusConflict, "Running jobs cannot be deleted")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
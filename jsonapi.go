@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const jsonAPIContentType = "application/vnd.api+json"
+
+// jsonAPIType describes how a model is served as a JSON:API resource object
+type jsonAPIType struct {
+	Name string
+	// Builds the ID of models without an id field
+	ID func(v reflect.Value) string
+}
+
+// Models served as JSON:API resources. Fields holding one or a list of these
+// become relationships, with the related resources included.
+var jsonAPITypes = map[reflect.Type]jsonAPIType{
+	reflect.TypeOf(User{}):            {Name: "users"},
+	reflect.TypeOf(Role{}):            {Name: "roles"},
+	reflect.TypeOf(APIKey{}):          {Name: "api-keys"},
+	reflect.TypeOf(AuditLog{}):        {Name: "audit-logs"},
+	reflect.TypeOf(Tenant{}):          {Name: "tenants"},
+	reflect.TypeOf(Webhook{}):         {Name: "webhooks"},
+	reflect.TypeOf(WebhookDelivery{}): {Name: "webhook-deliveries"},
+	reflect.TypeOf(UserVersion{}): {Name: "user-versions", ID: func(v reflect.Value) string {
+		version := v.Interface().(UserVersion)
+		user := strconv.FormatUint(uint64(version.UserID), 10)
+		if userIDType == idTypeUUID {
+			user = ""
+			if u, err := userUUID(version.UserID); err == nil && u != nil {
+				user = *u
+			}
+		}
+		return fmt.Sprintf("%s-%d", user, version.Version)
+	}},
+}
+
+type jsonAPIDocument struct {
+	Data     interface{}     `json:"data,omitempty"`
+	Included []jsonAPIObject `json:"included,omitempty"`
+	Meta     interface{}     `json:"meta,omitempty"`
+	Links    Links           `json:"links,omitempty"`
+	JSONAPI  map[string]any  `json:"jsonapi"`
+}
+
+type jsonAPIObject struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    map[string]json.RawMessage     `json:"attributes,omitempty"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Links         Links                          `json:"links,omitempty"`
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type jsonAPIRelationship struct {
+	Data interface{} `json:"data"`
+}
+
+// Builds one JSON:API document, collecting the related resources it includes
+type jsonAPIEncoder struct {
+	included []jsonAPIObject
+	seen     map[jsonAPIIdentifier]bool
+}
+
+// Encode a response as a JSON:API document. Resources, pages of resources and
+// lists of models become primary data; page metadata and links carry over.
+// Responses that are not resources, such as reports, go in the top-level meta.
+func encodeJSONAPI(c echo.Context, v interface{}) ([]byte, error) {
+	enc := &jsonAPIEncoder{seen: map[jsonAPIIdentifier]bool{}}
+	doc := jsonAPIDocument{
+		Links:   Links{"self": c.Request().URL.RequestURI()},
+		JSONAPI: map[string]any{"version": "1.1"},
+	}
+	var err error
+	switch t := v.(type) {
+	case Resource:
+		var obj *jsonAPIObject
+		if obj, err = enc.object(reflect.ValueOf(t.Data)); obj != nil {
+			obj.Links = t.Links
+			doc.Data = obj
+		}
+	case PagedResponse:
+		doc.Data, err = enc.list(t.Data)
+		doc.Meta, doc.Links = t.Meta, t.Links
+	case CursorPage:
+		doc.Data, err = enc.list(t.Data)
+		doc.Meta, doc.Links = t.Meta, t.Links
+	default:
+		rv := reflect.Indirect(reflect.ValueOf(v))
+		switch {
+		case rv.Kind() == reflect.Slice && enc.isResource(rv.Type().Elem()):
+			doc.Data, err = enc.objects(rv)
+		case rv.IsValid() && enc.isResource(rv.Type()):
+			doc.Data, err = enc.object(rv)
+		default:
+			doc.Meta = v
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.Included = enc.included
+	return json.Marshal(doc)
+}
+
+func (enc *jsonAPIEncoder) isResource(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	_, ok := jsonAPITypes[t]
+	return ok
+}
+
+// Convert a page's items, keeping only the picked fields of a projection.
+// Unlike plain JSON, resources keep their ID whichever fields were picked.
+func (enc *jsonAPIEncoder) list(data interface{}) ([]jsonAPIObject, error) {
+	projection, ok := data.(Projection)
+	if !ok {
+		return enc.objects(reflect.ValueOf(data))
+	}
+	objects, err := enc.objects(reflect.ValueOf(projection.Items))
+	for _, obj := range objects {
+		maps.DeleteFunc(obj.Attributes, func(name string, _ json.RawMessage) bool {
+			return !slices.Contains(projection.Fields.Names, name)
+		})
+		maps.DeleteFunc(obj.Relationships, func(name string, _ jsonAPIRelationship) bool {
+			return !slices.Contains(projection.Fields.Names, name)
+		})
+	}
+	return objects, err
+}
+
+func (enc *jsonAPIEncoder) objects(list reflect.Value) ([]jsonAPIObject, error) {
+	objects := make([]jsonAPIObject, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		obj, err := enc.object(list.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, *obj)
+	}
+	return objects, nil
+}
+
+// Split a model into its type, ID, attributes and relationships
+func (enc *jsonAPIEncoder) object(v reflect.Value) (*jsonAPIObject, error) {
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return nil, nil
+	}
+	raw, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &attrs); err != nil {
+		return nil, err
+	}
+
+	model := jsonAPITypes[v.Type()]
+	obj := &jsonAPIObject{Type: model.Name, Attributes: attrs}
+	if model.ID != nil {
+		obj.ID = model.ID(v)
+	} else {
+		obj.ID = jsonAPIID(attrs["id"])
+	}
+	delete(attrs, "id")
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if _, ok := attrs[name]; !ok {
+			continue
+		}
+		related, many := field.Type, false
+		if related.Kind() == reflect.Slice {
+			related, many = related.Elem(), true
+		}
+		if related.Kind() == reflect.Pointer {
+			related = related.Elem()
+		}
+		if _, ok := jsonAPITypes[related]; !ok {
+			continue
+		}
+		delete(attrs, name)
+
+		rel, err := enc.relationship(v.Field(i), many)
+		if err != nil {
+			return nil, err
+		}
+		if obj.Relationships == nil {
+			obj.Relationships = map[string]jsonAPIRelationship{}
+		}
+		obj.Relationships[name] = rel
+	}
+	return obj, nil
+}
+
+// Link to the models in a field, a list of them if many, including each
+func (enc *jsonAPIEncoder) relationship(value reflect.Value, many bool) (jsonAPIRelationship, error) {
+	if !many {
+		id, err := enc.include(value)
+		if id == nil {
+			// A missing to-one relationship is null rather than absent
+			return jsonAPIRelationship{}, err
+		}
+		return jsonAPIRelationship{Data: id}, err
+	}
+	ids := make([]jsonAPIIdentifier, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		id, err := enc.include(value.Index(i))
+		if err != nil {
+			return jsonAPIRelationship{}, err
+		}
+		ids = append(ids, *id)
+	}
+	return jsonAPIRelationship{Data: ids}, nil
+}
+
+// Add a related model to the included resources, once, returning its identifier
+func (enc *jsonAPIEncoder) include(v reflect.Value) (*jsonAPIIdentifier, error) {
+	obj, err := enc.object(v)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	id := jsonAPIIdentifier{Type: obj.Type, ID: obj.ID}
+	if !enc.seen[id] {
+		enc.seen[id] = true
+		enc.included = append(enc.included, *obj)
+	}
+	return &id, nil
+}
+
+// JSON:API IDs are strings, so numeric IDs are quoted
+func jsonAPIID(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// Render a problem as a JSON:API error document
+func writeJSONAPIError(c echo.Context, p *Problem) error {
+	type errorObject struct {
+		Status string         `json:"status"`
+		Title  string         `json:"title"`
+		Detail string         `json:"detail,omitempty"`
+		Source map[string]any `json:"source,omitempty"`
+		Meta   map[string]any `json:"meta,omitempty"`
+	}
+	status := strconv.Itoa(p.Status)
+	meta := map[string]any{"request_id": p.RequestID}
+	errs := []errorObject{{Status: status, Title: p.Title, Detail: p.Detail, Meta: meta}}
+	// One error per invalid field, pointing at its attribute
+	if len(p.Errors) > 0 {
+		errs = errs[:0]
+		for _, field := range slices.Sorted(maps.Keys(p.Errors)) {
+			errs = append(errs, errorObject{
+				Status: status,
+				Title:  p.Title,
+				Detail: field + " " + p.Errors[field],
+				Source: map[string]any{"pointer": "/data/attributes/" + field},
+				Meta:   meta,
+			})
+		}
+	}
+	c.Response().Header().Set(echo.HeaderContentType, jsonAPIContentType)
+	c.Response().WriteHeader(p.Status)
+	return json.NewEncoder(c.Response()).Encode(map[string]any{"errors": errs})
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kafka protocol requests used by the publisher, and the versions spoken
+const (
+	kafkaProduce         int16 = 0
+	kafkaProduceVersion  int16 = 3
+	kafkaMetadata        int16 = 3
+	kafkaMetadataVersion int16 = 1
+
+	// Largest response read from a broker
+	kafkaMaxResponse = 64 << 20
+	// Wait after a failed publish before the cluster is tried again
+	kafkaRetryBackoff = 5 * time.Second
+)
+
+// Record batches are checksummed with CRC-32C
+var kafkaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by a Kafka broker
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return name
+	}
+	return "error code " + strconv.Itoa(int(e))
+}
+
+// KafkaPublisher produces messages to one topic over the Kafka protocol,
+// partitioned by key so each user's events stay in order, as kafka-go's hash
+// balancer does. Publish returns once every in-sync replica has the messages.
+// After a failure the connections and metadata are dropped, and the cluster
+// is left alone for a while so writes are not held up by it.
+type KafkaPublisher struct {
+	brokers []string
+	topic   string
+	timeout time.Duration
+
+	mu sync.Mutex
+	// Connection to each broker by node ID, opened on first use
+	conns map[int32]net.Conn
+	// Broker addresses by node ID and the leader of each partition, or -1,
+	// from the last metadata; nil until fetched
+	addrs         map[int32]string
+	leaders       []int32
+	correlationID int32
+	downUntil     time.Time
+}
+
+func NewKafkaPublisher(brokers []string, topic string, timeout time.Duration) *KafkaPublisher {
+	return &KafkaPublisher{brokers: brokers, topic: topic, timeout: timeout, conns: map[int32]net.Conn{}}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, messages []BrokerMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if wait := time.Until(p.downUntil); wait > 0 {
+		return fmt.Errorf("cluster unavailable, retrying in %s", wait.Round(time.Second))
+	}
+	err := p.produce(ctx, messages)
+	if err != nil {
+		p.closeConns()
+		p.leaders = nil
+		p.downUntil = time.Now().Add(kafkaRetryBackoff)
+	}
+	return err
+}
+
+func (p *KafkaPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConns()
+	return nil
+}
+
+func (p *KafkaPublisher) closeConns() {
+	for node, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, node)
+	}
+}
+
+// Send the messages to their partitions' leaders, one request per leader
+func (p *KafkaPublisher) produce(ctx context.Context, messages []BrokerMessage) error {
+	if p.leaders == nil {
+		if err := p.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	byPartition := map[int32][]BrokerMessage{}
+	for _, m := range messages {
+		h := fnv.New32a()
+		h.Write([]byte(m.Key))
+		partition := int32(h.Sum32() % uint32(len(p.leaders)))
+		byPartition[partition] = append(byPartition[partition], m)
+	}
+	byLeader := map[int32][]int32{}
+	for partition := range byPartition {
+		leader := p.leaders[partition]
+		if leader < 0 {
+			return fmt.Errorf("partition %d: %w", partition, kafkaError(5))
+		}
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+
+	now := time.Now()
+	for leader, partitions := range byLeader {
+		conn, err := p.conn(ctx, leader)
+		if err != nil {
+			return err
+		}
+		var w kafkaWriter
+		w.int16(-1) // no transactional ID
+		w.int16(-1) // acks from all in-sync replicas
+		w.int32(int32(p.remaining(ctx) / time.Millisecond))
+		w.int32(1)
+		w.string(p.topic)
+		w.int32(int32(len(partitions)))
+		for _, partition := range partitions {
+			w.int32(partition)
+			w.bytes(kafkaRecordBatch(byPartition[partition], now))
+		}
+		r, err := p.roundTrip(ctx, conn, kafkaProduce, kafkaProduceVersion, w.buf)
+		if err != nil {
+			return err
+		}
+		for n := r.arrayLen(); n > 0; n-- {
+			r.string()
+			for m := r.arrayLen(); m > 0; m-- {
+				partition, code := r.int32(), kafkaError(r.int16())
+				r.int64() // base offset
+				r.int64() // log append time
+				if code != 0 && err == nil {
+					err = fmt.Errorf("partition %d: %w", partition, code)
+				}
+			}
+		}
+		r.int32() // throttle time
+		if r.err != nil {
+			return r.err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Learn the brokers and the topic's partition leaders from the first
+// bootstrap broker that answers
+func (p *KafkaPublisher) refreshMetadata(ctx context.Context) error {
+	var errs []error
+	for _, addr := range p.brokers {
+		err := p.metadataFrom(ctx, addr)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (p *KafkaPublisher) metadataFrom(ctx context.Context, addr string) error {
+	conn, err := p.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var w kafkaWriter
+	w.int32(1)
+	w.string(p.topic)
+	r, err := p.roundTrip(ctx, conn, kafkaMetadata, kafkaMetadataVersion, w.buf)
+	if err != nil {
+		return err
+	}
+
+	addrs := map[int32]string{}
+	for n := r.arrayLen(); n > 0; n-- {
+		node, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		addrs[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller
+	var leaders []int32
+	var topicErr error
+	for n := r.arrayLen(); n > 0; n-- {
+		code, name := kafkaError(r.int16()), r.string()
+		r.int8() // internal
+		for m := r.arrayLen(); m > 0; m-- {
+			partitionCode, partition, leader := r.int16(), r.int32(), r.int32()
+			r.int32s() // replicas
+			r.int32s() // in-sync replicas
+			if name != p.topic || partition < 0 {
+				continue
+			}
+			for int(partition) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			if partitionCode == 0 {
+				leaders[partition] = leader
+			}
+		}
+		if name == p.topic && code != 0 {
+			topicErr = code
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if topicErr != nil {
+		return fmt.Errorf("topic %s: %w", p.topic, topicErr)
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", p.topic)
+	}
+	p.addrs, p.leaders = addrs, leaders
+	return nil
+}
+
+// The open connection to a broker, dialling it if needed
+func (p *KafkaPublisher) conn(ctx context.Context, node int32) (net.Conn, error) {
+	if conn, ok := p.conns[node]; ok {
+		return conn, nil
+	}
+	addr, ok := p.addrs[node]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", node)
+	}
+	conn, err := p.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[node] = conn
+	return conn, nil
+}
+
+func (p *KafkaPublisher) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Time left to wait on the cluster: until the context's deadline, or the timeout
+func (p *KafkaPublisher) remaining(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return p.timeout
+}
+
+// Send one request on the connection and read its response, past the header
+func (p *KafkaPublisher) roundTrip(ctx context.Context, conn net.Conn, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	p.correlationID++
+	id := p.correlationID
+	var w kafkaWriter
+	w.int32(0) // size, set below
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(id)
+	w.string(brokerClientName)
+	w.buf = append(w.buf, body...)
+	binary.BigEndian.PutUint32(w.buf, uint32(len(w.buf)-4))
+
+	conn.SetDeadline(time.Now().Add(p.remaining(ctx)))
+	if _, err := conn.Write(w.buf); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{buf: resp}
+	if r.int32() != id {
+		return nil, errors.New("response to another request")
+	}
+	return r, nil
+}
+
+// Encode the messages as a v2 record batch. Each record carries its event
+// type and the payload's schema version as headers.
+func kafkaRecordBatch(messages []BrokerMessage, now time.Time) []byte {
+	schemaVersion := strconv.Itoa(brokerSchemaVersion)
+	var records []byte
+	for i, m := range messages {
+		rec := []byte{0}                         // attributes
+		rec = binary.AppendVarint(rec, 0)        // timestamp delta
+		rec = binary.AppendVarint(rec, int64(i)) // offset delta
+		rec = appendKafkaVarBytes(rec, m.Key)
+		rec = appendKafkaVarBytes(rec, string(m.Value))
+		headers := [][2]string{
+			{"event", m.Event},
+			{"schema_version", schemaVersion},
+			{"content-type", "application/json"},
+		}
+		rec = binary.AppendVarint(rec, int64(len(headers)))
+		for _, h := range headers {
+			rec = appendKafkaVarBytes(rec, h[0])
+			rec = appendKafkaVarBytes(rec, h[1])
+		}
+		records = binary.AppendVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	// The part of the batch after the checksum, which it covers
+	var body kafkaWriter
+	body.int16(0) // attributes: uncompressed, create time
+	body.int32(int32(len(messages) - 1))
+	body.int64(now.UnixMilli())
+	body.int64(now.UnixMilli())
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(messages)))
+	body.buf = append(body.buf, records...)
+
+	var batch kafkaWriter
+	batch.int64(0) // base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.buf, kafkaCRC)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+func appendKafkaVarBytes(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// kafkaWriter encodes the big-endian fields of a Kafka request
+type kafkaWriter struct {
+	buf []byte
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.buf = append(w.buf, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// kafkaReader decodes a Kafka response, remembering the first error so
+// fields can be read without checking each one
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errors.New("truncated response")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Read a string, or a null one as empty
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// Read an array's length, or a null array's as 0
+func (r *kafkaReader) arrayLen() int32 {
+	n := r.int32()
+	if n < 0 || r.err != nil {
+		return 0
+	}
+	return n
+}
+
+// Skip an array of int32s
+func (r *kafkaReader) int32s() {
+	r.next(4 * int(r.arrayLen()))
+}
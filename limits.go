@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Routes taking uploads or batches, allowed UPLOAD_BODY_LIMIT and LONG_REQUEST_TIMEOUT
+var uploadRoutes = map[string]bool{
+	"POST /users/import":    true,
+	"POST /users/bulk":      true,
+	"PUT /users/:id/avatar": true,
+}
+
+// Routes allowed LONG_REQUEST_TIMEOUT for large result sets
+var longRoutes = map[string]bool{
+	"GET /users/export": true,
+	"DELETE /users":     true,
+}
+
+// Routes streaming responses for as long as the client listens, without a deadline
+var streamingRoutes = map[string]bool{
+	"GET /users/events": true,
+	"GET /ws":           true,
+}
+
+func routeKey(c echo.Context) string {
+	return c.Request().Method + " " + unversionedPath(c)
+}
+
+// Middleware rejecting request bodies over BODY_LIMIT, or UPLOAD_BODY_LIMIT on upload routes
+func bodyLimitMiddleware() echo.MiddlewareFunc {
+	standard := middleware.BodyLimit(cfg.HTTP.BodyLimit)
+	upload := middleware.BodyLimit(cfg.HTTP.UploadBodyLimit)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		standard, upload := standard(next), upload(next)
+		return func(c echo.Context) error {
+			if uploadRoutes[routeKey(c)] {
+				return upload(c)
+			}
+			return standard(c)
+		}
+	}
+}
+
+// Middleware giving each request a deadline of REQUEST_TIMEOUT, or
+// LONG_REQUEST_TIMEOUT on upload and export routes. GORM queries run under the
+// request context, so they are cancelled at the deadline, as they are when
+// the client disconnects.
+func timeoutMiddleware() echo.MiddlewareFunc {
+	standard := contextTimeout(cfg.HTTP.RequestTimeout)
+	long := contextTimeout(cfg.HTTP.LongRequestTimeout)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		standard, long := standard(next), long(next)
+		return func(c echo.Context) error {
+			key := routeKey(c)
+			switch {
+			case streamingRoutes[key]:
+				return next(c)
+			case uploadRoutes[key] || longRoutes[key]:
+				return long(c)
+			}
+			return standard(c)
+		}
+	}
+}
+
+// Report requests whose handler failed after the deadline as timed out,
+// whatever error the cancelled query surfaced as
+func contextTimeout(timeout time.Duration) echo.MiddlewareFunc {
+	return middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+		Timeout: timeout,
+		ErrorHandler: func(err error, c echo.Context) error {
+			if !errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+				return err
+			}
+			requestLogger(c).Warn("Request timed out", "route", c.Path(), "timeout", timeout.String(), "error", err)
+			return newProblem(http.StatusServiceUnavailable, "Request timed out")
+		},
+	})
+}
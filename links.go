@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Links are hypermedia links keyed by relation, e.g. self, next or history
+type Links map[string]string
+
+// Resource is the envelope for single-resource responses
+type Resource struct {
+	Data  interface{} `json:"data"`
+	Links Links       `json:"links"`
+}
+
+// The path prefix a request came in under, e.g. /api/v1, so links stay on the
+// API version the client is using
+func apiBase(c echo.Context) string {
+	return strings.TrimSuffix(c.Path(), unversionedPath(c))
+}
+
+// Link to the current request with some query parameters set and others dropped
+func linkWithQuery(c echo.Context, set map[string]string, drop ...string) string {
+	u := *c.Request().URL
+	q := u.Query()
+	for name, value := range set {
+		q.Set(name, value)
+	}
+	for _, name := range drop {
+		q.Del(name)
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// The ID the API exposes a user under: its UUID when ID_TYPE=uuid, so links
+// do not reveal the sequential one
+func publicUserID(user *User) string {
+	if userIDType == idTypeUUID {
+		return user.UUID
+	}
+	return strconv.FormatUint(uint64(user.ID), 10)
+}
+
+// Path of a user under the request's API prefix
+func userPath(c echo.Context, user *User) string {
+	return apiBase(c) + "/users/" + publicUserID(user)
+}
+
+// Path of the user with the given ID, looking up its UUID when ID_TYPE=uuid
+func userPathByID(c echo.Context, id uint) string {
+	user := &User{ID: id}
+	if userIDType != idTypeUUID {
+		return userPath(c, user)
+	}
+	uuid, err := userUUID(id)
+	if err != nil {
+		contextLogger(c.Request().Context()).Error("failed to look up user UUID", "user_id", id, "error", err)
+	} else if uuid != nil {
+		user.UUID = *uuid
+	}
+	return userPath(c, user)
+}
+
+// Wrap a user with links to itself, its history and reports, its manager and
+// avatar if it has them, and the user collection
+func newUserResource(c echo.Context, user *User) Resource {
+	self := userPath(c, user)
+	links := Links{
+		"self":       self,
+		"history":    self + "/history",
+		"reports":    self + "/reports",
+		"collection": apiBase(c) + "/users",
+	}
+	switch {
+	case user.Manager != nil:
+		links["manager"] = userPath(c, user.Manager)
+	case user.ManagerID != nil:
+		links["manager"] = userPathByID(c, *user.ManagerID)
+	}
+	if user.Avatar != "" {
+		links["avatar"] = self + "/avatar"
+	}
+	return Resource{Data: user, Links: links}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Users copied into user_listings per statement when rebuilding it
+const listingBatchSize = 500
+
+// UserListing is a user as user lists show it, with its roles inline, kept in
+// user_listings so lists need not join the roles. The user event handler
+// refreshes it after each change and the rebuild-user-listings task catches
+// up on changes that publish no event, such as role assignments.
+type UserListing struct {
+	ID           uint `gorm:"primaryKey;autoIncrement:false"`
+	TenantID     uint `gorm:"not null;index"`
+	UUID         string
+	Name         string
+	Email        *string
+	ExternalID   *string
+	IsVerified   bool
+	Status       string
+	StatusReason string
+	Birthday     Date
+	AvatarStatus string
+	Roles        listingRoles
+	ManagerID    *uint
+	Metadata     Metadata
+	AnonymizedAt *time.Time
+	LastLoginAt  *time.Time
+	DeletedAt    gorm.DeletedAt
+	Version      uint
+	// Copied from the user, never set on saving the listing
+	CreatedAt time.Time `gorm:"autoCreateTime:false"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime:false"`
+}
+
+// listingRoles stores a user's roles as a JSON array
+type listingRoles []Role
+
+func (listingRoles) GormDataType() string {
+	return "text"
+}
+
+func (r listingRoles) Value() (driver.Value, error) {
+	b, err := json.Marshal([]Role(r))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *listingRoles) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, (*[]Role)(r))
+	case string:
+		return json.Unmarshal([]byte(v), (*[]Role)(r))
+	}
+	return fmt.Errorf("cannot scan %T into roles", value)
+}
+
+func newUserListing(u User) UserListing {
+	return UserListing{
+		ID:           u.ID,
+		TenantID:     u.TenantID,
+		UUID:         u.UUID,
+		Name:         u.Name,
+		Email:        u.Email,
+		ExternalID:   u.ExternalID,
+		IsVerified:   u.IsVerified,
+		Status:       u.Status,
+		StatusReason: u.StatusReason,
+		Birthday:     u.Birthday,
+		AvatarStatus: u.AvatarStatus,
+		Roles:        listingRoles(u.Roles),
+		ManagerID:    u.ManagerID,
+		Metadata:     u.Metadata,
+		AnonymizedAt: u.AnonymizedAt,
+		LastLoginAt:  u.LastLoginAt,
+		DeletedAt:    u.DeletedAt,
+		Version:      u.Version,
+		CreatedAt:    u.CreatedAt,
+		UpdatedAt:    u.UpdatedAt,
+	}
+}
+
+func (l UserListing) user() User {
+	return User{
+		ID:           l.ID,
+		TenantID:     l.TenantID,
+		UUID:         l.UUID,
+		Name:         l.Name,
+		Email:        l.Email,
+		ExternalID:   l.ExternalID,
+		IsVerified:   l.IsVerified,
+		Status:       l.Status,
+		StatusReason: l.StatusReason,
+		Birthday:     l.Birthday,
+		AvatarStatus: l.AvatarStatus,
+		Roles:        []Role(l.Roles),
+		ManagerID:    l.ManagerID,
+		Metadata:     l.Metadata,
+		AnonymizedAt: l.AnonymizedAt,
+		LastLoginAt:  l.LastLoginAt,
+		DeletedAt:    l.DeletedAt,
+		Version:      l.Version,
+		CreatedAt:    l.CreatedAt,
+		UpdatedAt:    l.UpdatedAt,
+	}
+}
+
+func listedUsers(listings []UserListing) []User {
+	users := make([]User, len(listings))
+	for i, l := range listings {
+		users[i] = l.user()
+	}
+	return users
+}
+
+// Keep user_listings up to date when USERS_READ_MODEL is set. Registered
+// ahead of the response cache, so a list cached after the cache is cleared
+// already reads the new listings.
+func initReadModel() {
+	if cfg.ReadModel.Enabled {
+		userEvents.Handle(refreshUserListings)
+	}
+}
+
+// Copy the users of one commit into user_listings. A failure leaves the
+// events for the outbox to publish again.
+func refreshUserListings(ctx context.Context, events []UserEvent) error {
+	var ids []uint
+	for _, e := range events {
+		if !slices.Contains(ids, e.Data.ID) {
+			ids = append(ids, e.Data.ID)
+		}
+	}
+	q := db.WithContext(ctx)
+	var users []User
+	if err := q.Unscoped().Preload("Roles").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return err
+	}
+	return q.Transaction(func(tx *gorm.DB) error {
+		if err := saveUserListings(tx, users); err != nil {
+			return err
+		}
+		// The rest were purged
+		for _, u := range users {
+			ids = slices.DeleteFunc(ids, func(id uint) bool { return id == u.ID })
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&UserListing{}).Error
+	})
+}
+
+// Insert or overwrite the listings of the users
+func saveUserListings(tx *gorm.DB, users []User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	listings := make([]UserListing, len(users))
+	for i, u := range users {
+		listings[i] = newUserListing(u)
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		UpdateAll: true,
+	}).Create(&listings).Error
+}
+
+// Copy every user into user_listings and drop the listings of purged users
+func rebuildUserListings(ctx context.Context) error {
+	q := db.WithContext(ctx)
+	var users []User
+	err := q.Unscoped().Preload("Roles").FindInBatches(&users, listingBatchSize, func(tx *gorm.DB, batch int) error {
+		return saveUserListings(q, users)
+	}).Error
+	if err != nil {
+		return err
+	}
+	return q.Unscoped().
+		Where("id NOT IN (?)", q.Unscoped().Model(&User{}).Select("id")).
+		Delete(&UserListing{}).Error
+}
+
+// ListingUserRepository reads user lists and counts from user_listings,
+// leaving single-user reads, exports and every write to the users table
+type ListingUserRepository struct {
+	UserRepository
+	db *gorm.DB
+}
+
+func NewListingUserRepository(db *gorm.DB, users UserRepository) *ListingUserRepository {
+	return &ListingUserRepository{UserRepository: users, db: db}
+}
+
+func (r *ListingUserRepository) listings(ctx context.Context, uq UserQuery) *gorm.DB {
+	q := r.db.WithContext(ctx).Model(&UserListing{})
+	if uq.IncludeDeleted {
+		q = q.Unscoped()
+	}
+	return applyConditions(q, uq.Conditions)
+}
+
+func (r *ListingUserRepository) Find(ctx context.Context, uq UserQuery) ([]User, int64, error) {
+	q := r.listings(ctx, uq)
+
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var listings []UserListing
+	err := selectListingFields(applySort(q, uq.Sort), uq).Offset(uq.Offset).Limit(uq.Limit).Find(&listings).Error
+	return listedUsers(listings), total, err
+}
+
+func (r *ListingUserRepository) Count(ctx context.Context, uq UserQuery) (int64, error) {
+	var total int64
+	err := r.listings(ctx, uq).Count(&total).Error
+	return total, err
+}
+
+func (r *ListingUserRepository) FindAfter(ctx context.Context, uq UserQuery, after *Cursor) ([]User, error) {
+	q := r.listings(ctx, uq)
+	if after != nil {
+		q = applyKeyset(q, after)
+	}
+
+	var listings []UserListing
+	err := selectListingFields(applySort(q, uq.Sort), uq).Limit(uq.Limit).Find(&listings).Error
+	return listedUsers(listings), err
+}
+
+// Load only the fieldset's columns, as selectUserFields does, with the roles
+// read from their column rather than preloaded
+func selectListingFields(q *gorm.DB, uq UserQuery) *gorm.DB {
+	if uq.Fields == nil {
+		return q
+	}
+	columns := userFieldColumns(uq)
+	if slices.Contains(uq.Fields.Preloads, "Roles") {
+		columns = append(columns, "roles")
+	}
+	return q.Select(columns)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginThrottle counts recent failed logins for an account ("user:<id>") or
+// client address ("ip:<addr>"), locking it out after LOGIN_MAX_FAILURES, or
+// LOGIN_MAX_ADDRESS_FAILURES for addresses
+type LoginThrottle struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID uint   `gorm:"not null;default:1;uniqueIndex:idx_login_throttles_subject,priority:1"`
+	Subject  string `gorm:"size:100;not null;uniqueIndex:idx_login_throttles_subject,priority:2"`
+	// Failures since the last lockout, within LOGIN_FAILURE_WINDOW of each other
+	Failures int `gorm:"not null;default:0"`
+	// Lockouts so far; each one lasts twice as long as the one before
+	Lockouts      int `gorm:"not null;default:0"`
+	LockedUntil   *time.Time
+	LastFailureAt time.Time
+}
+
+func accountThrottle(id uint) string {
+	return "user:" + strconv.FormatUint(uint64(id), 10)
+}
+
+func addressThrottle(ip string) string {
+	return "ip:" + ip
+}
+
+// Failed logins locking out a subject, 0 if it is never locked out
+func maxLoginFailures(subject string) int {
+	if strings.HasPrefix(subject, "ip:") {
+		return cfg.Auth.LoginMaxAddressFailures
+	}
+	return cfg.Auth.LoginMaxFailures
+}
+
+// How much longer a subject is locked out, zero if it is not
+func lockedFor(ctx context.Context, subject string) (time.Duration, error) {
+	if maxLoginFailures(subject) == 0 {
+		return 0, nil
+	}
+	var throttle LoginThrottle
+	err := db.WithContext(ctx).Where("subject = ?", subject).Take(&throttle).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil || throttle.LockedUntil == nil {
+		return 0, err
+	}
+	return max(time.Until(*throttle.LockedUntil), 0), nil
+}
+
+// Count a failed login against each subject, locking out those reaching
+// their maximum failures for LOGIN_LOCKOUT, doubled on each further lockout up
+// to LOGIN_LOCKOUT_MAX. Counts start over after a quiet LOGIN_LOCKOUT_MAX.
+func recordLoginFailure(ctx context.Context, subjects ...string) {
+	now := time.Now()
+	for _, subject := range subjects {
+		if maxLoginFailures(subject) == 0 {
+			continue
+		}
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// Create the row if need be and lock it, so concurrent failures
+			// are each counted rather than overwriting one another
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "subject"}},
+				DoNothing: true,
+			}).Create(&LoginThrottle{Subject: subject}).Error
+			if err != nil {
+				return err
+			}
+			var throttle LoginThrottle
+			if err := forUpdate(tx).Where("subject = ?", subject).Take(&throttle).Error; err != nil {
+				return err
+			}
+			quiet := now.Sub(throttle.LastFailureAt)
+			if quiet > cfg.Auth.LockoutMax {
+				throttle.Lockouts = 0
+			}
+			if quiet > cfg.Auth.LoginFailureWindow {
+				throttle.Failures = 0
+			}
+			throttle.Failures++
+			throttle.LastFailureAt = now
+			if throttle.Failures >= maxLoginFailures(subject) {
+				lockout := min(float64(cfg.Auth.Lockout)*math.Pow(2, float64(throttle.Lockouts)), float64(cfg.Auth.LockoutMax))
+				lockedUntil := now.Add(time.Duration(lockout))
+				throttle.LockedUntil = &lockedUntil
+				throttle.Lockouts++
+				throttle.Failures = 0
+				contextLogger(ctx).Warn("Locked out after failed logins", "subject", subject, "until", lockedUntil)
+			}
+			return tx.Save(&throttle).Error
+		})
+		if err != nil {
+			contextLogger(ctx).Error("failed to record login failure", "subject", subject, "error", err)
+		}
+	}
+}
+
+// Forget an account's failed logins after it logs in
+func clearLoginFailures(ctx context.Context, subject string) {
+	if cfg.Auth.LoginMaxFailures == 0 {
+		return
+	}
+	if err := db.WithContext(ctx).Where("subject = ?", subject).Delete(&LoginThrottle{}).Error; err != nil {
+		contextLogger(ctx).Error("failed to clear login failures", "subject", subject, "error", err)
+	}
+}
+
+// Problem for a locked out login, saying when to try again
+func lockedOut(c echo.Context, status int, detail string, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return newProblem(status, detail)
+}
+
+// Lift a user's lockout and forget their failed logins
+func unlockUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	if err := dbCtx(c).Where("subject = ?", accountThrottle(id)).Delete(&LoginThrottle{}).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to unlock user")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const slowQueryThreshold = 200 * time.Millisecond
+
+type requestIDKey struct{}
+
+// The log file when LOG_FILE is set, rotated by the rotate-logs task
+var logFile *rotatingFile
+
+// rotatingFile is a log file that can be renamed aside and reopened while in
+// use, keeping a limited number of old files
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	maxBackups int
+}
+
+func openRotatingFile(path string, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Move the current file aside with a timestamp suffix and start a new one,
+// deleting the oldest files beyond LOG_MAX_BACKUPS
+func (f *rotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().Format("20060102-150405"))
+	// Keep logging even if the rename failed
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	// Timestamp suffixes sort oldest first
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Route all logging, including the standard log package, through a JSON slog
+// handler writing to stdout, or to LOG_FILE when set. LOG_LEVEL may be debug,
+// info, warn or error.
+func initLogging() {
+	var level slog.Level
+	switch strings.ToLower(cfg.LogLevel) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+	var out io.Writer = os.Stdout
+	if cfg.LogFile != "" {
+		var err error
+		if logFile, err = openRotatingFile(cfg.LogFile, cfg.LogMaxBackups); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open LOG_FILE: %v\n", err)
+			os.Exit(1)
+		}
+		out = logFile
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})))
+}
+
+// Logger tagged with the current request's ID
+func requestLogger(c echo.Context) *slog.Logger {
+	return slog.Default().With("request_id", requestID(c))
+}
+
+// The X-Request-ID assigned by the RequestID middleware
+func requestID(c echo.Context) string {
+	return c.Response().Header().Get(echo.HeaderXRequestID)
+}
+
+// Middleware assigning an X-Request-ID and carrying it in the request context
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			ctx := context.WithValue(c.Request().Context(), requestIDKey{}, id)
+			c.SetRequest(c.Request().WithContext(ctx))
+		},
+	})
+}
+
+// Middleware writing one structured log line per request
+func requestLoggingMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		HandleError:  true,
+		LogLatency:   true,
+		LogRemoteIP:  true,
+		LogMethod:    true,
+		LogURI:       true,
+		LogRoutePath: true,
+		LogRequestID: true,
+		LogUserAgent: true,
+		LogStatus:    true,
+		LogError:     true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			level := slog.LevelInfo
+			switch {
+			case v.Status >= 500:
+				level = slog.LevelError
+			case v.Status >= 400:
+				level = slog.LevelWarn
+			}
+
+			attrs := []slog.Attr{
+				slog.String("request_id", v.RequestID),
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.String("route", v.RoutePath),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("remote_ip", v.RemoteIP),
+				slog.String("user_agent", v.UserAgent),
+			}
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("error", v.Error.Error()))
+			}
+			slog.LogAttrs(context.Background(), level, "request", attrs...)
+			return nil
+		},
+	})
+}
+
+// slogGormLogger sends GORM's logs through slog, tagged with the request ID
+type slogGormLogger struct {
+	level gormlogger.LogLevel
+}
+
+func newGormLogger() gormlogger.Interface {
+	return &slogGormLogger{level: gormlogger.Warn}
+}
+
+func (l *slogGormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	return &slogGormLogger{level: level}
+}
+
+func (l *slogGormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		contextLogger(ctx).Info(msg, "args", args)
+	}
+}
+
+func (l *slogGormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		contextLogger(ctx).Warn(msg, "args", args)
+	}
+}
+
+func (l *slogGormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		contextLogger(ctx).Error(msg, "args", args)
+	}
+}
+
+func (l *slogGormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		contextLogger(ctx).Error("query failed", "error", err, "sql", sql, "rows", rows, "elapsed", elapsed)
+	case elapsed > slowQueryThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		contextLogger(ctx).Warn("slow query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	case l.level >= gormlogger.Info:
+		sql, rows := fc()
+		contextLogger(ctx).Debug("query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
+
+// Logger tagged with the request ID carried by ctx, if any
+func contextLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
@@ -1,25 +1,96 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/go-playground/validator/v10"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
 )
 
 var db *gorm.DB
 
 type User struct {
-	ID       uint   `json:"id" gorm:"primaryKey"`
-	Name     string `json:"name"`
-	Birthday string `json:"birthday"`
+	ID           uint           `json:"id" gorm:"primaryKey"`
+	TenantID     uint           `json:"-" gorm:"not null;default:1;uniqueIndex:idx_users_tenant_email,priority:1;uniqueIndex:idx_users_tenant_external_id,priority:1"`
+	UUID         string         `json:"uuid" gorm:"size:36;uniqueIndex:idx_users_uuid"`
+	Name         string         `json:"name"`
+	Email        *string        `json:"email" gorm:"size:255;uniqueIndex:idx_users_tenant_email,priority:2"`
+	ExternalID   *string        `json:"external_id,omitempty" gorm:"size:100;uniqueIndex:idx_users_tenant_external_id,priority:2"`
+	IsVerified   bool           `json:"is_verified" gorm:"not null;default:false"`
+	Status       string         `json:"status" gorm:"size:20;not null;default:active;index"`
+	StatusReason string         `json:"status_reason,omitempty" gorm:"size:255"`
+	Birthday     Date           `json:"birthday" gorm:"type:date"`
+	PasswordHash string         `json:"-"`
+	Avatar       string         `json:"-" gorm:"size:255"`
+	AvatarStatus string         `json:"avatar_status,omitempty" gorm:"size:20"`
+	Roles        []Role         `json:"roles,omitempty" gorm:"many2many:user_roles;"`
+	Addresses    []Address      `json:"addresses,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	Groups       []Group        `json:"groups,omitempty" gorm:"many2many:group_members"`
+	ManagerID    *uint          `json:"manager_id" gorm:"index"`
+	Manager      *User          `json:"manager,omitempty"`
+	Metadata     Metadata       `json:"metadata"`
+	AnonymizedAt *time.Time     `json:"anonymized_at,omitempty"`
+	LastLoginAt  *time.Time     `json:"last_login_at"`
+	Consents     ConsentSummary `json:"consents,omitempty" gorm:"-"`
+	DeletedAt    gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
+	Version      uint           `json:"version" gorm:"not null;default:1"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+}
+
+type createUserRequest struct {
+	Name     string   `json:"name" validate:"required,max=100"`
+	Email    string   `json:"email" validate:"omitempty,email,max=255"`
+	Birthday Date     `json:"birthday" validate:"required,notfuture"`
+	Password string   `json:"password" validate:"omitempty,min=8,max=72"`
+	Metadata Metadata `json:"metadata" validate:"max=50"`
+}
+
+// upsertUserRequest is a createUserRequest keyed on its email, which is required
+type upsertUserRequest struct {
+	Name     string   `json:"name" validate:"required,max=100"`
+	Email    string   `json:"email" validate:"required,email,max=255"`
+	Birthday Date     `json:"birthday" validate:"required,notfuture"`
+	Password string   `json:"password" validate:"omitempty,min=8,max=72"`
+	Metadata Metadata `json:"metadata" validate:"max=50"`
+}
+
+type updateUserRequest struct {
+	Name     string   `json:"name" validate:"omitempty,max=100"`
+	Email    string   `json:"email" validate:"omitempty,email,max=255"`
+	Birthday Date     `json:"birthday" validate:"omitempty,notfuture"`
+	Password string   `json:"password" validate:"omitempty,min=8,max=72"`
+	Metadata Metadata `json:"metadata" validate:"max=50"`
+}
+
+// patchUserDocument is the representation of a user that patches apply to
+type patchUserDocument struct {
+	Name     string   `json:"name" validate:"required,max=100"`
+	Email    string   `json:"email,omitempty" validate:"omitempty,email,max=255"`
+	Birthday Date     `json:"birthday" validate:"omitempty,notfuture"`
+	Password string   `json:"password,omitempty" validate:"omitempty,min=8,max=72"`
+	Metadata Metadata `json:"metadata" validate:"max=50"`
 }
 
 // Load environment variables
@@ -29,137 +100,893 @@ func loadEnv() {
 	}
 }
 
-// Initialize database connection
-func initDB() {
-	var err error
-	dbType := os.Getenv("DB_TYPE")
+var errUnsupportedDB = errors.New("Unsupported database type. Set DB_TYPE to 'postgres', 'mysql', 'sqlserver' or 'sqlite'")
 
+// Build the GORM dialector for a database of the given type
+func openDialector(dbType, dsn string) (gorm.Dialector, error) {
 	switch dbType {
 	case "postgres":
-		dsn := os.Getenv("DATABASE_URL")
-		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		return postgres.Open(dsn), nil
+	case "mysql":
+		dsn, err := mysqlDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return mysql.Open(dsn), nil
+	case "sqlserver":
+		return sqlserver.Open(dsn), nil
 	case "sqlite":
-		dsn := "users.db"
-		db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
-	default:
-		log.Fatal("Unsupported database type. Set DB_TYPE to 'postgres' or 'sqlite'")
+		return sqlite.Open(dsn), nil
+	}
+	return nil, errUnsupportedDB
+}
+
+// Initialize database connection
+func initDB() {
+	dsn := cfg.DB.URL
+	if cfg.DB.Type == "sqlite" {
+		dsn = "users.db"
+	}
+
+	dialector, err := openDialector(cfg.DB.Type, dsn)
+	if errors.Is(err, errUnsupportedDB) {
+		log.Fatal(err)
+	}
+	if err == nil {
+		db, err = openDB(dialector)
 	}
 
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-
-	db.AutoMigrate(&User{})
-	log.Println("Database connected and migrated successfully.")
+	configurePool()
+	if err := registerTenantCallbacks(db); err != nil {
+		log.Fatalf("Failed to register tenant callbacks: %v", err)
+	}
+	if err := registerEventCallbacks(db); err != nil {
+		log.Fatalf("Failed to register event callbacks: %v", err)
+	}
+	if err := registerOutboxCallbacks(db); err != nil {
+		log.Fatalf("Failed to register outbox callbacks: %v", err)
+	}
+	if err := registerAuditCallbacks(db); err != nil {
+		log.Fatalf("Failed to register audit callbacks: %v", err)
+	}
+	if err := registerVersionCallbacks(db); err != nil {
+		log.Fatalf("Failed to register version callbacks: %v", err)
+	}
+	log.Println("Database connected successfully.")
 }
 
-// Fetch all users
+// Fetch a page of users
 func getUsers(c echo.Context) error {
-	var users []User
-	if err := db.Find(&users).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch users"})
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	conds, err := userQuery.ParseFilters(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	fields, err := userQuery.ParseFields(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	if acceptsNDJSON(c) {
+		// Streams every match, so paging and sorting do not apply
+		return streamUsersNDJSON(c, UserQuery{
+			Conditions:     conds,
+			IncludeDeleted: c.QueryParam("include_deleted") == "true",
+			Fields:         fields,
+		})
+	}
+	if c.QueryParams().Has("after") {
+		return getUsersAfter(c, p, conds, fields)
+	}
+	if c.QueryParams().Has("_start") || c.QueryParams().Has("_end") {
+		return getUsersRange(c, conds, fields)
+	}
+	sort, err := userQuery.ParseSort(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	users, total, err := userService.List(c.Request().Context(), UserQuery{
+		Conditions:     conds,
+		Sort:           sort,
+		Offset:         p.Offset,
+		Limit:          p.Limit,
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+		Fields:         fields,
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
 	}
-	return c.JSON(http.StatusOK, users)
+	data := projectUsers(users, fields)
+	setLastModified(c, latestUpdate(users))
+	return respondWithETag(c, http.StatusOK, newPagedResponse(c, p, total, data))
+}
+
+// Count the users matching the list filters without loading them. The total
+// goes in X-Total-Count, and in the body for GET /users/count.
+func countUsers(c echo.Context) error {
+	conds, err := userQuery.ParseFilters(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	total, err := userService.Count(c.Request().Context(), UserQuery{
+		Conditions:     conds,
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to count users")
+	}
+	c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(http.StatusOK)
+	}
+	return respond(c, http.StatusOK, map[string]int64{"count": total})
+}
+
+// Trim users to the fields picked with ?fields=, if any
+func projectUsers(users []User, fields *Fieldset) interface{} {
+	if fields == nil {
+		return users
+	}
+	return Projection{Items: users, Fields: fields}
+}
+
+// Fetch the users in ?_start=&_end= as a bare array, for react-admin, with the
+// total and links to neighbouring ranges in headers
+func getUsersRange(c echo.Context, conds []Condition, fields *Fieldset) error {
+	if c.QueryParam("page") != "" || c.QueryParam("offset") != "" {
+		return newProblem(http.StatusBadRequest, "_start and _end cannot be combined with page or offset")
+	}
+	p, err := parseRange(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	sort, err := userQuery.ParseRangeSort(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	users, total, err := userService.List(c.Request().Context(), UserQuery{
+		Conditions:     conds,
+		Sort:           sort,
+		Offset:         p.Offset,
+		Limit:          p.Limit,
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+		Fields:         fields,
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	setRangeHeaders(c, p, total)
+	setLastModified(c, latestUpdate(users))
+	return respondWithETag(c, http.StatusOK, projectUsers(users, fields))
+}
+
+// Fetch the page of users after ?after=<cursor>; an empty cursor starts at the beginning
+func getUsersAfter(c echo.Context, p Pagination, conds []Condition, fields *Fieldset) error {
+	if c.QueryParam("page") != "" || c.QueryParam("offset") != "" {
+		return newProblem(http.StatusBadRequest, "after cannot be combined with page or offset")
+	}
+
+	var after *Cursor
+	sort := c.QueryParam("sort")
+	if token := c.QueryParam("after"); token != "" {
+		cur, err := decodeCursor(token)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+		if sort != "" && sort != cur.Sort {
+			return newProblem(http.StatusBadRequest, "Cursor was issued for a different sort")
+		}
+		after, sort = cur, cur.Sort
+	}
+	if sort == "" {
+		sort = "id"
+	}
+	keyset, ok := keysetSorts[sort]
+	if !ok {
+		return newProblem(http.StatusBadRequest, "Cursor pagination supports sort=id, -id, created_at or -created_at")
+	}
+
+	users, next, err := userService.ListAfter(c.Request().Context(), UserQuery{
+		Conditions:     conds,
+		Sort:           keyset,
+		Limit:          p.Limit,
+		IncludeDeleted: c.QueryParam("include_deleted") == "true",
+		Fields:         fields,
+	}, sort, after)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	data := projectUsers(users, fields)
+	setLastModified(c, latestUpdate(users))
+
+	meta := CursorMeta{Limit: p.Limit, HasMore: next != nil}
+	links := Links{
+		"self":  c.Request().URL.RequestURI(),
+		"first": linkWithQuery(c, map[string]string{"after": ""}),
+	}
+	if next != nil {
+		token := next.Encode()
+		meta.NextCursor = &token
+		links["next"] = linkWithQuery(c, map[string]string{"after": token})
+	}
+	return respondWithETag(c, http.StatusOK, CursorPage{Data: data, Meta: meta, Links: links})
+}
+
+// Search users by name or email, most relevant first
+func searchUsers(c echo.Context) error {
+	term := strings.TrimSpace(c.QueryParam("q"))
+	if term == "" {
+		return newProblem(http.StatusBadRequest, "Query parameter q is required")
+	}
+	if len(term) > maxSearchLength {
+		return newProblem(http.StatusBadRequest, "Query parameter q is too long")
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	users, total, err := userService.Search(c.Request().Context(), term, p.Offset, p.Limit)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to search users")
+	}
+	return respondWithETag(c, http.StatusOK, newPagedResponse(c, p, total, users))
 }
 
 // Fetch a  user
 func getUser(c echo.Context) error {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	expand, err := parseExpand(c)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		return newProblem(http.StatusBadRequest, err.Error())
 	}
-	var user User
-	if err := db.First(&user, id).Error; err != nil {
-		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	if len(expand) > 0 {
+		// The version does not cover associations, so expanded users get no ETag
+		user, err := userService.GetExpanded(c.Request().Context(), id, expand)
+		if err != nil {
+			return userError(err, "Failed to fetch user")
+		}
+		return respond(c, http.StatusOK, newUserResource(c, user))
 	}
-	return c.JSON(http.StatusOK, user)
+	user, err := userService.Get(c.Request().Context(), id)
+	if err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	setUserETag(c, user)
+	setLastModified(c, user.UpdatedAt)
+	if notModified(c, userETag(user)) || notModifiedSince(c, user.UpdatedAt) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
+
+// Fetch several users by ID in one query
+func batchGetUsers(c echo.Context) error {
+	req := new(struct {
+		IDs []UserRef `json:"ids"`
+	})
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if len(req.IDs) == 0 {
+		return newProblem(http.StatusBadRequest, "Expected a non-empty list of ids")
+	}
+	if len(req.IDs) > maxBatchGetSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d ids per request", maxBatchGetSize))
+	}
+
+	users, missing, err := userService.GetMany(c.Request().Context(), req.IDs)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch users")
+	}
+	return respond(c, http.StatusOK, map[string]interface{}{
+		"data":      users,
+		"not_found": missing,
+	})
 }
 
 // Create a new user
 func createUser(c echo.Context) error {
-	user := new(User)
-	if err := c.Bind(user); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	req := new(createUserRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+
+	user, err := userService.Create(c.Request().Context(), *req)
+	if err != nil {
+		return userError(err, "Failed to create user")
+	}
+	setUserETag(c, user)
+	c.Response().Header().Set(echo.HeaderLocation, userPath(c, user))
+	return respond(c, http.StatusCreated, newUserResource(c, user))
+}
+
+// Create the user with the request's email, or update the one already
+// holding it, for clients replaying records: 201 with a Location when
+// created, 200 when the user existed
+func upsertUser(c echo.Context) error {
+	req := new(upsertUserRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
 	}
-	if user.Name == "" || user.Birthday == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name and Birthday are required"})
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
 	}
 
-	if err := db.Create(user).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+	user, created, err := userService.Upsert(c.Request().Context(), createUserRequest(*req))
+	if err != nil {
+		return userError(err, "Failed to save user")
 	}
-	return c.JSON(http.StatusCreated, user)
+	setUserETag(c, user)
+	if !created {
+		return respond(c, http.StatusOK, newUserResource(c, user))
+	}
+	c.Response().Header().Set(echo.HeaderLocation, userPath(c, user))
+	return respond(c, http.StatusCreated, newUserResource(c, user))
+}
+
+// Create many users in one request, reporting the outcome of each
+func createUsersBulk(c echo.Context) error {
+	var reqs []createUserRequest
+	if err := c.Bind(&reqs); err != nil {
+		return bindError(err)
+	}
+	if len(reqs) == 0 {
+		return newProblem(http.StatusBadRequest, "Expected a non-empty array of users")
+	}
+	if len(reqs) > maxBulkSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d users per request", maxBulkSize))
+	}
+
+	results, err := userService.CreateMany(c.Request().Context(), reqs)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create users")
+	}
+
+	created := 0
+	for _, r := range results {
+		if r.Status == http.StatusCreated {
+			created++
+		}
+	}
+	return respond(c, http.StatusOK, map[string]interface{}{
+		"created": created,
+		"failed":  len(results) - created,
+		"results": results,
+	})
 }
 
 // Update an existing user
 func updateUser(c echo.Context) error {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	version, err := ifMatchVersion(c)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		return err
+	}
+	req := new(updateUserRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
 	}
 
-	var user User
-	if err := db.First(&user, id).Error; err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	user, err := userService.Update(c.Request().Context(), id, version, *req)
+	if err != nil {
+		return userError(err, "Failed to update user")
 	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
 
-	updatedUser := new(User)
-	if err := c.Bind(updatedUser); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+// Apply a JSON Merge Patch (RFC 7386) or JSON Patch (RFC 6902) to a user
+func patchUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
 	}
 
-	// Update user fields if provided
-	if updatedUser.Name != "" {
-		user.Name = updatedUser.Name
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		return err
 	}
-	if updatedUser.Birthday != "" {
-		user.Birthday = updatedUser.Birthday
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
 	}
 
-	if err := db.Save(&user).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update user"})
+	var apply func(doc []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case mergePatchContentType, echo.MIMEApplicationJSON:
+		apply = func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}
+	case jsonPatchContentType:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, "Invalid patch: "+err.Error())
+		}
+		apply = patch.Apply
+	default:
+		return newProblem(http.StatusUnsupportedMediaType, "Use "+mergePatchContentType+" or "+jsonPatchContentType)
 	}
 
-	return c.JSON(http.StatusOK, user)
+	user, err := userService.Patch(c.Request().Context(), id, version, apply)
+	if err != nil {
+		return userError(err, "Failed to update user")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
 }
 
 // Delete a user
 func deleteUser(c echo.Context) error {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	version, err := ifMatchVersion(c)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		return err
 	}
+	if err := userService.Delete(c.Request().Context(), id, version); err != nil {
+		return userError(err, "Failed to delete user")
+	}
+	return respond(c, http.StatusOK, map[string]string{"message": "User deleted successfully"})
+}
 
-	var user User
-	if err := db.First(&user, id).Error; err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+// Delete several users in one transaction
+func deleteUsers(c echo.Context) error {
+	req := new(struct {
+		IDs []UserRef `json:"ids"`
+	})
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if len(req.IDs) == 0 {
+		return newProblem(http.StatusBadRequest, "Expected a non-empty list of ids")
+	}
+	if len(req.IDs) > maxBulkSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d ids per request", maxBulkSize))
 	}
 
-	if err := db.Delete(&user).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete user"})
+	deleted, missing, err := userService.DeleteMany(c.Request().Context(), req.IDs)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to delete users")
 	}
+	return respond(c, http.StatusOK, map[string]interface{}{
+		"deleted":   deleted,
+		"not_found": len(missing),
+		"missing":   missing,
+	})
+}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "User deleted successfully"})
+// Restore a soft-deleted user
+func restoreUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	user, err := userService.Restore(c.Request().Context(), id)
+	if err != nil {
+		return userError(err, "Failed to restore user")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
+
+// Permanently remove a user, deleted or not
+func purgeUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	if err := userService.Purge(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to purge user")
+	}
+	return respond(c, http.StatusOK, map[string]string{"message": "User purged successfully"})
+}
+
+// Resolve the :id path param, an integer ID or UUID, to the user's ID
+func userID(c echo.Context) (uint, error) {
+	return resolveUserRef(c, UserRef(c.Param("id")))
+}
+
+// Resolve an integer ID or UUID from the request to the user's ID
+func resolveUserRef(c echo.Context, ref UserRef) (uint, error) {
+	id, err := userService.Resolve(c.Request().Context(), ref)
+	if errors.Is(err, errInvalidUserRef) {
+		return 0, newProblem(http.StatusBadRequest, "Invalid user ID")
+	}
+	if err != nil {
+		return 0, userError(err, "Failed to fetch user")
+	}
+	return id, nil
+}
+
+// Map a UserService error onto a problem, using detail for unexpected failures
+func userError(err error, detail string) error {
+	var verrs validator.ValidationErrors
+	var transition *StatusTransitionError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return newProblem(http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrEmailTaken):
+		p := newProblem(http.StatusConflict, "A user with this email already exists")
+		p.Errors = map[string]string{"email": "is already in use"}
+		return p
+	case errors.Is(err, ErrVersionConflict):
+		return newProblem(http.StatusPreconditionFailed, "User was modified by another request")
+	case errors.Is(err, ErrUserVersionNotFound):
+		return newProblem(http.StatusNotFound, "Version not found")
+	case errors.Is(err, ErrUserNotDeleted):
+		return newProblem(http.StatusConflict, "User is not deleted")
+	case errors.Is(err, ErrUserAnonymized):
+		return newProblem(http.StatusConflict, "User is already anonymized")
+	case errors.As(err, &transition):
+		return newProblem(http.StatusConflict, transition.Detail())
+	case errors.Is(err, ErrInvalidPatch):
+		return newProblem(http.StatusBadRequest, err.Error())
+	case errors.Is(err, errInvalidDate):
+		return bindError(err)
+	case errors.As(err, &verrs):
+		return validationError(err)
+	}
+	return newProblem(http.StatusInternalServerError, detail)
 }
 
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+const (
+	maxBulkSize     = 10000
+	maxBatchGetSize = 1000
+	maxSearchLength = 200
+)
+
+const usage = `Usage: %s <command> [options]
+
+Commands:
+  serve                 start the HTTP server (default)
+  migrate up            apply all pending migrations
+  migrate down          roll back the last applied migration
+  migrate status        list migrations and whether they have been applied
+  seed                  create the bootstrap admin and optional sample data
+`
+
 func main() {
 	loadEnv()
+	var err error
+	cfg, err = loadConfig()
+	initLogging()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serveCommand(args)
+	case "migrate":
+		migrateCommand(args)
+	case "seed":
+		seedCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+}
+
+// Start the HTTP server
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&cfg.Port, "port", cfg.Port, "port to listen on (default $PORT or 8000)")
+	flags.StringVar(&cfg.GRPCPort, "grpc-port", cfg.GRPCPort, "port for the gRPC API (default $GRPC_PORT; disabled when empty)")
+	flags.Parse(args)
+
+	initIDType()
+	initAuth()
+	initOAuth()
+	initSessions()
+	initWebhooks()
+	initEmail()
+	initExports()
+	initAvatars()
+	initStorage()
+	initEmailVerification()
 	initDB()
+	ensureMigrated()
+	// Only once migrations have run on the primary
+	initReplicas()
+	initMetrics()
+	shutdownTracing := initTracing()
+	initReadModel()
+	initCache()
+	initBroker()
+	initFanout()
+	initGraphQL()
 
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	requestValidator := newRequestValidator()
+	var users UserRepository = NewGormUserRepository(db)
+	if cfg.ReadModel.Enabled {
+		users = NewListingUserRepository(db, users)
+	}
+	userService = NewUserService(users, requestValidator)
+
+	e.Validator = requestValidator
+	e.HTTPErrorHandler = problemErrorHandler
+	e.IPExtractor = clientIPExtractor(cfg.HTTP.TrustedProxies)
+	// End event streams so shutdown does not wait on them
+	e.Server.RegisterOnShutdown(userEvents.Close)
+	e.TLSServer.RegisterOnShutdown(userEvents.Close)
+	// No write timeout: event streams and websockets stay open indefinitely
+	for _, s := range []*http.Server{e.Server, e.TLSServer} {
+		s.ReadHeaderTimeout = cfg.HTTP.ReadHeaderTimeout
+		s.IdleTimeout = cfg.HTTP.IdleTimeout
+	}
 
-	e.Use(middleware.Logger())
+	e.Use(requestIDMiddleware())
+	// Before tenant resolution and auth, which preflight requests carry no headers for
+	e.Use(corsMiddleware())
+	e.Use(bodyLimitMiddleware())
+	e.Use(timeoutMiddleware())
+	e.Use(tenantMiddleware())
+	e.Use(auditMiddleware())
+	e.Use(requestLoggingMiddleware())
+	e.Use(tracingMiddleware())
+	e.Use(metricsMiddleware())
 	e.Use(middleware.Recover())
 
-	e.GET("/users", getUsers)
-	e.GET("/users/:id", getUser)
-	e.POST("/users", createUser)
-	e.PUT("/users/:id", updateUser)
-	e.DELETE("/users/:id", deleteUser)
+	e.GET("/healthz", healthz)
+	e.GET("/livez", livez)
+	e.GET("/readyz", readyz)
+	e.GET("/metrics", metricsHandler())
+	e.GET("/openapi.json", openAPIHandler)
+	e.GET("/docs", swaggerUI)
+
+	limitLogin := rateLimit("login", cfg.RateLimit.Login)
+	limitAPI := rateLimit("api", cfg.RateLimit.API)
+
+	auth := requireAuth()
+	csrf := csrfProtect()
+	adminOnly := requireRole(RoleAdmin)
+
+	// User routes also accept API keys with a sufficient scope
+	canRead := requireScopeOr(ScopeRead, auth, requireRole(RoleAdmin, RoleEditor, RoleViewer))
+	canWrite := requireScopeOr(ScopeWrite, auth, requireRole(RoleAdmin, RoleEditor))
+	canAdmin := requireScopeOr(ScopeAdmin, auth, adminOnly)
+
+	// Cached reads run after auth; user events clear the cache on every change
+	cached := cacheResponses(userCache)
+
+	// Caching headers of each route group, from the *_CACHE_CONTROL settings
+	authCache := cacheHeaders(cfg.HTTPCache.Auth.CacheControl, false)
+	usersCache := cacheHeaders(cfg.HTTPCache.Users.CacheControl, cfg.HTTPCache.Users.LastModified)
+	adminCache := cacheHeaders(cfg.HTTPCache.Admin.CacheControl, false)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// The API, mounted once per version prefix. Mount middleware goes on each
+	// route rather than the group, whose catch-all would turn 405s into 404s.
+	apiRoutes := func(api *echo.Group, mount echo.MiddlewareFunc) {
+		api.POST("/auth/login", login, mount, authCache, limitLogin)
+		api.POST("/auth/refresh", refreshTokens, mount, authCache, limitLogin)
+		api.POST("/auth/logout", logout, mount, authCache, limitLogin)
+		api.POST("/auth/session", sessionLogin, mount, authCache, limitLogin)
+		api.GET("/auth/session", getSession, mount, authCache, csrf)
+		api.DELETE("/auth/session", sessionLogout, mount, authCache, csrf)
+		if cfg.Auth.TwoFactorEnabled {
+			twoFactor := api.Group("/auth/2fa", mount, authCache, limitLogin, auth, requireRole(RoleAdmin, RoleEditor, RoleViewer))
+			twoFactor.POST("/setup", setupTwoFactor)
+			twoFactor.POST("/enable", enableTwoFactor)
+			twoFactor.POST("/disable", disableTwoFactor)
+			twoFactor.POST("/backup-codes", regenerateBackupCodes)
+		}
+		api.GET("/auth/verify", verifyEmail, mount, authCache, limitLogin)
+		api.POST("/auth/verify/resend", resendVerification, mount, authCache, limitLogin)
+		api.POST("/auth/forgot", forgotPassword, mount, authCache, limitLogin)
+		api.POST("/auth/reset", resetPassword, mount, authCache, limitLogin)
+		api.GET("/auth/:provider", oauthLogin, mount, authCache, limitLogin)
+		api.GET("/auth/:provider/callback", oauthCallback, mount, authCache, limitLogin)
+
+		users := api.Group("/users", mount, usersCache, limitAPI)
+		users.GET("", getUsers, canRead, cached)
+		users.HEAD("", countUsers, canRead)
+		users.GET("/count", countUsers, canRead, cached)
+		users.GET("/search", searchUsers, canRead, cached)
+		users.GET("/stats", getUsersStats, canRead, cached)
+		users.GET("/duplicates", getUserDuplicates, canRead)
+		users.GET("/export", exportUsers, canRead)
+		users.POST("/export", createExport, canRead)
+		users.GET("/events", streamUserEvents, canRead)
+		users.GET("/:id", getUser, canRead, cached)
+		users.POST("", createUser, canWrite, idempotent)
+		users.PUT("", upsertUser, canWrite)
+		users.POST("/bulk", createUsersBulk, canWrite)
+		users.POST("/import", importUsers, canWrite)
+		users.POST("/batch-get", batchGetUsers, canRead)
+		users.PUT("/:id", updateUser, canWrite)
+		users.PATCH("/:id", patchUser, canWrite)
+		users.DELETE("", deleteUsers, canAdmin)
+		users.DELETE("/:id", deleteUser, canAdmin)
+		users.POST("/:id/restore", restoreUser, canAdmin)
+		users.DELETE("/:id/purge", purgeUser, canAdmin)
+		users.POST("/:id/anonymize", anonymizeUser, canAdmin)
+		users.POST("/:id/suspend", changeUserStatus(userSuspended), canAdmin)
+		users.POST("/:id/ban", changeUserStatus(userBanned), canAdmin)
+		users.POST("/:id/activate", changeUserStatus(userActive), canAdmin)
+		users.POST("/:id/merge/:other_id", mergeUsers, canAdmin)
+		users.PUT("/:id/roles", setUserRoles, canAdmin)
+		users.POST("/:id/unlock", unlockUser, canAdmin)
+		// Passwords belong to people, so API keys cannot change them
+		users.POST("/:id/password", changePassword, auth, requireRole(RoleAdmin, RoleEditor, RoleViewer))
+		users.GET("/:id/avatar", getUserAvatar, canRead)
+		users.PUT("/:id/avatar", putUserAvatar, canWrite)
+		users.DELETE("/:id/avatar", deleteUserAvatar, canWrite)
+		users.GET("/:id/attachments", getAttachments, canRead)
+		users.POST("/:id/attachments", createAttachment, canWrite)
+		users.GET("/:id/attachments/:attachment_id", getAttachment, canRead)
+		users.POST("/:id/attachments/:attachment_id/confirm", confirmAttachment, canWrite)
+		users.GET("/:id/attachments/:attachment_id/download", downloadAttachment, canRead)
+		users.DELETE("/:id/attachments/:attachment_id", deleteAttachment, canWrite)
+		users.GET("/:id/addresses", getAddresses, canRead)
+		users.POST("/:id/addresses", createAddress, canWrite, invalidateCache(userCache))
+		users.GET("/:id/addresses/:address_id", getAddress, canRead)
+		users.PUT("/:id/addresses/:address_id", updateAddress, canWrite, invalidateCache(userCache))
+		users.DELETE("/:id/addresses/:address_id", deleteAddress, canWrite, invalidateCache(userCache))
+		users.GET("/:id/consents", getConsents, canRead)
+		users.POST("/:id/consents", grantConsent, canWrite, invalidateCache(userCache))
+		users.GET("/:id/consents/:purpose", getConsent, canRead)
+		users.DELETE("/:id/consents/:purpose", revokeConsent, canWrite, invalidateCache(userCache))
+		users.GET("/:id/groups", getUserGroups, canRead)
+		users.PUT("/:id/manager", setUserManager, canWrite)
+		users.GET("/:id/reports", getUserReports, canRead)
+		users.GET("/:id/chain", getUserChain, canRead)
+		users.GET("/:id/posts", getUserPosts, canRead)
+		users.POST("/:id/posts", createUserPost, canWrite)
+		users.GET("/:id/history", getUserHistory, canRead)
+		users.POST("/:id/revert/:version", revertUser, canWrite)
+		// Users may export their own data; others' needs an admin
+		users.GET("/:id/export", exportUser, requireScopeOr(ScopeAdmin, auth, requireRole(RoleAdmin, RoleEditor, RoleViewer)))
+
+		api.POST("/sync/users", syncUsers, mount, usersCache, limitAPI, canAdmin)
+
+		roles := api.Group("/roles", mount, adminCache, limitAPI, auth, adminOnly, invalidateCache(userCache))
+		roles.GET("", getRoles)
+		roles.GET("/:id", getRole)
+		roles.POST("", createRole)
+		roles.PUT("/:id", updateRole)
+		roles.DELETE("/:id", deleteRole)
+
+		groups := api.Group("/groups", mount, usersCache, limitAPI)
+		groups.GET("", getGroups, canRead)
+		groups.POST("", createGroup, canWrite)
+		groups.GET("/:id", getGroup, canRead)
+		groups.GET("/:id/users", getGroupUsers, canRead)
+		groups.POST("/:id/members", addGroupMember, canWrite, invalidateCache(userCache))
+		groups.DELETE("/:id/members/:user_id", removeGroupMember, canWrite, invalidateCache(userCache))
+
+		posts := api.Group("/posts", mount, usersCache, limitAPI)
+		posts.GET("/:id", getPost, canRead)
+
+		exports := api.Group("/exports", mount, usersCache, limitAPI)
+		exports.GET("/:id", getExport, canRead)
+		exports.GET("/:id/download", downloadExport, canRead)
+
+		api.GET("/ws", serveWebSocket, mount, limitAPI, canRead)
+
+		// GraphQL reads need the read scope; mutations check write access themselves
+		api.POST("/graphql", graphQLHandler, mount, limitAPI, canRead)
+
+		apiKeys := api.Group("/api-keys", mount, adminCache, limitAPI, auth, adminOnly)
+		apiKeys.GET("", getAPIKeys)
+		apiKeys.POST("", createAPIKey)
+		apiKeys.DELETE("/:id", revokeAPIKey)
+
+		api.GET("/audit-logs", getAuditLogs, mount, adminCache, limitAPI, auth, adminOnly)
+
+		// Admins of the default tenant manage the others
+		tenants := api.Group("/tenants", mount, adminCache, limitAPI, auth, adminOnly, defaultTenantOnly)
+		tenants.GET("", getTenants)
+		tenants.POST("", createTenant)
+
+		webhooks := api.Group("/webhooks", mount, adminCache, limitAPI, auth, adminOnly)
+		webhooks.GET("", getWebhooks)
+		webhooks.POST("", createWebhook)
+		webhooks.PUT("/:id", updateWebhook)
+		webhooks.DELETE("/:id", deleteWebhook)
+		webhooks.GET("/:id/deliveries", getWebhookDeliveries)
+
+		jobs := api.Group("/admin/jobs", mount, adminCache, limitAPI, auth, adminOnly)
+		jobs.GET("", getJobs)
+		jobs.GET("/:id", getJob)
+		jobs.POST("/:id/retry", retryJob)
+		jobs.DELETE("/:id", deleteJob)
+
+		// Scheduled tasks span every tenant
+		cronTasks := api.Group("/admin/cron", mount, adminCache, limitAPI, auth, adminOnly, defaultTenantOnly)
+		cronTasks.GET("", getScheduledTasks)
+		cronTasks.POST("/:name/run", runScheduledTask)
+
+		retention := api.Group("/admin/retention", mount, adminCache, limitAPI, auth, adminOnly, defaultTenantOnly)
+		retention.GET("", getRetention)
+		retention.GET("/preview", previewRetention)
+	}
+	apiRoutes(e.Group(apiPrefix+"/"+currentAPIVersion), pinAPIVersion(currentAPIVersion))
+	// Clients may also pick the version with the Accept header
+	apiRoutes(e.Group(apiPrefix), negotiateAPIVersion)
+	// The original unversioned paths, kept for existing clients
+	if cfg.API.LegacyRoutes {
+		apiRoutes(e.Group(""), deprecatedRoute)
+	}
+
+	e.GET("/debug/config", getConfig, limitAPI, auth, adminOnly, defaultTenantOnly)
+
+	stopJobs := startJobWorkers()
+	stopScheduler := startScheduler()
+	stopDBMonitor := startDBMonitor()
+	stopIdempotencyCleanup := startIdempotencyCleanup()
+	stopTokenCleanup := startTokenCleanup()
+	stopOutboxRelay := startOutboxRelay()
+	stopEventFanout := startEventFanout()
+	shutdownGRPC := func(context.Context) {}
+	if cfg.GRPCPort != "" {
+		shutdownGRPC = startGRPCServer(cfg.GRPCPort)
+	}
+
+	go func() {
+		if err := serveHTTP(e); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+	stopRedirect := startHTTPSRedirect(e)
+
+	// Wait for SIGINT/SIGTERM, then drain in-flight requests before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to drain requests: %v", err)
+	}
+	stopRedirect(shutdownCtx)
+	drainWebSockets(shutdownCtx)
+	shutdownGRPC(shutdownCtx)
+	stopJobs(shutdownCtx)
+	stopScheduler(shutdownCtx)
+	stopDBMonitor()
+	stopIdempotencyCleanup()
+	stopTokenCleanup()
+	stopOutboxRelay()
+	stopEventFanout()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
 	}
-	e.Logger.Fatal(e.Start(":" + port))
+	closeDB()
+	closeRedis()
+	closeBroker()
+	log.Println("Server stopped.")
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Query parameters starting with this filter on a metadata key, e.g. ?meta.plan=pro
+const metaFilterPrefix = "meta."
+
+// Keys that may be filtered on; dots reach into nested objects
+var metaKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Metadata is free-form JSON a client attaches to a record, stored as JSONB on
+// Postgres and as serialized JSON elsewhere
+type Metadata map[string]interface{}
+
+// Unset metadata reads as an empty object
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]interface{}(m))
+}
+
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(map[string]interface{}(m))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (m *Metadata) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Metadata", value)
+	}
+	if len(b) == 0 {
+		*m = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*map[string]interface{})(m))
+}
+
+func (Metadata) GormDataType() string {
+	return "json"
+}
+
+// Use each dialect's JSON type where it has one
+func (Metadata) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "jsonb"
+	case "mysql":
+		return "json"
+	case "sqlserver":
+		return "nvarchar(max)"
+	}
+	return "text"
+}
+
+// Parse ?meta.<key>=<value> params into conditions on a metadata column,
+// in key order so the same query always builds the same SQL
+func parseMetaFilters(values url.Values, column string) ([]Condition, error) {
+	var params []string
+	for param := range values {
+		if strings.HasPrefix(param, metaFilterPrefix) {
+			params = append(params, param)
+		}
+	}
+	sort.Strings(params)
+
+	var conds []Condition
+	for _, param := range params {
+		key := strings.TrimPrefix(param, metaFilterPrefix)
+		for _, part := range strings.Split(key, ".") {
+			if !metaKeyPattern.MatchString(part) {
+				return nil, errors.New(param + ": Invalid metadata key")
+			}
+		}
+		conds = append(conds, Condition{Column: column, Key: key, Op: "=", Value: values.Get(param)})
+	}
+	return conds, nil
+}
+
+// Build an expression reading a dotted key from a JSON column as text
+func jsonText(q *gorm.DB, column, key string) clause.Expr {
+	col := clause.Column{Name: column}
+	parts := strings.Split(key, ".")
+	switch q.Dialector.Name() {
+	case "postgres":
+		sql := "?"
+		vars := []interface{}{col}
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				sql += " ->> ?"
+			} else {
+				sql += " -> ?"
+			}
+			vars = append(vars, part)
+		}
+		return clause.Expr{SQL: "(" + sql + ")", Vars: vars}
+	}
+
+	// Keys are quoted in the path so dashes and leading digits are allowed
+	path := "$"
+	for _, part := range parts {
+		path += `."` + part + `"`
+	}
+	switch q.Dialector.Name() {
+	case "mysql":
+		return clause.Expr{SQL: "JSON_UNQUOTE(JSON_EXTRACT(?, ?))", Vars: []interface{}{col, path}}
+	case "sqlserver":
+		return clause.Expr{SQL: "JSON_VALUE(?, ?)", Vars: []interface{}{col, path}}
+	}
+	// SQLite returns numbers as numbers, which never equal the text of a query value
+	return clause.Expr{SQL: "CAST(json_extract(?, ?) AS TEXT)", Vars: []interface{}{col, path}}
+}
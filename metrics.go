@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	usersCreatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "users_created_total",
+		Help: "Number of users created.",
+	})
+
+	emailsSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "emails_sent_total",
+		Help: "Number of emails handed to the mail provider, by outcome.",
+	}, []string{"outcome"})
+
+	cronRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cron_task_runs_total",
+		Help: "Number of scheduled task runs by task and outcome.",
+	}, []string{"task", "outcome"})
+
+	// Refreshed by the refresh-stats task rather than counted on each scrape
+	usersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "users",
+		Help: "Number of users by tenant and state, as of the last stats refresh.",
+	}, []string{"tenant", "state"})
+)
+
+// Register application metrics; call after initDB
+func initMetrics() {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatalf("Failed to access database pool: %v", err)
+	}
+
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		usersCreatedTotal,
+		emailsSentTotal,
+		cronRunsTotal,
+		usersGauge,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "db_open_connections",
+			Help: "Number of established database connections, in use or idle.",
+		}, func() float64 {
+			return float64(sqlDB.Stats().OpenConnections)
+		}),
+	)
+}
+
+// Middleware recording request counts and latency per route
+func metricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			// Render errors here so the final status code is known
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			labels := prometheus.Labels{
+				"method": c.Request().Method,
+				"route":  route,
+				"status": strconv.Itoa(c.Response().Status),
+			}
+			httpRequestsTotal.With(labels).Inc()
+			httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// Expose metrics in the Prometheus text format
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
@@ -0,0 +1,1372 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const migrationsTable = "schema_migrations"
+
+var migrationOptions = &gormigrate.Options{
+	TableName:                 migrationsTable,
+	IDColumnName:              "id",
+	IDColumnSize:              255,
+	ValidateUnknownMigrations: true,
+}
+
+// Schema changes, oldest first. Each migration declares its own snapshot of the
+// models it touches so it keeps working after the application structs change.
+// Never edit a migration that has been released; add a new one instead.
+var migrations = []*gormigrate.Migration{
+	{
+		ID: "0001_create_users",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID       uint `gorm:"primaryKey"`
+				Name     string
+				Birthday string
+			}
+			return tx.AutoMigrate(&User{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("users")
+		},
+	},
+	{
+		ID: "0002_add_users_password_hash",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				PasswordHash string
+			}
+			if tx.Migrator().HasColumn(&User{}, "PasswordHash") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "PasswordHash")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				PasswordHash string
+			}
+			return tx.Migrator().DropColumn(&User{}, "PasswordHash")
+		},
+	},
+	{
+		ID: "0003_create_roles",
+		Migrate: func(tx *gorm.DB) error {
+			type Role struct {
+				ID   uint   `gorm:"primaryKey"`
+				Name string `gorm:"size:50;uniqueIndex;not null"`
+			}
+			type UserRole struct {
+				UserID uint `gorm:"primaryKey"`
+				RoleID uint `gorm:"primaryKey"`
+			}
+			return tx.AutoMigrate(&Role{}, &UserRole{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_roles", "roles")
+		},
+	},
+	{
+		ID: "0004_users_birthday_date",
+		Migrate: func(tx *gorm.DB) error {
+			if err := clearInvalidBirthdays(tx); err != nil {
+				return err
+			}
+			type User struct {
+				Birthday string `gorm:"type:date"`
+			}
+			return tx.Migrator().AlterColumn(&User{}, "Birthday")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Birthday string
+			}
+			return tx.Migrator().AlterColumn(&User{}, "Birthday")
+		},
+	},
+	{
+		ID: "0005_add_users_deleted_at",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				DeletedAt gorm.DeletedAt `gorm:"index"`
+			}
+			return tx.AutoMigrate(&User{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				DeletedAt gorm.DeletedAt `gorm:"index"`
+			}
+			if tx.Migrator().HasIndex(&User{}, "DeletedAt") {
+				if err := tx.Migrator().DropIndex(&User{}, "DeletedAt"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&User{}, "DeletedAt")
+		},
+	},
+	{
+		ID: "0006_seed_builtin_roles",
+		Migrate: func(tx *gorm.DB) error {
+			type Role struct {
+				ID   uint
+				Name string
+			}
+			for _, name := range []string{"admin", "editor", "viewer"} {
+				if err := tx.FirstOrCreate(&Role{}, Role{Name: name}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Exec("DELETE FROM roles WHERE name IN ?", []string{"admin", "editor", "viewer"}).Error
+		},
+	},
+	{
+		ID: "0007_add_users_version",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				Version uint `gorm:"not null;default:1"`
+			}
+			if tx.Migrator().HasColumn(&User{}, "Version") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "Version")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Version uint
+			}
+			return tx.Migrator().DropColumn(&User{}, "Version")
+		},
+	},
+	{
+		ID: "0008_add_users_email",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				Email *string `gorm:"size:255;uniqueIndex:idx_users_email"`
+			}
+			if !tx.Migrator().HasColumn(&User{}, "Email") {
+				if err := tx.Migrator().AddColumn(&User{}, "Email"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_email") {
+				return nil
+			}
+			// SQL Server treats NULLs as equal in unique indexes, so only index set emails
+			if tx.Dialector.Name() == "sqlserver" {
+				return tx.Exec("CREATE UNIQUE INDEX idx_users_email ON users (email) WHERE email IS NOT NULL").Error
+			}
+			return tx.Migrator().CreateIndex(&User{}, "idx_users_email")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Email *string `gorm:"size:255;uniqueIndex:idx_users_email"`
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_email") {
+				if err := tx.Migrator().DropIndex(&User{}, "idx_users_email"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&User{}, "Email")
+		},
+	},
+	{
+		ID: "0009_add_users_timestamps",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			for _, field := range []string{"CreatedAt", "UpdatedAt"} {
+				if tx.Migrator().HasColumn(&User{}, field) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&User{}, field); err != nil {
+					return err
+				}
+			}
+			// Existing users get the migration time as their best-known timestamps
+			now := time.Now()
+			return tx.Table("users").Where("created_at IS NULL").
+				Updates(map[string]interface{}{"created_at": now, "updated_at": now}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			if err := tx.Migrator().DropColumn(&User{}, "UpdatedAt"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&User{}, "CreatedAt")
+		},
+	},
+	{
+		ID: "0010_add_users_uuid",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID   uint
+				UUID string `gorm:"size:36;uniqueIndex:idx_users_uuid"`
+			}
+			if !tx.Migrator().HasColumn(&User{}, "UUID") {
+				if err := tx.Migrator().AddColumn(&User{}, "UUID"); err != nil {
+					return err
+				}
+			}
+
+			var ids []uint
+			if err := tx.Table("users").Where("uuid IS NULL OR uuid = ''").Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			for _, id := range ids {
+				u, err := uuid.NewV7()
+				if err != nil {
+					return err
+				}
+				if err := tx.Table("users").Where("id = ?", id).Update("uuid", u.String()).Error; err != nil {
+					return err
+				}
+			}
+
+			if tx.Migrator().HasIndex(&User{}, "idx_users_uuid") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&User{}, "idx_users_uuid")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				UUID string `gorm:"size:36;uniqueIndex:idx_users_uuid"`
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_uuid") {
+				if err := tx.Migrator().DropIndex(&User{}, "idx_users_uuid"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&User{}, "UUID")
+		},
+	},
+	{
+		ID: "0011_create_api_keys",
+		Migrate: func(tx *gorm.DB) error {
+			type APIKey struct {
+				ID          uint   `gorm:"primaryKey"`
+				Name        string `gorm:"size:100;not null"`
+				Prefix      string `gorm:"size:16;not null"`
+				KeyHash     string `gorm:"size:64;uniqueIndex;not null"`
+				Scopes      string `gorm:"size:100;not null"`
+				CreatedByID uint
+				ExpiresAt   *time.Time
+				RevokedAt   *time.Time
+				LastUsedAt  *time.Time
+				CreatedAt   time.Time
+			}
+			return tx.AutoMigrate(&APIKey{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("api_keys")
+		},
+	},
+	{
+		ID: "0012_add_users_search_index",
+		Migrate: func(tx *gorm.DB) error {
+			// Only Postgres has full-text search; other databases fall back to LIKE
+			if tx.Dialector.Name() != "postgres" {
+				return nil
+			}
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_users_search ON users USING GIN (" + userSearchVector + ")").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() != "postgres" {
+				return nil
+			}
+			return tx.Exec("DROP INDEX IF EXISTS idx_users_search").Error
+		},
+	},
+	{
+		ID: "0013_create_webhooks",
+		Migrate: func(tx *gorm.DB) error {
+			type Webhook struct {
+				ID        uint   `gorm:"primaryKey"`
+				URL       string `gorm:"size:2048;not null"`
+				Secret    string `gorm:"size:100;not null"`
+				Events    string `gorm:"size:255;not null"`
+				Active    bool   `gorm:"not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			type WebhookDelivery struct {
+				ID             uint      `gorm:"primaryKey"`
+				WebhookID      uint      `gorm:"index;not null"`
+				Event          string    `gorm:"size:50;not null"`
+				Payload        string    `gorm:"type:text;not null"`
+				Status         string    `gorm:"size:20;not null;index:idx_webhook_deliveries_due,priority:1"`
+				Attempts       int       `gorm:"not null"`
+				NextAttemptAt  time.Time `gorm:"index:idx_webhook_deliveries_due,priority:2"`
+				ResponseStatus int
+				LastError      string `gorm:"size:500"`
+				DeliveredAt    *time.Time
+				CreatedAt      time.Time
+			}
+			return tx.AutoMigrate(&Webhook{}, &WebhookDelivery{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable("webhook_deliveries"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable("webhooks")
+		},
+	},
+	{
+		ID: "0014_create_audit_logs",
+		Migrate: func(tx *gorm.DB) error {
+			type AuditLog struct {
+				ID         uint      `gorm:"primaryKey"`
+				ActorType  string    `gorm:"size:20;not null;index:idx_audit_logs_actor,priority:1"`
+				ActorID    *uint     `gorm:"index:idx_audit_logs_actor,priority:2"`
+				Action     string    `gorm:"size:10;not null"`
+				EntityType string    `gorm:"size:50;not null;index:idx_audit_logs_entity,priority:1"`
+				EntityID   string    `gorm:"size:64;not null;index:idx_audit_logs_entity,priority:2"`
+				Changes    string    `gorm:"type:text;not null"`
+				IP         string    `gorm:"size:45"`
+				RequestID  string    `gorm:"size:64"`
+				CreatedAt  time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&AuditLog{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("audit_logs")
+		},
+	},
+	{
+		ID: "0015_create_user_versions",
+		Migrate: func(tx *gorm.DB) error {
+			type UserVersion struct {
+				ID        uint `gorm:"primaryKey"`
+				UserID    uint `gorm:"not null;uniqueIndex:idx_user_versions_user_version,priority:1"`
+				Version   uint `gorm:"not null;uniqueIndex:idx_user_versions_user_version,priority:2"`
+				Name      string
+				Email     *string `gorm:"size:255"`
+				Birthday  string  `gorm:"type:date"`
+				CreatedAt time.Time
+			}
+			if err := tx.AutoMigrate(&UserVersion{}); err != nil {
+				return err
+			}
+			// Existing users start their history at their current version
+			return tx.Exec(`INSERT INTO user_versions (user_id, version, name, email, birthday, created_at)
+				SELECT id, version, name, email, birthday, updated_at FROM users`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_versions")
+		},
+	},
+	{
+		ID: "0016_add_tenants",
+		Migrate: func(tx *gorm.DB) error {
+			type Tenant struct {
+				ID        uint   `gorm:"primaryKey"`
+				Slug      string `gorm:"size:63;not null;uniqueIndex"`
+				Name      string `gorm:"size:100;not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			if err := tx.AutoMigrate(&Tenant{}); err != nil {
+				return err
+			}
+			// Everything that exists so far belongs to the default tenant, the
+			// table's first row and so defaultTenantID
+			now := time.Now()
+			if err := tx.Create(&Tenant{Slug: defaultTenantSlug, Name: "Default", CreatedAt: now, UpdatedAt: now}).Error; err != nil {
+				return err
+			}
+
+			type User struct {
+				TenantID uint    `gorm:"not null;default:1;uniqueIndex:idx_users_tenant_email,priority:1"`
+				Email    *string `gorm:"size:255;uniqueIndex:idx_users_tenant_email,priority:2"`
+			}
+			type APIKey struct {
+				TenantID uint `gorm:"not null;default:1;index"`
+			}
+			type Webhook struct {
+				TenantID uint `gorm:"not null;default:1;index"`
+			}
+			type AuditLog struct {
+				TenantID uint `gorm:"not null;default:1;index"`
+			}
+			for _, model := range []interface{}{&User{}, &APIKey{}, &Webhook{}, &AuditLog{}} {
+				if err := tx.Migrator().AddColumn(model, "TenantID"); err != nil {
+					return err
+				}
+			}
+			for _, model := range []interface{}{&APIKey{}, &Webhook{}, &AuditLog{}} {
+				if err := tx.Migrator().CreateIndex(model, "TenantID"); err != nil {
+					return err
+				}
+			}
+
+			// Emails are unique within a tenant rather than across all of them
+			if tx.Migrator().HasIndex(&User{}, "idx_users_email") {
+				if err := tx.Migrator().DropIndex(&User{}, "idx_users_email"); err != nil {
+					return err
+				}
+			}
+			if tx.Dialector.Name() == "sqlserver" {
+				return tx.Exec("CREATE UNIQUE INDEX idx_users_tenant_email ON users (tenant_id, email) WHERE email IS NOT NULL").Error
+			}
+			return tx.Migrator().CreateIndex(&User{}, "idx_users_tenant_email")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				TenantID uint    `gorm:"uniqueIndex:idx_users_tenant_email,priority:1"`
+				Email    *string `gorm:"size:255;uniqueIndex:idx_users_email"`
+			}
+			type APIKey struct {
+				TenantID uint `gorm:"index"`
+			}
+			type Webhook struct {
+				TenantID uint `gorm:"index"`
+			}
+			type AuditLog struct {
+				TenantID uint `gorm:"index"`
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_tenant_email") {
+				if err := tx.Migrator().DropIndex(&User{}, "idx_users_tenant_email"); err != nil {
+					return err
+				}
+			}
+			for _, model := range []interface{}{&APIKey{}, &Webhook{}, &AuditLog{}} {
+				if err := tx.Migrator().DropIndex(model, "TenantID"); err != nil {
+					return err
+				}
+			}
+			for _, model := range []interface{}{&User{}, &APIKey{}, &Webhook{}, &AuditLog{}} {
+				if err := tx.Migrator().DropColumn(model, "TenantID"); err != nil {
+					return err
+				}
+			}
+
+			if !tx.Migrator().HasIndex(&User{}, "idx_users_email") {
+				var err error
+				if tx.Dialector.Name() == "sqlserver" {
+					err = tx.Exec("CREATE UNIQUE INDEX idx_users_email ON users (email) WHERE email IS NOT NULL").Error
+				} else {
+					err = tx.Migrator().CreateIndex(&User{}, "idx_users_email")
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable("tenants")
+		},
+	},
+	{
+		ID: "0017_create_idempotency_keys",
+		Migrate: func(tx *gorm.DB) error {
+			type IdempotencyKey struct {
+				ID          uint   `gorm:"primaryKey"`
+				TenantID    uint   `gorm:"not null;default:1;uniqueIndex:idx_idempotency_keys_tenant_key,priority:1"`
+				Key         string `gorm:"column:idempotency_key;size:255;not null;uniqueIndex:idx_idempotency_keys_tenant_key,priority:2"`
+				RequestHash string `gorm:"size:64;not null"`
+				Status      int    `gorm:"not null"`
+				ContentType string `gorm:"size:100"`
+				ETag        string `gorm:"size:100"`
+				Body        []byte
+				CreatedAt   time.Time
+				ExpiresAt   time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&IdempotencyKey{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("idempotency_keys")
+		},
+	},
+	{
+		ID: "0018_create_password_reset_tokens",
+		Migrate: func(tx *gorm.DB) error {
+			type PasswordResetToken struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;index"`
+				UserID    uint   `gorm:"not null;index"`
+				TokenHash string `gorm:"size:64;not null;uniqueIndex"`
+				ExpiresAt time.Time
+				UsedAt    *time.Time
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&PasswordResetToken{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("password_reset_tokens")
+		},
+	},
+	{
+		ID: "0019_create_user_identities",
+		Migrate: func(tx *gorm.DB) error {
+			type UserIdentity struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;uniqueIndex:idx_user_identities_provider_subject,priority:1"`
+				UserID    uint   `gorm:"not null;index"`
+				Provider  string `gorm:"size:20;not null;uniqueIndex:idx_user_identities_provider_subject,priority:2"`
+				Subject   string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_provider_subject,priority:3"`
+				Email     string `gorm:"size:255"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&UserIdentity{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_identities")
+		},
+	},
+	{
+		ID: "0020_create_refresh_tokens",
+		Migrate: func(tx *gorm.DB) error {
+			type RefreshToken struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;index"`
+				UserID    uint   `gorm:"not null;index"`
+				FamilyID  string `gorm:"size:36;not null;index"`
+				TokenHash string `gorm:"size:64;not null;uniqueIndex"`
+				ExpiresAt time.Time
+				RevokedAt *time.Time
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&RefreshToken{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("refresh_tokens")
+		},
+	},
+	{
+		ID: "0021_create_two_factor",
+		Migrate: func(tx *gorm.DB) error {
+			type TwoFactorSecret struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;index"`
+				UserID    uint   `gorm:"not null;uniqueIndex"`
+				Secret    string `gorm:"size:64;not null"`
+				EnabledAt *time.Time
+				CreatedAt time.Time
+			}
+			type BackupCode struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;index"`
+				UserID    uint   `gorm:"not null;index"`
+				CodeHash  string `gorm:"size:64;not null"`
+				UsedAt    *time.Time
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&TwoFactorSecret{}, &BackupCode{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("backup_codes", "two_factor_secrets")
+		},
+	},
+	{
+		ID: "0022_create_login_throttles",
+		Migrate: func(tx *gorm.DB) error {
+			type LoginThrottle struct {
+				ID            uint   `gorm:"primaryKey"`
+				TenantID      uint   `gorm:"not null;default:1;uniqueIndex:idx_login_throttles_subject,priority:1"`
+				Subject       string `gorm:"size:100;not null;uniqueIndex:idx_login_throttles_subject,priority:2"`
+				Failures      int    `gorm:"not null;default:0"`
+				Lockouts      int    `gorm:"not null;default:0"`
+				LockedUntil   *time.Time
+				LastFailureAt time.Time
+			}
+			return tx.AutoMigrate(&LoginThrottle{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("login_throttles")
+		},
+	},
+	{
+		ID: "0023_add_users_is_verified",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				IsVerified bool `gorm:"not null;default:false"`
+			}
+			if tx.Migrator().HasColumn(&User{}, "IsVerified") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "IsVerified")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				IsVerified bool
+			}
+			return tx.Migrator().DropColumn(&User{}, "IsVerified")
+		},
+	},
+	{
+		ID: "0024_create_jobs",
+		Migrate: func(tx *gorm.DB) error {
+			type Job struct {
+				ID          uint      `gorm:"primaryKey"`
+				TenantID    uint      `gorm:"not null;default:1;index"`
+				Type        string    `gorm:"size:50;not null;index"`
+				Payload     string    `gorm:"type:text;not null"`
+				Status      string    `gorm:"size:20;not null;index:idx_jobs_due,priority:1"`
+				Attempts    int       `gorm:"not null"`
+				MaxAttempts int       `gorm:"not null"`
+				RunAt       time.Time `gorm:"index:idx_jobs_due,priority:2"`
+				LastError   string    `gorm:"size:500"`
+				FinishedAt  *time.Time
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}
+			if err := tx.AutoMigrate(&Job{}); err != nil {
+				return err
+			}
+
+			// Deliveries still pending were left to the old delivery worker;
+			// queue a job for each with the attempts it has left
+			var pending []struct {
+				ID            uint
+				TenantID      uint
+				Attempts      int
+				NextAttemptAt time.Time
+			}
+			err := tx.Table("webhook_deliveries").
+				Select("webhook_deliveries.id, webhooks.tenant_id, webhook_deliveries.attempts, webhook_deliveries.next_attempt_at").
+				Joins("JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id").
+				Where("webhook_deliveries.status = ?", "pending").Scan(&pending).Error
+			if err != nil || len(pending) == 0 {
+				return err
+			}
+			maxAttempts := max(cfg.Webhooks.MaxAttempts, 1)
+			jobs := make([]Job, len(pending))
+			for i, d := range pending {
+				jobs[i] = Job{
+					TenantID:    d.TenantID,
+					Type:        "webhook.deliver",
+					Payload:     fmt.Sprintf(`{"delivery_id":%d}`, d.ID),
+					Status:      "pending",
+					Attempts:    min(d.Attempts, maxAttempts-1),
+					MaxAttempts: maxAttempts,
+					RunAt:       d.NextAttemptAt,
+				}
+			}
+			return tx.CreateInBatches(jobs, 100).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			// Pending deliveries go back to the old delivery worker
+			return tx.Migrator().DropTable("jobs")
+		},
+	},
+	{
+		ID: "0025_create_user_stats",
+		Migrate: func(tx *gorm.DB) error {
+			type UserStats struct {
+				TenantID    uint `gorm:"primaryKey;autoIncrement:false"`
+				Total       int64
+				Active      int64
+				Deleted     int64
+				Verified    int64
+				RefreshedAt time.Time
+			}
+			return tx.AutoMigrate(&UserStats{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_stats")
+		},
+	},
+	{
+		ID: "0026_create_exports",
+		Migrate: func(tx *gorm.DB) error {
+			type Export struct {
+				ID             uint   `gorm:"primaryKey"`
+				TenantID       uint   `gorm:"not null;default:1;index"`
+				Format         string `gorm:"size:10;not null"`
+				Query          string `gorm:"type:text;not null"`
+				IncludeDeleted bool   `gorm:"not null"`
+				Status         string `gorm:"size:20;not null"`
+				Rows           int64
+				Size           int64
+				Error          string `gorm:"size:500"`
+				FilePath       string `gorm:"size:1024"`
+				JobID          uint
+				CreatedAt      time.Time
+				CompletedAt    *time.Time
+				ExpiresAt      *time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&Export{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("exports")
+		},
+	},
+	{
+		ID: "0027_add_users_avatar",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				Avatar string `gorm:"size:255"`
+			}
+			if tx.Migrator().HasColumn(&User{}, "Avatar") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "Avatar")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Avatar string
+			}
+			return tx.Migrator().DropColumn(&User{}, "Avatar")
+		},
+	},
+	{
+		ID: "0028_create_attachments",
+		Migrate: func(tx *gorm.DB) error {
+			type Attachment struct {
+				ID          uint   `gorm:"primaryKey"`
+				TenantID    uint   `gorm:"not null;default:1;index"`
+				UserID      uint   `gorm:"not null;index"`
+				Key         string `gorm:"size:255;not null"`
+				Filename    string `gorm:"size:255;not null"`
+				ContentType string `gorm:"size:100;not null"`
+				Size        int64
+				Status      string `gorm:"size:20;not null"`
+				CreatedAt   time.Time
+				UploadedAt  *time.Time
+			}
+			return tx.AutoMigrate(&Attachment{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("attachments")
+		},
+	},
+	{
+		ID: "0029_add_users_avatar_status",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				AvatarStatus string `gorm:"size:20"`
+			}
+			if tx.Migrator().HasColumn(&User{}, "AvatarStatus") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "AvatarStatus")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				AvatarStatus string
+			}
+			return tx.Migrator().DropColumn(&User{}, "AvatarStatus")
+		},
+	},
+	{
+		ID: "0030_create_posts",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID uint `gorm:"primaryKey"`
+			}
+			type Post struct {
+				ID        uint   `gorm:"primaryKey"`
+				TenantID  uint   `gorm:"not null;default:1;index"`
+				UserID    uint   `gorm:"not null;index"`
+				User      User   `gorm:"constraint:OnDelete:CASCADE"`
+				Title     string `gorm:"size:200;not null"`
+				Body      string `gorm:"type:text"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			// Only posts: the users table is left as it is
+			return tx.Migrator().CreateTable(&Post{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("posts")
+		},
+	},
+	{
+		ID: "0031_create_addresses",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID uint `gorm:"primaryKey"`
+			}
+			type Address struct {
+				ID         uint   `gorm:"primaryKey"`
+				TenantID   uint   `gorm:"not null;default:1;index"`
+				UserID     uint   `gorm:"not null;index"`
+				User       User   `gorm:"constraint:OnDelete:CASCADE"`
+				Label      string `gorm:"size:50"`
+				Line1      string `gorm:"size:200;not null"`
+				Line2      string `gorm:"size:200"`
+				City       string `gorm:"size:100;not null"`
+				Region     string `gorm:"size:100"`
+				PostalCode string `gorm:"size:20"`
+				Country    string `gorm:"size:2;not null"`
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+			}
+			return tx.Migrator().CreateTable(&Address{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("addresses")
+		},
+	},
+	{
+		ID: "0032_create_groups",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID uint `gorm:"primaryKey"`
+			}
+			type Group struct {
+				ID          uint   `gorm:"primaryKey"`
+				TenantID    uint   `gorm:"not null;default:1;uniqueIndex:idx_groups_tenant_name,priority:1"`
+				Name        string `gorm:"size:100;not null;uniqueIndex:idx_groups_tenant_name,priority:2"`
+				Description string `gorm:"size:500"`
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}
+			type GroupMember struct {
+				GroupID   uint      `gorm:"primaryKey"`
+				Group     Group     `gorm:"constraint:OnDelete:CASCADE"`
+				UserID    uint      `gorm:"primaryKey;index"`
+				User      User      `gorm:"constraint:OnDelete:CASCADE"`
+				CreatedAt time.Time `gorm:"not null"`
+			}
+			return tx.Migrator().CreateTable(&Group{}, &GroupMember{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("group_members", "groups")
+		},
+	},
+	{
+		ID: "0033_add_users_manager_id",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID        uint  `gorm:"primaryKey"`
+				ManagerID *uint `gorm:"index"`
+				Manager   *User
+			}
+			if !tx.Migrator().HasColumn(&User{}, "ManagerID") {
+				if err := tx.Migrator().AddColumn(&User{}, "ManagerID"); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasIndex(&User{}, "ManagerID") {
+				if err := tx.Migrator().CreateIndex(&User{}, "ManagerID"); err != nil {
+					return err
+				}
+			}
+			// SQLite cannot add a foreign key to an existing table. Purging a
+			// manager clears their reports first, so no delete action is needed.
+			if tx.Dialector.Name() == "sqlite" || tx.Migrator().HasConstraint(&User{}, "Manager") {
+				return nil
+			}
+			return tx.Migrator().CreateConstraint(&User{}, "Manager")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				ID        uint  `gorm:"primaryKey"`
+				ManagerID *uint `gorm:"index"`
+				Manager   *User
+			}
+			if tx.Migrator().HasConstraint(&User{}, "Manager") {
+				if err := tx.Migrator().DropConstraint(&User{}, "Manager"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&User{}, "ManagerID") {
+				if err := tx.Migrator().DropIndex(&User{}, "ManagerID"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&User{}, "ManagerID")
+		},
+	},
+	{
+		ID: "0034_add_users_metadata",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				Metadata Metadata
+			}
+			if tx.Migrator().HasColumn(&User{}, "Metadata") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "Metadata")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Metadata Metadata
+			}
+			return tx.Migrator().DropColumn(&User{}, "Metadata")
+		},
+	},
+	{
+		ID: "0035_add_exports_user_id",
+		Migrate: func(tx *gorm.DB) error {
+			type Export struct {
+				UserID *uint `gorm:"index"`
+			}
+			if tx.Migrator().HasColumn(&Export{}, "UserID") {
+				return nil
+			}
+			if err := tx.Migrator().AddColumn(&Export{}, "UserID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&Export{}, "UserID")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Export struct {
+				UserID *uint `gorm:"index"`
+			}
+			if tx.Migrator().HasIndex(&Export{}, "UserID") {
+				if err := tx.Migrator().DropIndex(&Export{}, "UserID"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&Export{}, "UserID")
+		},
+	},
+	{
+		ID: "0036_add_users_anonymized_at",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				AnonymizedAt *time.Time
+			}
+			if tx.Migrator().HasColumn(&User{}, "AnonymizedAt") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "AnonymizedAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				AnonymizedAt *time.Time
+			}
+			return tx.Migrator().DropColumn(&User{}, "AnonymizedAt")
+		},
+	},
+	{
+		ID: "0037_add_users_last_login_at",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				LastLoginAt *time.Time
+			}
+			if tx.Migrator().HasColumn(&User{}, "LastLoginAt") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&User{}, "LastLoginAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				LastLoginAt *time.Time
+			}
+			return tx.Migrator().DropColumn(&User{}, "LastLoginAt")
+		},
+	},
+	{
+		ID: "0038_create_consents",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				ID uint `gorm:"primaryKey"`
+			}
+			type Consent struct {
+				ID        uint      `gorm:"primaryKey"`
+				TenantID  uint      `gorm:"not null;default:1;index"`
+				UserID    uint      `gorm:"not null;index:idx_consents_user_purpose,priority:1"`
+				User      User      `gorm:"constraint:OnDelete:CASCADE"`
+				Purpose   string    `gorm:"size:50;not null;index:idx_consents_user_purpose,priority:2"`
+				Source    string    `gorm:"size:100"`
+				GrantedAt time.Time `gorm:"not null"`
+				RevokedAt *time.Time
+			}
+			return tx.Migrator().CreateTable(&Consent{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("consents")
+		},
+	},
+	{
+		ID: "0039_add_users_status",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				Status       string `gorm:"size:20;not null;default:active;index"`
+				StatusReason string `gorm:"size:255"`
+			}
+			for _, field := range []string{"Status", "StatusReason"} {
+				if tx.Migrator().HasColumn(&User{}, field) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&User{}, field); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&User{}, "Status") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&User{}, "Status")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				Status       string `gorm:"index"`
+				StatusReason string
+			}
+			if tx.Migrator().HasIndex(&User{}, "Status") {
+				if err := tx.Migrator().DropIndex(&User{}, "Status"); err != nil {
+					return err
+				}
+			}
+			for _, field := range []string{"Status", "StatusReason"} {
+				if err := tx.Migrator().DropColumn(&User{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "0040_add_users_external_id",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				TenantID   uint    `gorm:"uniqueIndex:idx_users_tenant_external_id,priority:1"`
+				ExternalID *string `gorm:"size:100;uniqueIndex:idx_users_tenant_external_id,priority:2"`
+			}
+			if !tx.Migrator().HasColumn(&User{}, "ExternalID") {
+				if err := tx.Migrator().AddColumn(&User{}, "ExternalID"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_tenant_external_id") {
+				return nil
+			}
+			// SQL Server counts NULLs as equal in unique indexes
+			if tx.Dialector.Name() == "sqlserver" {
+				return tx.Exec("CREATE UNIQUE INDEX idx_users_tenant_external_id ON users (tenant_id, external_id) WHERE external_id IS NOT NULL").Error
+			}
+			return tx.Migrator().CreateIndex(&User{}, "idx_users_tenant_external_id")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				TenantID   uint    `gorm:"uniqueIndex:idx_users_tenant_external_id,priority:1"`
+				ExternalID *string `gorm:"uniqueIndex:idx_users_tenant_external_id,priority:2"`
+			}
+			if tx.Migrator().HasIndex(&User{}, "idx_users_tenant_external_id") {
+				if err := tx.Migrator().DropIndex(&User{}, "idx_users_tenant_external_id"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&User{}, "ExternalID")
+		},
+	},
+	{
+		ID: "0041_create_outbox_events",
+		Migrate: func(tx *gorm.DB) error {
+			type OutboxEvent struct {
+				ID          uint64 `gorm:"primaryKey"`
+				TenantID    uint   `gorm:"not null;default:1;index"`
+				Event       string `gorm:"size:50;not null"`
+				Payload     string `gorm:"type:text;not null"`
+				Attempts    int    `gorm:"not null;default:0"`
+				LastError   string `gorm:"size:500"`
+				LockedUntil *time.Time
+				PublishedAt *time.Time `gorm:"index"`
+				CreatedAt   time.Time
+			}
+			return tx.Migrator().CreateTable(&OutboxEvent{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("outbox_events")
+		},
+	},
+	{
+		ID: "0042_create_user_listings",
+		Migrate: func(tx *gorm.DB) error {
+			type UserListing struct {
+				ID           uint   `gorm:"primaryKey;autoIncrement:false"`
+				TenantID     uint   `gorm:"not null;index"`
+				UUID         string `gorm:"size:36"`
+				Name         string
+				Email        *string `gorm:"size:255"`
+				ExternalID   *string `gorm:"size:100"`
+				IsVerified   bool
+				Status       string `gorm:"size:20;index"`
+				StatusReason string `gorm:"size:255"`
+				Birthday     string `gorm:"type:date"`
+				AvatarStatus string `gorm:"size:20"`
+				Roles        string `gorm:"type:text"`
+				ManagerID    *uint  `gorm:"index"`
+				Metadata     Metadata
+				AnonymizedAt *time.Time
+				LastLoginAt  *time.Time
+				DeletedAt    gorm.DeletedAt `gorm:"index"`
+				Version      uint
+				CreatedAt    time.Time `gorm:"index"`
+				UpdatedAt    time.Time
+			}
+			return tx.Migrator().CreateTable(&UserListing{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_listings")
+		},
+	},
+	{
+		ID: "0043_add_idempotency_keys_headers",
+		Migrate: func(tx *gorm.DB) error {
+			type IdempotencyKey struct {
+				Headers string `gorm:"type:text"`
+			}
+			if tx.Migrator().HasColumn(&IdempotencyKey{}, "Headers") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&IdempotencyKey{}, "Headers")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type IdempotencyKey struct {
+				Headers string
+			}
+			return tx.Migrator().DropColumn(&IdempotencyKey{}, "Headers")
+		},
+	},
+	{
+		ID: "0044_add_two_factor_secrets_last_used_step",
+		Migrate: func(tx *gorm.DB) error {
+			type TwoFactorSecret struct {
+				LastUsedStep uint64 `gorm:"not null;default:0"`
+			}
+			if tx.Migrator().HasColumn(&TwoFactorSecret{}, "LastUsedStep") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&TwoFactorSecret{}, "LastUsedStep")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type TwoFactorSecret struct {
+				LastUsedStep uint64
+			}
+			return tx.Migrator().DropColumn(&TwoFactorSecret{}, "LastUsedStep")
+		},
+	},
+	{
+		ID: "0045_add_roles_tenant_id",
+		Migrate: func(tx *gorm.DB) error {
+			type Role struct {
+				TenantID *uint  `gorm:"uniqueIndex:idx_roles_tenant_name,priority:1"`
+				Name     string `gorm:"size:50;uniqueIndex:idx_roles_name;uniqueIndex:idx_roles_tenant_name,priority:2"`
+			}
+			if !tx.Migrator().HasColumn(&Role{}, "TenantID") {
+				if err := tx.Migrator().AddColumn(&Role{}, "TenantID"); err != nil {
+					return err
+				}
+			}
+			// The built-in roles stay shared; custom roles so far were made in the default tenant
+			err := tx.Exec("UPDATE roles SET tenant_id = ? WHERE name NOT IN ?",
+				defaultTenantID, []string{RoleAdmin, RoleEditor, RoleViewer}).Error
+			if err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&Role{}, "idx_roles_name") {
+				if err := tx.Migrator().DropIndex(&Role{}, "idx_roles_name"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&Role{}, "idx_roles_tenant_name") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&Role{}, "idx_roles_tenant_name")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Role struct {
+				TenantID *uint  `gorm:"uniqueIndex:idx_roles_tenant_name,priority:1"`
+				Name     string `gorm:"size:50;uniqueIndex:idx_roles_name;uniqueIndex:idx_roles_tenant_name,priority:2"`
+			}
+			if tx.Migrator().HasIndex(&Role{}, "idx_roles_tenant_name") {
+				if err := tx.Migrator().DropIndex(&Role{}, "idx_roles_tenant_name"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().DropColumn(&Role{}, "TenantID"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&Role{}, "idx_roles_name") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&Role{}, "idx_roles_name")
+		},
+	},
+	{
+		ID: "0046_add_idempotency_keys_principal",
+		Migrate: func(tx *gorm.DB) error {
+			// Keys recorded before now have no principal, so no caller can replay them
+			type IdempotencyKey struct {
+				TenantID  uint   `gorm:"uniqueIndex:idx_idempotency_keys_tenant_key,priority:1;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:1"`
+				Principal string `gorm:"size:50;not null;default:'';uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:2"`
+				Key       string `gorm:"column:idempotency_key;size:255;uniqueIndex:idx_idempotency_keys_tenant_key,priority:2;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:3"`
+			}
+			if !tx.Migrator().HasColumn(&IdempotencyKey{}, "Principal") {
+				if err := tx.Migrator().AddColumn(&IdempotencyKey{}, "Principal"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_key") {
+				if err := tx.Migrator().DropIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_key"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_principal_key") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_principal_key")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type IdempotencyKey struct {
+				TenantID  uint   `gorm:"uniqueIndex:idx_idempotency_keys_tenant_key,priority:1;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:1"`
+				Principal string `gorm:"uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:2"`
+				Key       string `gorm:"column:idempotency_key;size:255;uniqueIndex:idx_idempotency_keys_tenant_key,priority:2;uniqueIndex:idx_idempotency_keys_tenant_principal_key,priority:3"`
+			}
+			if tx.Migrator().HasIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_principal_key") {
+				if err := tx.Migrator().DropIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_principal_key"); err != nil {
+					return err
+				}
+			}
+			// Keys now used by several callers would collide on the old index
+			if err := tx.Where("1 = 1").Delete(&IdempotencyKey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&IdempotencyKey{}, "Principal"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_key") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&IdempotencyKey{}, "idx_idempotency_keys_tenant_key")
+		},
+	},
+}
+
+// Data written by migrations is not audited: the log may not exist yet
+func newMigrator() *gormigrate.Gormigrate {
+	tx := db.Set(auditSkipSetting, true).Session(&gorm.Session{})
+	return gormigrate.New(tx, migrationOptions, migrations)
+}
+
+// Apply all pending migrations
+func migrateUp() error {
+	return newMigrator().Migrate()
+}
+
+// Roll back the most recently applied migration
+func migrateDown() error {
+	return newMigrator().RollbackLast()
+}
+
+// List the IDs of migrations that have not been applied yet
+func pendingMigrations() ([]string, error) {
+	applied := map[string]bool{}
+	if db.Migrator().HasTable(migrationsTable) {
+		var ids []string
+		if err := db.Table(migrationsTable).Pluck("id", &ids).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			applied[id] = true
+		}
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.ID] {
+			pending = append(pending, m.ID)
+		}
+	}
+	return pending, nil
+}
+
+// Handle "migrate up|down|status"
+func migrateCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: migrate up|down|status")
+		os.Exit(2)
+	}
+
+	initDB()
+
+	switch args[0] {
+	case "up":
+		if err := migrateUp(); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Println("Migrations applied.")
+	case "down":
+		if err := migrateDown(); err != nil {
+			log.Fatalf("Rollback failed: %v", err)
+		}
+		log.Println("Rolled back the last migration.")
+	case "status":
+		pending, err := pendingMigrations()
+		if err != nil {
+			log.Fatalf("Failed to check migrations: %v", err)
+		}
+		isPending := map[string]bool{}
+		for _, id := range pending {
+			isPending[id] = true
+		}
+		for _, m := range migrations {
+			status := "applied"
+			if isPending[m.ID] {
+				status = "pending"
+			}
+			fmt.Printf("%-8s %s\n", status, m.ID)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: migrate up|down|status")
+		os.Exit(2)
+	}
+}
+
+// Run migrations when AUTO_MIGRATE=true, then refuse to continue if any are pending
+func ensureMigrated() {
+	if cfg.DB.AutoMigrate {
+		if err := migrateUp(); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+	}
+
+	pending, err := pendingMigrations()
+	if err != nil {
+		log.Fatalf("Failed to check migrations: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Fatalf("%d pending migration(s) %v; apply them before starting the server", len(pending), pending)
+	}
+}
+
+var datePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// Clear birthdays that can't be converted before the column becomes a date
+func clearInvalidBirthdays(tx *gorm.DB) error {
+	columns, err := tx.Migrator().ColumnTypes("users")
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if column.Name() == "birthday" && strings.EqualFold(column.DatabaseTypeName(), "date") {
+			return nil
+		}
+	}
+
+	var rows []struct {
+		ID       uint
+		Birthday string
+	}
+	if err := tx.Table("users").Select("id", "birthday").Where("birthday IS NOT NULL").Scan(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := time.Parse(dateLayout, row.Birthday); err == nil && datePattern.MatchString(row.Birthday) {
+			continue
+		}
+		log.Printf("Clearing invalid birthday %q for user %d", row.Birthday, row.ID)
+		if err := tx.Table("users").Where("id = ?", row.ID).Update("birthday", nil).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+)
+
+// Run every migration up and back down on SQL Server, whose unique indexes
+// treat NULLs as equal, so user emails need filtered indexes there. Set
+// MSSQL_DSN to an empty database to run it.
+func TestMigrationsSQLServer(t *testing.T) {
+	dsn := os.Getenv("MSSQL_DSN")
+	if dsn == "" {
+		t.Skip("MSSQL_DSN is not set")
+	}
+	conn, err := gorm.Open(sqlserver.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	// Migrations run on the app's connection
+	db = conn
+
+	if err := migrateUp(); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	pending, err := pendingMigrations()
+	if err != nil {
+		t.Fatalf("listing pending migrations: %v", err)
+	}
+	if len(pending) > 0 {
+		t.Fatalf("pending after migrating up: %v", pending)
+	}
+
+	var index struct {
+		IsUnique         bool
+		HasFilter        bool
+		FilterDefinition string
+	}
+	err = db.Raw(`SELECT is_unique, has_filter, filter_definition FROM sys.indexes
+		WHERE object_id = OBJECT_ID('users') AND name = 'idx_users_tenant_email'`).Scan(&index).Error
+	if err != nil {
+		t.Fatalf("reading idx_users_tenant_email: %v", err)
+	}
+	if !index.IsUnique || !index.HasFilter || index.FilterDefinition != "([email] IS NOT NULL)" {
+		t.Errorf("idx_users_tenant_email: unique %v, filter %v %q; want a unique index filtered on [email] IS NOT NULL",
+			index.IsUnique, index.HasFilter, index.FilterDefinition)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if err := migrateDown(); err != nil {
+			t.Fatalf("rolling back %s: %v", migrations[i].ID, err)
+		}
+	}
+	if db.Migrator().HasTable("users") {
+		t.Error("users table left after rolling back every migration")
+	}
+}
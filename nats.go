@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest message read from the server
+	natsMaxPayload = 8 << 20
+	// Wait after a failed publish before the servers are tried again
+	natsRetryBackoff = 5 * time.Second
+	// JetStream error code for a stream that exists with another configuration
+	natsStreamNameInUse = 10058
+)
+
+// NATSPublisher publishes messages to JetStream over the NATS protocol, each
+// on a subject named after its event, and waits for the stream to store
+// them. Messages carry their ID as Nats-Msg-Id, so the stream drops those the
+// outbox publishes again. A lost connection is dialled again on the next
+// publish, after a pause so writes are not held up by the servers.
+type NATSPublisher struct {
+	servers []*url.URL
+	prefix  string
+	stream  string
+	timeout time.Duration
+
+	mu        sync.Mutex
+	conn      *natsConn
+	nextReply uint64
+	downUntil time.Time
+}
+
+// Parse the comma-separated NATS_URL servers
+func NewNATSPublisher(servers, prefix, stream string, timeout time.Duration) (*NATSPublisher, error) {
+	p := &NATSPublisher{prefix: prefix, stream: stream, timeout: timeout}
+	for _, s := range strings.Split(servers, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" || u.Host == "" {
+			return nil, fmt.Errorf("%s: expected nats://host:port or tls://host:port", u.Redacted())
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "4222")
+		}
+		p.servers = append(p.servers, u)
+	}
+	return p, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, messages []BrokerMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if wait := time.Until(p.downUntil); wait > 0 {
+		return fmt.Errorf("servers unavailable, retrying in %s", wait.Round(time.Second))
+	}
+	err := p.publish(ctx, messages)
+	if err != nil {
+		p.closeConn()
+		p.downUntil = time.Now().Add(natsRetryBackoff)
+	}
+	return err
+}
+
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConn()
+	return nil
+}
+
+func (p *NATSPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.close()
+		p.conn = nil
+	}
+}
+
+// Publish the messages in one write, then wait for the stream's ack of each
+func (p *NATSPublisher) publish(ctx context.Context, messages []BrokerMessage) error {
+	if p.conn == nil || p.conn.closed() {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	pending := make(map[string]bool, len(messages))
+	for _, m := range messages {
+		header := "NATS/1.0\r\nNats-Msg-Id: " + m.ID + "\r\nContent-Type: application/json\r\n\r\n"
+		reply := p.replySubject()
+		fmt.Fprintf(&buf, "HPUB %s.%s %s %d %d\r\n%s%s\r\n",
+			p.prefix, m.Event, reply, len(header), len(header)+len(m.Value), header, m.Value)
+		pending[reply] = true
+	}
+	if err := p.conn.write(ctx, buf.Bytes()); err != nil {
+		return err
+	}
+	return p.conn.awaitReplies(ctx, pending, jetStreamAckError)
+}
+
+// Connect to the first server that accepts us and make sure the stream exists
+func (p *NATSPublisher) connect(ctx context.Context) error {
+	p.closeConn()
+	var errs []error
+	for _, u := range p.servers {
+		conn, err := dialNATS(ctx, u, p.timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u.Host, err))
+			continue
+		}
+		p.conn = conn
+		return p.ensureStream(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+// Create the stream for the prefix's subjects, keeping it if it already
+// exists, even with another configuration
+func (p *NATSPublisher) ensureStream(ctx context.Context) error {
+	if p.stream == "" {
+		return nil
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"name":     p.stream,
+		"subjects": []string{p.prefix + ".>"},
+		"storage":  "file",
+	})
+	if err != nil {
+		return err
+	}
+	reply := p.replySubject()
+	request := fmt.Sprintf("PUB $JS.API.STREAM.CREATE.%s %s %d\r\n%s\r\n", p.stream, reply, len(config), config)
+	if err := p.conn.write(ctx, []byte(request)); err != nil {
+		return err
+	}
+	return p.conn.awaitReplies(ctx, map[string]bool{reply: true}, func(msg natsMsg) error {
+		var resp struct {
+			Error *jetStreamError `json:"error"`
+		}
+		if err := json.Unmarshal(msg.data, &resp); err != nil {
+			return err
+		}
+		if resp.Error != nil && resp.Error.ErrCode != natsStreamNameInUse {
+			return fmt.Errorf("create stream %s: %w", p.stream, resp.Error)
+		}
+		return nil
+	})
+}
+
+// A new subject on the connection's inbox, for one reply
+func (p *NATSPublisher) replySubject() string {
+	p.nextReply++
+	return p.conn.inbox + strconv.FormatUint(p.nextReply, 10)
+}
+
+// jetStreamError is the error in a JetStream API or publish reply
+type jetStreamError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *jetStreamError) Error() string {
+	return e.Description
+}
+
+// The error in the stream's reply to a publish, or nil if it stored the message
+func jetStreamAckError(msg natsMsg) error {
+	// The server answers for the stream when none listens on the subject
+	if strings.HasPrefix(msg.header, "NATS/1.0 503") {
+		return errors.New("no stream stores the subject")
+	}
+	var ack struct {
+		Stream string          `json:"stream"`
+		Error  *jetStreamError `json:"error"`
+	}
+	if err := json.Unmarshal(msg.data, &ack); err != nil {
+		return err
+	}
+	if ack.Error != nil {
+		return ack.Error
+	}
+	if ack.Stream == "" {
+		return errors.New("unexpected publish reply")
+	}
+	return nil
+}
+
+// natsMsg is a message delivered to the connection's inbox
+type natsMsg struct {
+	subject string
+	header  string
+	data    []byte
+}
+
+// natsConn is a connection to a NATS server subscribed to its own inbox. A
+// goroutine reads from it, answering the server's pings so an idle
+// connection stays up, and hands the inbox's messages to awaitReplies.
+type natsConn struct {
+	conn  net.Conn
+	inbox string
+	wmu   sync.Mutex
+	msgs  chan natsMsg
+	done  chan struct{}
+	// Why the connection ended; set before done is closed
+	err error
+}
+
+// Connect to a NATS server, upgrading to TLS if either side asks for it,
+// authenticate with the URL's credentials and subscribe to a new inbox
+func dialNATS(ctx context.Context, u *url.URL, timeout time.Duration) (*natsConn, error) {
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	raw, err := d.DialContext(dialCtx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := raw
+	ok := false
+	defer func() {
+		if !ok {
+			conn.Close()
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	infoJSON, found := strings.CutPrefix(line, "INFO ")
+	if !found {
+		return nil, fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return nil, err
+	}
+	if !info.Headers {
+		return nil, errors.New("server does not support headers")
+	}
+	if u.Scheme == "tls" || info.TLSRequired {
+		tc := tls.Client(raw, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(dialCtx); err != nil {
+			return nil, err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"lang":          "go",
+		"version":       "1.0.0",
+		"protocol":      1,
+		"name":          brokerClientName,
+		"headers":       true,
+		"no_responders": true,
+	}
+	if u.User != nil {
+		if pass, hasPass := u.User.Password(); hasPass {
+			options["user"], options["pass"] = u.User.Username(), pass
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	inbox := "_INBOX." + hex.EncodeToString(id) + "."
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s* 1\r\nPING\r\n", connect, inbox); err != nil {
+		return nil, err
+	}
+	// The server answers the ping once it has accepted the connection
+	if line, err = r.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	if line = strings.TrimSpace(line); line != "PONG" {
+		return nil, errors.New(strings.Trim(strings.TrimPrefix(line, "-ERR "), "'"))
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &natsConn{conn: conn, inbox: inbox, msgs: make(chan natsMsg, 64), done: make(chan struct{})}
+	go c.read(r)
+	ok = true
+	return c, nil
+}
+
+// Read from the server until the connection ends
+func (c *natsConn) read(r *bufio.Reader) {
+	defer close(c.done)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.err = err
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if err := c.write(context.Background(), []byte("PONG\r\n")); err != nil {
+				c.err = err
+				return
+			}
+		case "MSG", "HMSG":
+			msg, err := readNATSMsg(r, strings.ToUpper(op) == "HMSG", strings.Fields(args))
+			if err != nil {
+				c.err = err
+				c.conn.Close()
+				return
+			}
+			// Late replies to a publish that already gave up are dropped
+			select {
+			case c.msgs <- msg:
+			default:
+			}
+		case "-ERR":
+			c.err = errors.New(strings.Trim(args, "'"))
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// Read the body of a MSG <subject> <sid> [reply] <size> or
+// HMSG <subject> <sid> [reply] <header size> <size>
+func readNATSMsg(r *bufio.Reader, headers bool, fields []string) (natsMsg, error) {
+	fieldCount := 3
+	if headers {
+		fieldCount = 4
+	}
+	if len(fields) < fieldCount || len(fields) > fieldCount+1 {
+		return natsMsg{}, errors.New("malformed message")
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 || size > natsMaxPayload {
+		return natsMsg{}, errors.New("malformed message size")
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize < 0 || headerSize > size {
+			return natsMsg{}, errors.New("malformed message header size")
+		}
+	}
+	buf := make([]byte, size+2) // with the trailing CRLF
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return natsMsg{}, err
+	}
+	return natsMsg{subject: fields[0], header: string(buf[:headerSize]), data: buf[headerSize:size]}, nil
+}
+
+func (c *natsConn) write(ctx context.Context, b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsRetryBackoff)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Wait for a reply on each of the pending subjects, checking each with check
+func (c *natsConn) awaitReplies(ctx context.Context, pending map[string]bool, check func(natsMsg) error) error {
+	for len(pending) > 0 {
+		select {
+		case msg := <-c.msgs:
+			if !pending[msg.subject] {
+				continue
+			}
+			delete(pending, msg.subject)
+			if err := check(msg); err != nil {
+				return err
+			}
+		case <-c.done:
+			if c.err != nil {
+				return c.err
+			}
+			return errors.New("connection closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (c *natsConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *natsConn) close() {
+	c.conn.Close()
+	<-c.done
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	formatJSON    = "json"
+	formatXML     = "xml"
+	formatMsgpack = "msgpack"
+	formatJSONAPI = "jsonapi"
+)
+
+// Media types clients may ask for, and the format each maps to
+var responseFormats = map[string]string{
+	"application/json":      formatJSON,
+	"application/xml":       formatXML,
+	"text/xml":              formatXML,
+	"application/msgpack":   formatMsgpack,
+	"application/x-msgpack": formatMsgpack,
+	jsonAPIContentType:      formatJSONAPI,
+}
+
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// Pick the response format from the Accept header by quality, defaulting to JSON
+func negotiateFormat(c echo.Context) string {
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := responseFormats[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// Mark the response as depending on the Accept header, once
+func varyOnAccept(c echo.Context) {
+	header := c.Response().Header()
+	for _, v := range header.Values(echo.HeaderVary) {
+		if strings.EqualFold(v, echo.HeaderAccept) {
+			return
+		}
+	}
+	header.Add(echo.HeaderVary, echo.HeaderAccept)
+}
+
+// Encode v in the negotiated format. XML and MessagePack are derived from the
+// JSON form so every format carries the same field names and IDs.
+func encodeResponse(c echo.Context, v interface{}) (string, []byte, error) {
+	format := negotiateFormat(c)
+	if format == formatJSONAPI {
+		body, err := encodeJSONAPI(c, v)
+		return jsonAPIContentType, body, err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+	switch format {
+	case formatXML:
+		body, err = jsonToXML(body)
+		return echo.MIMEApplicationXMLCharsetUTF8, body, err
+	case formatMsgpack:
+		body, err = jsonToMsgpack(body)
+		return echo.MIMEApplicationMsgpack, body, err
+	default:
+		return echo.MIMEApplicationJSON, body, nil
+	}
+}
+
+// Write v with the status in the format the client accepts
+func respond(c echo.Context, status int, v interface{}) error {
+	contentType, body, err := encodeResponse(c, v)
+	if err != nil {
+		return err
+	}
+	varyOnAccept(c)
+	return c.Blob(status, contentType, body)
+}
+
+// Convert a JSON document to XML under a <response> root. Arrays become
+// repeated <item> elements; keys that are not valid XML names become
+// <entry key="...">.
+func jsonToXML(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if err := writeXMLValue(dec, enc, "response"); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeXMLValue(dec *json.Decoder, enc *xml.Encoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !xmlNamePattern.MatchString(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		for dec.More() {
+			child := "item"
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child = key.(string)
+			}
+			if err := writeXMLValue(dec, enc, child); err != nil {
+				return err
+			}
+		}
+		// Consume the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(t))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Convert a JSON document to MessagePack, keeping integers as integers
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(msgpackValue(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Replace json.Number with int64 or float64 throughout a decoded document
+func msgpackValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = msgpackValue(child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = msgpackValue(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+	"gorm.io/gorm"
+)
+
+const (
+	// Cookie carrying the state and PKCE verifier of a login from redirect to callback
+	oauthCookie    = "oauth_login"
+	oauthCookieTTL = 10 * time.Minute
+
+	oauthHTTPTimeout = 10 * time.Second
+)
+
+// UserIdentity links a user to their account at a social login provider
+type UserIdentity struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	TenantID  uint      `json:"-" gorm:"not null;default:1;uniqueIndex:idx_user_identities_provider_subject,priority:1"`
+	UserID    uint      `json:"-" gorm:"not null;index"`
+	Provider  string    `json:"provider" gorm:"size:20;not null;uniqueIndex:idx_user_identities_provider_subject,priority:2"`
+	Subject   string    `json:"subject" gorm:"size:255;not null;uniqueIndex:idx_user_identities_provider_subject,priority:3"`
+	Email     string    `json:"email" gorm:"size:255"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The account a provider reports for the logged-in person
+type oauthProfile struct {
+	Subject string
+	Name    string
+	Email   string
+	// Whether the provider has checked the person owns the email
+	EmailVerified bool
+}
+
+type oauthProvider struct {
+	config  oauth2.Config
+	profile func(ctx context.Context, client *http.Client) (oauthProfile, error)
+}
+
+// Social login providers with a client ID and secret configured
+var oauthProviders = map[string]*oauthProvider{}
+
+// Set up the social login providers that are configured
+func initOAuth() {
+	if cfg.OAuth.GoogleClientID != "" {
+		oauthProviders["google"] = &oauthProvider{
+			config: oauth2.Config{
+				ClientID:     cfg.OAuth.GoogleClientID,
+				ClientSecret: cfg.OAuth.GoogleClientSecret,
+				Endpoint:     endpoints.Google,
+				Scopes:       []string{"openid", "email", "profile"},
+			},
+			profile: googleProfile,
+		}
+	}
+	if cfg.OAuth.GitHubClientID != "" {
+		oauthProviders["github"] = &oauthProvider{
+			config: oauth2.Config{
+				ClientID:     cfg.OAuth.GitHubClientID,
+				ClientSecret: cfg.OAuth.GitHubClientSecret,
+				Endpoint:     endpoints.GitHub,
+				Scopes:       []string{"read:user", "user:email"},
+			},
+			profile: githubProfile,
+		}
+	}
+	for name := range oauthProviders {
+		log.Printf("Social login enabled for %s", name)
+	}
+}
+
+// The provider named in the path, with its callback URL on this mount of the API
+func oauthProviderFor(c echo.Context) (*oauth2.Config, *oauthProvider, error) {
+	provider, ok := oauthProviders[c.Param("provider")]
+	if !ok {
+		return nil, nil, newProblem(http.StatusNotFound, "Unknown login provider")
+	}
+	base := cfg.OAuth.RedirectBaseURL
+	if base == "" {
+		base = c.Scheme() + "://" + c.Request().Host
+	}
+	config := provider.config
+	config.RedirectURL = strings.TrimSuffix(base, "/") + apiBase(c) + "/auth/" + c.Param("provider") + "/callback"
+	return &config, provider, nil
+}
+
+// Send the browser to the provider to log in
+func oauthLogin(c echo.Context) error {
+	config, _, err := oauthProviderFor(c)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	verifier := oauth2.GenerateVerifier()
+
+	c.SetCookie(&http.Cookie{
+		Name:     oauthCookie,
+		Value:    state + "." + verifier,
+		Path:     apiBase(c) + "/auth/" + c.Param("provider"),
+		MaxAge:   int(oauthCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		// Lax lets the cookie through on the provider's top-level redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusFound, config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)))
+}
+
+// Finish a login: check the state, exchange the code, find or create the
+// user for the provider account and issue our own token
+func oauthCallback(c echo.Context) error {
+	config, provider, err := oauthProviderFor(c)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{Name: oauthCookie, Path: apiBase(c) + "/auth/" + c.Param("provider"), MaxAge: -1})
+
+	if reason := c.QueryParam("error"); reason != "" {
+		return newProblem(http.StatusUnauthorized, "Login was not completed: "+reason)
+	}
+	cookie, err := c.Cookie(oauthCookie)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Login expired, start again")
+	}
+	state, verifier, _ := strings.Cut(cookie.Value, ".")
+	if state == "" || c.QueryParam("state") != state {
+		return newProblem(http.StatusBadRequest, "Invalid login state")
+	}
+
+	ctx := context.WithValue(c.Request().Context(), oauth2.HTTPClient, &http.Client{Timeout: oauthHTTPTimeout})
+	token, err := config.Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		requestLogger(c).Warn("OAuth code exchange failed", "provider", c.Param("provider"), "error", err)
+		return newProblem(http.StatusUnauthorized, "Login with the provider failed")
+	}
+	profile, err := provider.profile(ctx, config.Client(ctx, token))
+	if err != nil {
+		requestLogger(c).Error("failed to fetch OAuth profile", "provider", c.Param("provider"), "error", err)
+		return newProblem(http.StatusBadGateway, "Failed to fetch the profile from the provider")
+	}
+
+	user, err := userForIdentity(c.Request().Context(), c.Param("provider"), profile)
+	if err != nil {
+		if errors.Is(err, ErrEmailTaken) {
+			return newProblem(http.StatusConflict, "A user with this email already exists, and the email is not verified by both the provider and the user")
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return newProblem(http.StatusUnauthorized, "The user linked to this account has been deleted")
+		}
+		requestLogger(c).Error("failed to link OAuth identity", "error", err)
+		return newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	if err := inactiveUserProblem(user); err != nil {
+		return err
+	}
+	// The callback has no way to ask for a TOTP code
+	if cfg.Auth.TwoFactorEnabled {
+		if _, err := enabledTwoFactor(c.Request().Context(), user.ID); err == nil {
+			return newProblem(http.StatusForbidden, "Users with two-factor authentication must log in with their password and code")
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return newProblem(http.StatusInternalServerError, "Failed to log in")
+		}
+	}
+	recordLogin(c.Request().Context(), user.ID)
+	tokens, err := issueTokens(c.Request().Context(), *user, "")
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to issue token")
+	}
+
+	// Browser logins land on the frontend with the tokens in the fragment,
+	// which is not sent to servers or logged
+	if cfg.OAuth.SuccessURL != "" {
+		fragment := url.Values{
+			"token":              {tokens.Token},
+			"token_type":         {tokens.TokenType},
+			"expires_at":         {tokens.ExpiresAt.Format(time.RFC3339)},
+			"refresh_token":      {tokens.RefreshToken},
+			"refresh_expires_at": {tokens.RefreshExpiresAt.Format(time.RFC3339)},
+		}
+		return c.Redirect(http.StatusFound, cfg.OAuth.SuccessURL+"#"+fragment.Encode())
+	}
+	return respond(c, http.StatusOK, tokens)
+}
+
+// Find the user linked to the provider account. Unlinked accounts are linked
+// to the user with the same email if both the provider and the user verified
+// it, or else get a new user with the default roles.
+func userForIdentity(ctx context.Context, provider string, profile oauthProfile) (*User, error) {
+	roles, err := defaultRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var user *User
+	// A user created here is only announced once the transaction commits, not
+	// when a concurrent callback's identity wins and this one rolls back
+	err = userTransaction(db.WithContext(ctx), func(tx *gorm.DB) error {
+		var identity UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, profile.Subject).Take(&identity).Error
+		if err == nil {
+			user = new(User)
+			return tx.Take(user, identity.UserID).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := normalizeEmail(profile.Email)
+		if email != "" {
+			existing := new(User)
+			err := tx.Unscoped().Where("email = ?", email).Take(existing).Error
+			switch {
+			case err == nil && !profile.EmailVerified:
+				return ErrEmailTaken
+			case err == nil && existing.DeletedAt.Valid:
+				// Deleted users stay deleted
+				return ErrEmailTaken
+			case err == nil && !existing.IsVerified:
+				// Whoever signed up with the address may not own it, and would
+				// keep their password on the linked account
+				return ErrEmailTaken
+			case err == nil:
+				user = existing
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				return err
+			}
+		}
+		if user == nil {
+			user = &User{Name: profile.Name, Email: optionalEmail(email), IsVerified: email != "" && profile.EmailVerified, Roles: roles}
+			if err := tx.Create(user).Error; err != nil {
+				return emailConflict(translateError(err))
+			}
+			usersCreatedTotal.Inc()
+		}
+		return tx.Create(&UserIdentity{UserID: user.ID, Provider: provider, Subject: profile.Subject, Email: email}).Error
+	})
+	return user, err
+}
+
+// Fetch a JSON document from a provider API
+func getProviderJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func googleProfile(ctx context.Context, client *http.Client) (oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getProviderJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return oauthProfile{}, err
+	}
+	name := info.Name
+	if name == "" {
+		name, _, _ = strings.Cut(info.Email, "@")
+	}
+	return oauthProfile{Subject: info.Sub, Name: name, Email: info.Email, EmailVerified: info.EmailVerified}, nil
+}
+
+func githubProfile(ctx context.Context, client *http.Client) (oauthProfile, error) {
+	var info struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getProviderJSON(ctx, client, "https://api.github.com/user", &info); err != nil {
+		return oauthProfile{}, err
+	}
+	// The profile's public email may be unset or unverified; the primary
+	// address from the emails API says whether it is verified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getProviderJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return oauthProfile{}, err
+	}
+	profile := oauthProfile{Subject: strconv.FormatInt(info.ID, 10), Name: info.Name}
+	if profile.Name == "" {
+		profile.Name = info.Login
+	}
+	for _, e := range emails {
+		if e.Primary {
+			profile.Email, profile.EmailVerified = e.Email, e.Verified
+		}
+	}
+	return profile, nil
+}
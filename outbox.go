@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// Statement setting holding the outbox rows a write added, for publishing
+	// once it commits
+	outboxSetting = "events:outbox"
+
+	// Events a relay pass claims at most
+	outboxBatchSize = 100
+	// How long a relay has to publish an event it claimed before another may
+	outboxLease = time.Minute
+	// Events younger than this are left to the process that wrote them
+	outboxGrace = 10 * time.Second
+	// First wait before an event whose handlers failed is relayed again
+	outboxBackoff       = 10 * time.Second
+	outboxPurgeInterval = time.Hour
+)
+
+// OutboxEvent is a user event written in the same transaction as the change
+// it announces. The writer publishes it after the commit; a relay publishes
+// any the writer did not get to, such as when the process died in between.
+type OutboxEvent struct {
+	ID          uint64 `gorm:"primaryKey"`
+	TenantID    uint   `gorm:"not null;default:1;index"`
+	Event       string `gorm:"size:50;not null"`
+	Payload     string `gorm:"type:text;not null"`
+	Attempts    int    `gorm:"not null;default:0"`
+	LastError   string `gorm:"size:500"`
+	LockedUntil *time.Time
+	PublishedAt *time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// outboxUser is a User stored as its own fields rather than its API form,
+// which may swap the ID for the UUID
+type outboxUser User
+
+// outboxPayload is a UserEvent as stored in the outbox
+type outboxPayload struct {
+	Event      string      `json:"event"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       *outboxUser `json:"data"`
+}
+
+// outboxBatch is the events one commit added to the outbox, with their rows
+type outboxBatch struct {
+	events []UserEvent
+	ids    []uint64
+}
+
+// Prepare an event for storing
+func newOutboxPayload(e UserEvent) outboxPayload {
+	user := *e.Data
+	// The manager is only ever loaded for display
+	user.Manager = nil
+	return outboxPayload{Event: e.Event, OccurredAt: e.OccurredAt, Data: (*outboxUser)(&user)}
+}
+
+// The stored event, back in the tenant it was stored with
+func (p *outboxPayload) userEvent(tenantID uint) UserEvent {
+	p.Data.TenantID = tenantID
+	return UserEvent{Event: p.Event, OccurredAt: p.OccurredAt, Data: (*User)(p.Data)}
+}
+
+// Add the events to the outbox within tx, the transaction of their change
+func writeOutbox(tx *gorm.DB, events []UserEvent) (*outboxBatch, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	rows := make([]OutboxEvent, len(events))
+	for i, e := range events {
+		payload, err := json.Marshal(newOutboxPayload(e))
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = OutboxEvent{TenantID: e.Data.TenantID, Event: e.Event, Payload: string(payload)}
+	}
+	if err := tx.Session(&gorm.Session{NewDB: true}).CreateInBatches(&rows, bulkInsertBatchSize).Error; err != nil {
+		return nil, err
+	}
+	batch := &outboxBatch{events: events, ids: make([]uint64, len(rows))}
+	for i, row := range rows {
+		batch.ids[i] = row.ID
+	}
+	return batch, nil
+}
+
+// Decode an outbox row back into its event
+func (o *OutboxEvent) userEvent() (UserEvent, error) {
+	var p outboxPayload
+	if err := json.Unmarshal([]byte(o.Payload), &p); err != nil {
+		return UserEvent{}, err
+	}
+	return p.userEvent(o.TenantID), nil
+}
+
+// GORM callback run before a write to users commits: add the changes its
+// User hooks recorded to the outbox in the same transaction. Changes held for
+// an enclosing userTransaction are added when that transaction ends.
+func outboxUserChanges(tx *gorm.DB) {
+	v, ok := tx.Statement.Settings.Load(userChangesSetting)
+	if !ok || tx.Error != nil || tx.RowsAffected == 0 {
+		return
+	}
+	if _, held := pendingChanges.Load(tx.Statement.ConnPool); held {
+		return
+	}
+	batch, err := writeOutbox(tx, newUserEvents(v.([]userChange)))
+	if err != nil {
+		tx.AddError(fmt.Errorf("outbox: %w", err))
+		return
+	}
+	tx.Statement.Settings.Store(outboxSetting, batch)
+}
+
+// Publish the events a commit just added to the outbox, then mark them
+// published. Events whose handlers fail are left for the relay to retry.
+func publishOutbox(ctx context.Context, batch *outboxBatch) {
+	if batch == nil {
+		return
+	}
+	err := userEvents.Publish(ctx, batch.events)
+	q := db.WithContext(context.WithoutCancel(ctx)).Model(&OutboxEvent{}).Where("id IN ?", batch.ids)
+	if err != nil {
+		err = q.Updates(map[string]interface{}{
+			"attempts":     1,
+			"last_error":   truncate(err.Error(), 500),
+			"locked_until": time.Now().Add(retryBackoff(outboxBackoff, 1)),
+		}).Error
+	} else {
+		err = q.Update("published_at", time.Now()).Error
+	}
+	if err != nil {
+		contextLogger(ctx).Error("failed to record outbox events", "error", err)
+	}
+}
+
+// Start relaying outbox events that their writers did not publish, every
+// OUTBOX_RELAY_INTERVAL, and deleting those published over OUTBOX_RETENTION
+// ago. The returned function stops the relay.
+func startOutboxRelay() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Outbox.RelayInterval)
+		defer ticker.Stop()
+		purge := time.NewTicker(outboxPurgeInterval)
+		defer purge.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				relayOutbox(ctx)
+			case <-purge.C:
+				err := db.WithContext(ctx).
+					Where("published_at < ?", time.Now().Add(-cfg.Outbox.Retention)).
+					Delete(&OutboxEvent{}).Error
+				if err != nil && ctx.Err() == nil {
+					contextLogger(ctx).Error("failed to delete published outbox events", "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Claim and publish the due unpublished events, oldest first, each in its
+// tenant. A replica that dies mid-publish leaves its claim to lapse, so every
+// event is published at least once.
+func relayOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		now := time.Now()
+		var rows []OutboxEvent
+		err := db.WithContext(ctx).
+			Where("published_at IS NULL AND created_at < ?", now.Add(-outboxGrace)).
+			Where("locked_until IS NULL OR locked_until < ?", now).
+			Order("id").Limit(outboxBatchSize).Find(&rows).Error
+		if err != nil {
+			if ctx.Err() == nil {
+				contextLogger(ctx).Error("failed to load outbox events", "error", err)
+			}
+			return
+		}
+		for i := range rows {
+			if claimOutboxEvent(ctx, &rows[i]) {
+				relayOutboxEvent(ctx, &rows[i])
+			}
+		}
+		if len(rows) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// Take the event for this relay until the lease ends, unless another relay got it first
+func claimOutboxEvent(ctx context.Context, row *OutboxEvent) bool {
+	now := time.Now()
+	claim := db.WithContext(ctx).Model(&OutboxEvent{}).
+		Where("id = ? AND published_at IS NULL AND attempts = ?", row.ID, row.Attempts).
+		Where("locked_until IS NULL OR locked_until < ?", now).
+		Updates(map[string]interface{}{"attempts": row.Attempts + 1, "locked_until": now.Add(outboxLease)})
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return false
+	}
+	row.Attempts++
+	return true
+}
+
+// Publish one claimed event in its tenant and record the outcome
+func relayOutboxEvent(ctx context.Context, row *OutboxEvent) {
+	e, err := row.userEvent()
+	if err == nil {
+		var tenant Tenant
+		if err = db.WithContext(ctx).Take(&tenant, row.TenantID).Error; err == nil {
+			err = userEvents.Publish(withTenant(ctx, &tenant), []UserEvent{e})
+		}
+	}
+	updates := map[string]interface{}{"locked_until": nil, "last_error": ""}
+	if err != nil {
+		updates["last_error"] = truncate(err.Error(), 500)
+		updates["locked_until"] = time.Now().Add(retryBackoff(outboxBackoff, row.Attempts))
+		contextLogger(ctx).Warn("outbox event not published", "outbox_id", row.ID, "attempts", row.Attempts, "error", err)
+	} else {
+		updates["published_at"] = time.Now()
+	}
+	if err := db.WithContext(ctx).Model(row).Updates(updates).Error; err != nil && ctx.Err() == nil {
+		contextLogger(ctx).Error("failed to record outbox event", "outbox_id", row.ID, "error", err)
+	}
+}
+
+// Add outbox rows in the transaction of each write to users
+func registerOutboxCallbacks(db *gorm.DB) error {
+	const name = "events:outbox_user_changes"
+	const commit = "gorm:commit_or_rollback_transaction"
+	if err := db.Callback().Create().After("gorm:after_create").Before(commit).Register(name, outboxUserChanges); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:after_update").Before(commit).Register(name, outboxUserChanges); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:after_delete").Before(commit).Register(name, outboxUserChanges)
+}
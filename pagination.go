@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Pagination describes the page requested by the client
+type Pagination struct {
+	Page   int
+	Limit  int
+	Offset int
+	// Paged with ?offset=, which need not fall on a page boundary
+	ByOffset bool
+}
+
+// PageMeta is returned alongside paginated results
+type PageMeta struct {
+	Page       int   `json:"page"`
+	Limit      int   `json:"limit"`
+	Total      int64 `json:"total"`
+	TotalPages int   `json:"total_pages"`
+	NextPage   *int  `json:"next_page"`
+	PrevPage   *int  `json:"prev_page"`
+}
+
+// PagedResponse is the envelope for paginated list endpoints
+type PagedResponse struct {
+	Data  interface{} `json:"data"`
+	Meta  PageMeta    `json:"meta"`
+	Links Links       `json:"links,omitempty"`
+}
+
+// CursorMeta is returned alongside cursor-paginated results
+type CursorMeta struct {
+	Limit      int     `json:"limit"`
+	NextCursor *string `json:"next_cursor"`
+	HasMore    bool    `json:"has_more"`
+}
+
+// CursorPage is the envelope for cursor-paginated list endpoints
+type CursorPage struct {
+	Data  interface{} `json:"data"`
+	Meta  CursorMeta  `json:"meta"`
+	Links Links       `json:"links"`
+}
+
+// Parse page/limit (or offset/limit) query params with defaults
+func parsePagination(c echo.Context) (Pagination, error) {
+	p := Pagination{Page: 1, Limit: defaultPageSize}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, errors.New("Invalid limit")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		p.Limit = limit
+	}
+
+	if v := c.QueryParam("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return p, errors.New("Invalid page")
+		}
+		p.Page = page
+		p.Offset = (page - 1) * p.Limit
+	} else if v := c.QueryParam("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return p, errors.New("Invalid offset")
+		}
+		p.Page = offset/p.Limit + 1
+		p.Offset = offset
+		p.ByOffset = true
+	}
+
+	return p, nil
+}
+
+// Parse a react-admin style ?_start=&_end= range, end exclusive, into a page
+func parseRange(c echo.Context) (Pagination, error) {
+	start, end := 0, defaultPageSize
+	if v := c.QueryParam("_start"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Pagination{}, errors.New("Invalid _start")
+		}
+		start, end = n, n+defaultPageSize
+	}
+	if v := c.QueryParam("_end"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= start {
+			return Pagination{}, errors.New("Invalid _end")
+		}
+		end = n
+	}
+	limit := min(end-start, maxPageSize)
+	return Pagination{Page: start/limit + 1, Limit: limit, Offset: start}, nil
+}
+
+// Report a range of results the way react-admin's json-server data provider
+// expects: the total in X-Total-Count and neighbouring ranges in an RFC 5988
+// Link header
+func setRangeHeaders(c echo.Context, p Pagination, total int64) {
+	header := c.Response().Header()
+	header.Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	link := func(start int, rel string) string {
+		url := linkWithQuery(c, map[string]string{
+			"_start": strconv.Itoa(start),
+			"_end":   strconv.Itoa(start + p.Limit),
+		})
+		return fmt.Sprintf(`<%s>; rel="%s"`, url, rel)
+	}
+	links := []string{link(0, "first")}
+	if p.Offset > 0 {
+		links = append(links, link(max(p.Offset-p.Limit, 0), "prev"))
+	}
+	if int64(p.Offset+p.Limit) < total {
+		links = append(links, link(p.Offset+p.Limit, "next"))
+	}
+	if total > 0 {
+		links = append(links, link(int((total-1)/int64(p.Limit))*p.Limit, "last"))
+	}
+	header.Add("Link", strings.Join(links, ", "))
+}
+
+// Build page metadata from the total row count
+func newPageMeta(p Pagination, total int64) PageMeta {
+	totalPages := int((total + int64(p.Limit) - 1) / int64(p.Limit))
+	meta := PageMeta{
+		Page:       p.Page,
+		Limit:      p.Limit,
+		Total:      total,
+		TotalPages: totalPages,
+	}
+	if p.Page < totalPages {
+		next := p.Page + 1
+		meta.NextPage = &next
+	}
+	if p.Page > 1 {
+		prev := p.Page - 1
+		if prev > totalPages && totalPages > 0 {
+			prev = totalPages
+		}
+		meta.PrevPage = &prev
+	}
+	return meta
+}
+
+// Build the envelope for a page of results, linking to the neighbouring pages
+func newPagedResponse(c echo.Context, p Pagination, total int64, data interface{}) PagedResponse {
+	meta := newPageMeta(p, total)
+	if p.ByOffset {
+		return PagedResponse{Data: data, Meta: meta, Links: offsetLinks(c, p, total)}
+	}
+	page := func(n int) string {
+		return linkWithQuery(c, map[string]string{"page": strconv.Itoa(n)}, "offset")
+	}
+	links := Links{"self": c.Request().URL.RequestURI(), "first": page(1)}
+	if meta.TotalPages > 0 {
+		links["last"] = page(meta.TotalPages)
+	}
+	if meta.PrevPage != nil {
+		links["prev"] = page(*meta.PrevPage)
+	}
+	if meta.NextPage != nil {
+		links["next"] = page(*meta.NextPage)
+	}
+	return PagedResponse{Data: data, Meta: meta, Links: links}
+}
+
+// Link to the neighbouring ranges of a page requested by offset, which page
+// numbers cannot express when the offset is not a multiple of the limit
+func offsetLinks(c echo.Context, p Pagination, total int64) Links {
+	offset := func(n int) string {
+		return linkWithQuery(c, map[string]string{"offset": strconv.Itoa(n)}, "page")
+	}
+	links := Links{"self": c.Request().URL.RequestURI(), "first": offset(0)}
+	if total > 0 {
+		links["last"] = offset(max(int(total)-p.Limit, 0))
+	}
+	if p.Offset > 0 {
+		links["prev"] = offset(max(p.Offset-p.Limit, 0))
+	}
+	if int64(p.Offset+p.Limit) < total {
+		links["next"] = offset(p.Offset + p.Limit)
+	}
+	return links
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// PasswordResetToken lets the holder of a link set a user's password once,
+// until it expires. Only a hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  uint   `gorm:"not null;default:1;index"`
+	UserID    uint   `gorm:"not null;index"`
+	TokenHash string `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=72"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+// Change a user's password. Users changing their own must give the current
+// one; admins may set anyone's without it.
+func changePassword(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req := new(changePasswordRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+
+	current := c.Get("currentUser").(*User)
+	self := current.ID == id
+	if !self && !current.HasRole(RoleAdmin) {
+		return newProblem(http.StatusForbidden, "Only admins may set other users' passwords")
+	}
+	if self && req.CurrentPassword == "" {
+		p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+		p.Errors = map[string]string{"current_password": "is required"}
+		return p
+	}
+
+	if err := userService.ChangePassword(c.Request().Context(), id, *req, self); err != nil {
+		if errors.Is(err, ErrWrongPassword) {
+			return newProblem(http.StatusForbidden, "Current password is incorrect")
+		}
+		return userError(err, "Failed to change password")
+	}
+	// Sessions started with the old password end
+	if err := revokeRefreshTokens(c.Request().Context(), "user_id = ?", id); err != nil {
+		requestLogger(c).Error("failed to revoke refresh tokens", "error", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Start a password reset for the user with the email. The response is the
+// same whether or not such a user exists, so it cannot be used to probe emails.
+func forgotPassword(c echo.Context) error {
+	req := new(forgotPasswordRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	var user User
+	err := dbCtx(c).Where("email = ?", normalizeEmail(req.Email)).Take(&user).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return newProblem(http.StatusInternalServerError, "Failed to start password reset")
+	default:
+		token, err := createPasswordResetToken(c.Request().Context(), user)
+		if err != nil {
+			requestLogger(c).Error("failed to create password reset token", "error", err)
+			return newProblem(http.StatusInternalServerError, "Failed to start password reset")
+		}
+		if err := sendPasswordReset(c.Request().Context(), user, token); err != nil {
+			requestLogger(c).Error("failed to send password reset", "error", err)
+			return newProblem(http.StatusInternalServerError, "Failed to start password reset")
+		}
+	}
+	return respond(c, http.StatusAccepted, map[string]string{
+		"message": "If a user has this email, a password reset link has been sent to it",
+	})
+}
+
+// Set a new password with a token from a reset link, using up the token
+func resetPassword(c echo.Context) error {
+	req := new(resetPasswordRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	now := time.Now()
+	var token PasswordResetToken
+	err := dbCtx(c).Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashAPIKey(req.Token), now).
+		Take(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusBadRequest, "Reset token is invalid, expired or already used")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to reset password")
+	}
+	// Claim the token so a concurrent reset with it fails
+	result := dbCtx(c).Model(&token).Where("used_at IS NULL").Update("used_at", now)
+	if result.Error != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to reset password")
+	}
+	if result.RowsAffected == 0 {
+		return newProblem(http.StatusBadRequest, "Reset token is invalid, expired or already used")
+	}
+
+	err = userService.ChangePassword(c.Request().Context(), token.UserID, changePasswordRequest{NewPassword: req.Password}, false)
+	if err != nil {
+		return userError(err, "Failed to reset password")
+	}
+	// Links sent before this one stop working too, as do existing sessions
+	if err := dbCtx(c).Where("user_id = ? AND used_at IS NULL", token.UserID).Delete(&PasswordResetToken{}).Error; err != nil {
+		requestLogger(c).Error("failed to revoke password reset tokens", "error", err)
+	}
+	if err := revokeRefreshTokens(c.Request().Context(), "user_id = ?", token.UserID); err != nil {
+		requestLogger(c).Error("failed to revoke refresh tokens", "error", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Issue a reset token for the user, valid for PASSWORD_RESET_TTL
+func createPasswordResetToken(ctx context.Context, user User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err := db.WithContext(ctx).Create(&PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashAPIKey(token),
+		ExpiresAt: time.Now().Add(cfg.Auth.PasswordResetTTL),
+	}).Error
+	return token, err
+}
+
+// Email the user a reset link
+func sendPasswordReset(ctx context.Context, user User, token string) error {
+	link := token
+	if cfg.Auth.PasswordResetURL != "" {
+		link = cfg.Auth.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	}
+	return sendTemplatedEmail(ctx, emailPasswordReset, derefEmail(user.Email), emailData{
+		User:    user,
+		Link:    link,
+		Expires: lifetime(cfg.Auth.PasswordResetTTL),
+	})
+}
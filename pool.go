@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const maxConnectBackoff = 10 * time.Second
+
+// Open the database, retrying with exponential backoff for up to
+// DB_CONNECT_TIMEOUT so the app can start before the database accepts
+// connections, as when both come up together under docker compose
+func openDB(dialector gorm.Dialector) (*gorm.DB, error) {
+	deadline := time.Now().Add(cfg.DB.ConnectTimeout)
+	backoff := cfg.DB.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := gorm.Open(dialector, &gorm.Config{Logger: newGormLogger(), TranslateError: true})
+		if err == nil {
+			return conn, nil
+		}
+		// A failed ping still leaves an open pool behind
+		if conn != nil {
+			if sqlDB, err := conn.DB(); err == nil {
+				sqlDB.Close()
+			}
+		}
+
+		wait := min(backoff, time.Until(deadline))
+		if wait <= 0 {
+			return nil, err
+		}
+		log.Printf("Database not ready (attempt %d): %v; retrying in %s", attempt, err, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// poolLimits are the connection pool settings applied to every database pool
+type poolLimits struct {
+	maxOpen  int
+	maxIdle  int
+	lifetime time.Duration
+}
+
+// Read connection pool limits from the configuration
+func loadPoolLimits() poolLimits {
+	return poolLimits{
+		maxOpen:  cfg.DB.MaxOpenConns,
+		maxIdle:  cfg.DB.MaxIdleConns,
+		lifetime: cfg.DB.ConnMaxLifetime,
+	}
+}
+
+// Apply connection pool limits from the environment
+func configurePool() {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatalf("Failed to access database pool: %v", err)
+	}
+
+	limits := loadPoolLimits()
+	sqlDB.SetMaxOpenConns(limits.maxOpen)
+	sqlDB.SetMaxIdleConns(limits.maxIdle)
+	sqlDB.SetConnMaxLifetime(limits.lifetime)
+	log.Printf("Database pool: max_open=%d max_idle=%d max_lifetime=%s", limits.maxOpen, limits.maxIdle, limits.lifetime)
+}
+
+// Close the underlying connection pool
+func closeDB() {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+}
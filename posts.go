@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Post is written by a user. Posts of a soft-deleted user are hidden until
+// the user is restored, and purging the user deletes them.
+type Post struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TenantID  uint      `json:"-" gorm:"not null;default:1;index"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	User      *User     `json:"user,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	Title     string    `json:"title" gorm:"size:200;not null"`
+	Body      string    `json:"body" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (p Post) MarshalJSON() ([]byte, error) {
+	type plainPost Post
+	if userIDType != idTypeUUID {
+		return json.Marshal(plainPost(p))
+	}
+	user, err := userUUID(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainPost
+		UserID *string `json:"user_id"`
+	}{plainPost(p), user})
+}
+
+type createPostRequest struct {
+	Title string `json:"title" validate:"required,max=200"`
+	Body  string `json:"body" validate:"max=65535"`
+}
+
+// Path of a post under the request's API prefix
+func postPath(c echo.Context, p *Post) string {
+	return fmt.Sprintf("%s/posts/%d", apiBase(c), p.ID)
+}
+
+// Wrap a post with links to itself and its author
+func newPostResource(c echo.Context, p *Post) Resource {
+	return Resource{Data: p, Links: Links{"self": postPath(c, p), "user": userPathByID(c, p.UserID)}}
+}
+
+// List a user's posts, newest first
+func getUserPosts(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	var posts []Post
+	var total int64
+	q := dbCtx(c).Model(&Post{}).Where("user_id = ?", id)
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch posts")
+	}
+	if err := q.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&posts).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch posts")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, posts))
+}
+
+// Write a post as a user
+func createUserPost(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	req := new(createPostRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	if _, err := userService.Get(c.Request().Context(), id); err != nil {
+		return userError(err, "Failed to fetch user")
+	}
+	post := Post{UserID: id, Title: req.Title, Body: req.Body}
+	if err := dbCtx(c).Create(&post).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create post")
+	}
+	c.Response().Header().Set(echo.HeaderLocation, postPath(c, &post))
+	return respond(c, http.StatusCreated, newPostResource(c, &post))
+}
+
+// Fetch a post with its author, unless the author is deleted
+func getPost(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid post ID")
+	}
+	var post Post
+	if err := dbCtx(c).Preload("User").First(&post, id).Error; err != nil || post.User == nil {
+		return newProblem(http.StatusNotFound, "Post not found")
+	}
+	return respond(c, http.StatusOK, newPostResource(c, &post))
+}
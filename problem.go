@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Title, p.Detail)
+}
+
+// Build a problem for the given status code
+func newProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Render every error returned by a handler as application/problem+json
+func problemErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var p *Problem
+	var he *echo.HTTPError
+	switch {
+	case errors.As(err, &p):
+		copied := *p
+		p = &copied
+	case errors.As(err, &he):
+		p = newProblem(he.Code, fmt.Sprint(he.Message))
+	default:
+		requestLogger(c).Error("unhandled error", "error", err)
+		p = newProblem(http.StatusInternalServerError, "")
+	}
+	p.Instance = c.Request().URL.Path
+	p.RequestID = requestID(c)
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else if negotiateFormat(c) == formatJSONAPI {
+		err = writeJSONAPIError(c, p)
+	} else {
+		c.Response().Header().Set(echo.HeaderContentType, problemContentType)
+		c.Response().WriteHeader(p.Status)
+		err = json.NewEncoder(c.Response()).Encode(p)
+	}
+	if err != nil {
+		requestLogger(c).Error("failed to write error response", "error", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Filter maps a query parameter onto a whitelisted column comparison
+type Filter struct {
+	Param  string
+	Column string
+	// Part of a date column to compare instead: year, month or day
+	Part  string
+	Op    string
+	Parse func(string) (interface{}, error)
+}
+
+// Field is a response field clients may pick with ?fields=, loaded from a
+// column or, for an association, by a preload
+type Field struct {
+	Name    string
+	Column  string
+	Preload string
+}
+
+// QuerySpec lists the filters, sort keys and fields a list endpoint accepts
+type QuerySpec struct {
+	Filters     []Filter
+	Sorts       map[string]string
+	DefaultSort string
+	Fields      []Field
+	// JSON column filtered with ?meta.<key>=, if any
+	MetaColumn string
+}
+
+var userQuery = QuerySpec{
+	Filters: []Filter{
+		{Param: "name", Column: "name", Op: "="},
+		{Param: "email", Column: "email", Op: "=", Parse: parseEmailParam},
+		{Param: "birthday", Column: "birthday", Op: "=", Parse: parseDateParam},
+		{Param: "birthday_after", Column: "birthday", Op: ">", Parse: parseDateParam},
+		{Param: "birthday_before", Column: "birthday", Op: "<", Parse: parseDateParam},
+		{Param: "birthday_month", Column: "birthday", Part: "month", Op: "=", Parse: parseMonthParam},
+		{Param: "min_age", Column: "birthday", Op: "<=", Parse: parseMinAgeParam},
+		{Param: "max_age", Column: "birthday", Op: ">", Parse: parseMaxAgeParam},
+		{Param: "created_after", Column: "created_at", Op: ">", Parse: parseTimeParam},
+		{Param: "created_before", Column: "created_at", Op: "<", Parse: parseTimeParam},
+		{Param: "updated_after", Column: "updated_at", Op: ">", Parse: parseTimeParam},
+		{Param: "updated_before", Column: "updated_at", Op: "<", Parse: parseTimeParam},
+		{Param: "manager_id", Column: "manager_id", Op: "=", Parse: parseUserRefParam},
+		{Param: "status", Column: "status", Op: "=", Parse: parseStatusParam},
+		{Param: "external_id", Column: "external_id", Op: "="},
+	},
+	Sorts: map[string]string{
+		"id":         "id",
+		"name":       "name",
+		"birthday":   "birthday",
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+	},
+	DefaultSort: "id",
+	MetaColumn:  "metadata",
+	Fields: []Field{
+		{Name: "id", Column: "id"},
+		{Name: "uuid", Column: "uuid"},
+		{Name: "name", Column: "name"},
+		{Name: "email", Column: "email"},
+		{Name: "external_id", Column: "external_id"},
+		{Name: "is_verified", Column: "is_verified"},
+		{Name: "status", Column: "status"},
+		{Name: "status_reason", Column: "status_reason"},
+		{Name: "birthday", Column: "birthday"},
+		{Name: "age", Column: "birthday"},
+		{Name: "roles", Preload: "Roles"},
+		{Name: "manager_id", Column: "manager_id"},
+		{Name: "metadata", Column: "metadata"},
+		{Name: "deleted_at", Column: "deleted_at"},
+		{Name: "version", Column: "version"},
+		{Name: "createdAt", Column: "created_at"},
+		{Name: "updatedAt", Column: "updated_at"},
+	},
+}
+
+// Validate a YYYY-MM-DD query value
+func parseDateParam(v string) (interface{}, error) {
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		return nil, errors.New("Invalid date, expected YYYY-MM-DD")
+	}
+	return v, nil
+}
+
+// Parse an RFC 3339 timestamp or a YYYY-MM-DD date (midnight UTC)
+func parseTimeParam(v string) (interface{}, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return nil, errors.New("Invalid time, expected YYYY-MM-DD or RFC 3339")
+}
+
+// Match emails the way they are stored
+func parseEmailParam(v string) (interface{}, error) {
+	return normalizeEmail(v), nil
+}
+
+// Condition is a single column comparison parsed from the query string.
+// With a Key, the value under that key of a JSON column is compared instead;
+// with a Part, that part of a date column.
+type Condition struct {
+	Column string
+	Key    string
+	Part   string
+	Op     string
+	Value  interface{}
+}
+
+// SortField orders results by a column
+type SortField struct {
+	Column string
+	Desc   bool
+}
+
+// Parse the filters present in the request into conditions
+func (s QuerySpec) ParseFilters(c echo.Context) ([]Condition, error) {
+	return s.ParseFilterValues(c.QueryParams())
+}
+
+// Parse filters from query values, as saved for work done outside the request
+func (s QuerySpec) ParseFilterValues(values url.Values) ([]Condition, error) {
+	var conds []Condition
+	for _, f := range s.Filters {
+		v := values.Get(f.Param)
+		if v == "" {
+			continue
+		}
+		var value interface{} = v
+		if f.Parse != nil {
+			parsed, err := f.Parse(v)
+			if err != nil {
+				return nil, errors.New(f.Param + ": " + err.Error())
+			}
+			value = parsed
+		}
+		conds = append(conds, Condition{Column: f.Column, Part: f.Part, Op: f.Op, Value: value})
+	}
+	if s.MetaColumn != "" {
+		meta, err := parseMetaFilters(values, s.MetaColumn)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, meta...)
+	}
+	return conds, nil
+}
+
+// Parse the ?sort= param, e.g. sort=-birthday,name
+func (s QuerySpec) ParseSort(c echo.Context) ([]SortField, error) {
+	return s.SortFields(c.QueryParam("sort"))
+}
+
+// Parse a comma-separated sort value, falling back to the default sort
+func (s QuerySpec) SortFields(sort string) ([]SortField, error) {
+	if sort == "" {
+		sort = s.DefaultSort
+	}
+	var fields []SortField
+	for _, key := range strings.Split(sort, ",") {
+		key = strings.TrimSpace(key)
+		desc := strings.HasPrefix(key, "-")
+		key = strings.ToLower(strings.TrimPrefix(key, "-"))
+		column, ok := s.Sorts[key]
+		if !ok {
+			return nil, errors.New("Invalid sort field: " + key)
+		}
+		fields = append(fields, SortField{Column: column, Desc: desc})
+	}
+	return fields, nil
+}
+
+// Fieldset is the subset of fields picked with ?fields=; nil means every field
+type Fieldset struct {
+	Names    []string
+	Columns  []string
+	Preloads []string
+}
+
+// Parse ?fields=id,name. Names match case-insensitively and ignoring
+// underscores, so ID, created_at and createdAt all work.
+func (s QuerySpec) ParseFields(c echo.Context) (*Fieldset, error) {
+	v := c.QueryParam("fields")
+	if v == "" {
+		return nil, nil
+	}
+	fs := new(Fieldset)
+	for _, name := range strings.Split(v, ",") {
+		i := s.fieldIndex(name)
+		if i < 0 {
+			return nil, errors.New("Invalid field: " + strings.TrimSpace(name))
+		}
+		f := s.Fields[i]
+		if slices.Contains(fs.Names, f.Name) {
+			continue
+		}
+		fs.Names = append(fs.Names, f.Name)
+		if f.Column != "" && !slices.Contains(fs.Columns, f.Column) {
+			fs.Columns = append(fs.Columns, f.Column)
+		}
+		if f.Preload != "" {
+			fs.Preloads = append(fs.Preloads, f.Preload)
+		}
+	}
+	return fs, nil
+}
+
+// Associations GET /users/:id includes when named in ?expand=; consents are
+// summarized rather than preloaded
+var userExpansions = map[string]string{
+	"addresses": "Addresses",
+	"groups":    "Groups",
+	"manager":   "Manager",
+	"consents":  "",
+}
+
+// Parse ?expand=addresses,groups,manager,consents, naming associations to include with a user
+func parseExpand(c echo.Context) ([]string, error) {
+	v := c.QueryParam("expand")
+	if v == "" {
+		return nil, nil
+	}
+	var expand []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := userExpansions[name]; !ok {
+			return nil, errors.New("Invalid expand: " + name)
+		}
+		if !slices.Contains(expand, name) {
+			expand = append(expand, name)
+		}
+	}
+	return expand, nil
+}
+
+// Find a field by name, case-insensitively and ignoring underscores
+func (s QuerySpec) fieldIndex(name string) int {
+	normalize := func(name string) string {
+		return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "_", ""))
+	}
+	return slices.IndexFunc(s.Fields, func(f Field) bool { return normalize(f.Name) == normalize(name) })
+}
+
+// Parse react-admin style ?_sort=&_order= params, e.g. _sort=createdAt,name&_order=DESC,ASC.
+// Fields go by their response names, as react-admin knows them.
+func (s QuerySpec) ParseRangeSort(c echo.Context) ([]SortField, error) {
+	if c.QueryParam("_sort") == "" {
+		return s.SortFields("")
+	}
+	orders := strings.Split(c.QueryParam("_order"), ",")
+	var keys []string
+	for i, name := range strings.Split(c.QueryParam("_sort"), ",") {
+		key := strings.TrimSpace(name)
+		if f := s.fieldIndex(name); f >= 0 {
+			for k, column := range s.Sorts {
+				if column == s.Fields[f].Column {
+					key = k
+				}
+			}
+		}
+		if i < len(orders) && strings.EqualFold(strings.TrimSpace(orders[i]), "desc") {
+			key = "-" + key
+		}
+		keys = append(keys, key)
+	}
+	return s.SortFields(strings.Join(keys, ","))
+}
+
+// Keep only the fieldset's fields of each item in a list
+func (fs *Fieldset) Project(items interface{}) ([]map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &objects); err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		for name := range obj {
+			if !slices.Contains(fs.Names, name) {
+				delete(obj, name)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// Projection is a list encoded with only the fields of a fieldset
+type Projection struct {
+	Items  interface{}
+	Fields *Fieldset
+}
+
+func (p Projection) MarshalJSON() ([]byte, error) {
+	objects, err := p.Fields.Project(p.Items)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(objects)
+}
+
+// Add the conditions to a GORM query
+func applyConditions(q *gorm.DB, conds []Condition) *gorm.DB {
+	for _, cond := range conds {
+		var left interface{} = clause.Column{Name: cond.Column}
+		switch {
+		case cond.Key != "":
+			left = jsonText(q, cond.Column, cond.Key)
+		case cond.Part != "":
+			left = datePart(q, cond.Column, cond.Part)
+		}
+		q = q.Where(clause.Expr{
+			SQL:  "? " + cond.Op + " ?",
+			Vars: []interface{}{left, cond.Value},
+		})
+	}
+	return q
+}
+
+// Add the sort order to a GORM query. Rows tied on every field are ordered
+// by id in the last field's direction, so offset pages never repeat or skip
+// rows between requests.
+func applySort(q *gorm.DB, fields []SortField) *gorm.DB {
+	for _, f := range fields {
+		q = q.Order(clause.OrderByColumn{Column: clause.Column{Name: f.Column}, Desc: f.Desc})
+	}
+	if len(fields) > 0 && !slices.ContainsFunc(fields, func(f SortField) bool { return f.Column == "id" }) {
+		q = q.Order(clause.OrderByColumn{Column: clause.Column{Name: "id"}, Desc: fields[len(fields)-1].Desc})
+	}
+	return q
+}
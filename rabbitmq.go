@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQP 0-9-1 frame types
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+)
+
+const (
+	// Largest frame accepted from or offered to the broker
+	amqpMaxFrame = 128 << 10
+	// Longest heartbeat interval accepted; the broker may ask for a shorter one
+	amqpMaxHeartbeat = 60 * time.Second
+	// The one channel messages are published on
+	amqpChannel = 1
+	// Delivery mode of messages written to disk
+	amqpPersistent = 2
+	// Wait after a failed publish before the broker is tried again
+	rabbitRetryBackoff = 5 * time.Second
+)
+
+// amqpMethodID is the class and method of an AMQP method
+type amqpMethodID struct {
+	class, method uint16
+}
+
+// The AMQP methods the publisher sends or reacts to
+var (
+	amqpConnectionStart   = amqpMethodID{10, 10}
+	amqpConnectionStartOK = amqpMethodID{10, 11}
+	amqpConnectionTune    = amqpMethodID{10, 30}
+	amqpConnectionTuneOK  = amqpMethodID{10, 31}
+	amqpConnectionOpen    = amqpMethodID{10, 40}
+	amqpConnectionOpenOK  = amqpMethodID{10, 41}
+	amqpConnectionClose   = amqpMethodID{10, 50}
+	amqpConnectionCloseOK = amqpMethodID{10, 51}
+	amqpChannelOpen       = amqpMethodID{20, 10}
+	amqpChannelOpenOK     = amqpMethodID{20, 11}
+	amqpChannelClose      = amqpMethodID{20, 40}
+	amqpChannelCloseOK    = amqpMethodID{20, 41}
+	amqpExchangeDeclare   = amqpMethodID{40, 10}
+	amqpExchangeDeclareOK = amqpMethodID{40, 11}
+	amqpQueueDeclare      = amqpMethodID{50, 10}
+	amqpQueueDeclareOK    = amqpMethodID{50, 11}
+	amqpQueueBind         = amqpMethodID{50, 20}
+	amqpQueueBindOK       = amqpMethodID{50, 21}
+	amqpBasicPublish      = amqpMethodID{60, 40}
+	amqpBasicAck          = amqpMethodID{60, 80}
+	amqpBasicNack         = amqpMethodID{60, 120}
+	amqpConfirmSelect     = amqpMethodID{85, 10}
+	amqpConfirmSelectOK   = amqpMethodID{85, 11}
+)
+
+// amqpMethod is a method frame received from the broker
+type amqpMethod struct {
+	channel uint16
+	id      amqpMethodID
+	args    *amqpReader
+}
+
+// amqpChannelClosed is returned when the broker closes the channel, such as
+// when a declaration conflicts with an existing exchange. The connection
+// stays up and a new channel is opened for the next publish.
+type amqpChannelClosed struct {
+	err error
+}
+
+func (e *amqpChannelClosed) Error() string {
+	return "channel closed: " + e.err.Error()
+}
+
+func (e *amqpChannelClosed) Unwrap() error {
+	return e.err
+}
+
+// RabbitMQPublisher publishes messages over AMQP 0-9-1 to a durable topic
+// exchange, routed by event type, with a durable queue bound to every event.
+// Messages are persistent and Publish waits for the broker to confirm them.
+// A channel the broker closes is opened again, with its declarations, and a
+// lost connection is dialled again, after a pause so writes are not held up
+// by the broker.
+type RabbitMQPublisher struct {
+	url      *url.URL
+	exchange string
+	queue    string
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	conn        *amqpConn
+	channelOpen bool
+	// Delivery tag of the last message published on the channel
+	deliveryTag uint64
+	downUntil   time.Time
+}
+
+// Parse RABBITMQ_URL
+func NewRabbitMQPublisher(rawURL, exchange, queue string, timeout time.Duration) (*RabbitMQPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqp" && u.Scheme != "amqps" || u.Host == "" {
+		return nil, fmt.Errorf("%s: expected amqp://host:port/vhost or amqps://", u.Redacted())
+	}
+	if u.Port() == "" {
+		port := "5672"
+		if u.Scheme == "amqps" {
+			port = "5671"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if exchange == "" {
+		return nil, errors.New("RABBITMQ_EXCHANGE must be set")
+	}
+	return &RabbitMQPublisher{url: u, exchange: exchange, queue: queue, timeout: timeout}, nil
+}
+
+func (p *RabbitMQPublisher) Publish(ctx context.Context, messages []BrokerMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if wait := time.Until(p.downUntil); wait > 0 {
+		return fmt.Errorf("broker unavailable, retrying in %s", wait.Round(time.Second))
+	}
+	err := p.publish(ctx, messages)
+	if err != nil {
+		var closed *amqpChannelClosed
+		if !errors.As(err, &closed) {
+			p.closeConn()
+		}
+		p.channelOpen = false
+		p.downUntil = time.Now().Add(rabbitRetryBackoff)
+	}
+	return err
+}
+
+func (p *RabbitMQPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConn()
+	return nil
+}
+
+func (p *RabbitMQPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.close()
+		p.conn = nil
+	}
+	p.channelOpen = false
+}
+
+// Publish the messages in one write, then wait for the broker to confirm them
+func (p *RabbitMQPublisher) publish(ctx context.Context, messages []BrokerMessage) error {
+	if p.conn == nil || p.conn.closed() {
+		p.closeConn()
+		conn, err := dialAMQP(ctx, p.url, p.timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	if !p.channelOpen {
+		if err := p.openChannel(ctx); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	pending := make(map[uint64]bool, len(messages))
+	for _, m := range messages {
+		p.deliveryTag++
+		pending[p.deliveryTag] = true
+
+		var args amqpWriter
+		args.short(0)
+		args.shortstr(p.exchange)
+		args.shortstr(m.Event)
+		args.octet(0) // neither mandatory nor immediate
+		buf = appendAMQPMethod(buf, amqpChannel, amqpBasicPublish, args.buf)
+
+		var header amqpWriter
+		header.short(amqpBasicPublish.class)
+		header.short(0) // weight
+		header.longlong(uint64(len(m.Value)))
+		header.short(1<<15 | 1<<13 | 1<<12 | 1<<7 | 1<<5 | 1<<3)
+		header.shortstr("application/json")
+		header.table(map[string]interface{}{"schema_version": int32(brokerSchemaVersion)})
+		header.octet(amqpPersistent)
+		header.shortstr(m.ID)
+		header.shortstr(m.Event)
+		header.shortstr(brokerClientName)
+		buf = appendAMQPFrame(buf, amqpFrameHeader, amqpChannel, header.buf)
+
+		for body := m.Value; len(body) > 0; {
+			n := min(len(body), p.conn.frameMax-8)
+			buf = appendAMQPFrame(buf, amqpFrameBody, amqpChannel, body[:n])
+			body = body[n:]
+		}
+	}
+	if err := p.conn.write(ctx, buf); err != nil {
+		return err
+	}
+
+	for len(pending) > 0 {
+		m, err := p.conn.next(ctx)
+		if err != nil {
+			return err
+		}
+		switch m.id {
+		case amqpBasicAck:
+			tag, multiple := m.args.longlong(), m.args.octet()&1 != 0
+			for t := range pending {
+				if t == tag || multiple && t < tag {
+					delete(pending, t)
+				}
+			}
+		case amqpBasicNack:
+			return errors.New("broker rejected a message")
+		}
+	}
+	return nil
+}
+
+// Open the channel in confirm mode and declare the exchange, and the queue
+// bound to all its events
+func (p *RabbitMQPublisher) openChannel(ctx context.Context) error {
+	var open amqpWriter
+	open.shortstr("")
+	if _, err := p.conn.call(ctx, amqpChannelOpen, open.buf, amqpChannelOpenOK); err != nil {
+		return err
+	}
+	var confirm amqpWriter
+	confirm.octet(0)
+	if _, err := p.conn.call(ctx, amqpConfirmSelect, confirm.buf, amqpConfirmSelectOK); err != nil {
+		return err
+	}
+	p.channelOpen = true
+	p.deliveryTag = 0
+
+	var exchange amqpWriter
+	exchange.short(0)
+	exchange.shortstr(p.exchange)
+	exchange.shortstr("topic")
+	exchange.octet(1 << 1) // durable
+	exchange.table(nil)
+	if _, err := p.conn.call(ctx, amqpExchangeDeclare, exchange.buf, amqpExchangeDeclareOK); err != nil {
+		return err
+	}
+	if p.queue == "" {
+		return nil
+	}
+	var queue amqpWriter
+	queue.short(0)
+	queue.shortstr(p.queue)
+	queue.octet(1 << 1) // durable
+	queue.table(nil)
+	if _, err := p.conn.call(ctx, amqpQueueDeclare, queue.buf, amqpQueueDeclareOK); err != nil {
+		return err
+	}
+	var bind amqpWriter
+	bind.short(0)
+	bind.shortstr(p.queue)
+	bind.shortstr(p.exchange)
+	bind.shortstr("user.#")
+	bind.octet(0)
+	bind.table(nil)
+	_, err := p.conn.call(ctx, amqpQueueBind, bind.buf, amqpQueueBindOK)
+	return err
+}
+
+// amqpConn is a connection to an AMQP broker. A goroutine reads from it,
+// answering the broker's requests to close the connection or a channel and
+// handing other methods to the publisher; another sends heartbeats.
+type amqpConn struct {
+	conn      net.Conn
+	frameMax  int
+	heartbeat time.Duration
+	wmu       sync.Mutex
+	methods   chan amqpMethod
+	quit      chan struct{}
+	quitOnce  sync.Once
+	done      chan struct{}
+	// Why the connection ended; set before done is closed
+	err error
+}
+
+// Connect to an AMQP broker, over TLS for amqps, log in with the URL's
+// credentials (guest by default) and open its virtual host
+func dialAMQP(ctx context.Context, u *url.URL, timeout time.Duration) (*amqpConn, error) {
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := d.DialContext(dialCtx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			conn.Close()
+		}
+	}()
+	if u.Scheme == "amqps" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(dialCtx); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	start, err := expectAMQPMethod(r, amqpConnectionStart)
+	if err != nil {
+		return nil, err
+	}
+	start.args.octet()   // major version
+	start.args.octet()   // minor version
+	start.args.longstr() // server properties
+	if mechanisms := start.args.longstr(); !strings.Contains(" "+mechanisms+" ", " PLAIN ") {
+		return nil, fmt.Errorf("broker does not offer PLAIN login, only %s", mechanisms)
+	}
+	user, pass := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	var startOK amqpWriter
+	startOK.table(map[string]interface{}{
+		"product":  brokerClientName,
+		"platform": "Go",
+		"capabilities": map[string]interface{}{
+			"publisher_confirms":     true,
+			"connection.blocked":     false,
+			"consumer_cancel_notify": false,
+		},
+	})
+	startOK.shortstr("PLAIN")
+	startOK.longstr("\x00" + user + "\x00" + pass)
+	startOK.shortstr("en_US")
+	if _, err := conn.Write(appendAMQPMethod(nil, 0, amqpConnectionStartOK, startOK.buf)); err != nil {
+		return nil, err
+	}
+
+	tune, err := expectAMQPMethod(r, amqpConnectionTune)
+	if err != nil {
+		return nil, err
+	}
+	channelMax, frameMax, heartbeat := tune.args.short(), int(tune.args.long()), time.Duration(tune.args.short())*time.Second
+	if frameMax == 0 || frameMax > amqpMaxFrame {
+		frameMax = amqpMaxFrame
+	}
+	heartbeat = min(heartbeat, amqpMaxHeartbeat)
+	var tuneOK amqpWriter
+	tuneOK.short(channelMax)
+	tuneOK.long(uint32(frameMax))
+	tuneOK.short(uint16(heartbeat / time.Second))
+
+	vhost := "/"
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		vhost = path
+	}
+	var open amqpWriter
+	open.shortstr(vhost)
+	open.shortstr("")
+	open.octet(0)
+	frames := appendAMQPMethod(nil, 0, amqpConnectionTuneOK, tuneOK.buf)
+	frames = appendAMQPMethod(frames, 0, amqpConnectionOpen, open.buf)
+	if _, err := conn.Write(frames); err != nil {
+		return nil, err
+	}
+	if _, err := expectAMQPMethod(r, amqpConnectionOpenOK); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &amqpConn{
+		conn:      conn,
+		frameMax:  frameMax,
+		heartbeat: heartbeat,
+		methods:   make(chan amqpMethod, 64),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go c.read(r)
+	if heartbeat > 0 {
+		go c.sendHeartbeats()
+	}
+	ok = true
+	return c, nil
+}
+
+// Read the next method during the handshake, failing unless it is want
+func expectAMQPMethod(r *bufio.Reader, want amqpMethodID) (*amqpMethod, error) {
+	for {
+		typ, channel, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != amqpFrameMethod {
+			continue
+		}
+		m := parseAMQPMethod(channel, payload)
+		if m.id == amqpConnectionClose {
+			return nil, amqpCloseError(m.args)
+		}
+		if m.id != want {
+			return nil, fmt.Errorf("expected method %d.%d, got %d.%d", want.class, want.method, m.id.class, m.id.method)
+		}
+		return m, nil
+	}
+}
+
+// Read from the broker until the connection ends
+func (c *amqpConn) read(r *bufio.Reader) {
+	defer close(c.done)
+	for {
+		if c.heartbeat > 0 {
+			// Missing two heartbeats means the broker is gone
+			c.conn.SetReadDeadline(time.Now().Add(2 * c.heartbeat))
+		}
+		typ, channel, payload, err := readAMQPFrame(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		// Heartbeats need no answer, and nothing else but methods is expected
+		if typ != amqpFrameMethod {
+			continue
+		}
+		m := parseAMQPMethod(channel, payload)
+		switch m.id {
+		case amqpConnectionClose:
+			c.write(context.Background(), appendAMQPMethod(nil, 0, amqpConnectionCloseOK, nil))
+			c.err = amqpCloseError(m.args)
+			c.conn.Close()
+			return
+		case amqpChannelClose:
+			c.write(context.Background(), appendAMQPMethod(nil, channel, amqpChannelCloseOK, nil))
+		}
+		if channel == 0 {
+			continue
+		}
+		select {
+		case c.methods <- *m:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Send a heartbeat every half interval until the connection ends
+func (c *amqpConn) sendHeartbeats() {
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+	heartbeat := appendAMQPFrame(nil, amqpFrameHeartbeat, 0, nil)
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(context.Background(), heartbeat) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *amqpConn) write(ctx context.Context, b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rabbitRetryBackoff)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// The next method on the publishing channel, or an error if the channel or
+// connection closes first
+func (c *amqpConn) next(ctx context.Context) (*amqpMethod, error) {
+	for {
+		select {
+		case m := <-c.methods:
+			if m.channel != amqpChannel {
+				continue
+			}
+			if m.id == amqpChannelClose {
+				return nil, &amqpChannelClosed{amqpCloseError(m.args)}
+			}
+			return &m, nil
+		case <-c.done:
+			if c.err != nil {
+				return nil, c.err
+			}
+			return nil, errors.New("connection closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Send a method on the publishing channel and wait for its reply
+func (c *amqpConn) call(ctx context.Context, id amqpMethodID, args []byte, reply amqpMethodID) (*amqpMethod, error) {
+	if err := c.write(ctx, appendAMQPMethod(nil, amqpChannel, id, args)); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m.id == reply {
+			return m, nil
+		}
+	}
+}
+
+func (c *amqpConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ask the broker to close the connection, without waiting for it to agree
+func (c *amqpConn) close() {
+	var args amqpWriter
+	args.short(200)
+	args.shortstr("shutdown")
+	args.short(0)
+	args.short(0)
+	c.write(context.Background(), appendAMQPMethod(nil, 0, amqpConnectionClose, args.buf))
+	c.quitOnce.Do(func() { close(c.quit) })
+	c.conn.Close()
+	<-c.done
+}
+
+// The error in a connection.close or channel.close from the broker
+func amqpCloseError(args *amqpReader) error {
+	code, text := args.short(), args.shortstr()
+	return fmt.Errorf("%d %s", code, text)
+}
+
+func readAMQPFrame(r *bufio.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	typ, channel = header[0], binary.BigEndian.Uint16(header[1:3])
+	size := binary.BigEndian.Uint32(header[3:7])
+	if size > amqpMaxFrame {
+		err = fmt.Errorf("frame of %d bytes exceeds the maximum", size)
+		return
+	}
+	payload = make([]byte, size+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[size] != amqpFrameEnd {
+		err = errors.New("malformed frame")
+		return
+	}
+	return typ, channel, payload[:size], nil
+}
+
+func parseAMQPMethod(channel uint16, payload []byte) *amqpMethod {
+	args := &amqpReader{buf: payload}
+	id := amqpMethodID{args.short(), args.short()}
+	return &amqpMethod{channel: channel, id: id, args: args}
+}
+
+func appendAMQPFrame(b []byte, typ byte, channel uint16, payload []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, channel)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	return append(b, amqpFrameEnd)
+}
+
+func appendAMQPMethod(b []byte, channel uint16, id amqpMethodID, args []byte) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, id.class)
+	payload = binary.BigEndian.AppendUint16(payload, id.method)
+	return appendAMQPFrame(b, amqpFrameMethod, channel, append(payload, args...))
+}
+
+// amqpWriter encodes the arguments of an AMQP method or content header
+type amqpWriter struct {
+	buf []byte
+}
+
+func (w *amqpWriter) octet(v byte)      { w.buf = append(w.buf, v) }
+func (w *amqpWriter) short(v uint16)    { w.buf = binary.BigEndian.AppendUint16(w.buf, v) }
+func (w *amqpWriter) long(v uint32)     { w.buf = binary.BigEndian.AppendUint32(w.buf, v) }
+func (w *amqpWriter) longlong(v uint64) { w.buf = binary.BigEndian.AppendUint64(w.buf, v) }
+
+// Encode a short string, cut to the 255 bytes it may hold
+func (w *amqpWriter) shortstr(s string) {
+	s = s[:min(len(s), 255)]
+	w.octet(byte(len(s)))
+	w.buf = append(w.buf, s...)
+}
+func (w *amqpWriter) longstr(s string) { w.long(uint32(len(s))); w.buf = append(w.buf, s...) }
+
+// Encode a field table of strings, booleans, 32-bit integers and nested tables
+func (w *amqpWriter) table(fields map[string]interface{}) {
+	var t amqpWriter
+	for name, value := range fields {
+		t.shortstr(name)
+		switch v := value.(type) {
+		case string:
+			t.octet('S')
+			t.longstr(v)
+		case bool:
+			t.octet('t')
+			if v {
+				t.octet(1)
+			} else {
+				t.octet(0)
+			}
+		case int32:
+			t.octet('I')
+			t.long(uint32(v))
+		case map[string]interface{}:
+			t.octet('F')
+			t.table(v)
+		}
+	}
+	w.long(uint32(len(t.buf)))
+	w.buf = append(w.buf, t.buf...)
+}
+
+// amqpReader decodes method arguments, reading zeros once they run out
+type amqpReader struct {
+	buf []byte
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if n > len(r.buf) {
+		r.buf = nil
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *amqpReader) octet() byte      { return r.next(1)[0] }
+func (r *amqpReader) short() uint16    { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *amqpReader) long() uint32     { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *amqpReader) longlong() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *amqpReader) shortstr() string { return string(r.next(int(r.octet()))) }
+func (r *amqpReader) longstr() string {
+	n := r.long()
+	if n > uint32(len(r.buf)) {
+		r.buf = nil
+		return ""
+	}
+	return string(r.next(int(n)))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit allows Requests per Window for each client
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Parse a limit such as "100/1m"; "" or "0" disables limiting
+func parseRateLimit(v string) (RateLimit, error) {
+	if v == "" || v == "0" {
+		return RateLimit{}, nil
+	}
+	count, window, ok := strings.Cut(v, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 100/1m", v)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 100/1m", v)
+	}
+	return RateLimit{Requests: n, Window: d}, nil
+}
+
+// RedisRateLimiterStore counts requests per client in fixed windows shared by all replicas
+type RedisRateLimiterStore struct {
+	name  string
+	limit RateLimit
+}
+
+func (s *RedisRateLimiterStore) Allow(identifier string) (bool, error) {
+	window := time.Now().UnixNano() / int64(s.limit.Window)
+	key := fmt.Sprintf("ratelimit:%s:%s:%d", s.name, identifier, window)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	pipe := getRedis().TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, s.limit.Window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Fail open: an unavailable Redis should not take the API down
+		log.Printf("Rate limiter unavailable: %v", err)
+		return true, nil
+	}
+	return incr.Val() <= int64(s.limit.Requests), nil
+}
+
+// Time until the current window ends
+func (s *RedisRateLimiterStore) RetryAfter() time.Duration {
+	elapsed := time.Duration(time.Now().UnixNano() % int64(s.limit.Window))
+	return s.limit.Window - elapsed
+}
+
+// Middleware limiting each client of a route group to a limit such as
+// "300/1m", using RATE_LIMIT_STORE=memory|redis
+func rateLimit(name, value string) echo.MiddlewareFunc {
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("Invalid rate limit for %s: %v", name, err)
+	}
+	if limit.Requests == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+
+	var store middleware.RateLimiterStore
+	retryAfter := func() time.Duration { return limit.Window / time.Duration(limit.Requests) }
+	switch cfg.RateLimit.Store {
+	case "", "memory":
+		store = middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(limit.Requests) / limit.Window.Seconds()),
+			Burst:     limit.Requests,
+			ExpiresIn: max(limit.Window, 3*time.Minute),
+		})
+	case "redis":
+		redisStore := &RedisRateLimiterStore{name: name, limit: limit}
+		store = redisStore
+		retryAfter = redisStore.RetryAfter
+	default:
+		log.Fatal("Unsupported RATE_LIMIT_STORE. Set it to 'memory' or 'redis'")
+	}
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store:               store,
+		IdentifierExtractor: rateLimitIdentifier,
+		ErrorHandler: func(c echo.Context, err error) error {
+			return newProblem(http.StatusForbidden, "Unable to identify client")
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			seconds := int(math.Ceil(retryAfter().Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			return newProblem(http.StatusTooManyRequests, "Rate limit exceeded")
+		},
+	})
+}
+
+// Take the client's IP from the connection or, for requests through one of
+// the trusted proxies, from X-Forwarded-For. Rate limits and lockouts key on
+// it, so clients must not be able to pick it with a header.
+func clientIPExtractor(trusted []string) echo.IPExtractor {
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	// Only the configured ranges, not Echo's default of every private address
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range trusted {
+		// Checked when the config was loaded
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// Identify clients by API key when present, otherwise by IP address
+func rateLimitIdentifier(c echo.Context) (string, error) {
+	if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+		return "key:" + hashAPIKey(key)[:16], nil
+	}
+	return "ip:" + c.RealIP(), nil
+}
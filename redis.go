@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisClient *redis.Client
+	redisOnce   sync.Once
+)
+
+// Connect to REDIS_URL on first use; features that need Redis call this
+func getRedis() *redis.Client {
+	redisOnce.Do(func() {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		redisClient = redis.NewClient(opts)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			log.Printf("Redis is not reachable yet: %v", err)
+		}
+	})
+	return redisClient
+}
+
+// Close the Redis connection if one was opened
+func closeRedis() {
+	if redisClient != nil {
+		redisClient.Close()
+	}
+}
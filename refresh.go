@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const tokenCleanupInterval = time.Hour
+
+// RefreshToken can be exchanged once for a new access token and refresh token.
+// Tokens rotated from the same login form a family; presenting a rotated token
+// again means it leaked, so the whole family is revoked.
+type RefreshToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  uint   `gorm:"not null;default:1;index"`
+	UserID    uint   `gorm:"not null;index"`
+	FamilyID  string `gorm:"size:36;not null;index"`
+	TokenHash string `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time
+	// Set when the token is rotated or revoked
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// The tokens issued on login and refresh
+type tokenResponse struct {
+	Token            string    `json:"token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// Issue an access token and a refresh token for the user. An empty family
+// starts a new one, as on login.
+func issueTokens(ctx context.Context, user User, family string) (*tokenResponse, error) {
+	access, expiresAt, err := issueToken(user)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+	if family == "" {
+		family = uuid.NewString()
+	}
+	record := RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  family,
+		TokenHash: hashAPIKey(refresh),
+		ExpiresAt: time.Now().Add(cfg.Auth.RefreshTokenTTL),
+	}
+	if err := db.WithContext(ctx).Create(&record).Error; err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		Token:            access,
+		TokenType:        "Bearer",
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+// Exchange a refresh token for new tokens, retiring it
+func refreshTokens(c echo.Context) error {
+	req := new(refreshRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	invalid := newProblem(http.StatusUnauthorized, "Invalid or expired refresh token")
+	var token RefreshToken
+	err := dbCtx(c).Where("token_hash = ?", hashAPIKey(req.RefreshToken)).Take(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return invalid
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to refresh token")
+	}
+
+	now := time.Now()
+	// Only one exchange of a token wins; any other is a replay
+	result := dbCtx(c).Model(&token).Where("revoked_at IS NULL").Update("revoked_at", now)
+	if result.Error != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to refresh token")
+	}
+	if result.RowsAffected == 0 {
+		requestLogger(c).Warn("Refresh token reused, revoking its family", "user_id", token.UserID, "family", token.FamilyID)
+		if err := revokeRefreshTokens(c.Request().Context(), "family_id = ?", token.FamilyID); err != nil {
+			requestLogger(c).Error("failed to revoke refresh token family", "error", err)
+		}
+		return invalid
+	}
+	if token.ExpiresAt.Before(now) {
+		return invalid
+	}
+
+	var user User
+	if err := dbCtx(c).Take(&user, token.UserID).Error; err != nil {
+		return invalid
+	}
+	if err := inactiveUserProblem(&user); err != nil {
+		return err
+	}
+	tokens, err := issueTokens(c.Request().Context(), user, token.FamilyID)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to issue token")
+	}
+	return respond(c, http.StatusOK, tokens)
+}
+
+// Log out the session a refresh token belongs to. Access tokens already
+// issued stay valid until they expire.
+func logout(c echo.Context) error {
+	req := new(refreshRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	var token RefreshToken
+	err := dbCtx(c).Where("token_hash = ?", hashAPIKey(req.RefreshToken)).Take(&token).Error
+	if err == nil {
+		err = revokeRefreshTokens(c.Request().Context(), "family_id = ?", token.FamilyID)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusInternalServerError, "Failed to log out")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Revoke the live refresh tokens matching a condition
+func revokeRefreshTokens(ctx context.Context, query string, args ...interface{}) error {
+	return db.WithContext(ctx).Model(&RefreshToken{}).
+		Where("revoked_at IS NULL").Where(query, args...).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Delete expired refresh and password reset tokens, and login throttles quiet
+// for LOGIN_LOCKOUT_MAX, every hour. The returned function stops the cleanup.
+func startTokenCleanup() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(tokenCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := time.Now()
+				for _, model := range []interface{}{&RefreshToken{}, &PasswordResetToken{}} {
+					err := db.WithContext(ctx).Where("expires_at < ?", now).Delete(model).Error
+					if err != nil && ctx.Err() == nil {
+						log.Printf("Failed to delete expired tokens: %v", err)
+					}
+				}
+				err := db.WithContext(ctx).
+					Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-cfg.Auth.LockoutMax), now).
+					Delete(&LoginThrottle{}).Error
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Failed to delete login throttles: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
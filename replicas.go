@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Send reads to the read replicas listed in DB_REPLICA_URLS, chosen at random
+// per query. Writes, locking reads and everything inside a transaction stay on
+// the primary, so read-modify-write flows never see a lagging replica.
+func initReplicas() {
+	if len(cfg.DB.ReplicaURLs) == 0 {
+		return
+	}
+
+	var replicas []gorm.Dialector
+	for _, url := range cfg.DB.ReplicaURLs {
+		dialector, err := openDialector(cfg.DB.Type, url)
+		if err != nil {
+			log.Fatalf("Invalid DB_REPLICA_URLS: %v", err)
+		}
+		replicas = append(replicas, dialector)
+	}
+
+	limits := loadPoolLimits()
+	resolver := dbresolver.Register(dbresolver.Config{
+		Replicas: replicas,
+		Policy:   dbresolver.RandomPolicy{},
+	}).
+		SetMaxOpenConns(limits.maxOpen).
+		SetMaxIdleConns(limits.maxIdle).
+		SetConnMaxLifetime(limits.lifetime)
+	if err := db.Use(resolver); err != nil {
+		log.Fatalf("Failed to connect to read replicas: %v", err)
+	}
+	log.Printf("Routing reads to %d replica(s)", len(replicas))
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrNotFound is returned by repositories when no record matches
+	ErrNotFound = errors.New("record not found")
+	// ErrVersionConflict is returned when a record changed since it was read
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrDuplicate is returned when a write violates a unique constraint
+	ErrDuplicate = errors.New("duplicate key")
+)
+
+// UserQuery selects a page of users
+type UserQuery struct {
+	Conditions     []Condition
+	Sort           []SortField
+	Offset         int
+	Limit          int
+	IncludeDeleted bool
+	// Load only these fields; nil loads every field. Search ignores it.
+	Fields *Fieldset
+}
+
+// UserRepository persists users
+type UserRepository interface {
+	// Find returns the page of users matching q and the total number of matches
+	Find(ctx context.Context, q UserQuery) ([]User, int64, error)
+	// FindAfter returns up to q.Limit users matching q that sort after the cursor,
+	// ignoring q.Offset; q.Sort must be the cursor's keyset order
+	FindAfter(ctx context.Context, q UserQuery, after *Cursor) ([]User, error)
+	// FindInBatches calls fn with successive batches of the users matching q, in ID
+	// order, ignoring q's sort and paging
+	FindInBatches(ctx context.Context, q UserQuery, batchSize int, fn func(users []User) error) error
+	// Count returns how many users match q, ignoring its sort, paging and fields
+	Count(ctx context.Context, q UserQuery) (int64, error)
+	// Search returns the page of live users whose name or email matches term,
+	// most relevant first, and the total number of matches
+	Search(ctx context.Context, term string, offset, limit int) ([]User, int64, error)
+	// Get loads a user with its roles; includeDeleted also finds soft-deleted users
+	Get(ctx context.Context, id uint, includeDeleted bool) (*User, error)
+	// GetWith is Get for a live user, also loading the named associations
+	GetWith(ctx context.Context, id uint, preloads ...string) (*User, error)
+	// GetForUpdate is Get, also locking the user's row until the transaction ends
+	GetForUpdate(ctx context.Context, id uint, includeDeleted bool) (*User, error)
+	// TakenEmails returns which of the emails belong to users other than exceptID, deleted or not
+	TakenEmails(ctx context.Context, emails []string, exceptID uint) (map[string]bool, error)
+	// Synced returns every user with an external ID, deleted or not, locked
+	// until the transaction ends
+	Synced(ctx context.Context) ([]User, error)
+	// IDsByUUID maps the given UUIDs to user IDs, including soft-deleted users
+	IDsByUUID(ctx context.Context, uuids []string) (map[string]uint, error)
+	// GetMany loads the live users with the given IDs, in no particular order
+	GetMany(ctx context.Context, ids []uint) ([]User, error)
+	Create(ctx context.Context, user *User) error
+	// CreateIfAbsent inserts the user unless another, deleted or not, already
+	// has its email in the tenant. It returns that other user, locked until the
+	// transaction ends, or nil if the user was inserted.
+	CreateIfAbsent(ctx context.Context, user *User) (*User, error)
+	// CreateBatch inserts users in batches of batchSize within one transaction
+	CreateBatch(ctx context.Context, users []*User, batchSize int) error
+	// Update saves the user's own columns, leaving its roles and last login
+	// untouched, and bumps its version. It fails with ErrVersionConflict if the stored version has moved on.
+	Update(ctx context.Context, user *User) error
+	// Delete soft-deletes the user, failing with ErrVersionConflict if it changed since read
+	Delete(ctx context.Context, user *User) error
+	// DeleteMany soft-deletes the users and reports how many were deleted
+	DeleteMany(ctx context.Context, users []User) (int64, error)
+	// Restore clears the user's deleted_at
+	Restore(ctx context.Context, user *User) error
+	// Purge removes the user, its role assignments, addresses, group memberships,
+	// history, attachments, posts and consents for good, returning the storage keys of the
+	// files left to delete
+	Purge(ctx context.Context, user *User) ([]string, error)
+	// Anonymize saves the user's scrubbed fields without auditing the old
+	// values, deletes its addresses, attachments and sign-in identities, scrubs
+	// its history and past audit entries, and records one anonymize entry. It
+	// returns the storage keys of the files left to delete.
+	Anonymize(ctx context.Context, user *User) ([]string, error)
+	// Consents returns every consent the user has granted, revoked or not
+	Consents(ctx context.Context, id uint) ([]Consent, error)
+	// Reassign moves the posts, addresses, attachments, consents, group
+	// memberships, direct reports and sign-in identities of one user to another
+	Reassign(ctx context.Context, from, to uint) error
+	// LockHierarchy serializes changes to the management hierarchy of the
+	// context's tenant until the transaction ends
+	LockHierarchy(ctx context.Context) error
+	// ManagerChain returns the IDs of the user's managers, deleted or not,
+	// nearest first and at most maxDepth of them
+	ManagerChain(ctx context.Context, id uint, maxDepth int) ([]uint, error)
+	// Versions returns a page of the user's recorded versions, newest first,
+	// and how many there are
+	Versions(ctx context.Context, id uint, offset, limit int) ([]UserVersion, int64, error)
+	// GetVersion loads one recorded version of the user
+	GetVersion(ctx context.Context, id, version uint) (*UserVersion, error)
+	// Transaction runs fn against a repository bound to a single transaction
+	Transaction(ctx context.Context, fn func(repo UserRepository) error) error
+}
+
+// GormUserRepository stores users through GORM
+type GormUserRepository struct {
+	db *gorm.DB
+}
+
+func NewGormUserRepository(db *gorm.DB) *GormUserRepository {
+	return &GormUserRepository{db: db}
+}
+
+func (r *GormUserRepository) Find(ctx context.Context, uq UserQuery) ([]User, int64, error) {
+	q := r.db.WithContext(ctx).Model(&User{})
+	if uq.IncludeDeleted {
+		q = q.Unscoped()
+	}
+	q = applyConditions(q, uq.Conditions)
+
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []User
+	err := selectUserFields(applySort(q, uq.Sort), uq).Offset(uq.Offset).Limit(uq.Limit).Find(&users).Error
+	return users, total, err
+}
+
+func (r *GormUserRepository) Count(ctx context.Context, uq UserQuery) (int64, error) {
+	q := r.db.WithContext(ctx).Model(&User{})
+	if uq.IncludeDeleted {
+		q = q.Unscoped()
+	}
+	var total int64
+	err := applyConditions(q, uq.Conditions).Count(&total).Error
+	return total, err
+}
+
+func (r *GormUserRepository) FindAfter(ctx context.Context, uq UserQuery, after *Cursor) ([]User, error) {
+	q := r.db.WithContext(ctx).Model(&User{})
+	if uq.IncludeDeleted {
+		q = q.Unscoped()
+	}
+	q = applyConditions(q, uq.Conditions)
+	if after != nil {
+		q = applyKeyset(q, after)
+	}
+
+	var users []User
+	err := selectUserFields(applySort(q, uq.Sort), uq).Limit(uq.Limit).Find(&users).Error
+	return users, err
+}
+
+// Load users with their roles or, given a fieldset, only its columns and
+// associations plus the ID and sort columns that paging relies on
+func selectUserFields(q *gorm.DB, uq UserQuery) *gorm.DB {
+	if uq.Fields == nil {
+		return q.Preload("Roles")
+	}
+	q = q.Select(userFieldColumns(uq))
+	for _, preload := range uq.Fields.Preloads {
+		q = q.Preload(preload)
+	}
+	return q
+}
+
+// The columns of the query's fieldset, with the ID and sort columns
+func userFieldColumns(uq UserQuery) []string {
+	columns := []string{"id"}
+	for _, column := range uq.Fields.Columns {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	for _, s := range uq.Sort {
+		if !slices.Contains(columns, s.Column) {
+			columns = append(columns, s.Column)
+		}
+	}
+	return columns
+}
+
+func (r *GormUserRepository) FindInBatches(ctx context.Context, uq UserQuery, batchSize int, fn func(users []User) error) error {
+	q := r.db.WithContext(ctx).Model(&User{})
+	if uq.IncludeDeleted {
+		q = q.Unscoped()
+	}
+	q = selectUserFields(applyConditions(q, uq.Conditions), uq)
+
+	var users []User
+	return q.FindInBatches(&users, batchSize, func(tx *gorm.DB, batch int) error {
+		return fn(users)
+	}).Error
+}
+
+// Document searched by Postgres full-text search; idx_users_search indexes this expression
+const userSearchVector = "to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(email, ''))"
+
+func (r *GormUserRepository) Search(ctx context.Context, term string, offset, limit int) ([]User, int64, error) {
+	q := r.db.WithContext(ctx).Model(&User{}).Preload("Roles")
+	var rank clause.Expr
+	if r.db.Dialector.Name() == "postgres" {
+		q = q.Where(userSearchVector+" @@ websearch_to_tsquery('simple', ?)", term)
+		rank = gorm.Expr("ts_rank("+userSearchVector+", websearch_to_tsquery('simple', ?)) DESC, id", term)
+	} else {
+		// Substring fallback: exact names rank first, then name prefixes, then other matches
+		lower := strings.ToLower(term)
+		pattern := "%" + escapeLike(lower) + "%"
+		q = q.Where("LOWER(name) LIKE ? ESCAPE '!' OR LOWER(email) LIKE ? ESCAPE '!'", pattern, pattern)
+		rank = gorm.Expr("CASE WHEN LOWER(name) = ? THEN 0 WHEN LOWER(name) LIKE ? ESCAPE '!' THEN 1 "+
+			"WHEN LOWER(name) LIKE ? ESCAPE '!' THEN 2 ELSE 3 END, id", lower, escapeLike(lower)+"%", pattern)
+	}
+
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []User
+	err := q.Order(clause.OrderBy{Expression: rank}).Offset(offset).Limit(limit).Find(&users).Error
+	return users, total, err
+}
+
+// Escape LIKE wildcards in s, using ! as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func (r *GormUserRepository) Get(ctx context.Context, id uint, includeDeleted bool) (*User, error) {
+	return findUser(r.db.WithContext(ctx), id, includeDeleted)
+}
+
+func (r *GormUserRepository) GetWith(ctx context.Context, id uint, preloads ...string) (*User, error) {
+	return findUser(r.db.WithContext(ctx), id, false, preloads...)
+}
+
+func (r *GormUserRepository) GetForUpdate(ctx context.Context, id uint, includeDeleted bool) (*User, error) {
+	return findUser(forUpdate(r.db.WithContext(ctx)), id, includeDeleted)
+}
+
+// Load a user with its roles and any other associations named, each in ID order
+func findUser(q *gorm.DB, id uint, includeDeleted bool, preloads ...string) (*User, error) {
+	q = q.Preload("Roles")
+	for _, preload := range preloads {
+		q = q.Preload(preload, func(tx *gorm.DB) *gorm.DB { return tx.Order("id") })
+	}
+	if includeDeleted {
+		q = q.Unscoped()
+	}
+	var user User
+	if err := q.First(&user, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &user, nil
+}
+
+func (r *GormUserRepository) TakenEmails(ctx context.Context, emails []string, exceptID uint) (map[string]bool, error) {
+	taken := map[string]bool{}
+	// Stay well below SQL Server's 2100 parameter limit
+	for start := 0; start < len(emails); start += 1000 {
+		end := min(start+1000, len(emails))
+		var found []string
+		err := r.db.WithContext(ctx).Unscoped().Model(&User{}).
+			Where("email IN ? AND id <> ?", emails[start:end], exceptID).Pluck("email", &found).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range found {
+			taken[email] = true
+		}
+	}
+	return taken, nil
+}
+
+func (r *GormUserRepository) Synced(ctx context.Context) ([]User, error) {
+	var users []User
+	err := forUpdate(r.db.WithContext(ctx)).Unscoped().Preload("Roles").
+		Where("external_id IS NOT NULL").Order("id").Find(&users).Error
+	return users, err
+}
+
+func (r *GormUserRepository) IDsByUUID(ctx context.Context, uuids []string) (map[string]uint, error) {
+	ids := make(map[string]uint, len(uuids))
+	for start := 0; start < len(uuids); start += 1000 {
+		end := min(start+1000, len(uuids))
+		var rows []User
+		err := r.db.WithContext(ctx).Unscoped().Select("id", "uuid").
+			Where("uuid IN ?", uuids[start:end]).Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			ids[row.UUID] = row.ID
+		}
+	}
+	return ids, nil
+}
+
+func (r *GormUserRepository) GetMany(ctx context.Context, ids []uint) ([]User, error) {
+	var users []User
+	err := r.db.WithContext(ctx).Preload("Roles").Where("id IN ?", ids).Find(&users).Error
+	return users, err
+}
+
+func (r *GormUserRepository) Create(ctx context.Context, user *User) error {
+	return translateError(r.db.WithContext(ctx).Create(user).Error)
+}
+
+func (r *GormUserRepository) CreateIfAbsent(ctx context.Context, user *User) (*User, error) {
+	q := r.db.WithContext(ctx)
+	// Roles are saved by hand below: GORM would assign them to the missing
+	// row of an insert that did nothing
+	result := q.Omit("Roles").Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "email"}},
+		DoNothing: true,
+	}).Create(user)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		var existing User
+		err := forUpdate(q).Unscoped().Preload("Roles").Where("email = ?", user.Email).Take(&existing).Error
+		if err != nil {
+			return nil, translateError(err)
+		}
+		return &existing, nil
+	}
+	for _, role := range user.Roles {
+		if err := q.Exec("INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)", user.ID, role.ID).Error; err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (r *GormUserRepository) CreateBatch(ctx context.Context, users []*User, batchSize int) error {
+	return translateError(userTransaction(r.db.WithContext(ctx), func(tx *gorm.DB) error {
+		return tx.CreateInBatches(users, batchSize).Error
+	}))
+}
+
+func (r *GormUserRepository) Update(ctx context.Context, user *User) error {
+	expected := user.Version
+	user.Version++
+	result := r.db.WithContext(ctx).Model(user).Where("version = ?", expected).
+		Select("*").Omit("ID", "Roles", "Addresses", "Groups", "Manager", "LastLoginAt").Updates(user)
+	if result.Error != nil {
+		user.Version = expected
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		user.Version = expected
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (r *GormUserRepository) Delete(ctx context.Context, user *User) error {
+	result := r.db.WithContext(ctx).Where("version = ?", user.Version).Delete(user)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return result.Error
+}
+
+func (r *GormUserRepository) DeleteMany(ctx context.Context, users []User) (int64, error) {
+	// Deleting the loaded users, not bare IDs, gives the delete hooks whole rows
+	result := r.db.WithContext(ctx).Delete(&users)
+	return result.RowsAffected, result.Error
+}
+
+func (r *GormUserRepository) Restore(ctx context.Context, user *User) error {
+	err := r.db.WithContext(ctx).Unscoped().Model(user).Updates(map[string]interface{}{
+		"deleted_at": nil,
+		"version":    gorm.Expr("version + 1"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	user.DeletedAt = gorm.DeletedAt{}
+	user.Version++
+	return nil
+}
+
+func (r *GormUserRepository) Purge(ctx context.Context, user *User) ([]string, error) {
+	if err := r.db.WithContext(ctx).Where("user_id = ?", user.ID).Delete(&UserVersion{}).Error; err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := r.db.WithContext(ctx).Model(&Attachment{}).Where("user_id = ?", user.ID).Pluck("key", &keys).Error; err != nil {
+		return nil, err
+	}
+	if err := r.db.WithContext(ctx).Where("user_id = ?", user.ID).Delete(&Attachment{}).Error; err != nil {
+		return nil, err
+	}
+	// The foreign keys cascade too, but SQLite only enforces them when asked
+	for _, model := range []interface{}{&Post{}, &Consent{}} {
+		if err := r.db.WithContext(ctx).Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+	keys = append(keys, avatarKeys(user.Avatar)...)
+	// Reports are left without a manager rather than deleted
+	err := r.db.WithContext(ctx).Table("users").Where("manager_id = ?", user.ID).Update("manager_id", nil).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, r.db.WithContext(ctx).Unscoped().Select("Roles", "Addresses", "Groups").Delete(user).Error
+}
+
+func (r *GormUserRepository) Anonymize(ctx context.Context, user *User) ([]string, error) {
+	// The usual audit entry would keep the old values
+	db := r.db.WithContext(ctx).Set(auditSkipSetting, true).Session(&gorm.Session{})
+	var before User
+	if err := db.Unscoped().Take(&before, user.ID).Error; err != nil {
+		return nil, translateError(err)
+	}
+	if err := NewGormUserRepository(db.Unscoped()).Update(ctx, user); err != nil {
+		return nil, err
+	}
+
+	var addressIDs []string
+	if err := db.Model(&Address{}).Where("user_id = ?", user.ID).Pluck("id", &addressIDs).Error; err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := db.Model(&Attachment{}).Where("user_id = ?", user.ID).Pluck("key", &keys).Error; err != nil {
+		return nil, err
+	}
+	for _, model := range []interface{}{&Address{}, &Attachment{}, &UserIdentity{}} {
+		if err := db.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+	keys = append(keys, avatarKeys(before.Avatar)...)
+	err := db.Model(&UserVersion{}).Where("user_id = ?", user.ID).Updates(map[string]interface{}{
+		"name":     user.Name,
+		"email":    nil,
+		"birthday": nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	// Unaudited writes skip the snapshot too
+	version := UserVersion{UserID: user.ID, Version: user.Version, Name: user.Name, CreatedAt: user.UpdatedAt}
+	if err := db.Create(&version).Error; err != nil {
+		return nil, err
+	}
+
+	// Earlier entries keep their shape but lose the values
+	entityID := strconv.FormatUint(uint64(user.ID), 10)
+	var logs []AuditLog
+	q := db.Where("entity_type = ? AND entity_id = ?", "users", entityID)
+	if len(addressIDs) > 0 {
+		q = q.Or("entity_type = ? AND entity_id IN ?", "addresses", addressIDs)
+	}
+	if err := q.Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	for _, log := range logs {
+		if !redactAuditChanges(log.Changes, log.EntityType == "addresses") {
+			continue
+		}
+		if err := db.Model(&log).UpdateColumn("changes", log.Changes).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	changes := AuditChanges{}
+	for column := range anonymizedColumns {
+		changes[column] = AuditChange{Before: redactedValue}
+	}
+	changes["name"] = AuditChange{Before: redactedValue, After: user.Name}
+	if before.IsVerified {
+		changes["is_verified"] = AuditChange{Before: true, After: false}
+	}
+	return keys, writeAuditLogs(db, newAuditLog(ctx, auditAnonymize, "users", entityID, changes))
+}
+
+func (r *GormUserRepository) Consents(ctx context.Context, id uint) ([]Consent, error) {
+	var consents []Consent
+	err := r.db.WithContext(ctx).Where("user_id = ?", id).Order("id").Find(&consents).Error
+	return consents, err
+}
+
+func (r *GormUserRepository) Reassign(ctx context.Context, from, to uint) error {
+	db := r.db.WithContext(ctx)
+	for _, model := range []interface{}{&Post{}, &Address{}, &Attachment{}, &Consent{}, &UserIdentity{}} {
+		if err := db.Model(model).Where("user_id = ?", from).UpdateColumn("user_id", to).Error; err != nil {
+			return err
+		}
+	}
+	// Memberships the user already has are kept with their own join date
+	err := db.Exec(`INSERT INTO group_members (group_id, user_id, created_at)
+		SELECT group_id, ?, created_at FROM group_members m
+		WHERE m.user_id = ? AND NOT EXISTS (
+			SELECT 1 FROM group_members o WHERE o.group_id = m.group_id AND o.user_id = ?
+		)`, to, from, to).Error
+	if err != nil {
+		return err
+	}
+	if err := db.Where("user_id = ?", from).Delete(&GroupMember{}).Error; err != nil {
+		return err
+	}
+	return db.Table("users").Where("manager_id = ? AND id <> ?", from, to).Update("manager_id", to).Error
+}
+
+// Lock the tenant's row, which every change to the hierarchy locks first
+func (r *GormUserRepository) LockHierarchy(ctx context.Context) error {
+	var tenantID uint = defaultTenantID
+	if tenant, ok := tenantFrom(ctx); ok {
+		tenantID = tenant.ID
+	}
+	var tenant Tenant
+	return forUpdate(r.db.WithContext(ctx)).Select("id").Take(&tenant, tenantID).Error
+}
+
+// Follow manager_id upwards with a recursive CTE where the database has one
+// spelled the standard way, and a query per level elsewhere. A cycle, which
+// SetManager prevents, would only repeat until maxDepth.
+func (r *GormUserRepository) ManagerChain(ctx context.Context, id uint, maxDepth int) ([]uint, error) {
+	var ids []uint
+	switch r.db.Dialector.Name() {
+	case "postgres", "sqlite":
+		err := r.db.WithContext(ctx).Raw(`WITH RECURSIVE chain (id, manager_id, depth) AS (
+			SELECT id, manager_id, 0 FROM users WHERE id = ?
+			UNION ALL
+			SELECT users.id, users.manager_id, chain.depth + 1
+			FROM users JOIN chain ON users.id = chain.manager_id
+			WHERE chain.depth < ?
+		)
+		SELECT id FROM chain WHERE depth > 0 ORDER BY depth`, id, maxDepth).Scan(&ids).Error
+		return ids, err
+	}
+	for len(ids) < maxDepth {
+		var user User
+		err := r.db.WithContext(ctx).Unscoped().Select("manager_id").Take(&user, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.ManagerID == nil {
+			break
+		}
+		id = *user.ManagerID
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *GormUserRepository) Versions(ctx context.Context, id uint, offset, limit int) ([]UserVersion, int64, error) {
+	var versions []UserVersion
+	var total int64
+	q := r.db.WithContext(ctx).Model(&UserVersion{}).Where("user_id = ?", id)
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := q.Order("version DESC").Offset(offset).Limit(limit).Find(&versions).Error
+	return versions, total, err
+}
+
+func (r *GormUserRepository) GetVersion(ctx context.Context, id, version uint) (*UserVersion, error) {
+	var v UserVersion
+	err := r.db.WithContext(ctx).Where("user_id = ? AND version = ?", id, version).Take(&v).Error
+	return &v, translateError(err)
+}
+
+func (r *GormUserRepository) Transaction(ctx context.Context, fn func(repo UserRepository) error) error {
+	return userTransaction(r.db.WithContext(ctx), func(tx *gorm.DB) error {
+		return fn(NewGormUserRepository(tx))
+	})
+}
+
+// Map GORM's errors onto the repository's
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return ErrDuplicate
+	}
+	return err
+}
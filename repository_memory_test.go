@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errMemoryConditions = errors.New("memory repository: query conditions are not supported")
+
+// MemoryUserRepository keeps users in a map, for testing UserService without
+// a database. Queries support the id sort and paging but no conditions, and
+// the records around users are only kept as far as the tests need them.
+type MemoryUserRepository struct {
+	mu       *sync.Mutex
+	users    map[uint]*User
+	consents map[uint][]Consent
+	nextID   *uint
+	// Set within a transaction, whose lock is already held
+	inTx bool
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	var nextID uint = 1
+	return &MemoryUserRepository{
+		mu:       new(sync.Mutex),
+		users:    map[uint]*User{},
+		consents: map[uint][]Consent{},
+		nextID:   &nextID,
+	}
+}
+
+func (r *MemoryUserRepository) lock() func() {
+	if r.inTx {
+		return func() {}
+	}
+	r.mu.Lock()
+	return r.mu.Unlock
+}
+
+// A copy the caller may change without touching the stored user
+func cloneUser(u *User) *User {
+	c := *u
+	c.Roles = slices.Clone(u.Roles)
+	c.Metadata = maps.Clone(u.Metadata)
+	return &c
+}
+
+// The stored users matching the query, in ID order
+func (r *MemoryUserRepository) matching(includeDeleted bool) []User {
+	ids := slices.Sorted(maps.Keys(r.users))
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if u := r.users[id]; includeDeleted || !u.DeletedAt.Valid {
+			users = append(users, *cloneUser(u))
+		}
+	}
+	return users
+}
+
+// Order users by the query's sort, which may only be by id
+func sortUsers(users []User, sort []SortField) error {
+	for _, f := range sort {
+		if f.Column != "id" {
+			return errors.New("memory repository: only the id sort is supported")
+		}
+		if f.Desc {
+			slices.Reverse(users)
+		}
+	}
+	return nil
+}
+
+func page(users []User, offset, limit int) []User {
+	if offset >= len(users) {
+		return []User{}
+	}
+	users = users[offset:]
+	if limit > 0 && limit < len(users) {
+		users = users[:limit]
+	}
+	return users
+}
+
+func (r *MemoryUserRepository) Find(ctx context.Context, q UserQuery) ([]User, int64, error) {
+	defer r.lock()()
+	if len(q.Conditions) > 0 {
+		return nil, 0, errMemoryConditions
+	}
+	users := r.matching(q.IncludeDeleted)
+	if err := sortUsers(users, q.Sort); err != nil {
+		return nil, 0, err
+	}
+	return page(users, q.Offset, q.Limit), int64(len(users)), nil
+}
+
+func (r *MemoryUserRepository) FindAfter(ctx context.Context, q UserQuery, after *Cursor) ([]User, error) {
+	defer r.lock()()
+	if len(q.Conditions) > 0 {
+		return nil, errMemoryConditions
+	}
+	users := r.matching(q.IncludeDeleted)
+	if err := sortUsers(users, q.Sort); err != nil {
+		return nil, err
+	}
+	if after != nil {
+		desc := len(q.Sort) > 0 && q.Sort[0].Desc
+		users = slices.DeleteFunc(users, func(u User) bool {
+			return (!desc && u.ID <= after.ID) || (desc && u.ID >= after.ID)
+		})
+	}
+	return page(users, 0, q.Limit), nil
+}
+
+func (r *MemoryUserRepository) FindInBatches(ctx context.Context, q UserQuery, batchSize int, fn func(users []User) error) error {
+	unlock := r.lock()
+	if len(q.Conditions) > 0 {
+		unlock()
+		return errMemoryConditions
+	}
+	users := r.matching(q.IncludeDeleted)
+	unlock()
+	for batch := range slices.Chunk(users, batchSize) {
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) Count(ctx context.Context, q UserQuery) (int64, error) {
+	defer r.lock()()
+	if len(q.Conditions) > 0 {
+		return 0, errMemoryConditions
+	}
+	return int64(len(r.matching(q.IncludeDeleted))), nil
+}
+
+func (r *MemoryUserRepository) Search(ctx context.Context, term string, offset, limit int) ([]User, int64, error) {
+	defer r.lock()()
+	term = strings.ToLower(term)
+	users := slices.DeleteFunc(r.matching(false), func(u User) bool {
+		return !strings.Contains(strings.ToLower(u.Name), term) && !strings.Contains(derefEmail(u.Email), term)
+	})
+	return page(users, offset, limit), int64(len(users)), nil
+}
+
+func (r *MemoryUserRepository) get(id uint, includeDeleted bool) (*User, error) {
+	u, ok := r.users[id]
+	if !ok || (u.DeletedAt.Valid && !includeDeleted) {
+		return nil, ErrNotFound
+	}
+	return cloneUser(u), nil
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, id uint, includeDeleted bool) (*User, error) {
+	defer r.lock()()
+	return r.get(id, includeDeleted)
+}
+
+func (r *MemoryUserRepository) GetWith(ctx context.Context, id uint, preloads ...string) (*User, error) {
+	defer r.lock()()
+	return r.get(id, false)
+}
+
+func (r *MemoryUserRepository) GetForUpdate(ctx context.Context, id uint, includeDeleted bool) (*User, error) {
+	defer r.lock()()
+	return r.get(id, includeDeleted)
+}
+
+func (r *MemoryUserRepository) TakenEmails(ctx context.Context, emails []string, exceptID uint) (map[string]bool, error) {
+	defer r.lock()()
+	taken := map[string]bool{}
+	for id, u := range r.users {
+		if id != exceptID && u.Email != nil && slices.Contains(emails, *u.Email) {
+			taken[*u.Email] = true
+		}
+	}
+	return taken, nil
+}
+
+func (r *MemoryUserRepository) Synced(ctx context.Context) ([]User, error) {
+	defer r.lock()()
+	return slices.DeleteFunc(r.matching(true), func(u User) bool { return u.ExternalID == nil }), nil
+}
+
+func (r *MemoryUserRepository) IDsByUUID(ctx context.Context, uuids []string) (map[string]uint, error) {
+	defer r.lock()()
+	ids := map[string]uint{}
+	for id, u := range r.users {
+		if slices.Contains(uuids, u.UUID) {
+			ids[u.UUID] = id
+		}
+	}
+	return ids, nil
+}
+
+func (r *MemoryUserRepository) GetMany(ctx context.Context, ids []uint) ([]User, error) {
+	defer r.lock()()
+	return slices.DeleteFunc(r.matching(false), func(u User) bool { return !slices.Contains(ids, u.ID) }), nil
+}
+
+// The user other than exceptID holding the email, deleted or not
+func (r *MemoryUserRepository) emailHolder(email *string, exceptID uint) *User {
+	if email == nil {
+		return nil
+	}
+	for id, u := range r.users {
+		if id != exceptID && u.Email != nil && *u.Email == *email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) create(user *User) error {
+	if r.emailHolder(user.Email, 0) != nil {
+		return ErrDuplicate
+	}
+	user.ID = *r.nextID
+	*r.nextID++
+	if user.UUID == "" {
+		user.UUID = uuid.NewString()
+	}
+	if user.Version == 0 {
+		user.Version = 1
+	}
+	if user.Status == "" {
+		user.Status = userActive
+	}
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	r.users[user.ID] = cloneUser(user)
+	return nil
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *User) error {
+	defer r.lock()()
+	return r.create(user)
+}
+
+func (r *MemoryUserRepository) CreateIfAbsent(ctx context.Context, user *User) (*User, error) {
+	defer r.lock()()
+	if existing := r.emailHolder(user.Email, 0); existing != nil {
+		return cloneUser(existing), nil
+	}
+	return nil, r.create(user)
+}
+
+func (r *MemoryUserRepository) CreateBatch(ctx context.Context, users []*User, batchSize int) error {
+	return r.Transaction(ctx, func(repo UserRepository) error {
+		for _, user := range users {
+			if err := repo.Create(ctx, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, user *User) error {
+	defer r.lock()()
+	stored, ok := r.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrVersionConflict
+	}
+	if r.emailHolder(user.Email, user.ID) != nil {
+		return ErrDuplicate
+	}
+	user.Version++
+	user.UpdatedAt = time.Now()
+	saved := cloneUser(user)
+	saved.Roles, saved.LastLoginAt = stored.Roles, stored.LastLoginAt
+	r.users[user.ID] = saved
+	return nil
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, user *User) error {
+	defer r.lock()()
+	stored, ok := r.users[user.ID]
+	if !ok || stored.DeletedAt.Valid || stored.Version != user.Version {
+		return ErrVersionConflict
+	}
+	stored.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	user.DeletedAt = stored.DeletedAt
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteMany(ctx context.Context, users []User) (int64, error) {
+	defer r.lock()()
+	var deleted int64
+	for _, user := range users {
+		if stored, ok := r.users[user.ID]; ok && !stored.DeletedAt.Valid {
+			stored.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *MemoryUserRepository) Restore(ctx context.Context, user *User) error {
+	defer r.lock()()
+	stored, ok := r.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.DeletedAt = gorm.DeletedAt{}
+	stored.Version++
+	user.DeletedAt, user.Version = stored.DeletedAt, stored.Version
+	return nil
+}
+
+func (r *MemoryUserRepository) Purge(ctx context.Context, user *User) ([]string, error) {
+	defer r.lock()()
+	delete(r.users, user.ID)
+	delete(r.consents, user.ID)
+	for _, u := range r.users {
+		if u.ManagerID != nil && *u.ManagerID == user.ID {
+			u.ManagerID = nil
+		}
+	}
+	return avatarKeys(user.Avatar), nil
+}
+
+func (r *MemoryUserRepository) Anonymize(ctx context.Context, user *User) ([]string, error) {
+	before, err := r.Get(ctx, user.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Update(ctx, user); err != nil {
+		return nil, err
+	}
+	return avatarKeys(before.Avatar), nil
+}
+
+func (r *MemoryUserRepository) Consents(ctx context.Context, id uint) ([]Consent, error) {
+	defer r.lock()()
+	return slices.Clone(r.consents[id]), nil
+}
+
+func (r *MemoryUserRepository) Reassign(ctx context.Context, from, to uint) error {
+	defer r.lock()()
+	for _, c := range r.consents[from] {
+		c.UserID = to
+		r.consents[to] = append(r.consents[to], c)
+	}
+	delete(r.consents, from)
+	for id, u := range r.users {
+		if id != to && u.ManagerID != nil && *u.ManagerID == from {
+			u.ManagerID = &to
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) LockHierarchy(ctx context.Context) error {
+	return nil
+}
+
+func (r *MemoryUserRepository) ManagerChain(ctx context.Context, id uint, maxDepth int) ([]uint, error) {
+	defer r.lock()()
+	var ids []uint
+	for len(ids) < maxDepth {
+		u, ok := r.users[id]
+		if !ok || u.ManagerID == nil {
+			break
+		}
+		id = *u.ManagerID
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *MemoryUserRepository) Versions(ctx context.Context, id uint, offset, limit int) ([]UserVersion, int64, error) {
+	return []UserVersion{}, 0, nil
+}
+
+func (r *MemoryUserRepository) GetVersion(ctx context.Context, id, version uint) (*UserVersion, error) {
+	return nil, ErrNotFound
+}
+
+// Run fn holding the lock, putting every user back as it was if fn fails
+func (r *MemoryUserRepository) Transaction(ctx context.Context, fn func(repo UserRepository) error) error {
+	defer r.lock()()
+	users := make(map[uint]*User, len(r.users))
+	for id, u := range r.users {
+		users[id] = cloneUser(u)
+	}
+	consents := maps.Clone(r.consents)
+	nextID := *r.nextID
+
+	tx := *r
+	tx.inTx = true
+	if err := fn(&tx); err != nil {
+		r.users, r.consents, *r.nextID = users, consents, nextID
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// What a retention rule does to the users it matches
+	retentionPurge     = "purge"
+	retentionAnonymize = "anonymize"
+
+	// Users loaded per query while applying a rule
+	retentionBatchSize = 100
+)
+
+// retentionRule applies an action to every user, in every tenant, past the
+// rule's age
+type retentionRule struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Action      string        `json:"action"`
+	After       time.Duration `json:"-"`
+	// Query the users the rule applies to at the cutoff
+	match func(q *gorm.DB, cutoff time.Time) *gorm.DB
+	apply func(ctx context.Context, id uint) error
+}
+
+// RetentionResult is what one rule matched and changed in a run
+type RetentionResult struct {
+	Rule     string    `json:"rule"`
+	Action   string    `json:"action"`
+	Cutoff   time.Time `json:"cutoff"`
+	Matched  int64     `json:"matched"`
+	Affected int64     `json:"affected"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// RetentionReport is the outcome of applying the retention rules once
+type RetentionReport struct {
+	DryRun     bool              `json:"dry_run"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Rules      []RetentionResult `json:"rules"`
+}
+
+var (
+	retentionMu sync.Mutex
+	// The report of this replica's last scheduled or manual run
+	lastRetentionReport *RetentionReport
+)
+
+// The rules enabled by their *_RETENTION setting
+func retentionRules() []retentionRule {
+	var rules []retentionRule
+	if cfg.Retention.DeletedUsers > 0 {
+		rules = append(rules, retentionRule{
+			Name:        "purge-deleted-users",
+			Description: "Permanently delete users soft-deleted more than DELETED_USER_RETENTION ago",
+			Action:      retentionPurge,
+			After:       cfg.Retention.DeletedUsers,
+			match: func(q *gorm.DB, cutoff time.Time) *gorm.DB {
+				return q.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+			},
+			apply: userService.Purge,
+		})
+	}
+	if cfg.Retention.InactiveUsers > 0 {
+		rules = append(rules, retentionRule{
+			Name:        "anonymize-inactive-users",
+			Description: "Anonymize live users who have neither logged in nor changed for INACTIVE_USER_RETENTION",
+			Action:      retentionAnonymize,
+			After:       cfg.Retention.InactiveUsers,
+			match: func(q *gorm.DB, cutoff time.Time) *gorm.DB {
+				return q.Where("anonymized_at IS NULL AND updated_at < ?", cutoff).
+					Where("last_login_at IS NULL OR last_login_at < ?", cutoff)
+			},
+			apply: func(ctx context.Context, id uint) error {
+				_, err := userService.Anonymize(ctx, id)
+				return err
+			},
+		})
+	}
+	return rules
+}
+
+// Apply each retention rule in turn, or with dryRun only count what they
+// match. A failing rule is reported and the rest still run.
+func applyRetention(ctx context.Context, dryRun bool) *RetentionReport {
+	report := &RetentionReport{DryRun: dryRun, StartedAt: time.Now(), Rules: []RetentionResult{}}
+	for _, rule := range retentionRules() {
+		result := RetentionResult{Rule: rule.Name, Action: rule.Action, Cutoff: report.StartedAt.Add(-rule.After)}
+		if err := rule.run(ctx, &result, dryRun); err != nil {
+			result.Error = err.Error()
+		}
+		report.Rules = append(report.Rules, result)
+	}
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// Count the users the rule matches and, unless dryRun, apply it to them in batches
+func (r retentionRule) run(ctx context.Context, result *RetentionResult, dryRun bool) error {
+	matched := func() *gorm.DB {
+		return r.match(db.WithContext(ctx).Model(&User{}), result.Cutoff)
+	}
+	if err := matched().Count(&result.Matched).Error; err != nil || dryRun {
+		return err
+	}
+	for {
+		var ids []uint
+		if err := matched().Order("id").Limit(retentionBatchSize).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, id := range ids {
+			// Users removed or anonymized since they were matched are skipped
+			err := r.apply(ctx, id)
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUserAnonymized) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.Affected++
+		}
+	}
+}
+
+// Run the retention rules as the scheduled task, dry when RETENTION_DRY_RUN is
+// set, and log and keep the report
+func runRetention(ctx context.Context) error {
+	report := applyRetention(ctx, cfg.Retention.DryRun)
+	retentionMu.Lock()
+	lastRetentionReport = report
+	retentionMu.Unlock()
+
+	var errs []error
+	for _, result := range report.Rules {
+		if result.Error != "" {
+			errs = append(errs, errors.New(result.Rule+": "+result.Error))
+		}
+		if result.Matched > 0 || result.Error != "" {
+			contextLogger(ctx).Info("Applied retention rule", "rule", result.Rule, "dry_run", report.DryRun,
+				"matched", result.Matched, "affected", result.Affected)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List the retention rules with their cutoffs, and the last run's report
+func getRetention(c echo.Context) error {
+	type ruleStatus struct {
+		retentionRule
+		After  string    `json:"after"`
+		Cutoff time.Time `json:"cutoff"`
+	}
+	now := time.Now()
+	rules := []ruleStatus{}
+	for _, rule := range retentionRules() {
+		rules = append(rules, ruleStatus{rule, rule.After.String(), now.Add(-rule.After)})
+	}
+	retentionMu.Lock()
+	last := lastRetentionReport
+	retentionMu.Unlock()
+	return respond(c, http.StatusOK, map[string]interface{}{
+		"dry_run":     cfg.Retention.DryRun,
+		"rules":       rules,
+		"last_report": last,
+	})
+}
+
+// Report what the retention rules would change if they ran now
+func previewRetention(c echo.Context) error {
+	// The rules span every tenant, so they leave the request's tenant behind
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := context.AfterFunc(c.Request().Context(), cancel)
+	defer stop()
+	return respond(c, http.StatusOK, applyRetention(ctx, true))
+}
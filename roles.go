@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Role is a named set of permissions. The built-in roles have no tenant and
+// are shared by every tenant; custom roles belong to the tenant creating them.
+type Role struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	TenantID *uint  `json:"-" gorm:"uniqueIndex:idx_roles_tenant_name,priority:1"`
+	Name     string `json:"name" gorm:"size:50;not null;uniqueIndex:idx_roles_tenant_name,priority:2" validate:"required,max=50"`
+}
+
+// Check whether the user holds any of the given roles
+func (u User) HasRole(names ...string) bool {
+	for _, role := range u.Roles {
+		for _, name := range names {
+			if role.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Look up the roles assigned to new users
+func defaultRoles(ctx context.Context) ([]Role, error) {
+	var roles []Role
+	err := db.WithContext(ctx).Where("name = ?", RoleViewer).Find(&roles).Error
+	return roles, err
+}
+
+// Middleware allowing only authenticated, active users holding one of the roles
+func requireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, ok := authUserID(c)
+			if !ok {
+				return newProblem(http.StatusUnauthorized, "Invalid or missing token")
+			}
+
+			var user User
+			if err := dbCtx(c).Preload("Roles").First(&user, id).Error; err != nil {
+				return newProblem(http.StatusUnauthorized, "Invalid or missing token")
+			}
+			if err := inactiveUserProblem(&user); err != nil {
+				return err
+			}
+			if !user.HasRole(roles...) {
+				return newProblem(http.StatusForbidden, "Forbidden")
+			}
+
+			c.Set("currentUser", &user)
+			setAuditActor(c.Request().Context(), actorUser, user.ID)
+			return next(c)
+		}
+	}
+}
+
+// Fetch all roles
+func getRoles(c echo.Context) error {
+	var roles []Role
+	if err := dbCtx(c).Order("id").Find(&roles).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch roles")
+	}
+	return respond(c, http.StatusOK, roles)
+}
+
+// Fetch a role
+func getRole(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid role ID")
+	}
+	var role Role
+	if err := dbCtx(c).First(&role, id).Error; err != nil {
+		return newProblem(http.StatusNotFound, "Role not found")
+	}
+	return respond(c, http.StatusOK, role)
+}
+
+// Create a new role
+func createRole(c echo.Context) error {
+	role := new(Role)
+	if err := c.Bind(role); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(role); err != nil {
+		return validationError(err)
+	}
+	role.ID = 0
+	if isBuiltinRole(role.Name) {
+		return reservedRoleName()
+	}
+
+	if err := dbCtx(c).Create(role).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create role")
+	}
+	return respond(c, http.StatusCreated, role)
+}
+
+// Rename an existing role
+func updateRole(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid role ID")
+	}
+
+	updatedRole := new(Role)
+	if err := c.Bind(updatedRole); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+
+	var role Role
+	err = WithTx(c, func(tx *gorm.DB) error {
+		if err := forUpdate(tx).First(&role, id).Error; err != nil {
+			return newProblem(http.StatusNotFound, "Role not found")
+		}
+		if isBuiltinRole(role.Name) {
+			return newProblem(http.StatusBadRequest, "Built-in roles cannot be modified")
+		}
+		if isBuiltinRole(updatedRole.Name) {
+			return reservedRoleName()
+		}
+		if updatedRole.Name != "" {
+			role.Name = updatedRole.Name
+		}
+		if err := tx.Save(&role).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to update role")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, role)
+}
+
+// Delete a role
+func deleteRole(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid role ID")
+	}
+
+	err = WithTx(c, func(tx *gorm.DB) error {
+		var role Role
+		if err := forUpdate(tx).First(&role, id).Error; err != nil {
+			return newProblem(http.StatusNotFound, "Role not found")
+		}
+		if isBuiltinRole(role.Name) {
+			return newProblem(http.StatusBadRequest, "Built-in roles cannot be deleted")
+		}
+		// Raw statements escape the tenant scope, so limit it to the tenant's users
+		users := tx.Model(&User{}).Select("id")
+		if err := tx.Exec("DELETE FROM user_roles WHERE role_id = ? AND user_id IN (?)", role.ID, users).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to delete role")
+		}
+		if err := tx.Delete(&role).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to delete role")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, map[string]string{"message": "Role deleted successfully"})
+}
+
+// Replace the set of roles assigned to a user
+func setUserRoles(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(struct {
+		Roles []string `json:"roles"`
+	})
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+
+	var roles []Role
+	if len(req.Roles) > 0 {
+		if err := dbCtx(c).Where("name IN ?", req.Roles).Find(&roles).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to update roles")
+		}
+	}
+	if len(roles) != len(req.Roles) {
+		return newProblem(http.StatusBadRequest, "Unknown role")
+	}
+
+	var user User
+	err = WithTx(c, func(tx *gorm.DB) error {
+		if err := forUpdate(tx).Preload("Roles").First(&user, id).Error; err != nil {
+			return newProblem(http.StatusNotFound, "User not found")
+		}
+		before := roleNames(user.Roles)
+
+		if err := tx.Model(&user).Association("Roles").Replace(roles); err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Update("version", gorm.Expr("version + 1")).Error; err != nil {
+			return err
+		}
+		// user_roles is not audited row by row, so record the assignment as a whole
+		changes := AuditChanges{"roles": {Before: before, After: roleNames(roles)}}
+		if err := writeAuditLogs(tx, newAuditLog(c.Request().Context(), auditUpdate, "users", strconv.FormatUint(uint64(user.ID), 10), changes)); err != nil {
+			return err
+		}
+		// Set before commit so the published event carries the new roles
+		user.Roles = roles
+		user.Version++
+		return nil
+	})
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to update roles")
+	}
+	setUserETag(c, &user)
+	return respond(c, http.StatusOK, newUserResource(c, &user))
+}
+
+func isBuiltinRole(name string) bool {
+	return name == RoleAdmin || name == RoleEditor || name == RoleViewer
+}
+
+// Custom roles cannot take a built-in role's name, which would grant its permissions
+func reservedRoleName() error {
+	p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+	p.Errors = map[string]string{"name": "is reserved"}
+	return p
+}
+
+// Names of the roles, sorted
+func roleNames(roles []Role) []string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"log"
+)
+
+var sampleUsers = []User{
+	{Name: "William", Birthday: mustParseDate("2002-10-29")},
+	{Name: "Alexander", Birthday: mustParseDate("2000-12-25")},
+	{Name: "Nicholas", Birthday: mustParseDate("2001-01-28")},
+}
+
+// Create the bootstrap admin and, with -sample, a few example users
+func seedCommand(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	name := flags.String("admin-name", cfg.Admin.Name, "bootstrap admin name (default $ADMIN_NAME)")
+	password := flags.String("admin-password", cfg.Admin.Password, "bootstrap admin password (default $ADMIN_PASSWORD, else a random one)")
+	sample := flags.Bool("sample", false, "also create sample users")
+	slug := flags.String("tenant", defaultTenantSlug, "tenant to seed")
+	flags.Parse(args)
+	if *password == "change-me" {
+		log.Fatal("The admin password must not be the change-me placeholder")
+	}
+
+	initDB()
+	ensureMigrated()
+
+	tenant, err := findTenant(context.Background(), *slug)
+	if err != nil {
+		log.Fatalf("Failed to find tenant %q: %v", *slug, err)
+	}
+	// Everything below reads and writes within the tenant
+	db = db.WithContext(withTenant(context.Background(), tenant))
+
+	if *name != "" {
+		seedAdmin(*name, *password)
+	}
+	if *sample {
+		seedSampleUsers()
+	}
+	log.Println("Seeding complete.")
+}
+
+// Create an admin account unless one already exists. Without a password, a
+// random one is generated and printed once.
+func seedAdmin(name, password string) {
+	var admins int64
+	db.Model(&User{}).Joins("JOIN user_roles ON user_roles.user_id = users.id").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("roles.name = ?", RoleAdmin).Count(&admins)
+	if admins > 0 {
+		log.Println("An admin user already exists, skipping.")
+		return
+	}
+
+	generated := password == ""
+	if generated {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("Failed to create admin user: %v", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Fatalf("Failed to create admin user: %v", err)
+	}
+	var role Role
+	if err := db.Where("name = ?", RoleAdmin).First(&role).Error; err != nil {
+		log.Fatalf("Failed to create admin user: %v", err)
+	}
+	admin := User{Name: name, PasswordHash: hash, Roles: []Role{role}}
+	if err := db.Create(&admin).Error; err != nil {
+		log.Fatalf("Failed to create admin user: %v", err)
+	}
+	log.Printf("Created bootstrap admin user %q", name)
+	if generated {
+		log.Printf("Its password is %s and will not be shown again", password)
+	}
+}
+
+// Create the sample users that don't exist yet
+func seedSampleUsers() {
+	roles, err := defaultRoles(db.Statement.Context)
+	if err != nil {
+		log.Fatalf("Failed to seed users: %v", err)
+	}
+	for _, sample := range sampleUsers {
+		user := sample
+		user.Roles = roles
+		result := db.Where(User{Name: user.Name}).FirstOrCreate(&user)
+		if result.Error != nil {
+			log.Fatalf("Failed to seed users: %v", result.Error)
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("Created sample user %q", user.Name)
+		}
+	}
+}
+
+func mustParseDate(s string) Date {
+	d, err := ParseDate(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
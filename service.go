@@ -0,0 +1,1043 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bulkInsertBatchSize = 500
+
+// BulkResult reports the outcome of one item in a bulk request
+type BulkResult struct {
+	Index  int               `json:"index"`
+	Status int               `json:"status"`
+	User   *User             `json:"user,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+var (
+	// ErrUserNotDeleted is returned when restoring a user that is not soft-deleted
+	ErrUserNotDeleted = errors.New("user is not deleted")
+	// ErrInvalidPatch is returned when a patch cannot be applied to a user
+	ErrInvalidPatch = errors.New("Invalid patch")
+	// ErrEmailTaken is returned when another user already has the email
+	ErrEmailTaken = errors.New("email is already in use")
+	// ErrManagerNotFound is returned when assigning a manager who is not a live user
+	ErrManagerNotFound = errors.New("manager not found")
+	// ErrManagerCycle is returned when a user would end up managing themselves
+	ErrManagerCycle = errors.New("manager cycle")
+	// ErrMergeSelf is returned when merging a user into themselves
+	ErrMergeSelf = errors.New("cannot merge a user into themselves")
+	// ErrUserAnonymized is returned when anonymizing a user a second time
+	ErrUserAnonymized = errors.New("user is already anonymized")
+	// ErrUserVersionNotFound is returned when reverting to a version that was never recorded
+	ErrUserVersionNotFound = errors.New("user version not found")
+	// ErrWrongPassword is returned when the current password given to change it does not match
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrVerificationStale is returned when the email changed after a verification link was sent
+	ErrVerificationStale = errors.New("email changed since the verification link was sent")
+)
+
+// UserService holds the business rules for users, independent of transport
+type UserService struct {
+	repo      UserRepository
+	validator *RequestValidator
+	// Looks up the roles given to new users
+	defaultRoles func(ctx context.Context) ([]Role, error)
+}
+
+var userService *UserService
+
+func NewUserService(repo UserRepository, validator *RequestValidator) *UserService {
+	return &UserService{repo: repo, validator: validator, defaultRoles: defaultRoles}
+}
+
+// List a page of users
+func (s *UserService) List(ctx context.Context, q UserQuery) ([]User, int64, error) {
+	return s.repo.Find(ctx, q)
+}
+
+// Count the users matching the query's conditions
+func (s *UserService) Count(ctx context.Context, q UserQuery) (int64, error) {
+	return s.repo.Count(ctx, q)
+}
+
+// List the users after the cursor, returning the cursor for the following page
+// or nil when this is the last one
+func (s *UserService) ListAfter(ctx context.Context, q UserQuery, sort string, after *Cursor) ([]User, *Cursor, error) {
+	// Fetch one extra row to learn whether another page follows
+	limit := q.Limit
+	q.Limit++
+	users, err := s.repo.FindAfter(ctx, q, after)
+	if err != nil || len(users) <= limit {
+		return users, nil, err
+	}
+	users = users[:limit]
+	next := cursorAfter(sort, users[limit-1])
+	return users, &next, nil
+}
+
+// Export passes every user matching q to fn in batches, so callers can stream them
+func (s *UserService) Export(ctx context.Context, q UserQuery, fn func(users []User) error) error {
+	return s.repo.FindInBatches(ctx, q, exportBatchSize, fn)
+}
+
+// Search live users by name or email, most relevant first
+func (s *UserService) Search(ctx context.Context, term string, offset, limit int) ([]User, int64, error) {
+	return s.repo.Search(ctx, strings.TrimSpace(term), offset, limit)
+}
+
+// Get a live user
+func (s *UserService) Get(ctx context.Context, id uint) (*User, error) {
+	return s.repo.Get(ctx, id, false)
+}
+
+// Fetch a live user with the associations named by expand, such as "addresses"
+func (s *UserService) GetExpanded(ctx context.Context, id uint, expand []string) (*User, error) {
+	var preloads []string
+	for _, name := range expand {
+		if preload := userExpansions[name]; preload != "" {
+			preloads = append(preloads, preload)
+		}
+	}
+	user, err := s.repo.GetWith(ctx, id, preloads...)
+	if err != nil || !slices.Contains(expand, "consents") {
+		return user, err
+	}
+	consents, err := s.repo.Consents(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	user.Consents = summarizeConsents(consents)
+	return user, nil
+}
+
+// Resolve an integer ID or UUID to the user's ID
+func (s *UserService) Resolve(ctx context.Context, ref UserRef) (uint, error) {
+	ids, err := s.resolveMany(ctx, []UserRef{ref})
+	if err != nil {
+		return 0, err
+	}
+	id, ok := ids[ref]
+	if !ok {
+		if _, _, err := ref.Parse(); err != nil {
+			return 0, err
+		}
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+// Map refs to user IDs; unknown UUIDs and malformed refs are left out
+func (s *UserService) resolveMany(ctx context.Context, refs []UserRef) (map[UserRef]uint, error) {
+	ids := make(map[UserRef]uint, len(refs))
+	var uuids []string
+	byUUID := map[string][]UserRef{}
+	for _, ref := range refs {
+		id, u, err := ref.Parse()
+		switch {
+		case err != nil:
+		case u != "":
+			uuids = append(uuids, u)
+			byUUID[u] = append(byUUID[u], ref)
+		default:
+			ids[ref] = id
+		}
+	}
+	if len(uuids) == 0 {
+		return ids, nil
+	}
+	found, err := s.repo.IDsByUUID(ctx, uuids)
+	if err != nil {
+		return nil, err
+	}
+	for u, id := range found {
+		for _, ref := range byUUID[u] {
+			ids[ref] = id
+		}
+	}
+	return ids, nil
+}
+
+// Get the users with the given refs in request order, plus the refs that were not found
+func (s *UserService) GetMany(ctx context.Context, refs []UserRef) ([]User, []UserRef, error) {
+	resolved, err := s.resolveMany(ctx, refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]uint, 0, len(resolved))
+	for _, id := range resolved {
+		ids = append(ids, id)
+	}
+
+	var found []User
+	if len(ids) > 0 {
+		if found, err = s.repo.GetMany(ctx, ids); err != nil {
+			return nil, nil, err
+		}
+	}
+	byID := make(map[uint]User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+
+	users := make([]User, 0, len(found))
+	missing := []UserRef{}
+	seen := make(map[uint]bool, len(refs))
+	for _, ref := range refs {
+		user, ok := byID[resolved[ref]]
+		if !ok {
+			missing = append(missing, ref)
+			continue
+		}
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			users = append(users, user)
+		}
+	}
+	return users, missing, nil
+}
+
+// Validate and create a user with the default roles
+func (s *UserService) Create(ctx context.Context, req createUserRequest) (*User, error) {
+	req.Email = normalizeEmail(req.Email)
+	if err := s.validator.Validate(req); err != nil {
+		return nil, err
+	}
+	if err := checkEmail(ctx, s.repo, req.Email, 0); err != nil {
+		return nil, err
+	}
+
+	user := &User{Name: req.Name, Email: optionalEmail(req.Email), Birthday: req.Birthday, Metadata: req.Metadata}
+	if req.Password != "" {
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = hash
+	}
+
+	roles, err := s.defaultRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user.Roles = roles
+
+	if err := s.repo.Create(ctx, user); err != nil {
+		return nil, emailConflict(err)
+	}
+	usersCreatedTotal.Inc()
+	return user, nil
+}
+
+// Create the user with req's email or, if a live user already has it, give
+// that user req's name and birthday, and its metadata and password if set.
+// It reports whether the user was created. Replaying a request changes nothing.
+func (s *UserService) Upsert(ctx context.Context, req createUserRequest) (*User, bool, error) {
+	req.Email = normalizeEmail(req.Email)
+	if err := s.validator.Validate(req); err != nil {
+		return nil, false, err
+	}
+	var hash string
+	if req.Password != "" {
+		var err error
+		if hash, err = hashPassword(req.Password); err != nil {
+			return nil, false, err
+		}
+	}
+	roles, err := s.defaultRoles(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var user *User
+	created := false
+	err = s.repo.Transaction(ctx, func(repo UserRepository) error {
+		user = &User{
+			Name:         req.Name,
+			Email:        optionalEmail(req.Email),
+			Birthday:     req.Birthday,
+			Metadata:     req.Metadata,
+			PasswordHash: hash,
+			Roles:        roles,
+		}
+		existing, err := repo.CreateIfAbsent(ctx, user)
+		if err != nil || existing == nil {
+			created = err == nil
+			return emailConflict(err)
+		}
+		// The email stays reserved until a deleted user is purged
+		if existing.DeletedAt.Valid {
+			return ErrEmailTaken
+		}
+		user = existing
+		changed := user.Name != req.Name || !user.Birthday.Equal(req.Birthday.Time)
+		user.Name, user.Birthday = req.Name, req.Birthday
+		if req.Metadata != nil && !reflect.DeepEqual(user.Metadata, req.Metadata) {
+			user.Metadata, changed = req.Metadata, true
+		}
+		if req.Password != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+			user.PasswordHash, changed = hash, true
+		}
+		if !changed {
+			return nil
+		}
+		return repo.Update(ctx, user)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		usersCreatedTotal.Inc()
+	}
+	return user, created, nil
+}
+
+// Apply a batch from an external system in one transaction, as described at
+// syncUsers. Any invalid user or email conflict rejects the whole batch with a
+// SyncItemError. Emails are claimed one user at a time, so two synced users
+// cannot swap emails in one batch.
+func (s *UserService) Sync(ctx context.Context, reqs []syncUserRequest) (*SyncSummary, error) {
+	externalIDs := make(map[string]bool, len(reqs))
+	emails := make(map[string]bool, len(reqs))
+	for i := range reqs {
+		req := &reqs[i]
+		req.Email = normalizeEmail(req.Email)
+		if err := s.validator.Validate(*req); err != nil {
+			return nil, &SyncItemError{Index: i, Status: http.StatusUnprocessableEntity, Errors: validationFields(err)}
+		}
+		if externalIDs[req.ExternalID] {
+			return nil, &SyncItemError{Index: i, Status: http.StatusUnprocessableEntity, Errors: map[string]string{"external_id": "appears earlier in the batch"}}
+		}
+		externalIDs[req.ExternalID] = true
+		if req.Email != "" {
+			if emails[req.Email] {
+				return nil, &SyncItemError{Index: i, Status: http.StatusUnprocessableEntity, Errors: map[string]string{"email": "appears earlier in the batch"}}
+			}
+			emails[req.Email] = true
+		}
+	}
+	roles, err := s.defaultRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary *SyncSummary
+	err = s.repo.Transaction(ctx, func(repo UserRepository) error {
+		summary = &SyncSummary{Changes: []SyncChange{}}
+		synced, err := repo.Synced(ctx)
+		if err != nil {
+			return err
+		}
+		byExternalID := make(map[string]*User, len(synced))
+		var missing []User
+		for i := range synced {
+			user := &synced[i]
+			if externalIDs[*user.ExternalID] {
+				byExternalID[*user.ExternalID] = user
+			} else if !user.DeletedAt.Valid {
+				missing = append(missing, *user)
+			}
+		}
+		if len(missing) > 0 {
+			if _, err := repo.DeleteMany(ctx, missing); err != nil {
+				return err
+			}
+			for i := range missing {
+				summary.record(&missing[i], syncDeleted)
+			}
+		}
+
+		emailTaken := func(i int, err error) error {
+			if errors.Is(err, ErrDuplicate) {
+				return &SyncItemError{Index: i, Status: http.StatusConflict, Errors: map[string]string{"email": "is already in use"}}
+			}
+			return err
+		}
+		for i, req := range reqs {
+			user, ok := byExternalID[req.ExternalID]
+			if !ok {
+				externalID := req.ExternalID
+				user = &User{
+					ExternalID: &externalID,
+					Name:       req.Name,
+					Email:      optionalEmail(req.Email),
+					Birthday:   req.Birthday,
+					Metadata:   req.Metadata,
+					Roles:      roles,
+				}
+				if err := repo.Create(ctx, user); err != nil {
+					return emailTaken(i, err)
+				}
+				summary.record(user, syncCreated)
+				continue
+			}
+
+			action := syncUpdated
+			if user.DeletedAt.Valid {
+				if err := repo.Restore(ctx, user); err != nil {
+					return err
+				}
+				action = syncRestored
+			}
+			changed := user.Name != req.Name || derefEmail(user.Email) != req.Email || !user.Birthday.Equal(req.Birthday.Time)
+			if req.Email != derefEmail(user.Email) {
+				user.IsVerified = false
+			}
+			user.Name, user.Email, user.Birthday = req.Name, optionalEmail(req.Email), req.Birthday
+			if req.Metadata != nil && !reflect.DeepEqual(user.Metadata, req.Metadata) {
+				user.Metadata, changed = req.Metadata, true
+			}
+			if changed {
+				if err := repo.Update(ctx, user); err != nil {
+					return emailTaken(i, err)
+				}
+			}
+			if changed || action == syncRestored {
+				summary.record(user, action)
+			} else {
+				summary.Unchanged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	usersCreatedTotal.Add(float64(summary.Created))
+	return summary, nil
+}
+
+// Validate each request and insert the valid ones in a single transaction.
+// Invalid items are reported in the results and do not block the others.
+func (s *UserService) CreateMany(ctx context.Context, reqs []createUserRequest) ([]BulkResult, error) {
+	roles, err := s.defaultRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []string
+	for i := range reqs {
+		reqs[i].Email = normalizeEmail(reqs[i].Email)
+		if reqs[i].Email != "" {
+			emails = append(emails, reqs[i].Email)
+		}
+	}
+	taken, err := s.repo.TakenEmails(ctx, emails, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BulkResult, len(reqs))
+	var users []*User
+	for i, req := range reqs {
+		results[i].Index = i
+		if err := s.validator.Validate(req); err != nil {
+			results[i].Status = http.StatusUnprocessableEntity
+			results[i].Errors = validationFields(err)
+			continue
+		}
+		// Later duplicates within the batch conflict with the first one
+		if req.Email != "" {
+			if taken[req.Email] {
+				results[i].Status = http.StatusConflict
+				results[i].Errors = map[string]string{"email": "is already in use"}
+				continue
+			}
+			taken[req.Email] = true
+		}
+
+		user := &User{Name: req.Name, Email: optionalEmail(req.Email), Birthday: req.Birthday, Metadata: req.Metadata, Roles: roles}
+		if req.Password != "" {
+			hash, err := hashPassword(req.Password)
+			if err != nil {
+				return nil, err
+			}
+			user.PasswordHash = hash
+		}
+		results[i].Status = http.StatusCreated
+		results[i].User = user
+		users = append(users, user)
+	}
+
+	if len(users) > 0 {
+		if err := s.repo.CreateBatch(ctx, users, bulkInsertBatchSize); err != nil {
+			return nil, emailConflict(err)
+		}
+		usersCreatedTotal.Add(float64(len(users)))
+	}
+	return results, nil
+}
+
+// Validate and apply the provided fields to a user.
+// A non-zero version must match the stored one.
+func (s *UserService) Update(ctx context.Context, id, version uint, req updateUserRequest) (*User, error) {
+	req.Email = normalizeEmail(req.Email)
+	if err := s.validator.Validate(req); err != nil {
+		return nil, err
+	}
+
+	var hash string
+	if req.Password != "" {
+		var err error
+		if hash, err = hashPassword(req.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = getVersion(ctx, repo, id, version); err != nil {
+			return err
+		}
+		if req.Name != "" {
+			user.Name = req.Name
+		}
+		if req.Email != "" {
+			if err := checkEmail(ctx, repo, req.Email, user.ID); err != nil {
+				return err
+			}
+			if req.Email != derefEmail(user.Email) {
+				user.IsVerified = false
+			}
+			user.Email = optionalEmail(req.Email)
+		}
+		if !req.Birthday.IsZero() {
+			user.Birthday = req.Birthday
+		}
+		// Metadata is replaced as a whole; {} clears it
+		if req.Metadata != nil {
+			user.Metadata = req.Metadata
+		}
+		if hash != "" {
+			user.PasswordHash = hash
+		}
+		return emailConflict(repo.Update(ctx, user))
+	})
+	return user, err
+}
+
+// Apply a patch to the user's document, then validate and save the result.
+// Fields missing from the patched document are cleared.
+func (s *UserService) Patch(ctx context.Context, id, version uint, apply func(doc []byte) ([]byte, error)) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = getVersion(ctx, repo, id, version); err != nil {
+			return err
+		}
+
+		doc, err := json.Marshal(patchUserDocument{Name: user.Name, Email: derefEmail(user.Email), Birthday: user.Birthday, Metadata: user.Metadata})
+		if err != nil {
+			return err
+		}
+		patched, err := apply(doc)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+
+		var req patchUserDocument
+		dec := json.NewDecoder(bytes.NewReader(patched))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, errInvalidDate) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		req.Email = normalizeEmail(req.Email)
+		if err := s.validator.Validate(req); err != nil {
+			return err
+		}
+		if err := checkEmail(ctx, repo, req.Email, user.ID); err != nil {
+			return err
+		}
+
+		if req.Email != derefEmail(user.Email) {
+			user.IsVerified = false
+		}
+		user.Name = req.Name
+		user.Email = optionalEmail(req.Email)
+		user.Birthday = req.Birthday
+		user.Metadata = req.Metadata
+		if req.Password != "" {
+			if user.PasswordHash, err = hashPassword(req.Password); err != nil {
+				return err
+			}
+		}
+		return emailConflict(repo.Update(ctx, user))
+	})
+	return user, err
+}
+
+// Mark the user's email verified, if it is still the one the link was sent to
+func (s *UserService) Verify(ctx context.Context, id uint, email string) error {
+	return s.repo.Transaction(ctx, func(repo UserRepository) error {
+		user, err := repo.GetForUpdate(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		if derefEmail(user.Email) != email {
+			return ErrVerificationStale
+		}
+		if user.IsVerified {
+			return nil
+		}
+		user.IsVerified = true
+		return repo.Update(ctx, user)
+	})
+}
+
+// Replace a user's password. With checkCurrent, req.CurrentPassword must match
+// the stored password first.
+func (s *UserService) ChangePassword(ctx context.Context, id uint, req changePasswordRequest, checkCurrent bool) error {
+	if err := s.validator.Validate(req); err != nil {
+		return err
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+	return s.repo.Transaction(ctx, func(repo UserRepository) error {
+		user, err := repo.GetForUpdate(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		if checkCurrent && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)) != nil {
+			return ErrWrongPassword
+		}
+		user.PasswordHash = hash
+		return repo.Update(ctx, user)
+	})
+}
+
+// Point a live user at a new avatar, pending processing, or none with an
+// empty key, returning the key of the avatar it replaced for the caller to delete
+func (s *UserService) SetAvatar(ctx context.Context, id uint, key string) (*User, string, error) {
+	var user *User
+	var old string
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, false); err != nil {
+			return err
+		}
+		if user.Avatar == key {
+			return nil
+		}
+		old, user.Avatar, user.AvatarStatus = user.Avatar, key, ""
+		if key != "" {
+			user.AvatarStatus = avatarPending
+		}
+		return repo.Update(ctx, user)
+	})
+	return user, old, err
+}
+
+// Record how processing a user's avatar went, unless the avatar has since
+// been replaced
+func (s *UserService) SetAvatarStatus(ctx context.Context, id uint, key, status string) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, false); err != nil {
+			return err
+		}
+		if user.Avatar != key || user.AvatarStatus == status {
+			return nil
+		}
+		user.AvatarStatus = status
+		return repo.Update(ctx, user)
+	})
+	return user, err
+}
+
+// Make managerID a user's manager, or leave them without one when it is zero.
+// Changes to the hierarchy are serialized, so two assignments cannot make a
+// cycle between them.
+func (s *UserService) SetManager(ctx context.Context, id, managerID uint) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		if err := repo.LockHierarchy(ctx); err != nil {
+			return err
+		}
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, false); err != nil {
+			return err
+		}
+		var current uint
+		if user.ManagerID != nil {
+			current = *user.ManagerID
+		}
+		if current == managerID {
+			return nil
+		}
+		user.ManagerID = nil
+		if managerID != 0 {
+			if _, err := repo.Get(ctx, managerID, false); errors.Is(err, ErrNotFound) {
+				return ErrManagerNotFound
+			} else if err != nil {
+				return err
+			}
+			chain, err := repo.ManagerChain(ctx, managerID, maxManagerDepth)
+			if err != nil {
+				return err
+			}
+			if managerID == id || slices.Contains(chain, id) {
+				return ErrManagerCycle
+			}
+			user.ManagerID = &managerID
+		}
+		return repo.Update(ctx, user)
+	})
+	return user, err
+}
+
+// Merge the user otherID into the user id, which keeps its own fields and
+// takes the other's where it has none. The other user's related records move
+// over and the other user is soft-deleted. Fails with ErrManagerCycle when
+// the user reports to the other through someone else, whose reports they
+// would become.
+func (s *UserService) Merge(ctx context.Context, id, otherID uint) (*User, error) {
+	if id == otherID {
+		return nil, ErrMergeSelf
+	}
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		if err := repo.LockHierarchy(ctx); err != nil {
+			return err
+		}
+		// Lock in ID order so concurrent merges of the same pair cannot deadlock
+		first, second := min(id, otherID), max(id, otherID)
+		a, err := repo.GetForUpdate(ctx, first, false)
+		if err != nil {
+			return err
+		}
+		b, err := repo.GetForUpdate(ctx, second, false)
+		if err != nil {
+			return err
+		}
+		other := b
+		user = a
+		if user.ID != id {
+			user, other = b, a
+		}
+
+		chain, err := repo.ManagerChain(ctx, id, maxManagerDepth)
+		if err != nil {
+			return err
+		}
+		if i := slices.Index(chain, otherID); i > 0 {
+			return ErrManagerCycle
+		} else if i == 0 {
+			user.ManagerID = other.ManagerID
+		}
+
+		// The other user gives up what moves over, since emails stay unique
+		// and a purge would delete the avatar files
+		released := false
+		if user.Email == nil && other.Email != nil {
+			user.Email, user.IsVerified = other.Email, other.IsVerified
+			other.Email, released = nil, true
+		}
+		if user.Avatar == "" && other.Avatar != "" {
+			user.Avatar, user.AvatarStatus = other.Avatar, other.AvatarStatus
+			other.Avatar, other.AvatarStatus, released = "", "", true
+		}
+		if user.Birthday.IsZero() {
+			user.Birthday = other.Birthday
+		}
+		if user.PasswordHash == "" {
+			user.PasswordHash = other.PasswordHash
+		}
+		for k, v := range other.Metadata {
+			if _, ok := user.Metadata[k]; !ok {
+				if user.Metadata == nil {
+					user.Metadata = Metadata{}
+				}
+				user.Metadata[k] = v
+			}
+		}
+
+		if released {
+			if err := repo.Update(ctx, other); err != nil {
+				return err
+			}
+		}
+		if err := repo.Reassign(ctx, otherID, id); err != nil {
+			return err
+		}
+		if err := repo.Update(ctx, user); err != nil {
+			return err
+		}
+		return repo.Delete(ctx, other)
+	})
+	return user, err
+}
+
+// List a live user's live managers, nearest first
+func (s *UserService) ManagerChain(ctx context.Context, id uint) ([]User, error) {
+	if _, err := s.repo.Get(ctx, id, false); err != nil {
+		return nil, err
+	}
+	ids, err := s.repo.ManagerChain(ctx, id, maxManagerDepth)
+	if err != nil || len(ids) == 0 {
+		return []User{}, err
+	}
+	found, err := s.repo.GetMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+	managers := make([]User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			managers = append(managers, user)
+		}
+	}
+	return managers, nil
+}
+
+// Soft-delete a user. A non-zero version must match the stored one.
+func (s *UserService) Delete(ctx context.Context, id, version uint) error {
+	return s.repo.Transaction(ctx, func(repo UserRepository) error {
+		user, err := getVersion(ctx, repo, id, version)
+		if err != nil {
+			return err
+		}
+		return repo.Delete(ctx, user)
+	})
+}
+
+// Soft-delete several users atomically, returning the count deleted and the refs not found
+func (s *UserService) DeleteMany(ctx context.Context, refs []UserRef) (int64, []UserRef, error) {
+	resolved, err := s.resolveMany(ctx, refs)
+	if err != nil {
+		return 0, nil, err
+	}
+	ids := make([]uint, 0, len(resolved))
+	for _, id := range resolved {
+		ids = append(ids, id)
+	}
+
+	var deleted int64
+	var missing []UserRef
+	err = s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var found []User
+		if len(ids) > 0 {
+			var err error
+			if found, err = repo.GetMany(ctx, ids); err != nil {
+				return err
+			}
+		}
+		exists := make(map[uint]bool, len(found))
+		for _, user := range found {
+			exists[user.ID] = true
+		}
+		missing = []UserRef{}
+		for _, ref := range refs {
+			if !exists[resolved[ref]] {
+				missing = append(missing, ref)
+			}
+		}
+		if len(found) == 0 {
+			return nil
+		}
+		var err error
+		deleted, err = repo.DeleteMany(ctx, found)
+		return err
+	})
+	return deleted, missing, err
+}
+
+// Bring back a soft-deleted user
+func (s *UserService) Restore(ctx context.Context, id uint) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, true); err != nil {
+			return err
+		}
+		if !user.DeletedAt.Valid {
+			return ErrUserNotDeleted
+		}
+		return repo.Restore(ctx, user)
+	})
+	return user, err
+}
+
+// Permanently remove a user, deleted or not, along with its files
+func (s *UserService) Purge(ctx context.Context, id uint) error {
+	var files []string
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		user, err := repo.GetForUpdate(ctx, id, true)
+		if err != nil {
+			return err
+		}
+		files, err = repo.Purge(ctx, user)
+		return err
+	})
+	if err == nil {
+		deleteStoredObjects(ctx, files...)
+	}
+	return err
+}
+
+// Irreversibly replace a user's personal data, deleted or not, with
+// placeholders. The user keeps its ID, posts, roles, groups and place in the
+// hierarchy, but not its addresses, files or sign-in identities.
+func (s *UserService) Anonymize(ctx context.Context, id uint) (*User, error) {
+	var user *User
+	var files []string
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, true); err != nil {
+			return err
+		}
+		if user.AnonymizedAt != nil {
+			return ErrUserAnonymized
+		}
+		now := time.Now()
+		user.Name = anonymizedName
+		user.Email, user.IsVerified = nil, false
+		user.Birthday = Date{}
+		user.PasswordHash = ""
+		user.Avatar, user.AvatarStatus = "", ""
+		user.Metadata = nil
+		user.AnonymizedAt = &now
+		files, err = repo.Anonymize(ctx, user)
+		return err
+	})
+	if err == nil {
+		deleteStoredObjects(ctx, files...)
+	}
+	return user, err
+}
+
+// Move a live user to another status, which the state machine must allow.
+// The reason is kept while the user is suspended or banned.
+func (s *UserService) SetStatus(ctx context.Context, id uint, status, reason string) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = repo.GetForUpdate(ctx, id, false); err != nil {
+			return err
+		}
+		if !canTransition(user.Status, status) {
+			return &StatusTransitionError{From: user.Status, To: status}
+		}
+		user.Status = status
+		user.StatusReason = ""
+		if status != userActive {
+			user.StatusReason = reason
+		}
+		return repo.Update(ctx, user)
+	})
+	return user, err
+}
+
+// List a user's recorded versions, deleted or not, newest first
+func (s *UserService) History(ctx context.Context, id uint, offset, limit int) ([]UserVersion, int64, error) {
+	if _, err := s.repo.Get(ctx, id, true); err != nil {
+		return nil, 0, err
+	}
+	return s.repo.Versions(ctx, id, offset, limit)
+}
+
+// Set a user's fields back to those of an earlier version, saving the result
+// as a new version. A non-zero version must match the stored one.
+func (s *UserService) Revert(ctx context.Context, id, version, target uint) (*User, error) {
+	var user *User
+	err := s.repo.Transaction(ctx, func(repo UserRepository) error {
+		var err error
+		if user, err = getVersion(ctx, repo, id, version); err != nil {
+			return err
+		}
+		snapshot, err := repo.GetVersion(ctx, id, target)
+		if errors.Is(err, ErrNotFound) {
+			return ErrUserVersionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// The old email may have been taken by another user since
+		if err := checkEmail(ctx, repo, derefEmail(snapshot.Email), user.ID); err != nil {
+			return err
+		}
+
+		user.Name = snapshot.Name
+		user.Email = snapshot.Email
+		user.Birthday = snapshot.Birthday
+		return emailConflict(repo.Update(ctx, user))
+	})
+	return user, err
+}
+
+// Load and lock a live user for a change, checking it is still at version
+// unless version is zero
+func getVersion(ctx context.Context, repo UserRepository, id, version uint) (*User, error) {
+	user, err := repo.GetForUpdate(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && user.Version != version {
+		return nil, ErrVersionConflict
+	}
+	return user, nil
+}
+
+// Fail with ErrEmailTaken if a user other than exceptID already has the email
+func checkEmail(ctx context.Context, repo UserRepository, email string, exceptID uint) error {
+	if email == "" {
+		return nil
+	}
+	taken, err := repo.TakenEmails(ctx, []string{email}, exceptID)
+	if err != nil {
+		return err
+	}
+	if taken[email] {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// Report a unique constraint violation as ErrEmailTaken, the only unique user column
+func emailConflict(err error) error {
+	if errors.Is(err, ErrDuplicate) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// Emails are compared case-insensitively
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Store empty emails as NULL so the unique index ignores them
+func optionalEmail(email string) *string {
+	if email == "" {
+		return nil
+	}
+	return &email
+}
+
+func derefEmail(email *string) string {
+	if email == nil {
+		return ""
+	}
+	return *email
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A UserService over an empty in-memory repository, giving new users the viewer role
+func newTestUserService() (*UserService, *MemoryUserRepository) {
+	repo := NewMemoryUserRepository()
+	s := NewUserService(repo, newRequestValidator())
+	s.defaultRoles = func(context.Context) ([]Role, error) {
+		return []Role{{ID: 3, Name: RoleViewer}}, nil
+	}
+	return s, repo
+}
+
+// Store a user directly, bypassing the service's rules
+func addTestUser(t *testing.T, repo *MemoryUserRepository, user User) *User {
+	t.Helper()
+	if user.Birthday.IsZero() {
+		user.Birthday = mustParseDate("1990-01-01")
+	}
+	if err := repo.Create(context.Background(), &user); err != nil {
+		t.Fatalf("adding user %q: %v", user.Name, err)
+	}
+	return &user
+}
+
+func setTestManager(t *testing.T, repo *MemoryUserRepository, user *User, managerID uint) {
+	t.Helper()
+	user.ManagerID = &managerID
+	if err := repo.Update(context.Background(), user); err != nil {
+		t.Fatalf("setting the manager of %q: %v", user.Name, err)
+	}
+}
+
+func TestUserServiceCreate(t *testing.T) {
+	tests := []struct {
+		name string
+		// Email of a live user, and of a deleted one
+		live, deleted string
+		req           createUserRequest
+		wantErr       error
+		wantFields    []string
+	}{
+		{
+			name: "creates a user",
+			req:  createUserRequest{Name: "Ann", Email: "ann@example.com", Birthday: mustParseDate("1990-01-01")},
+		},
+		{
+			name: "creates a user without an email alongside another",
+			live: "bob@example.com",
+			req:  createUserRequest{Name: "Ann", Birthday: mustParseDate("1990-01-01")},
+		},
+		{
+			name:    "rejects an email in use",
+			live:    "ann@example.com",
+			req:     createUserRequest{Name: "Ann", Email: "ann@example.com", Birthday: mustParseDate("1990-01-01")},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:    "compares emails case-insensitively",
+			live:    "ann@example.com",
+			req:     createUserRequest{Name: "Ann", Email: " Ann@Example.COM", Birthday: mustParseDate("1990-01-01")},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:    "rejects the email of a deleted user",
+			deleted: "ann@example.com",
+			req:     createUserRequest{Name: "Ann", Email: "ann@example.com", Birthday: mustParseDate("1990-01-01")},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:       "validates the request",
+			req:        createUserRequest{Email: "not an email"},
+			wantFields: []string{"name", "email", "birthday"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestUserService()
+			ctx := context.Background()
+			if tt.live != "" {
+				addTestUser(t, repo, User{Name: "Live", Email: optionalEmail(tt.live)})
+			}
+			if tt.deleted != "" {
+				u := addTestUser(t, repo, User{Name: "Deleted", Email: optionalEmail(tt.deleted)})
+				if err := repo.Delete(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			user, err := s.Create(ctx, tt.req)
+			if tt.wantFields != nil {
+				fields := validationFields(err)
+				for _, field := range tt.wantFields {
+					if _, ok := fields[field]; !ok {
+						t.Errorf("got validation errors %v, want one for %s", fields, field)
+					}
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			stored, err := repo.Get(ctx, user.ID, false)
+			if err != nil {
+				t.Fatalf("loading the created user: %v", err)
+			}
+			if stored.Version != 1 || !stored.HasRole(RoleViewer) || derefEmail(stored.Email) != normalizeEmail(tt.req.Email) {
+				t.Errorf("stored version %d, roles %v, email %q; want version 1 as a viewer with email %q",
+					stored.Version, roleNames(stored.Roles), derefEmail(stored.Email), normalizeEmail(tt.req.Email))
+			}
+		})
+	}
+}
+
+func TestUserServiceUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		// Version sent by the client; zero skips the check
+		version      uint
+		req          updateUserRequest
+		wantErr      error
+		wantVersion  uint
+		wantVerified bool
+	}{
+		{
+			name:         "updates any version when none is given",
+			req:          updateUserRequest{Name: "Annie"},
+			wantVersion:  3,
+			wantVerified: true,
+		},
+		{
+			name:         "updates the current version",
+			version:      2,
+			req:          updateUserRequest{Name: "Annie"},
+			wantVersion:  3,
+			wantVerified: true,
+		},
+		{
+			name:    "rejects a stale version",
+			version: 1,
+			req:     updateUserRequest{Name: "Annie"},
+			wantErr: ErrVersionConflict,
+		},
+		{
+			name:    "rejects another user's email",
+			req:     updateUserRequest{Email: "bob@example.com"},
+			wantErr: ErrEmailTaken,
+		},
+		{
+			name:         "keeps the user's own email verified",
+			req:          updateUserRequest{Email: "ANN@example.com"},
+			wantVersion:  3,
+			wantVerified: true,
+		},
+		{
+			name:        "unverifies a changed email",
+			req:         updateUserRequest{Email: "annie@example.com"},
+			wantVersion: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestUserService()
+			ctx := context.Background()
+			// Verified, so at version 2
+			ann := addTestUser(t, repo, User{Name: "Ann", Email: optionalEmail("ann@example.com")})
+			if err := s.Verify(ctx, ann.ID, "ann@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			addTestUser(t, repo, User{Name: "Bob", Email: optionalEmail("bob@example.com")})
+
+			_, err := s.Update(ctx, ann.ID, tt.version, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			stored, _ := repo.Get(ctx, ann.ID, false)
+			if err != nil {
+				if stored.Version != 2 || stored.Name != "Ann" {
+					t.Errorf("failed update left version %d and name %q", stored.Version, stored.Name)
+				}
+				return
+			}
+			if stored.Version != tt.wantVersion || stored.IsVerified != tt.wantVerified {
+				t.Errorf("got version %d, verified %v; want %d, %v", stored.Version, stored.IsVerified, tt.wantVersion, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestUserServiceSetManager(t *testing.T) {
+	// ceo manages vp, who manages dev; gone is deleted
+	tests := []struct {
+		name        string
+		user, boss  string
+		wantErr     error
+		wantManager string
+	}{
+		{name: "assigns a manager", user: "intern", boss: "dev", wantManager: "dev"},
+		{name: "moves a user", user: "dev", boss: "ceo", wantManager: "ceo"},
+		{name: "clears the manager", user: "dev", boss: "", wantManager: ""},
+		{name: "rejects the user itself", user: "dev", boss: "dev", wantErr: ErrManagerCycle},
+		{name: "rejects a direct report", user: "vp", boss: "dev", wantErr: ErrManagerCycle},
+		{name: "rejects an indirect report", user: "ceo", boss: "dev", wantErr: ErrManagerCycle},
+		{name: "rejects a deleted manager", user: "dev", boss: "gone", wantErr: ErrManagerNotFound},
+		{name: "rejects a missing user", user: "nobody", boss: "ceo", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestUserService()
+			ctx := context.Background()
+			ids := map[string]uint{"nobody": 999}
+			for _, name := range []string{"ceo", "vp", "dev", "intern", "gone"} {
+				ids[name] = addTestUser(t, repo, User{Name: name}).ID
+			}
+			vp, _ := repo.Get(ctx, ids["vp"], false)
+			setTestManager(t, repo, vp, ids["ceo"])
+			dev, _ := repo.Get(ctx, ids["dev"], false)
+			setTestManager(t, repo, dev, ids["vp"])
+			gone, _ := repo.Get(ctx, ids["gone"], false)
+			if err := repo.Delete(ctx, gone); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := s.SetManager(ctx, ids[tt.user], ids[tt.boss])
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var want *uint
+			if tt.wantManager != "" {
+				id := ids[tt.wantManager]
+				want = &id
+			}
+			stored, _ := repo.Get(ctx, user.ID, false)
+			if (stored.ManagerID == nil) != (want == nil) || (want != nil && *stored.ManagerID != *want) {
+				t.Errorf("got manager %v, want %v", stored.ManagerID, want)
+			}
+		})
+	}
+}
+
+func TestUserServiceMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// How the kept user and the merged one relate before the merge
+		setup   func(t *testing.T, repo *MemoryUserRepository, kept, merged, boss *User)
+		self    bool
+		wantErr error
+		// The kept user's manager afterwards, by name
+		wantManager string
+	}{
+		{name: "rejects merging a user into itself", self: true, wantErr: ErrMergeSelf},
+		{
+			name: "merges unrelated users",
+		},
+		{
+			name: "takes the manager of the merged user it reported to",
+			setup: func(t *testing.T, repo *MemoryUserRepository, kept, merged, boss *User) {
+				setTestManager(t, repo, merged, boss.ID)
+				setTestManager(t, repo, kept, merged.ID)
+			},
+			wantManager: "boss",
+		},
+		{
+			name: "rejects a user reporting to the merged one through another",
+			setup: func(t *testing.T, repo *MemoryUserRepository, kept, merged, boss *User) {
+				setTestManager(t, repo, boss, merged.ID)
+				setTestManager(t, repo, kept, boss.ID)
+			},
+			wantErr: ErrManagerCycle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestUserService()
+			ctx := context.Background()
+			kept := addTestUser(t, repo, User{Name: "kept", Metadata: Metadata{"team": "a"}})
+			merged := addTestUser(t, repo, User{
+				Name:     "merged",
+				Email:    optionalEmail("merged@example.com"),
+				Metadata: Metadata{"team": "b", "desk": "12"},
+			})
+			boss := addTestUser(t, repo, User{Name: "boss"})
+			report := addTestUser(t, repo, User{Name: "report"})
+			setTestManager(t, repo, report, merged.ID)
+			repo.consents[merged.ID] = []Consent{{UserID: merged.ID, Purpose: "marketing", GrantedAt: time.Now()}}
+			if tt.setup != nil {
+				tt.setup(t, repo, kept, merged, boss)
+			}
+
+			otherID := merged.ID
+			if tt.self {
+				otherID = kept.ID
+			}
+			_, err := s.Merge(ctx, kept.ID, otherID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, err := repo.Get(ctx, merged.ID, false); err != nil {
+					t.Errorf("failed merge deleted the merged user: %v", err)
+				}
+				return
+			}
+
+			if _, err := repo.Get(ctx, merged.ID, false); !errors.Is(err, ErrNotFound) {
+				t.Errorf("merged user is still live (%v)", err)
+			}
+			stored, _ := repo.Get(ctx, kept.ID, false)
+			if derefEmail(stored.Email) != "merged@example.com" {
+				t.Errorf("got email %q, want the merged user's", derefEmail(stored.Email))
+			}
+			if stored.Metadata["team"] != "a" || stored.Metadata["desk"] != "12" {
+				t.Errorf("got metadata %v, want the kept user's team and the merged user's desk", stored.Metadata)
+			}
+			names := map[uint]string{boss.ID: "boss"}
+			var manager string
+			if stored.ManagerID != nil {
+				manager = names[*stored.ManagerID]
+			}
+			if manager != tt.wantManager {
+				t.Errorf("got manager %q, want %q", manager, tt.wantManager)
+			}
+			moved, _ := repo.Get(ctx, report.ID, false)
+			if moved.ManagerID == nil || *moved.ManagerID != kept.ID {
+				t.Errorf("report's manager is %v, want the kept user %d", moved.ManagerID, kept.ID)
+			}
+			consents, _ := repo.Consents(ctx, kept.ID)
+			if len(consents) != 1 || consents[0].UserID != kept.ID || consents[0].Purpose != "marketing" {
+				t.Errorf("got consents %v, want the merged user's marketing consent", consents)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionCookie = "session"
+	csrfCookie    = "csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// Where session data is kept, chosen by SESSION_STORE
+var sessionStore *ServerStore
+
+// SessionBackend keeps session data on the server, keyed by session ID
+type SessionBackend interface {
+	// Load returns nil data for sessions that do not exist or have expired
+	Load(ctx context.Context, id string) ([]byte, error)
+	Save(ctx context.Context, id string, data []byte, ttl time.Duration) error
+	Delete(ctx context.Context, id string) error
+}
+
+// MemorySessions keeps sessions in this process, so they are lost on restart
+// and not shared between replicas
+type MemorySessions struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (m *MemorySessions) Load(ctx context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(m.entries, id)
+		return nil, nil
+	}
+	return entry.value, nil
+}
+
+func (m *MemorySessions) Save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[id] = memoryCacheEntry{value: data, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (m *MemorySessions) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, id)
+	return nil
+}
+
+// RedisSessions shares sessions between replicas, expiring them with the key TTL
+type RedisSessions struct{}
+
+func (RedisSessions) Load(ctx context.Context, id string) ([]byte, error) {
+	data, err := getRedis().Get(ctx, "session:"+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (RedisSessions) Save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	return getRedis().Set(ctx, "session:"+id, data, ttl).Err()
+}
+
+func (RedisSessions) Delete(ctx context.Context, id string) error {
+	return getRedis().Del(ctx, "session:"+id).Err()
+}
+
+// ServerStore is a gorilla/sessions store keeping session values in a
+// SessionBackend. The cookie only carries the signed session ID.
+type ServerStore struct {
+	backend SessionBackend
+	codecs  []securecookie.Codec
+	options sessions.Options
+}
+
+func NewServerStore(backend SessionBackend, hashKey []byte, ttl time.Duration) *ServerStore {
+	codecs := securecookie.CodecsFromPairs(hashKey)
+	for _, codec := range codecs {
+		codec.(*securecookie.SecureCookie).MaxAge(int(ttl.Seconds()))
+	}
+	return &ServerStore{
+		backend: backend,
+		codecs:  codecs,
+		options: sessions.Options{
+			Path:     "/",
+			MaxAge:   int(ttl.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+// Get returns the request's session, loading it once per request
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie, or starts an empty
+// one if the cookie is missing, forged or names an expired session
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, nil
+	}
+	data, err := s.backend.Load(r.Context(), id)
+	if err != nil || data == nil {
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and sets its cookie. A negative MaxAge deletes both.
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(r.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(b)
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.backend.Save(r.Context(), session.ID, data, ttl); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Set up the session store. Session cookies are signed with SESSION_SECRET,
+// or JWT_SECRET when it is unset.
+func initSessions() {
+	secret := cfg.Session.Secret
+	if secret == "" {
+		secret = cfg.Auth.JWTSecret
+	}
+	hashKey := sha256.Sum256([]byte(secret))
+
+	var backend SessionBackend
+	switch cfg.Session.Store {
+	case "", "memory":
+		backend = NewMemorySessions()
+	case "redis":
+		backend = RedisSessions{}
+	default:
+		log.Fatal("Unsupported SESSION_STORE. Set it to 'memory' or 'redis'")
+	}
+	sessionStore = NewServerStore(backend, hashKey[:], cfg.Session.TTL)
+}
+
+// The user ID of the request's session, if it has a live session in the
+// request's tenant
+func sessionUserID(c echo.Context) (uint, bool) {
+	if _, err := c.Cookie(sessionCookie); err != nil {
+		return 0, false
+	}
+	session, err := sessionStore.Get(c.Request(), sessionCookie)
+	if err != nil {
+		requestLogger(c).Error("failed to load session", "error", err)
+		return 0, false
+	}
+	id, ok := session.Values["user_id"].(uint)
+	if !ok {
+		return 0, false
+	}
+	if tenant, ok := tenantFrom(c.Request().Context()); ok && session.Values["tenant_id"] != tenant.ID {
+		return 0, false
+	}
+	return id, true
+}
+
+// Middleware checking the CSRF token of unsafe requests authenticated by a
+// session cookie. Safe requests get the token in the csrf cookie, which the
+// page's scripts echo in the X-CSRF-Token header.
+func csrfProtect() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "header:" + csrfHeader,
+		CookieName:     csrfCookie,
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteStrictMode,
+		ErrorHandler: func(err error, c echo.Context) error {
+			return newProblem(http.StatusForbidden, "Invalid or missing CSRF token")
+		},
+	})
+}
+
+// Log in with a name and password, starting a cookie session for the
+// server-rendered admin pages
+func sessionLogin(c echo.Context) error {
+	req := new(loginRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := checkLogin(c, *req)
+	if err != nil {
+		return err
+	}
+	session, err := sessionStore.Get(c.Request(), sessionCookie)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	// A new session ID on login, so an ID planted before it is useless
+	if !session.IsNew {
+		if err := sessionStore.backend.Delete(c.Request().Context(), session.ID); err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to log in")
+		}
+		session.ID = ""
+		session.Values = map[interface{}]interface{}{}
+	}
+	session.Values["user_id"] = user.ID
+	if tenant, ok := tenantFrom(c.Request().Context()); ok {
+		session.Values["tenant_id"] = tenant.ID
+	}
+	session.Options.Secure = c.Scheme() == "https"
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		requestLogger(c).Error("failed to save session", "error", err)
+		return newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
+
+// Fetch the session's user and the CSRF token to send with unsafe requests
+func getSession(c echo.Context) error {
+	id, ok := sessionUserID(c)
+	if !ok {
+		return newProblem(http.StatusUnauthorized, "Not logged in")
+	}
+	var user User
+	if err := dbCtx(c).Preload("Roles").First(&user, id).Error; err != nil {
+		return newProblem(http.StatusUnauthorized, "Not logged in")
+	}
+	return respond(c, http.StatusOK, map[string]interface{}{
+		"user":       user,
+		"csrf_token": c.Get("csrf"),
+	})
+}
+
+// End the request's session
+func sessionLogout(c echo.Context) error {
+	session, err := sessionStore.Get(c.Request(), sessionCookie)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to log out")
+	}
+	session.Options.MaxAge = -1
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		requestLogger(c).Error("failed to delete session", "error", err)
+		return newProblem(http.StatusInternalServerError, "Failed to log out")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
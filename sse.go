@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Comment lines sent while idle so proxies keep the stream open
+	sseHeartbeatInterval = 15 * time.Second
+	// Reconnect delay suggested to EventSource clients, in milliseconds
+	sseRetryMillis = 3000
+)
+
+// Stream user changes as Server-Sent Events until the client disconnects.
+// ?events=user.created,user.deleted limits the stream to those event types.
+func streamUserEvents(c echo.Context) error {
+	var only map[string]bool
+	if v := c.QueryParam("events"); v != "" {
+		var err error
+		if only, err = parseEventTypes(strings.Split(v, ",")); err != nil {
+			return newProblem(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	events, cancel := userEvents.Subscribe()
+	defer cancel()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	// Stop nginx from buffering the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: %d\n\n", sseRetryMillis)
+	res.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case e, ok := <-events:
+			if !ok {
+				// Dropped for falling behind, or the server is shutting down;
+				// either way the client reconnects after the retry delay
+				return nil
+			}
+			if !sameTenant(ctx, e) || only != nil && !only[e.Event] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				contextLogger(ctx).Error("failed to encode user event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Event, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
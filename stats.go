@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Periods of signups GET /users/stats counts, back from the current one
+const (
+	statsDays   = 30
+	statsWeeks  = 12
+	statsMonths = 12
+)
+
+// AgeBucket is an age range GET /users/stats counts users in, from Min up to
+// the next bucket's Min
+type AgeBucket struct {
+	Label string
+	Min   int
+}
+
+var ageBuckets = []AgeBucket{
+	{"0-17", 0}, {"18-24", 18}, {"25-34", 25}, {"35-44", 35}, {"45-54", 45}, {"55-64", 55}, {"65+", 65},
+}
+
+// Users without a birthday are counted under this label
+const unknownAgeBucket = "unknown"
+
+// PeriodCount is the number of users who signed up in a day, week or month
+type PeriodCount struct {
+	Period string `json:"period"`
+	Count  int64  `json:"count"`
+}
+
+// BucketCount is the number of users in an age range
+type BucketCount struct {
+	Bucket string `json:"bucket"`
+	Count  int64  `json:"count"`
+}
+
+// UserStatsReport summarizes a tenant's live users for the dashboard
+type UserStatsReport struct {
+	Total   int64 `json:"total"`
+	Signups struct {
+		Day   []PeriodCount `json:"day"`
+		Week  []PeriodCount `json:"week"`
+		Month []PeriodCount `json:"month"`
+	} `json:"signups"`
+	Ages        []BucketCount `json:"ages"`
+	GeneratedAt time.Time     `json:"generated_at"`
+}
+
+// UserStats is a tenant's user counts, materialized by the refresh-stats task
+// so dashboards and metrics need not count the users table
+type UserStats struct {
+	TenantID    uint      `json:"-" gorm:"primaryKey;autoIncrement:false"`
+	Total       int64     `json:"total"`
+	Active      int64     `json:"active"`
+	Deleted     int64     `json:"deleted"`
+	Verified    int64     `json:"verified"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+// Recount every tenant's users into user_stats and the users gauge
+func refreshUserStats(ctx context.Context) error {
+	var rows []struct {
+		TenantID uint
+		Total    int64
+		Active   int64
+		Verified int64
+	}
+	err := db.WithContext(ctx).Unscoped().Model(&User{}).
+		Select("tenant_id, COUNT(*) AS total, "+
+			"SUM(CASE WHEN deleted_at IS NULL THEN 1 ELSE 0 END) AS active, "+
+			"SUM(CASE WHEN deleted_at IS NULL AND is_verified = ? THEN 1 ELSE 0 END) AS verified", true).
+		Group("tenant_id").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	stats := make([]UserStats, len(rows))
+	for i, row := range rows {
+		stats[i] = UserStats{
+			TenantID:    row.TenantID,
+			Total:       row.Total,
+			Active:      row.Active,
+			Deleted:     row.Total - row.Active,
+			Verified:    row.Verified,
+			RefreshedAt: now,
+		}
+	}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&UserStats{}).Error; err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			return nil
+		}
+		return tx.Create(&stats).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	usersGauge.Reset()
+	for _, s := range stats {
+		tenant := strconv.FormatUint(uint64(s.TenantID), 10)
+		usersGauge.WithLabelValues(tenant, "active").Set(float64(s.Active))
+		usersGauge.WithLabelValues(tenant, "deleted").Set(float64(s.Deleted))
+		usersGauge.WithLabelValues(tenant, "verified").Set(float64(s.Verified))
+	}
+	return nil
+}
+
+// Report live user totals, signups per recent day, week (from Monday) and
+// month in UTC, and users per age range, each counted with a grouped query
+func getUsersStats(c echo.Context) error {
+	q := dbCtx(c)
+	now := time.Now().UTC()
+	report := UserStatsReport{GeneratedAt: now}
+	if err := q.Model(&User{}).Count(&report.Total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to compute user stats")
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var err error
+	if report.Signups.Day, err = countSignups(q, "day", today, statsDays, func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) }); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to compute user stats")
+	}
+	if report.Signups.Week, err = countSignups(q, "week", monday, statsWeeks, func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) }); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to compute user stats")
+	}
+	if report.Signups.Month, err = countSignups(q, "month", firstOfMonth, statsMonths, func(t time.Time, n int) time.Time { return t.AddDate(0, n, 0) }); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to compute user stats")
+	}
+	if report.Ages, err = countAges(q, now); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to compute user stats")
+	}
+	return respond(c, http.StatusOK, report)
+}
+
+// Count signups in the n periods of a unit ending with the one starting at
+// current, oldest first, including periods nobody signed up in
+func countSignups(q *gorm.DB, unit string, current time.Time, n int, add func(time.Time, int) time.Time) ([]PeriodCount, error) {
+	since := add(current, 1-n)
+	sub := q.Model(&User{}).Select(signupPeriod(q, unit)+" AS period").Where("created_at >= ?", since)
+	var rows []PeriodCount
+	if err := q.Table("(?) AS signups", sub).Select("period, COUNT(*) AS count").Group("period").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Period] = row.Count
+	}
+
+	layout := dateLayout
+	if unit == "month" {
+		layout = "2006-01"
+	}
+	periods := make([]PeriodCount, n)
+	for i := range periods {
+		key := add(since, i).Format(layout)
+		periods[i] = PeriodCount{Period: key, Count: counts[key]}
+	}
+	return periods, nil
+}
+
+// SQL naming the day, week or month a user signed up in, formatted as
+// YYYY-MM-DD (the Monday, for weeks) or YYYY-MM
+func signupPeriod(q *gorm.DB, unit string) string {
+	switch q.Dialector.Name() {
+	case "postgres":
+		return map[string]string{
+			"day":   "to_char(created_at, 'YYYY-MM-DD')",
+			"week":  "to_char(date_trunc('week', created_at), 'YYYY-MM-DD')",
+			"month": "to_char(created_at, 'YYYY-MM')",
+		}[unit]
+	case "mysql":
+		return map[string]string{
+			"day":   "DATE_FORMAT(created_at, '%Y-%m-%d')",
+			"week":  "DATE_FORMAT(created_at - INTERVAL WEEKDAY(created_at) DAY, '%Y-%m-%d')",
+			"month": "DATE_FORMAT(created_at, '%Y-%m')",
+		}[unit]
+	case "sqlserver":
+		// Style 23 is yyyy-mm-dd; the week sum is 0 on Mondays whatever DATEFIRST is
+		return map[string]string{
+			"day":   "CONVERT(char(10), created_at, 23)",
+			"week":  "CONVERT(char(10), DATEADD(day, -((DATEPART(weekday, created_at) + @@DATEFIRST + 5) % 7), created_at), 23)",
+			"month": "CONVERT(char(7), created_at, 23)",
+		}[unit]
+	}
+	return map[string]string{
+		"day":   "strftime('%Y-%m-%d', created_at)",
+		"week":  "date(created_at, 'weekday 0', '-6 days')",
+		"month": "strftime('%Y-%m', created_at)",
+	}[unit]
+}
+
+// Count users per age bucket, youngest first, then those without a birthday
+func countAges(q *gorm.DB, now time.Time) ([]BucketCount, error) {
+	bucket := "CASE WHEN birthday IS NULL THEN ?"
+	vars := []interface{}{unknownAgeBucket}
+	for i := len(ageBuckets) - 1; i > 0; i-- {
+		bucket += " WHEN birthday <= ? THEN ?"
+		vars = append(vars, Date{now.AddDate(-ageBuckets[i].Min, 0, 0)}.String(), ageBuckets[i].Label)
+	}
+	bucket += " ELSE ? END AS bucket"
+	vars = append(vars, ageBuckets[0].Label)
+
+	sub := q.Model(&User{}).Select(bucket, vars...)
+	var rows []BucketCount
+	if err := q.Table("(?) AS ages", sub).Select("bucket, COUNT(*) AS count").Group("bucket").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Bucket] = row.Count
+	}
+	ages := make([]BucketCount, 0, len(ageBuckets)+1)
+	for _, b := range ageBuckets {
+		ages = append(ages, BucketCount{Bucket: b.Label, Count: counts[b.Label]})
+	}
+	return append(ages, BucketCount{Bucket: unknownAgeBucket, Count: counts[unknownAgeBucket]}), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Account statuses. Only active users may log in or use their tokens.
+const (
+	userActive    = "active"
+	userSuspended = "suspended"
+	userBanned    = "banned"
+)
+
+// The statuses each status may move to. A ban is only lifted by activating
+// the user, not by suspending them.
+var userStatusTransitions = map[string][]string{
+	userActive:    {userSuspended, userBanned},
+	userSuspended: {userActive, userBanned},
+	userBanned:    {userActive},
+}
+
+// The verb each transition endpoint is named after, for messages
+var userStatusVerbs = map[string]string{
+	userActive:    "activate",
+	userSuspended: "suspend",
+	userBanned:    "ban",
+}
+
+// StatusTransitionError is returned when a user cannot move from one status to another
+type StatusTransitionError struct {
+	From, To string
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("cannot move a user from %s to %s", e.From, e.To)
+}
+
+// Describe the refused transition for the client
+func (e *StatusTransitionError) Detail() string {
+	if e.From == e.To {
+		return "User is already " + e.From
+	}
+	return "Cannot " + userStatusVerbs[e.To] + " a " + e.From + " user"
+}
+
+// Report whether a user in status from may be moved to status to
+func canTransition(from, to string) bool {
+	return slices.Contains(userStatusTransitions[from], to)
+}
+
+// Validate a ?status= query value
+func parseStatusParam(v string) (interface{}, error) {
+	if _, ok := userStatusTransitions[v]; !ok {
+		return nil, errors.New("Invalid status, expected active, suspended or banned")
+	}
+	return v, nil
+}
+
+type changeStatusRequest struct {
+	// Why the user is suspended or banned; required for both
+	Reason string `json:"reason" validate:"max=255"`
+}
+
+// Handler moving the user to status, as POST /users/:id/suspend, /ban and
+// /activate. Suspending or banning needs a reason and ends the user's
+// sessions; activating clears the reason.
+func changeUserStatus(status string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := userID(c)
+		if err != nil {
+			return err
+		}
+		req := new(changeStatusRequest)
+		if err := c.Bind(req); err != nil {
+			return bindError(err)
+		}
+		if err := c.Validate(req); err != nil {
+			return validationError(err)
+		}
+		if status != userActive {
+			if req.Reason == "" {
+				p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+				p.Errors = map[string]string{"reason": "is required"}
+				return p
+			}
+			if current, ok := c.Get("currentUser").(*User); ok && current.ID == id {
+				return newProblem(http.StatusUnprocessableEntity, "You cannot "+userStatusVerbs[status]+" yourself")
+			}
+		}
+
+		ctx := c.Request().Context()
+		user, err := userService.SetStatus(ctx, id, status, req.Reason)
+		if err != nil {
+			return userError(err, "Failed to change user status")
+		}
+		if status != userActive {
+			if err := revokeRefreshTokens(ctx, "user_id = ?", id); err != nil {
+				return newProblem(http.StatusInternalServerError, "Failed to revoke sessions")
+			}
+		}
+		setUserETag(c, user)
+		return respond(c, http.StatusOK, newUserResource(c, user))
+	}
+}
+
+// The problem refusing a user who is not active, or nil if they are
+func inactiveUserProblem(user *User) error {
+	if user.Status == userActive {
+		return nil
+	}
+	return newProblem(http.StatusForbidden, "Account is "+user.Status)
+}
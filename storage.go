@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrObjectNotFound is returned by storage when no object has the key
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrDirectUploadUnsupported is returned by storage that cannot take
+	// uploads from clients directly
+	ErrDirectUploadUnsupported = errors.New("direct uploads are not supported")
+)
+
+// Keeps uploaded files, chosen by STORAGE_BACKEND
+var fileStorage Storage
+
+// Storage keeps uploaded files, such as avatars, under slash-separated keys
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Open reads an object, failing with ErrObjectNotFound if there is none
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Size of an object in bytes, failing with ErrObjectNotFound if there is none
+	Size(ctx context.Context, key string) (int64, error)
+	Delete(ctx context.Context, key string) error
+	// URL links to an object for clients to fetch directly, or is empty when
+	// the API has to serve the object itself
+	URL(ctx context.Context, key string) (string, error)
+	// UploadURL links to where clients can PUT an object themselves, for
+	// uploads too large to pass through the API
+	UploadURL(ctx context.Context, key string) (string, error)
+}
+
+// LocalStorage keeps objects as files under a directory
+type LocalStorage struct {
+	Dir string
+}
+
+// The file of an object, refusing keys that would escape the directory
+func (s LocalStorage) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Write the file under a temporary name first, so readers never see part of it
+func (s LocalStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (s LocalStorage) Size(ctx context.Context, key string) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s LocalStorage) URL(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+func (s LocalStorage) UploadURL(ctx context.Context, key string) (string, error) {
+	return "", ErrDirectUploadUnsupported
+}
+
+// S3Storage keeps objects in an S3 bucket, signing requests with the AWS_*
+// credentials. Clients fetch objects from pre-signed URLs valid for URLTTL.
+type S3Storage struct {
+	Credentials awsCredentials
+	Bucket      string
+	// Base URL of an S3-compatible service, such as MinIO, addressed
+	// path-style; empty for AWS
+	Endpoint string
+	URLTTL   time.Duration
+	Client   *http.Client
+}
+
+// The URL of an object
+func (s S3Storage) objectURL(key string) *url.URL {
+	if s.Endpoint != "" {
+		u, _ := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + key)
+		return u
+	}
+	return &url.URL{Scheme: "https", Host: s.Bucket + ".s3." + s.Credentials.Region + ".amazonaws.com", Path: "/" + key}
+}
+
+// Send a signed request for an object, failing on any status but 2xx
+func (s S3Storage) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.Credentials.sign(req, "s3", body, time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("S3 answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+}
+
+func (s S3Storage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s S3Storage) Size(ctx context.Context, key string) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Deleting a missing object succeeds, as S3 does
+func (s S3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s S3Storage) URL(ctx context.Context, key string) (string, error) {
+	return s.Credentials.presign(http.MethodGet, s.objectURL(key), "s3", s.URLTTL, time.Now()), nil
+}
+
+func (s S3Storage) UploadURL(ctx context.Context, key string) (string, error) {
+	return s.Credentials.presign(http.MethodPut, s.objectURL(key), "s3", s.URLTTL, time.Now()), nil
+}
+
+// Set up the storage for STORAGE_BACKEND
+func initStorage() {
+	switch cfg.Storage.Backend {
+	case "local":
+		fileStorage = LocalStorage{Dir: cfg.Storage.Dir}
+	case "s3":
+		fileStorage = S3Storage{
+			Credentials: configuredAWSCredentials(),
+			Bucket:      cfg.Storage.S3Bucket,
+			Endpoint:    cfg.Storage.S3Endpoint,
+			URLTTL:      cfg.Storage.URLTTL,
+			Client:      &http.Client{},
+		}
+	default:
+		log.Fatal("Unsupported STORAGE_BACKEND. Set it to 'local' or 's3'")
+	}
+}
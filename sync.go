@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What a sync did to one user
+const (
+	syncCreated  = "created"
+	syncUpdated  = "updated"
+	syncRestored = "restored"
+	syncDeleted  = "deleted"
+)
+
+// syncUserRequest is one user as the external system knows it
+type syncUserRequest struct {
+	ExternalID string   `json:"external_id" validate:"required,max=100"`
+	Name       string   `json:"name" validate:"required,max=100"`
+	Email      string   `json:"email" validate:"omitempty,email,max=255"`
+	Birthday   Date     `json:"birthday" validate:"required,notfuture"`
+	Metadata   Metadata `json:"metadata" validate:"max=50"`
+}
+
+// SyncChange is one user a sync created, updated, restored or deleted
+type SyncChange struct {
+	ExternalID string `json:"external_id"`
+	ID         uint   `json:"id"`
+	Action     string `json:"action"`
+}
+
+// SyncSummary counts what a sync changed, and lists the changed users
+type SyncSummary struct {
+	Created   int          `json:"created"`
+	Updated   int          `json:"updated"`
+	Restored  int          `json:"restored"`
+	Deleted   int          `json:"deleted"`
+	Unchanged int          `json:"unchanged"`
+	Changes   []SyncChange `json:"changes"`
+}
+
+// Count a change to the user and list it
+func (s *SyncSummary) record(user *User, action string) {
+	switch action {
+	case syncCreated:
+		s.Created++
+	case syncUpdated:
+		s.Updated++
+	case syncRestored:
+		s.Restored++
+	case syncDeleted:
+		s.Deleted++
+	}
+	s.Changes = append(s.Changes, SyncChange{ExternalID: *user.ExternalID, ID: user.ID, Action: action})
+}
+
+// SyncItemError rejects a whole sync because of one user in it
+type SyncItemError struct {
+	Index  int
+	Status int
+	Errors map[string]string
+}
+
+func (e *SyncItemError) Error() string {
+	return fmt.Sprintf("sync user %d rejected", e.Index)
+}
+
+// Bring the users from an external system, keyed by external_id, in line
+// with the batch in one transaction: unknown users are created, changed ones
+// updated and deleted ones restored, and synced users missing from the batch
+// are soft-deleted. Users without an external_id are left alone.
+func syncUsers(c echo.Context) error {
+	req := new(struct {
+		Users []syncUserRequest `json:"users"`
+	})
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	// An empty batch would delete every synced user, which is more likely a
+	// broken export than an empty company
+	if len(req.Users) == 0 {
+		return newProblem(http.StatusBadRequest, "Expected a non-empty users array")
+	}
+	if len(req.Users) > maxBulkSize {
+		return newProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d users per request", maxBulkSize))
+	}
+
+	summary, err := userService.Sync(c.Request().Context(), req.Users)
+	var itemErr *SyncItemError
+	if errors.As(err, &itemErr) {
+		p := newProblem(itemErr.Status, fmt.Sprintf("User %d in the batch was rejected; nothing was synced", itemErr.Index))
+		p.Errors = make(map[string]string, len(itemErr.Errors))
+		for field, msg := range itemErr.Errors {
+			p.Errors[fmt.Sprintf("users[%d].%s", itemErr.Index, field)] = msg
+		}
+		return p
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to sync users")
+	}
+	return respond(c, http.StatusOK, summary)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	// Header naming the tenant of a request by slug
+	tenantHeader = "X-Tenant"
+
+	// The tenant of requests that name none, and of data written outside any request
+	defaultTenantID   = 1
+	defaultTenantSlug = "default"
+
+	// Column that marks a model as belonging to a tenant
+	tenantColumn = "tenant_id"
+)
+
+// Tenant is an isolated set of users, API keys, webhooks and audit logs
+type Tenant struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Slug      string    `json:"slug" gorm:"size:63;not null;uniqueIndex"`
+	Name      string    `json:"name" gorm:"size:100;not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type createTenantRequest struct {
+	Slug  string `json:"slug" validate:"required,slug,max=63"`
+	Name  string `json:"name" validate:"required,max=100"`
+	Admin *struct {
+		Name     string `json:"name" validate:"required,max=100"`
+		Password string `json:"password" validate:"required,min=8,max=72"`
+	} `json:"admin"`
+}
+
+type tenantContextKey struct{}
+
+// Scope the GORM queries made under the returned context to the tenant
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// The tenant a context is scoped to, if any
+func tenantFrom(ctx context.Context) (*Tenant, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant, ok
+}
+
+// Tenants by slug. Tenants cannot be renamed or removed, so entries never go stale.
+var tenantsBySlug sync.Map
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+// Load a tenant by slug, remembering it for later requests
+func findTenant(ctx context.Context, slug string) (*Tenant, error) {
+	if tenant, ok := tenantsBySlug.Load(slug); ok {
+		return tenant.(*Tenant), nil
+	}
+	tenant := new(Tenant)
+	err := db.WithContext(ctx).Where("slug = ?", slug).Take(tenant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errUnknownTenant
+	}
+	if err != nil {
+		return nil, err
+	}
+	tenantsBySlug.Store(slug, tenant)
+	return tenant, nil
+}
+
+// Pick the tenant slug of a request: the X-Tenant header, else the subdomain
+// of TENANT_DOMAIN the request was sent to, else the default tenant
+func tenantSlug(header, host, domain string) string {
+	if header != "" {
+		return header
+	}
+	if domain != "" {
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if sub, ok := strings.CutSuffix(strings.ToLower(host), "."+domain); ok && sub != "" && !strings.Contains(sub, ".") {
+			return sub
+		}
+	}
+	return defaultTenantSlug
+}
+
+// Middleware resolving the tenant of each request and scoping its queries to it
+func tenantMiddleware() echo.MiddlewareFunc {
+	domain := strings.ToLower(strings.TrimPrefix(cfg.TenantDomain, "."))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			tenant, err := findTenant(req.Context(), tenantSlug(req.Header.Get(tenantHeader), req.Host, domain))
+			if errors.Is(err, errUnknownTenant) {
+				return newProblem(http.StatusNotFound, "Tenant not found")
+			}
+			if err != nil {
+				return newProblem(http.StatusInternalServerError, "Failed to resolve tenant")
+			}
+			c.SetRequest(req.WithContext(withTenant(req.Context(), tenant)))
+			return next(c)
+		}
+	}
+}
+
+// Middleware restricting a route to the default tenant, whose admins manage the others
+func defaultTenantOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if tenant, ok := tenantFrom(c.Request().Context()); !ok || tenant.ID != defaultTenantID {
+			return newProblem(http.StatusForbidden, "Forbidden")
+		}
+		return next(c)
+	}
+}
+
+// Report whether the event is about a user of the context's tenant
+func sameTenant(ctx context.Context, e UserEvent) bool {
+	tenant, ok := tenantFrom(ctx)
+	return !ok || e.Data.TenantID == tenant.ID
+}
+
+// The tenant column of the statement's model, if it belongs to tenants
+func tenantField(tx *gorm.DB) (*schema.Field, bool) {
+	if tx.Statement.Schema == nil {
+		return nil, false
+	}
+	field := tx.Statement.Schema.LookUpField(tenantColumn)
+	return field, field != nil
+}
+
+// Restrict reads of tenant-owned models to the context's tenant. Without a
+// tenant in the context, as in background workers, every tenant is visible.
+// Rows left without a tenant in a nullable tenant column, such as the
+// built-in roles, are shared and visible to every tenant.
+func scopeTenantReads(tx *gorm.DB) {
+	scopeTenant(tx, true)
+}
+
+func scopeTenant(tx *gorm.DB, shared bool) {
+	tenant, ok := tenantFrom(tx.Statement.Context)
+	if !ok {
+		return
+	}
+	field, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	column := clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+	var expr clause.Expression = clause.Eq{Column: column, Value: tenant.ID}
+	if shared && field.FieldType.Kind() == reflect.Ptr {
+		expr = clause.Or(expr, clause.Eq{Column: column, Value: nil})
+	}
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{expr}})
+}
+
+// Restrict updates and deletes likewise, leaving a write with no conditions
+// of its own for GORM to reject as a global update or delete. Shared rows
+// cannot be written from within a tenant.
+func scopeTenantWrites(tx *gorm.DB) {
+	s := tx.Statement
+	if _, ok := s.Clauses["WHERE"]; !ok && !s.AllowGlobalUpdate {
+		if s.Schema == nil || s.Schema.PrioritizedPrimaryField == nil || len(auditModelIDs(tx)) == 0 {
+			return
+		}
+	}
+	scopeTenant(tx, false)
+}
+
+// Assign new tenant-owned rows to the context's tenant, or to the default tenant
+// outside any request, unless the caller chose a tenant explicitly
+func assignTenant(tx *gorm.DB) {
+	field, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	var tenantID uint = defaultTenantID
+	if tenant, ok := tenantFrom(tx.Statement.Context); ok {
+		tenantID = tenant.ID
+	}
+	ctx := tx.Statement.Context
+	set := func(v reflect.Value) {
+		if _, zero := field.ValueOf(ctx, v); zero {
+			if err := field.Set(ctx, v, tenantID); err != nil {
+				tx.AddError(fmt.Errorf("tenant: %w", err))
+			}
+		}
+	}
+	rv := tx.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			set(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		set(rv)
+	}
+}
+
+// Scope every GORM statement on tenant-owned models to the current tenant
+func registerTenantCallbacks(db *gorm.DB) error {
+	const name = "tenants:scope"
+	cb := db.Callback()
+	if err := cb.Query().Before("gorm:query").Register(name, scopeTenantReads); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register(name, scopeTenantReads); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register(name, scopeTenantWrites); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register(name, scopeTenantWrites); err != nil {
+		return err
+	}
+	return cb.Create().Before("gorm:create").Register("tenants:assign", assignTenant)
+}
+
+// List tenants
+func getTenants(c echo.Context) error {
+	var tenants []Tenant
+	if err := dbCtx(c).Order("id").Find(&tenants).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch tenants")
+	}
+	return respond(c, http.StatusOK, tenants)
+}
+
+// Create a tenant, optionally with its first admin user
+func createTenant(c echo.Context) error {
+	req := new(createTenantRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	var admin *User
+	if req.Admin != nil {
+		hash, err := hashPassword(req.Admin.Password)
+		if err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to create tenant")
+		}
+		admin = &User{Name: req.Admin.Name, PasswordHash: hash}
+		if err := dbCtx(c).Where("name = ?", RoleAdmin).Find(&admin.Roles).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to create tenant")
+		}
+	}
+
+	tenant := Tenant{Slug: req.Slug, Name: req.Name}
+	err := userTransaction(dbCtx(c), func(tx *gorm.DB) error {
+		if err := tx.Create(&tenant).Error; err != nil {
+			return err
+		}
+		if admin == nil {
+			return nil
+		}
+		admin.TenantID = tenant.ID
+		return tx.Create(admin).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		p := newProblem(http.StatusConflict, "A tenant with this slug already exists")
+		p.Errors = map[string]string{"slug": "is already in use"}
+		return p
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create tenant")
+	}
+	return respond(c, http.StatusCreated, tenant)
+}
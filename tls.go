@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Serve the API on PORT: over HTTPS with TLS_CERT_FILE and TLS_KEY_FILE, over
+// HTTPS with Let's Encrypt certificates for TLS_AUTOCERT_DOMAINS, else over HTTP
+func serveHTTP(e *echo.Echo) error {
+	addr := ":" + cfg.Port
+	switch {
+	case cfg.TLS.CertFile != "":
+		log.Printf("Listening on %s (HTTPS)", addr)
+		return e.StartTLS(addr, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	case len(cfg.TLS.AutocertDomains) > 0:
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cfg.TLS.AutocertDomains...)
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.TLS.AutocertCache)
+		e.AutoTLSManager.Email = cfg.TLS.AutocertEmail
+		log.Printf("Listening on %s (HTTPS, certificates for %v)", addr, cfg.TLS.AutocertDomains)
+		return e.StartAutoTLS(addr)
+	}
+	log.Printf("Listening on %s", addr)
+	return e.Start(addr)
+}
+
+// Redirect plain HTTP requests on HTTP_REDIRECT_PORT to HTTPS, also answering
+// ACME HTTP-01 challenges when certificates come from Let's Encrypt. The
+// returned function stops the listener.
+func startHTTPSRedirect(e *echo.Echo) func(ctx context.Context) {
+	if cfg.TLS.RedirectPort == "" {
+		return func(context.Context) {}
+	}
+
+	var handler http.Handler = http.HandlerFunc(redirectToHTTPS)
+	if len(cfg.TLS.AutocertDomains) > 0 {
+		handler = e.AutoTLSManager.HTTPHandler(handler)
+	}
+	srv := &http.Server{Addr: ":" + cfg.TLS.RedirectPort, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Printf("Redirecting HTTP on %s to HTTPS", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("HTTPS redirect server failed: %v", err)
+		}
+	}()
+	return func(ctx context.Context) {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to stop HTTPS redirect server: %v", err)
+		}
+	}
+}
+
+// Send the client to the same URL over HTTPS on PORT
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if cfg.Port != "443" {
+		host = net.JoinHostPort(host, cfg.Port)
+	}
+	// 308 keeps the method and body of writes; browsers expect 301 for page loads
+	code := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
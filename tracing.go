@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"gorm.io/gorm"
+	"gorm.io/plugin/opentelemetry/tracing"
+)
+
+const serviceName = "echo-gorm"
+
+// Export traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// The exporter reads the standard OTEL_EXPORTER_OTLP_* variables for headers, TLS, etc.
+// Returns a function that flushes pending spans on shutdown.
+func initTracing() func(context.Context) error {
+	if cfg.Tracing.Endpoint == "" && cfg.Tracing.TracesEndpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create trace exporter: %v", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		log.Fatalf("Failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if err := db.Use(tracing.NewPlugin(tracing.WithoutQueryVariables())); err != nil {
+		log.Fatalf("Failed to instrument database: %v", err)
+	}
+
+	log.Println("OpenTelemetry tracing enabled.")
+	return provider.Shutdown
+}
+
+// Middleware starting a server span per request, skipping probes and metrics scrapes
+func tracingMiddleware() echo.MiddlewareFunc {
+	return otelecho.Middleware(serviceName, otelecho.WithSkipper(func(c echo.Context) bool {
+		switch c.Path() {
+		case "/healthz", "/livez", "/readyz", "/metrics":
+			return true
+		}
+		return false
+	}))
+}
+
+// Database handle bound to the request context so queries join the request's
+// trace, and are cancelled when the client disconnects or the deadline passes
+func dbCtx(c echo.Context) *gorm.DB {
+	return db.WithContext(c.Request().Context())
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Run a handler's reads and writes in one transaction bound to the request
+// context. User changes made inside are published once it commits.
+func WithTx(c echo.Context, fn func(tx *gorm.DB) error) error {
+	return userTransaction(dbCtx(c), fn)
+}
+
+// Lock the rows a query reads until the transaction ends, so a concurrent
+// read-modify-write waits instead of overwriting the change. SQLite already
+// serializes writers and SQL Server has no FOR UPDATE, so only Postgres and
+// MySQL take row locks.
+func forUpdate(tx *gorm.DB) *gorm.DB {
+	switch tx.Dialector.Name() {
+	case "postgres", "mysql":
+		return tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate})
+	}
+	return tx
+}
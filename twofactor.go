@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	backupCodeCount = 10
+	// Crockford's base32 alphabet, without letters easily mistaken for digits
+	backupCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	qrCodeSize         = 256
+	// Seconds each TOTP code is valid for
+	totpPeriod = 30
+)
+
+// TwoFactorSecret is a user's TOTP secret. It is only checked at login once
+// the user has confirmed it with a code from their authenticator app.
+type TwoFactorSecret struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  uint   `gorm:"not null;default:1;index"`
+	UserID    uint   `gorm:"not null;uniqueIndex"`
+	Secret    string `gorm:"size:64;not null"`
+	EnabledAt *time.Time
+	// Time step of the last TOTP code accepted, so no code is used twice
+	LastUsedStep uint64 `gorm:"not null;default:0"`
+	CreatedAt    time.Time
+}
+
+// BackupCode logs in once in place of a TOTP code. Only a hash is stored.
+type BackupCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  uint   `gorm:"not null;default:1;index"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"size:64;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// Start enrolling the current user in two-factor authentication. The secret
+// is returned as an otpauth:// URI and a QR code for authenticator apps.
+func setupTwoFactor(c echo.Context) error {
+	user := c.Get("currentUser").(*User)
+	if _, err := enabledTwoFactor(c.Request().Context(), user.ID); err == nil {
+		return newProblem(http.StatusConflict, "Two-factor authentication is already enabled")
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+
+	account := user.Name
+	if user.Email != nil {
+		account = *user.Email
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: cfg.Auth.TwoFactorIssuer, AccountName: account})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+	img, err := key.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+
+	// Setting up again replaces a secret that was never confirmed
+	err = dbCtx(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&TwoFactorSecret{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&TwoFactorSecret{UserID: user.ID, Secret: key.Secret()}).Error
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+	return respond(c, http.StatusOK, map[string]string{
+		"secret":      key.Secret(),
+		"otpauth_uri": key.URL(),
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+	})
+}
+
+// Confirm enrollment with a code from the authenticator app, turning on
+// two-factor login and issuing backup codes
+func enableTwoFactor(c echo.Context) error {
+	req := new(twoFactorCodeRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	user := c.Get("currentUser").(*User)
+
+	var secret TwoFactorSecret
+	err := dbCtx(c).Where("user_id = ?", user.ID).Take(&secret).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusConflict, "Set up two-factor authentication first")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to enable two-factor authentication")
+	}
+	if secret.EnabledAt != nil {
+		return newProblem(http.StatusConflict, "Two-factor authentication is already enabled")
+	}
+	ok, err := useTOTPCode(dbCtx(c), &secret, req.Code)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to enable two-factor authentication")
+	}
+	if !ok {
+		return invalidCode("code")
+	}
+
+	var codes []string
+	err = dbCtx(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&secret).Update("enabled_at", time.Now()).Error; err != nil {
+			return err
+		}
+		codes, err = replaceBackupCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to enable two-factor authentication")
+	}
+	return respond(c, http.StatusOK, map[string][]string{"backup_codes": codes})
+}
+
+// Turn off two-factor authentication, given a TOTP or backup code
+func disableTwoFactor(c echo.Context) error {
+	req := new(twoFactorCodeRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	user := c.Get("currentUser").(*User)
+
+	secret, err := enabledTwoFactor(c.Request().Context(), user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusConflict, "Two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to disable two-factor authentication")
+	}
+	ok, err := checkTwoFactorCode(c.Request().Context(), secret, req.Code)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to disable two-factor authentication")
+	}
+	if !ok {
+		return invalidCode("code")
+	}
+
+	err = dbCtx(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&BackupCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(secret).Error
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to disable two-factor authentication")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Replace the current user's backup codes, given a TOTP code
+func regenerateBackupCodes(c echo.Context) error {
+	req := new(twoFactorCodeRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+	user := c.Get("currentUser").(*User)
+
+	secret, err := enabledTwoFactor(c.Request().Context(), user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusConflict, "Two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create backup codes")
+	}
+	ok, err := useTOTPCode(dbCtx(c), secret, req.Code)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create backup codes")
+	}
+	if !ok {
+		return invalidCode("code")
+	}
+	var codes []string
+	err = dbCtx(c).Transaction(func(tx *gorm.DB) error {
+		codes, err = replaceBackupCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create backup codes")
+	}
+	return respond(c, http.StatusOK, map[string][]string{"backup_codes": codes})
+}
+
+// Require the second factor at login from users who have enabled it. Does
+// nothing when TWO_FACTOR_ENABLED is off.
+func checkSecondFactor(ctx context.Context, user User, code string) error {
+	if !cfg.Auth.TwoFactorEnabled {
+		return nil
+	}
+	secret, err := enabledTwoFactor(ctx, user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	if code == "" {
+		p := newProblem(http.StatusUnauthorized, "Two-factor code required")
+		p.Errors = map[string]string{"otp": "is required"}
+		return p
+	}
+	ok, err := checkTwoFactorCode(ctx, secret, code)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to log in")
+	}
+	if !ok {
+		p := newProblem(http.StatusUnauthorized, "Invalid two-factor code")
+		p.Errors = map[string]string{"otp": "is invalid"}
+		return p
+	}
+	return nil
+}
+
+// The user's confirmed TOTP secret
+func enabledTwoFactor(ctx context.Context, userID uint) (*TwoFactorSecret, error) {
+	var secret TwoFactorSecret
+	err := db.WithContext(ctx).Where("user_id = ? AND enabled_at IS NOT NULL", userID).Take(&secret).Error
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// Check a TOTP code, or else use up a matching backup code
+func checkTwoFactorCode(ctx context.Context, secret *TwoFactorSecret, code string) (bool, error) {
+	ok, err := useTOTPCode(db.WithContext(ctx), secret, code)
+	if ok || err != nil {
+		return ok, err
+	}
+	result := db.WithContext(ctx).Model(&BackupCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", secret.UserID, hashAPIKey(normalizeBackupCode(code))).
+		Update("used_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+// Accept a TOTP code at most once. Recording its time step rejects the code,
+// and any older one, when replayed within the skew window.
+func useTOTPCode(tx *gorm.DB, secret *TwoFactorSecret, code string) (bool, error) {
+	step, ok := totpStep(strings.TrimSpace(code), secret.Secret, time.Now())
+	if !ok {
+		return false, nil
+	}
+	result := tx.Model(&TwoFactorSecret{}).
+		Where("id = ? AND last_used_step < ?", secret.ID, step).
+		Update("last_used_step", step)
+	return result.RowsAffected > 0, result.Error
+}
+
+// The time step a TOTP code belongs to, allowing one step of clock skew
+// either way as totp.Validate does
+func totpStep(code, secret string, now time.Time) (uint64, bool) {
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	for skew := -1; skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		if ok, err := totp.ValidateCustom(code, secret, t, opts); err == nil && ok {
+			return uint64(t.Unix()) / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// Issue a fresh set of backup codes for the user, dropping the old ones
+func replaceBackupCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&BackupCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, backupCodeCount)
+	records := make([]BackupCode, backupCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = backupCodeAlphabet[int(b[j])%len(backupCodeAlphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		records[i] = BackupCode{UserID: userID, CodeHash: hashAPIKey(string(b))}
+	}
+	return codes, tx.Create(&records).Error
+}
+
+// Backup codes are accepted in any case, with or without the dash
+func normalizeBackupCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func invalidCode(field string) error {
+	p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+	p.Errors = map[string]string{field: "is invalid"}
+	return p
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Lowercase letters, digits and inner hyphens, usable as a DNS label
+var slugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// RequestValidator plugs go-playground/validator into Echo
+type RequestValidator struct {
+	validator *validator.Validate
+}
+
+func newRequestValidator() *RequestValidator {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report fields by their JSON names
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	// Validate dates by their YYYY-MM-DD form so "required" treats zero dates as empty
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		return field.Interface().(Date).String()
+	}, Date{})
+
+	v.RegisterValidation("notfuture", func(fl validator.FieldLevel) bool {
+		value := fl.Field().String()
+		if value == "" {
+			return true
+		}
+		date, err := ParseDate(value)
+		return err == nil && !date.IsFuture()
+	})
+
+	v.RegisterValidation("slug", func(fl validator.FieldLevel) bool {
+		return slugPattern.MatchString(fl.Field().String())
+	})
+
+	return &RequestValidator{validator: v}
+}
+
+func (rv *RequestValidator) Validate(i interface{}) error {
+	return rv.validator.Struct(i)
+}
+
+// Convert a failed validation into a problem with field-level details
+func validationError(err error) error {
+	fields := validationFields(err)
+	if fields == nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+	p.Errors = fields
+	return p
+}
+
+// Map each failed field to a message, or nil if err is not a validation failure
+func validationFields(err error) map[string]string {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return nil
+	}
+	fields := make(map[string]string, len(errs))
+	for _, fe := range errs {
+		fields[fe.Field()] = validationMessage(fe)
+	}
+	return fields
+}
+
+// Convert a failed bind into a problem, reporting malformed dates as field errors
+func bindError(err error) error {
+	if errors.Is(err, errInvalidDate) {
+		p := newProblem(http.StatusUnprocessableEntity, "Validation failed")
+		p.Errors = map[string]string{"birthday": "must be a date in YYYY-MM-DD format"}
+		return p
+	}
+	return newProblem(http.StatusBadRequest, "Invalid request")
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return "must be at least " + fe.Param() + " characters"
+	case "max":
+		return "must be at most " + fe.Param() + " characters"
+	case "email":
+		return "must be a valid email address"
+	case "notfuture":
+		return "must not be in the future"
+	case "slug":
+		return "must contain only lowercase letters, digits and hyphens"
+	case "http_url":
+		return "must be an http or https URL"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	}
+	return "is invalid"
+}
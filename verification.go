@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Audience of email verification tokens, so access tokens cannot verify
+const verifyAudience = "email-verification"
+
+// Claims of an email verification token. The email ties the token to the
+// address it was sent to.
+type verifyClaims struct {
+	UserID uint   `json:"uid"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+type resendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// Send new users with an email a verification link
+func initEmailVerification() {
+	userEvents.Handle(func(ctx context.Context, events []UserEvent) error {
+		for _, e := range events {
+			if e.Event == EventUserCreated && e.Data.Email != nil && !e.Data.IsVerified {
+				if err := sendVerification(ctx, *e.Data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Key signing verification tokens, derived from JWT_SECRET but distinct from
+// it, since access token checks do not look at the audience
+func verifyKey() []byte {
+	key := sha256.Sum256(append([]byte(verifyAudience+":"), jwtSecret...))
+	return key[:]
+}
+
+// Sign a token verifying the user's current email, valid for EMAIL_VERIFY_TTL
+func verificationToken(user User) (string, error) {
+	claims := verifyClaims{
+		UserID: user.ID,
+		Email:  derefEmail(user.Email),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{verifyAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(cfg.Auth.EmailVerifyTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(verifyKey())
+}
+
+// Email the user a verification link
+func sendVerification(ctx context.Context, user User) error {
+	token, err := verificationToken(user)
+	if err != nil {
+		return err
+	}
+	link := token
+	if cfg.Auth.EmailVerifyURL != "" {
+		link = cfg.Auth.EmailVerifyURL + "?token=" + url.QueryEscape(token)
+	}
+	return sendTemplatedEmail(ctx, emailVerification, derefEmail(user.Email), emailData{
+		User:    user,
+		Link:    link,
+		Expires: lifetime(cfg.Auth.EmailVerifyTTL),
+	})
+}
+
+// Mark the user's email verified with the token from a verification link
+func verifyEmail(c echo.Context) error {
+	invalid := newProblem(http.StatusBadRequest, "Verification link is invalid or expired")
+	claims := new(verifyClaims)
+	_, err := jwt.ParseWithClaims(c.QueryParam("token"), claims, func(*jwt.Token) (interface{}, error) {
+		return verifyKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithAudience(verifyAudience))
+	if err != nil {
+		return invalid
+	}
+
+	err = userService.Verify(c.Request().Context(), claims.UserID, claims.Email)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVerificationStale) {
+		return invalid
+	}
+	if err != nil {
+		return userError(err, "Failed to verify email")
+	}
+	return respond(c, http.StatusOK, map[string]string{"message": "Email verified"})
+}
+
+// Send another verification link to an unverified email. The response is the
+// same whether or not such a user exists, so it cannot be used to probe emails.
+func resendVerification(c echo.Context) error {
+	req := new(resendVerificationRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	var user User
+	err := dbCtx(c).Where("email = ? AND is_verified = ?", normalizeEmail(req.Email), false).Take(&user).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return newProblem(http.StatusInternalServerError, "Failed to send verification")
+	default:
+		if err := sendVerification(c.Request().Context(), user); err != nil {
+			requestLogger(c).Error("failed to send verification", "error", err)
+			return newProblem(http.StatusInternalServerError, "Failed to send verification")
+		}
+	}
+	return respond(c, http.StatusAccepted, map[string]string{
+		"message": "If an unverified user has this email, a verification link has been sent to it",
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	apiPrefix = "/api"
+
+	// The newest API version, served to /api requests that ask for none
+	currentAPIVersion = "v1"
+
+	// Response header naming the API version that handled the request
+	apiVersionHeader = "API-Version"
+
+	apiVersionKey = "api_version"
+)
+
+// Every API version still served, oldest first
+var apiVersions = []string{"v1"}
+
+// When the unversioned routes were deprecated in favour of /api/v1
+var legacyRoutesDeprecatedAt = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// Middleware tagging requests to a version's path prefix with that version
+func pinAPIVersion(version string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(apiVersionKey, version)
+			c.Response().Header().Set(apiVersionHeader, version)
+			return next(c)
+		}
+	}
+}
+
+// Middleware picking the version of /api requests from a version parameter of
+// the Accept header, as in "Accept: application/json; version=1", defaulting
+// to the current version
+func negotiateAPIVersion(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		version := currentAPIVersion
+		for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || params["version"] == "" {
+				continue
+			}
+			version = "v" + strings.TrimPrefix(params["version"], "v")
+			break
+		}
+		if !slices.Contains(apiVersions, version) {
+			return newProblem(http.StatusNotAcceptable, fmt.Sprintf("Unsupported API version, expected one of: %s", strings.Join(apiVersions, ", ")))
+		}
+		varyOnAccept(c)
+		return pinAPIVersion(version)(next)(c)
+	}
+}
+
+// Middleware marking the unversioned routes deprecated (RFC 9745) and, once
+// LEGACY_ROUTES_SUNSET is set, announcing when they go away (RFC 8594)
+func deprecatedRoute(next echo.HandlerFunc) echo.HandlerFunc {
+	deprecation := fmt.Sprintf("@%d", legacyRoutesDeprecatedAt.Unix())
+	var sunset string
+	if !cfg.API.LegacySunset.IsZero() {
+		sunset = cfg.API.LegacySunset.UTC().Format(http.TimeFormat)
+	}
+	return func(c echo.Context) error {
+		header := c.Response().Header()
+		header.Set("Deprecation", deprecation)
+		if sunset != "" {
+			header.Set("Sunset", sunset)
+		}
+		successor := apiPrefix + "/" + currentAPIVersion + c.Request().URL.Path
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		return pinAPIVersion(apiVersions[0])(next)(c)
+	}
+}
+
+// The API version a request was routed to
+func apiVersion(c echo.Context) string {
+	if v, ok := c.Get(apiVersionKey).(string); ok {
+		return v
+	}
+	return currentAPIVersion
+}
+
+// The route path of a request without its API prefix, the same for every
+// mount of a route, e.g. /users/:id
+func unversionedPath(c echo.Context) string {
+	path := c.Path()
+	for _, version := range apiVersions {
+		if rest, ok := strings.CutPrefix(path, apiPrefix+"/"+version); ok && (rest == "" || rest[0] == '/') {
+			return rest
+		}
+	}
+	if rest, ok := strings.CutPrefix(path, apiPrefix); ok && (rest == "" || rest[0] == '/') {
+		return rest
+	}
+	return path
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// UserVersion is a snapshot of a user's editable fields as of one version
+type UserVersion struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_user_versions_user_version,priority:1"`
+	Version   uint      `json:"version" gorm:"not null;uniqueIndex:idx_user_versions_user_version,priority:2"`
+	Name      string    `json:"name"`
+	Email     *string   `json:"email" gorm:"size:255"`
+	Birthday  Date      `json:"birthday" gorm:"type:date"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Refer to the user by its UUID when ID_TYPE=uuid
+func (v UserVersion) MarshalJSON() ([]byte, error) {
+	type plainUserVersion UserVersion
+	if userIDType != idTypeUUID {
+		return json.Marshal(plainUserVersion(v))
+	}
+	user, err := userUUID(v.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plainUserVersion
+		UserID *string `json:"user_id"`
+	}{plainUserVersion(v), user})
+}
+
+// Copy the current state of the written users into user_versions, once per
+// version. Writes that leave the version alone, such as GORM touching a user
+// while saving its roles, find their version already recorded.
+func snapshotUsers(tx *gorm.DB) {
+	if tx.Error != nil || tx.Statement.Schema == nil || tx.Statement.Table != "users" {
+		return
+	}
+	if _, skip := tx.Get(auditSkipSetting); skip {
+		return
+	}
+	ids := auditModelIDs(tx)
+	if len(ids) == 0 {
+		return
+	}
+	err := tx.Session(&gorm.Session{NewDB: true}).Exec(`INSERT INTO user_versions (user_id, version, name, email, birthday, created_at)
+		SELECT id, version, name, email, birthday, updated_at FROM users
+		WHERE id IN ? AND NOT EXISTS (
+			SELECT 1 FROM user_versions v WHERE v.user_id = users.id AND v.version = users.version
+		)`, ids).Error
+	if err != nil {
+		tx.AddError(fmt.Errorf("user versions: %w", err))
+	}
+}
+
+// Snapshot users in the same transaction as every create and update
+func registerVersionCallbacks(db *gorm.DB) error {
+	const name = "versions:snapshot_users"
+	const commit = "gorm:commit_or_rollback_transaction"
+	if err := db.Callback().Create().After("gorm:after_create").Before(commit).Register(name, snapshotUsers); err != nil {
+		return err
+	}
+	return db.Callback().Update().After("gorm:after_update").Before(commit).Register(name, snapshotUsers)
+}
+
+// List a user's recorded versions, newest first
+func getUserHistory(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+	versions, total, err := userService.History(c.Request().Context(), id, p.Offset, p.Limit)
+	if err != nil {
+		return userError(err, "Failed to fetch user history")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, versions))
+}
+
+// Restore a user's fields from an earlier version, as a new version
+func revertUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	target, err := strconv.ParseUint(c.Param("version"), 10, 32)
+	if err != nil || target == 0 {
+		return newProblem(http.StatusBadRequest, "Invalid version")
+	}
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		return err
+	}
+
+	user, err := userService.Revert(c.Request().Context(), id, version, uint(target))
+	if err != nil {
+		return userError(err, "Failed to revert user")
+	}
+	setUserETag(c, user)
+	return respond(c, http.StatusOK, newUserResource(c, user))
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	jobWebhookDelivery = "webhook.deliver"
+
+	// Most of a failing endpoint's response kept in the delivery log
+	maxWebhookErrorLength = 500
+)
+
+// WebhookEvents is stored as a comma-separated list
+type WebhookEvents []string
+
+func (e WebhookEvents) Value() (driver.Value, error) {
+	return strings.Join(e, ","), nil
+}
+
+func (e *WebhookEvents) Scan(value interface{}) error {
+	list, err := scanCommaList(value)
+	*e = list
+	return err
+}
+
+// Report whether the subscription covers the event
+func (e WebhookEvents) Has(event string) bool {
+	for _, subscribed := range e {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook subscribes a URL to user lifecycle events
+type Webhook struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	TenantID  uint          `json:"-" gorm:"not null;default:1;index"`
+	URL       string        `json:"url" gorm:"size:2048;not null"`
+	Secret    string        `json:"-" gorm:"size:100;not null"`
+	Events    WebhookEvents `json:"events" gorm:"size:255;not null"`
+	Active    bool          `json:"active" gorm:"not null"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// WebhookDelivery is one event queued for one webhook, retried until it succeeds
+// or runs out of attempts
+type WebhookDelivery struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	WebhookID      uint       `json:"webhook_id" gorm:"index;not null"`
+	Event          string     `json:"event" gorm:"size:50;not null"`
+	Payload        string     `json:"-" gorm:"type:text;not null"`
+	Status         string     `json:"status" gorm:"size:20;not null;index:idx_webhook_deliveries_due,priority:1"`
+	Attempts       int        `json:"attempts" gorm:"not null"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"index:idx_webhook_deliveries_due,priority:2"`
+	ResponseStatus int        `json:"response_status"`
+	LastError      string     `json:"last_error" gorm:"size:500"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type createWebhookRequest struct {
+	URL    string   `json:"url" validate:"required,http_url,max=2048"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=user.created user.updated user.deleted"`
+	Secret string   `json:"secret" validate:"omitempty,min=16,max=100"`
+}
+
+type updateWebhookRequest struct {
+	URL    string   `json:"url" validate:"omitempty,http_url,max=2048"`
+	Events []string `json:"events" validate:"omitempty,min=1,dive,oneof=user.created user.updated user.deleted"`
+	Active *bool    `json:"active"`
+}
+
+// The payload of a webhook delivery job
+type webhookDeliveryJob struct {
+	DeliveryID uint `json:"delivery_id"`
+}
+
+// Sends webhook deliveries, with WEBHOOK_TIMEOUT
+var webhookClient *http.Client
+
+// Redirects a delivery follows before giving up
+const maxWebhookRedirects = 5
+
+// Shared address space (RFC 6598), used inside some clouds for metadata services
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Dialer Control refusing connections to loopback, private, link-local and
+// other non-public addresses, such as the cloud metadata service at
+// 169.254.169.254, so tenants cannot reach internal services through webhooks.
+// It checks the address actually dialed, after DNS resolution.
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("webhook address %s is not public", ip)
+	}
+	return nil
+}
+
+// HTTP client for deliveries. Every connection, including those for
+// redirects, goes through the address check unless WEBHOOK_ALLOW_PRIVATE_NETWORKS
+// is set, and no proxy is used since the check would then only see the proxy.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Webhooks.Timeout}
+	if !cfg.Webhooks.AllowPrivateNetworks {
+		dialer.Control = rejectPrivateAddress
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   cfg.Webhooks.Timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxWebhookRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxWebhookRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// Generate a random signing secret
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign the timestamp and body with the webhook secret. Receivers recompute
+// the HMAC over "<timestamp>.<body>" and reject stale timestamps to stop replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queue a delivery of each event to every active webhook subscribed to it,
+// each delivered by a job
+func enqueueWebhooks(ctx context.Context, events []UserEvent) error {
+	var hooks []Webhook
+	if err := db.WithContext(ctx).Where("active = ?", true).Find(&hooks).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var deliveries []WebhookDelivery
+	for _, e := range events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			if !hook.Events.Has(e.Event) {
+				continue
+			}
+			deliveries = append(deliveries, WebhookDelivery{
+				WebhookID:     hook.ID,
+				Event:         e.Event,
+				Payload:       string(body),
+				Status:        deliveryPending,
+				NextAttemptAt: now,
+			})
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(deliveries, bulkInsertBatchSize).Error; err != nil {
+			return err
+		}
+		jobs := make([]Job, len(deliveries))
+		for i, d := range deliveries {
+			job, err := newJob(jobWebhookDelivery, webhookDeliveryJob{DeliveryID: d.ID})
+			if err != nil {
+				return err
+			}
+			jobs[i] = job
+		}
+		return enqueueJobs(tx, jobs)
+	})
+}
+
+// Deliver webhooks with jobs retried WEBHOOK_MAX_ATTEMPTS times, and queue
+// deliveries on every user event
+func initWebhooks() {
+	webhookClient = newWebhookClient()
+	registerJobType(jobWebhookDelivery, JobType{
+		Run:         deliverWebhook,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		Backoff:     cfg.Webhooks.Backoff,
+		Timeout:     cfg.Webhooks.Timeout,
+	})
+	userEvents.Handle(enqueueWebhooks)
+}
+
+// Attempt a delivery and record the outcome in the delivery log. Failures
+// are returned so the job is retried, until its last attempt fails the delivery.
+func deliverWebhook(ctx context.Context, job *Job) error {
+	var payload webhookDeliveryJob
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+	var d WebhookDelivery
+	err := db.WithContext(ctx).Take(&d, payload.DeliveryID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Deleted along with its webhook
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Failed deliveries are attempted again when an admin retries their job
+	if d.Status == deliveryDelivered {
+		return nil
+	}
+
+	updates := map[string]interface{}{"attempts": job.Attempts}
+	var hook Webhook
+	err = db.WithContext(ctx).First(&hook, d.WebhookID).Error
+	switch {
+	case err != nil || !hook.Active:
+		updates["status"] = deliveryFailed
+		updates["last_error"] = "webhook deleted or disabled"
+		err = nil
+	default:
+		var status int
+		status, err = postWebhook(ctx, &hook, &d)
+		updates["response_status"] = status
+		if err == nil {
+			updates["status"] = deliveryDelivered
+			updates["delivered_at"] = time.Now()
+			updates["last_error"] = ""
+			break
+		}
+		updates["last_error"] = truncate(err.Error(), maxWebhookErrorLength)
+		if job.RetryAt.IsZero() {
+			updates["status"] = deliveryFailed
+		} else {
+			updates["next_attempt_at"] = job.RetryAt
+		}
+	}
+
+	if dbErr := db.WithContext(ctx).Model(&d).Updates(updates).Error; dbErr != nil {
+		contextLogger(ctx).Error("failed to record webhook delivery", "delivery_id", d.ID, "error", dbErr)
+	}
+	return err
+}
+
+// POST the signed payload, failing on transport errors and non-2xx responses
+func postWebhook(ctx context.Context, hook *Webhook, d *WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "echo-gorm-webhooks/1")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, timestamp, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(res.Body, maxWebhookErrorLength))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("%s: %s", res.Status, snippet)
+	}
+	return res.StatusCode, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// Load the webhook named by the id path parameter
+func findWebhook(c echo.Context, tx *gorm.DB) (*Webhook, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "Invalid webhook ID")
+	}
+	var hook Webhook
+	if err := tx.First(&hook, id).Error; err != nil {
+		return nil, newProblem(http.StatusNotFound, "Webhook not found")
+	}
+	return &hook, nil
+}
+
+// List all webhooks
+func getWebhooks(c echo.Context) error {
+	var hooks []Webhook
+	if err := dbCtx(c).Order("id").Find(&hooks).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch webhooks")
+	}
+	return respond(c, http.StatusOK, hooks)
+}
+
+// Subscribe a URL to events; the signing secret is only ever returned here
+func createWebhook(c echo.Context) error {
+	req := new(createWebhookRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		var err error
+		if secret, err = generateWebhookSecret(); err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to create webhook")
+		}
+	}
+	hook := Webhook{URL: req.URL, Secret: secret, Events: req.Events, Active: true}
+	if err := dbCtx(c).Create(&hook).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to create webhook")
+	}
+
+	return respond(c, http.StatusCreated, map[string]interface{}{
+		"webhook": hook,
+		"secret":  secret,
+	})
+}
+
+// Change a webhook's URL or events, or pause and resume it
+func updateWebhook(c echo.Context) error {
+	req := new(updateWebhookRequest)
+	if err := c.Bind(req); err != nil {
+		return newProblem(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(req); err != nil {
+		return validationError(err)
+	}
+
+	var hook *Webhook
+	err := WithTx(c, func(tx *gorm.DB) error {
+		var err error
+		if hook, err = findWebhook(c, forUpdate(tx)); err != nil {
+			return err
+		}
+		if req.URL != "" {
+			hook.URL = req.URL
+		}
+		if req.Events != nil {
+			hook.Events = req.Events
+		}
+		if req.Active != nil {
+			hook.Active = *req.Active
+		}
+		if err := tx.Save(hook).Error; err != nil {
+			return newProblem(http.StatusInternalServerError, "Failed to update webhook")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, hook)
+}
+
+// Delete a webhook along with its delivery log
+func deleteWebhook(c echo.Context) error {
+	hook, err := findWebhook(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	err = WithTx(c, func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to delete webhook")
+	}
+	return respond(c, http.StatusOK, map[string]string{"message": "Webhook deleted successfully"})
+}
+
+// List a webhook's deliveries, newest first
+func getWebhookDeliveries(c echo.Context) error {
+	hook, err := findWebhook(c, dbCtx(c))
+	if err != nil {
+		return err
+	}
+	p, err := parsePagination(c)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, err.Error())
+	}
+
+	var deliveries []WebhookDelivery
+	var total int64
+	q := dbCtx(c).Model(&WebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+	if status := c.QueryParam("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if err := q.Count(&total).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch deliveries")
+	}
+	if err := q.Order("id DESC").Offset(p.Offset).Limit(p.Limit).Find(&deliveries).Error; err != nil {
+		return newProblem(http.StatusInternalServerError, "Failed to fetch deliveries")
+	}
+	return respond(c, http.StatusOK, newPagedResponse(c, p, total, deliveries))
+}
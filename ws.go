@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	// Time allowed between pongs before the connection is considered dead
+	wsPongWait = 60 * time.Second
+	// Send pings at this interval, comfortably inside wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// Largest message accepted from clients
+	wsMaxMessageSize = 4096
+)
+
+// Cross-origin upgrades are refused: the default CheckOrigin requires the
+// Origin header, when present, to match the Host
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// Open WebSocket handlers. Hijacked connections are invisible to the HTTP
+// server's shutdown, so they are tracked here instead.
+var wsConnections sync.WaitGroup
+
+// wsClientMessage is sent by clients to change their subscription. Empty
+// events or user_ids match everything.
+type wsClientMessage struct {
+	Type    string   `json:"type"`
+	Events  []string `json:"events"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// wsServerMessage is sent to clients: a user event, a subscription
+// acknowledgement or an error
+type wsServerMessage struct {
+	Type    string   `json:"type"`
+	Events  []string `json:"events,omitempty"`
+	UserIDs []string `json:"user_ids,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	*UserEvent
+}
+
+// wsFilter selects the events a connection receives
+type wsFilter struct {
+	events map[string]bool
+	users  map[string]bool
+}
+
+// Report whether the event passes the filter; users match by ID or UUID
+func (f wsFilter) match(e UserEvent) bool {
+	if f.events != nil && !f.events[e.Event] {
+		return false
+	}
+	if f.users != nil && !f.users[strconv.FormatUint(uint64(e.Data.ID), 10)] && !f.users[e.Data.UUID] {
+		return false
+	}
+	return true
+}
+
+// Build a filter from a subscribe message
+func newWSFilter(msg wsClientMessage) (wsFilter, error) {
+	var f wsFilter
+	if len(msg.Events) > 0 {
+		var err error
+		if f.events, err = parseEventTypes(msg.Events); err != nil {
+			return f, err
+		}
+	}
+	if len(msg.UserIDs) > 0 {
+		f.users = make(map[string]bool, len(msg.UserIDs))
+		for _, id := range msg.UserIDs {
+			f.users[id] = true
+		}
+	}
+	return f, nil
+}
+
+// Broadcast user events over a WebSocket. Clients narrow the stream by sending
+// {"type":"subscribe","events":[...],"user_ids":[...]}. A client too slow to
+// keep up is disconnected with 1013 (try again later) rather than skipping events.
+func serveWebSocket(c echo.Context) error {
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader has already replied with an error status
+		return nil
+	}
+	defer conn.Close()
+	wsConnections.Add(1)
+	defer wsConnections.Done()
+
+	events, cancel := userEvents.Subscribe()
+	defer cancel()
+
+	// The reader only parses client messages; all writes happen below
+	replies := make(chan wsServerMessage)
+	filters := make(chan wsFilter)
+	readerDone := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(readerDone)
+		conn.SetReadLimit(wsMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg wsClientMessage
+			reply := wsServerMessage{Type: "error"}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				reply.Error = "Invalid message"
+			} else if msg.Type != "subscribe" {
+				reply.Error = `Unknown message type, expected "subscribe"`
+			} else if f, err := newWSFilter(msg); err != nil {
+				reply.Error = err.Error()
+			} else {
+				select {
+				case filters <- f:
+				case <-quit:
+					return
+				}
+				reply = wsServerMessage{Type: "subscribed", Events: msg.Events, UserIDs: msg.UserIDs}
+			}
+			select {
+			case replies <- reply:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	write := func(msg wsServerMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg)
+	}
+
+	var filter wsFilter
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-readerDone:
+			return nil
+		case filter = <-filters:
+		case reply := <-replies:
+			if err := write(reply); err != nil {
+				return nil
+			}
+		case e, ok := <-events:
+			if !ok {
+				// Dropped for falling behind, or the server is shutting down
+				msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Reconnect later")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				return nil
+			}
+			if !sameTenant(c.Request().Context(), e) || !filter.match(e) {
+				continue
+			}
+			if err := write(wsServerMessage{Type: "event", UserEvent: &e}); err != nil {
+				return nil
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// Wait for WebSocket handlers to send their close frames, giving up when ctx expires
+func drainWebSockets(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		wsConnections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}